@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/plan"
+	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diff compares the dashboards, folders and libraries of the repository with
+// the ones on Grafana, without changing anything, and prints on the given
+// output a unified diff per object which differs, then the objects only found
+// on one side.
+// Returns the process' exit code: exitChanges if anything differs.
+func diff(ctx context.Context, client *grafana.Client, cfg *config.Config, out io.Writer) int {
+	diffs, err := puller.Diff(ctx, client, cfg)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to compare the repository with Grafana")
+		return exitError
+	}
+
+	repoOnly, grafanaOnly := make([]string, 0), make([]string, 0)
+	changed := 0
+	for _, d := range diffs {
+		switch {
+		case d.Grafana == nil:
+			repoOnly = append(repoOnly, d.Path)
+		case d.Repository == nil:
+			grafanaOnly = append(grafanaOnly, d.Path)
+		default:
+			changed++
+			fmt.Fprint(out, plan.UnifiedDiff("repository/"+d.Path, "grafana/"+d.Path, string(d.Repository), string(d.Grafana)))
+		}
+	}
+
+	printPaths(out, "Only in the repository:", repoOnly)
+	printPaths(out, "Only on Grafana:", grafanaOnly)
+	fmt.Fprintf(out, "%d object(s) differ, %d only in the repository, %d only on Grafana\n", changed, len(repoOnly), len(grafanaOnly))
+
+	if len(diffs) > 0 {
+		return exitChanges
+	}
+	return exitNoChanges
+}
+
+// printPaths prints the given paths on the given output under the given title,
+// if there are any.
+func printPaths(out io.Writer, title string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	fmt.Fprintln(out, title)
+	for _, path := range paths {
+		fmt.Fprintf(out, "  %s\n", path)
+	}
+}
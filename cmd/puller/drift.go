@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Output formats of the drift detection.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Changes of a drifted dashboard or library.
+const (
+	driftAdded   = "added"
+	driftUpdated = "updated"
+	driftRemoved = "removed"
+)
+
+// driftItem is a dashboard or a library which differs between Grafana and the
+// repository.
+type driftItem struct {
+	Branch string `json:"branch"`
+	// Kind is "dashboard" or "library".
+	Kind string `json:"kind"`
+	// Name is the slug of a dashboard, or the UID of a library.
+	Name string `json:"name"`
+	// Change is driftAdded if it's only on Grafana, driftRemoved if it's
+	// only in the repository, or driftUpdated if Grafana has a newer version.
+	Change string `json:"change"`
+	// Old and New are the versions in the repository and on Grafana, zero
+	// if unknown.
+	Old int `json:"old,omitempty"`
+	New int `json:"new,omitempty"`
+}
+
+// driftReport is the output of the drift detection.
+type driftReport struct {
+	Drift bool        `json:"drift"`
+	Items []driftItem `json:"items"`
+}
+
+// detectDrift compares Grafana with the repository like a dry run, and prints
+// the dashboards and libraries which differ on the given output, in the given
+// format.
+// Returns the process' exit code: exitChanges if anything differs.
+func detectDrift(ctx context.Context, client *grafana.Client, cfg *config.Config, output string, out io.Writer) int {
+	plans, err := puller.DryRun(ctx, client, cfg)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Drift detection failed")
+		return exitError
+	}
+
+	report := driftReport{Items: driftItems(plans)}
+	report.Drift = len(report.Items) > 0
+
+	if output == outputJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(report); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to write the drift report")
+			return exitError
+		}
+	} else {
+		for _, item := range report.Items {
+			fmt.Fprintf(out, "%s %-9s %-7s %s", item.Branch, item.Kind, item.Change, item.Name)
+			if item.Change == driftUpdated {
+				fmt.Fprintf(out, " (%d => %d)", item.Old, item.New)
+			}
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "%d drifted dashboard(s) or library(ies) detected\n", len(report.Items))
+	}
+
+	if report.Drift {
+		return exitChanges
+	}
+	return exitNoChanges
+}
+
+// driftItems returns the dashboards and libraries the given plans would
+// write or remove: the ones which versions changed, then the ones which files
+// would be removed, by branch. The files which are only moved, e.g. to the
+// directory of another folder, aren't drift.
+func driftItems(plans []puller.BranchPlan) (items []driftItem) {
+	items = make([]driftItem, 0)
+	for _, plan := range plans {
+		written := make(map[string]bool)
+		for _, change := range plan.Changes {
+			if change.Action != puller.FileDelete {
+				written[filepath.Base(change.Path)] = true
+			}
+		}
+
+		for _, v := range plan.Versions {
+			change := driftUpdated
+			if v.Old == 0 {
+				change = driftAdded
+			}
+			items = append(items, driftItem{
+				Branch: plan.Branch,
+				Kind:   v.Kind,
+				Name:   v.Name,
+				Change: change,
+				Old:    v.Old,
+				New:    v.New,
+			})
+		}
+
+		for _, change := range plan.Changes {
+			name := filepath.Base(change.Path)
+			if change.Action != puller.FileDelete || written[name] || format.IsPermissionsFile(name) || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			var kind string
+			switch strings.SplitN(filepath.ToSlash(change.Path), "/", 2)[0] {
+			case "dashboards":
+				kind = "dashboard"
+			case "libraries":
+				kind = "library"
+			default:
+				continue
+			}
+			items = append(items, driftItem{
+				Branch: plan.Branch,
+				Kind:   kind,
+				Name:   strings.TrimSuffix(name, ".json"),
+				Change: driftRemoved,
+			})
+		}
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the puller's runs which don't change anything.
+const (
+	exitNoChanges = 0
+	exitError     = 1
+	// exitChanges tells -detect-drift or -diff found differences between
+	// Grafana and the repository.
+	exitChanges = 2
+)
+
+// dryRun runs the puller without changing anything, and prints the changes it
+// would make on the given output, with the number of changes detected.
+// Returns the process' exit code, which is 0 whether there are changes or not,
+// unless the dry run failed.
+func dryRun(ctx context.Context, client *grafana.Client, cfg *config.Config, out io.Writer) int {
+	plans, err := puller.DryRun(ctx, client, cfg)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Dry run failed")
+		return exitError
+	}
+
+	printPlans(out, plans)
+
+	files, branches := 0, 0
+	for _, plan := range plans {
+		if len(plan.Changes) > 0 {
+			files += len(plan.Changes)
+			branches++
+		}
+	}
+	fmt.Fprintf(out, "%d file change(s) detected on %d branch(es)\n", files, branches)
+	return exitNoChanges
+}
+
+// printPlans prints the changes the puller would make to each branch, and the
+// message of the commits it would create.
+func printPlans(out io.Writer, plans []puller.BranchPlan) {
+	for _, plan := range plans {
+		fmt.Fprintf(out, "Branch %s:\n", plan.Branch)
+		if len(plan.Changes) == 0 {
+			fmt.Fprintf(out, "  no changes\n")
+			continue
+		}
+
+		for _, change := range plan.Changes {
+			fmt.Fprintf(out, "  %-6s %s (%+d bytes)\n", change.Action, change.Path, change.SizeDelta)
+		}
+
+		if len(plan.Versions) > 0 {
+			fmt.Fprintf(out, "  Versions:\n")
+			for _, v := range plan.Versions {
+				fmt.Fprintf(out, "    %-9s %s: %d => %d\n", v.Kind, v.Name, v.Old, v.New)
+			}
+		}
+
+		if plan.CommitMessage != "" {
+			fmt.Fprintf(out, "  Commit message:\n")
+			for _, line := range strings.Split(strings.TrimRight(plan.CommitMessage, "\n"), "\n") {
+				fmt.Fprintf(out, "    %s\n", line)
+			}
+		}
+	}
+}
@@ -1,47 +1,46 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
 	"github.com/pkg/errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
 	"github.com/bruce34/grafana-dashboards-manager/internal/logger"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
 	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
 
 	"github.com/sirupsen/logrus"
 )
 
-type StacktraceHook struct {
-}
-
-func (h *StacktraceHook) Levels() []logrus.Level {
-	return logrus.AllLevels
-}
-
-func (h *StacktraceHook) Fire(e *logrus.Entry) error {
-	if v, found := e.Data[logrus.ErrorKey]; found {
-		if err, iserr := v.(error); iserr {
-			type stackTracer interface {
-				StackTrace() errors.StackTrace
-			}
-			if st, isst := err.(stackTracer); isst {
-				stack := fmt.Sprintf("%+v", st.StackTrace())
-				e.Data["stacktrace"] = stack
-			}
-		}
-	}
-	return nil
-}
-
 func main() {
 	// Define this flag in the main function because else it would cause a
 	// conflict with the one in the pusher.
 	configFile := flag.String("config", "config.yaml", "Path to the configuration file")
 	version := flag.Bool("version", false, "Print version info and exit")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+	seedFrom := flag.String("seed-from", "", "Create this host's versions file from the versions file with the given prefix (e.g. \"otherhost-\") and the Grafana instance, then exit")
+	seedForce := flag.Bool("seed-force", false, "Overwrite this host's versions file when seeding it")
+	printUID := flag.String("print-uid", "", "Print the file a pull would write for the dashboard with the given UID, without reading or changing the repository, then exit")
+	printRaw := flag.Bool("raw", false, "With -print-uid, print the dashboard as returned by the Grafana API before the file")
+	dryRunFlag := flag.Bool("dry-run", false, "Print the changes the puller would commit and how many there are, without changing anything, then exit")
+	detectDriftFlag := flag.Bool("detect-drift", false, "Print the dashboards and libraries which differ between Grafana and the repository, without changing anything, then exit with 2 if there are any")
+	diffFlag := flag.Bool("diff", false, "Print a unified diff of each dashboard, folder and library which differs between the repository and Grafana, and the ones only on one side, without changing anything, then exit with 2 if there are any")
+	output := flag.String("output", outputText, "Format of the output of -detect-drift, \"text\" or \"json\"")
+	debugHTTP := flag.String("debug-http", "", "Write each request to Grafana and its response, without the credentials, to a numbered file in the given directory")
+	debugHTTPMaxBody := flag.Int("debug-http-max-body", grafana.DefaultDebugHTTPMaxBody, "With -debug-http, truncate the bodies written above this size, in bytes")
+	forceFullPull := flag.Bool("force-full-pull", false, "Retrieve every dashboard, instead of reusing the ones retrieved by previous pulls which haven't changed since")
+	snapshotDir := flag.String("snapshot", "", "Export the dashboards, libraries and folders with the versions file to a timestamped tarball in the given directory, without reading or changing the repository, then exit")
+	summaryFile := flag.String("summary-file", "", "Write a JSON summary of the pull, with the items pulled and the commits created, to the given file at the end of the run")
+	shutdownGrace := flag.Duration("shutdown-grace", utils.DefaultShutdownGrace, "Time the pull in progress is given to finish once asked to stop, before its requests to Grafana are aborted")
 
 	flag.Parse()
 
@@ -50,16 +49,36 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *output != outputText && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "Invalid output %q, it must be %q or %q\n", *output, outputText, outputJSON)
+		os.Exit(exitError)
+	}
+
 	// Load the logger's configuration.
 	logger.LogConfig()
 	logrus.SetFormatter(&logrus.TextFormatter{DisableQuote: true})
-	logrus.AddHook(&StacktraceHook{})
 	// Load the configuration.
 	cfg, err := config.Load(*configFile)
 	if err != nil {
 		logrus.Panic(err)
 	}
 
+	if *printConfig {
+		out, err := cfg.RedactedYAML()
+		if err != nil {
+			logrus.Panic(err)
+		}
+		fmt.Print(string(out))
+		os.Exit(0)
+	}
+	cfg.LogEffective()
+
+	// Check the signing key now rather than on the first commit.
+	if _, err = git.SigningKey(cfg.Git); err != nil {
+		logrus.Panic(err)
+	}
+	cfg.ForceFullPull = *forceFullPull
+
 	// Tell the user which sync mode we use.
 	var syncMode string
 	if cfg.Git != nil {
@@ -72,11 +91,126 @@ func main() {
 		"sync_mode": syncMode,
 	}).Info("Sync mode set")
 
+	// Stop talking to Grafana when asked to stop, once the pull in progress
+	// had time to commit its changes. A second signal stops the process
+	// right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	workCtx, cancelWork := utils.GraceContext(ctx, *shutdownGrace)
+	defer cancelWork()
+	go func() {
+		<-ctx.Done()
+		logrus.WithFields(logrus.Fields{
+			"grace": *shutdownGrace,
+		}).Info("Asked to stop, letting the pull in progress finish")
+		stop()
+	}()
+
 	// Initialise the Grafana API client.
-	client := grafana.NewClient(cfg.Grafana.BaseURL, cfg.Grafana.APIKey, cfg.Grafana.Username, cfg.Grafana.Password, cfg.Grafana.SkipVerify)
-	// Run the puller.
-	if err := puller.PullGrafanaAndCommit(client, cfg); err != nil {
+	client, err := grafana.NewClientFromSettings(cfg.Grafana)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	client.Metrics = metrics.NewGrafanaRequests(metrics.Default)
+	filenameTemplate, err := cfg.Git.ParseFilenameTemplate()
+	if err != nil {
+		logrus.Panic(err)
+	}
+	client.FilenameTemplate = filenameTemplate
+	if *debugHTTP != "" {
+		if err := client.DebugHTTP(*debugHTTP, *debugHTTPMaxBody); err != nil {
+			logrus.Panic(err)
+		}
+	}
+	if err := client.CheckConnection(ctx); err != nil {
+		logrus.Warnf("%v\n", errors.WithStack(err))
+		os.Exit(1)
+	}
+	for _, orgCfg := range cfg.OrgConfigs() {
+		if err := client.ForOrg(orgCfg.Grafana.OrgID).SelectOrg(ctx); err != nil {
+			logrus.Warnf("%v\n", errors.WithStack(err))
+			os.Exit(1)
+		}
+	}
+
+	// Only print a dashboard, if asked to.
+	if *printUID != "" {
+		if err := puller.PrintDashboard(ctx, client, cfg.Git, *printUID, *printRaw, os.Stdout); err != nil {
+			logrus.Warnf("%v\n", errors.WithStack(err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Only export the dashboards, if asked to.
+	if *snapshotDir != "" {
+		path, err := puller.Export(ctx, client, cfg, *snapshotDir)
+		if err != nil {
+			logrus.Warnf("%v\n", errors.WithStack(err))
+			os.Exit(1)
+		}
+		fmt.Println(path)
+		os.Exit(0)
+	}
+
+	// Only print what drifted, if asked to.
+	if *detectDriftFlag {
+		os.Exit(detectDrift(ctx, client, cfg, *output, os.Stdout))
+	}
+
+	// Only print how the repository and Grafana differ, if asked to.
+	if *diffFlag {
+		os.Exit(diff(ctx, client, cfg, os.Stdout))
+	}
+
+	// Only print what would change, if asked to.
+	if *dryRunFlag {
+		os.Exit(dryRun(ctx, client, cfg, os.Stdout))
+	}
+
+	if cfg.Grafana.SelfDashboard {
+		if err := client.PushSelfDashboard(ctx); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Failed to push the status dashboard")
+		}
+	}
+	// Seed the versions file instead of pulling, if asked to.
+	if *seedFrom != "" {
+		if err := puller.Seed(ctx, client, cfg, *seedFrom, *seedForce); err != nil {
+			logrus.Warnf("%v\n", errors.WithStack(err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Run the puller, then push the metrics of the run and write its summary,
+	// failed or not.
+	results.Current.Path = *summaryFile
+	results.Current.Mode = "pull"
+	err = puller.PullGrafanaAndCommit(workCtx, client, cfg, nil)
+	pushMetrics(cfg)
+	results.Current.Flush(err)
+	if err != nil {
 		logrus.Warnf("%v\n", errors.WithStack(err))
 		os.Exit(1)
 	}
 }
+
+// pushMetrics pushes the metrics to the Pushgateway set in the configuration,
+// if any. A failure is only logged, so it doesn't fail the run.
+func pushMetrics(cfg *config.Config) {
+	if cfg.Metrics == nil || cfg.Metrics.PushgatewayURL == "" {
+		return
+	}
+	job := cfg.Metrics.PushgatewayJob
+	if job == "" {
+		job = config.DefaultPushgatewayJob
+	}
+	if err := metrics.Default.Push(cfg.Metrics.PushgatewayURL, job); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"url":   cfg.Metrics.PushgatewayURL,
+		}).Warn("Failed to push the metrics to the Pushgateway")
+	}
+}
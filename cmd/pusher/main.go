@@ -1,50 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
 	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
-	"github.com/pkg/errors"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/health"
 	"github.com/bruce34/grafana-dashboards-manager/internal/logger"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
 	"github.com/bruce34/grafana-dashboards-manager/internal/poller"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
 	"github.com/bruce34/grafana-dashboards-manager/internal/webhook"
 
 	"github.com/sirupsen/logrus"
+	gogit "gopkg.in/src-d/go-git.v4"
 )
 
 var (
-	deleteRemoved = flag.Bool("delete-removed", false, "For each file removed from Git, delete the corresponding dashboard on the Grafana API")
-	pushAll       = flag.Bool("push-all", false, "Force push all files, then quit")
-	singleShot    = flag.Bool("single-shot", false, "Run once, then quit")
+	deleteRemoved        = flag.Bool("delete-removed", false, "For each file removed from Git, delete the corresponding dashboard on the Grafana API")
+	dryRun               = flag.Bool("dry-run", false, "Only log and summarise the folders, dashboards and libraries which would be created, updated or deleted, without changing Grafana nor pulling the new versions")
+	deleteRemovedFolders = flag.Bool("delete-removed-folders", false, "With -delete-removed, also delete the folders removed from Git, if they don't hold anything else")
+	pushAll              = flag.Bool("push-all", false, "Force push all files, then quit")
+	singleShot           = flag.Bool("single-shot", false, "Run once, then quit")
+	strict               = flag.Bool("strict", false, "Don't push the dashboards needing datasources the Grafana instance doesn't have")
+	summaryFile          = flag.String("summary-file", "", "Write a JSON summary of each run, with the items pushed and pulled and the commits created, to the given file at its end")
+	shutdownGrace        = flag.Duration("shutdown-grace", utils.DefaultShutdownGrace, "Time the push in progress is given to finish once asked to stop, before its requests to Grafana are aborted")
 )
 
-type StacktraceHook struct {
-}
-
-func (h *StacktraceHook) Levels() []logrus.Level {
-	return logrus.AllLevels
-}
-
-func (h *StacktraceHook) Fire(e *logrus.Entry) error {
-	if v, found := e.Data[logrus.ErrorKey]; found {
-		if err, iserr := v.(error); iserr {
-			type stackTracer interface {
-				StackTrace() errors.StackTrace
-			}
-			if st, isst := err.(stackTracer); isst {
-				stack := fmt.Sprintf("%+v", st.StackTrace())
-				e.Data["stacktrace"] = stack
-			}
-		}
-	}
-	return nil
-}
-
 func main() {
 	var err error
 
@@ -52,92 +43,311 @@ func main() {
 	// conflict with the one in the puller.
 	configFile := flag.String("config", "config.yaml", "Path to the configuration file")
 	version := flag.Bool("version", false, "Print version info and exit")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+	debugHTTP := flag.String("debug-http", "", "Write each request to Grafana and its response, without the credentials, to a numbered file in the given directory")
+	debugHTTPMaxBody := flag.Int("debug-http-max-body", grafana.DefaultDebugHTTPMaxBody, "With -debug-http, truncate the bodies written above this size, in bytes")
 	flag.Parse()
 
 	// Load the logger's configuration.
 	logger.LogConfig()
 	logrus.SetFormatter(&logrus.TextFormatter{DisableQuote: true})
-	logrus.AddHook(&StacktraceHook{})
 
 	if *version {
 		fmt.Printf("BuildInfo: %v", utils.BuildInfoString())
 		os.Exit(0)
 	}
 
+	// Stop listening or polling when asked to stop, and stop talking to
+	// Grafana once the push in progress had time to finish. A second signal
+	// stops the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	workCtx, cancelWork := utils.GraceContext(ctx, *shutdownGrace)
+	defer cancelWork()
+	go func() {
+		<-ctx.Done()
+		logrus.WithFields(logrus.Fields{
+			"grace": *shutdownGrace,
+		}).Info("Asked to stop, letting the push in progress finish")
+		stop()
+	}()
+
+	// Push a single dashboard and exit, if asked to.
+	runPushOne(workCtx, *configFile)
+
 	// Load the configuration.
 	cfg, err := config.Load(*configFile)
 	if err != nil {
 		logrus.Panic(err)
 	}
 
+	if *printConfig {
+		out, err := cfg.RedactedYAML()
+		if err != nil {
+			logrus.Panic(err)
+		}
+		fmt.Print(string(out))
+		os.Exit(0)
+	}
+	cfg.LogEffective()
+
+	// Check the signing key now rather than on the first commit.
+	if _, err = git.SigningKey(cfg.Git); err != nil {
+		logrus.Panic(err)
+	}
+
 	if cfg.Git == nil || cfg.Pusher == nil {
 		logrus.Info("The git configuration or the pusher configuration (or both) is not defined in the configuration file. The pusher cannot start unless both are defined.")
 		os.Exit(0)
 	}
 
 	// Initialise the Grafana API client.
-	grafanaClient := grafana.NewClient(cfg.Grafana.BaseURL, cfg.Grafana.APIKey, cfg.Grafana.Username, cfg.Grafana.Password, cfg.Grafana.SkipVerify)
+	grafanaClient, err := grafana.NewClientFromSettings(cfg.Grafana)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	grafanaClient.StrictDatasources = *strict
+	grafanaClient.DeleteRemovedFolders = *deleteRemovedFolders
+	grafanaClient.DryRun = *dryRun
+	grafanaClient.Metrics = metrics.NewGrafanaRequests(metrics.Default)
+	if grafanaClient.FilenameTemplate, err = cfg.Git.ParseFilenameTemplate(); err != nil {
+		logrus.Panic(err)
+	}
+	if *debugHTTP != "" {
+		if err = grafanaClient.DebugHTTP(*debugHTTP, *debugHTTPMaxBody); err != nil {
+			logrus.Panic(err)
+		}
+	}
+	if err = grafanaClient.CheckConnection(ctx); err != nil {
+		logrus.Panic(err)
+	}
+	for _, orgCfg := range cfg.OrgConfigs() {
+		if err = grafanaClient.ForOrg(orgCfg.Grafana.OrgID).SelectOrg(ctx); err != nil {
+			logrus.Panic(err)
+		}
+	}
 
+	if cfg.Grafana.SelfDashboard && !*dryRun {
+		if err := grafanaClient.PushSelfDashboard(ctx); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Failed to push the status dashboard")
+		}
+	}
+
+	results.Current.Path = *summaryFile
+	results.Current.Mode = cfg.Pusher.Mode
 	if *pushAll {
-		syncPath := puller.SyncPath(cfg)
+		results.Current.Mode = "push-all"
+		if _, err = grafanaClient.CheckHealth(ctx); err != nil {
+			logrus.Panic(err)
+		}
+		// Each branch's clone holds the files of the folders mapped to it,
+		// in a subdirectory per organisation if there are several.
+		for _, branchCfg := range cfg.BranchConfigs() {
+			for _, orgCfg := range branchCfg.OrgConfigs() {
+				pushAllFiles(workCtx, orgCfg, grafanaClient.ForOrg(orgCfg.Grafana.OrgID))
+			}
+		}
+		results.Current.Flush(nil)
+
+		os.Exit(0)
+	}
+
+	// Expose the metrics on a listener of their own, if asked to.
+	if cfg.Metrics != nil && cfg.Metrics.Listen != "" {
+		go func() {
+			if err := metrics.Default.Serve(ctx, cfg.Metrics.Listen); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"addr":  cfg.Metrics.Listen,
+				}).Error("Failed to expose the metrics")
+			}
+		}()
+	}
+
+	// The readiness probe checks Grafana's health when it wasn't checked
+	// recently, e.g. while waiting for webhook events.
+	health.Default.SetGrafanaCheck(func(ctx context.Context) error {
+		_, err := grafanaClient.CheckHealth(ctx)
+		return err
+	})
+	// Expose the effective configuration along with the probes.
+	health.Default.SetConfig(cfg.RedactedYAML)
+	if cfg.Pusher.Mode == "git-pull" && cfg.Pusher.HealthListen != "" {
+		go func() {
+			if err := health.Default.Serve(ctx, cfg.Pusher.HealthListen); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"addr":  cfg.Pusher.HealthListen,
+				}).Error("Failed to expose the health probes")
+			}
+		}()
+	}
+
+	// Set up either a webhook or a poller depending on the mode specified in the
+	// configuration file.
+	switch cfg.Pusher.Mode {
+	case "webhook":
+		err = webhook.Setup(ctx, workCtx, cfg, grafanaClient, *deleteRemoved)
+		break
+	case "git-pull":
+		err = poller.Setup(ctx, workCtx, cfg, grafanaClient, *deleteRemoved, *singleShot)
+	}
 
-		folderFiles, folderContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, "/folders")
+	if err != nil {
+		logrus.Panic(err)
+		os.Exit(1)
+	}
+}
+
+// pushAllFiles pushes all the folders, libraries and dashboards found in the
+// clone described by the configuration to Grafana, for the organisation the
+// configuration is for.
+func pushAllFiles(ctx context.Context, cfg *config.Config, grafanaClient *grafana.Client) {
+	syncPath := puller.SyncPath(cfg)
 
-		// ensure all folders are created before we query for them
-		grafanaClient.CreateFolders(folderFiles, folderContents)
-		var grafanaVersionFile grafana.DefsFile
-		_, grafanaVersionFile, err = puller.GetDefinitionsFromGrafanaAPI(grafanaClient, cfg)
+	// The files are named after their paths in the clone, like the changes
+	// pushed in git-pull and webhook modes.
+	contents := make(map[string][]byte)
+	folderFiles, err := loadFiles(cfg, syncPath, "folders", false, contents)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Info("Unable to read the folders. Perhaps none have been pulled yet? If so, all good.")
+	}
+	var datasourceFiles []string
+	if cfg.Grafana.SyncDatasources {
+		datasourceFiles, err = loadFiles(cfg, syncPath, "datasources", false, contents)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Error("Failed to get grafana meta data")
+			}).Info("Unable to read the datasources. Perhaps none have been pulled yet? If so, all good.")
 		}
+	}
+	libraryFiles, err := loadFiles(cfg, syncPath, "libraries", false, contents)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Info("Unable to read libraries metadata file. Perhaps no libraries have been defined? If so, all good.")
+	}
+	dashboardFiles, err := loadFiles(cfg, syncPath, "dashboards", true, contents)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Unable to push all files")
+	}
+
+	var fileVersionFile grafana.DefsFile
+	fileVersionFile, _, err = puller.GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Unable to read dashboard metadata file. If running for the first time, consider seeding it with the puller's -seed-from flag once the files are pushed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"dashboardFiles":  dashboardFiles,
+		"fileVersionFile": fileVersionFile,
+		"error":           err,
+	}).Info("About to load dashboards")
 
-		dashboardFiles, dashboardContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, "/dashboards")
+	// Push the folders, datasources, libraries and dashboards in the order
+	// they depend on each other.
+	run, _, err := grafana.PushAll(ctx, cfg, grafanaClient, grafana.PushFiles{
+		Folders:     folderFiles,
+		Datasources: datasourceFiles,
+		Libraries:   libraryFiles,
+		Dashboards:  dashboardFiles,
+		Contents:    contents,
+	}, fileVersionFile, func(ctx context.Context) (defs grafana.DefsFile, err error) {
+		_, defs, err = puller.GetDefinitionsFromGrafanaAPI(ctx, grafanaClient, cfg)
+		return
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to get grafana meta data")
+	}
+
+	// Alert rules notify the contact points, which the notification policy
+	// tree routes to, muted by the mute timings.
+	if cfg.Grafana.SyncNotifications {
+		contactPointFiles, contactPointContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, filepath.Join("/alerting/contact-points", cfg.OrgDir), false)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Warn("Unable to push all files")
+			}).Info("Unable to read the contact points. Perhaps none have been pulled yet? If so, all good.")
 		}
-		var fileVersionFile grafana.DefsFile
-		fileVersionFile, _, err = puller.GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
+		muteTimingFiles, muteTimingContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, filepath.Join("/alerting/mute-timings", cfg.OrgDir), false)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Warn("Unable to read dashboard metadata file. Consider copying another hosts if running for the first time?")
+			}).Info("Unable to read the mute timings. Perhaps none have been pulled yet? If so, all good.")
 		}
-		logrus.WithFields(logrus.Fields{
-			"dashboardFiles": dashboardFiles,
-			//	"dashboardContents": dashboardContents,
-			"fileVersionFile": fileVersionFile,
-			"error":           err,
-		}).Info("About to load dashboards")
+		policiesFiles, policiesContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, filepath.Join("/alerting", cfg.OrgDir), false)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Info("Unable to read the notification policies. Perhaps they haven't been pulled yet? If so, all good.")
+		}
+		run.Merge(
+			grafana.PushNotificationFiles(ctx, contactPointFiles, nil, nil, contactPointContents, grafanaClient),
+			grafana.PushNotificationFiles(ctx, nil, muteTimingFiles, nil, muteTimingContents, grafanaClient),
+			grafana.PushNotificationFiles(ctx, nil, nil, policiesFiles, policiesContents, grafanaClient),
+		)
+	}
 
-		libraryFiles, libraryContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, "/libraries")
+	if cfg.Grafana.SyncAlertRules {
+		alertFiles, alertContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, filepath.Join("/alerts", cfg.OrgDir), false)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Info("Unable to read libraries metadata file. Perhaps no libraries have been defined? If so, all good.")
+			}).Info("Unable to read the alert rules. Perhaps none have been pulled yet? If so, all good.")
 		}
+		run.Merge(grafana.PushAlertRuleFiles(ctx, alertFiles, alertContents, grafanaClient))
+	}
 
-		grafana.PushLibraryFiles(libraryFiles, libraryContents, fileVersionFile, grafanaVersionFile, grafanaClient)
-		grafana.Push(cfg, fileVersionFile, grafanaVersionFile, dashboardFiles, dashboardContents, grafanaClient)
+	results.Current.Record(run)
+	logrus.WithFields(logrus.Fields{
+		"results": run.Summary(),
+	}).Info("Pushed all files to Grafana")
 
-		os.Exit(0)
+	if cfg.Pusher.Annotate {
+		grafanaClient.AnnotatePush(ctx, headCommit(syncPath), run)
+	}
+	if cfg.Grafana.SelfDashboard {
+		grafanaClient.UpdateSelfDashboardPush(ctx, headCommit(syncPath), run, run.Err())
 	}
+}
 
-	// Set up either a webhook or a poller depending on the mode specified in the
-	// configuration file.
-	switch cfg.Pusher.Mode {
-	case "webhook":
-		err = webhook.Setup(cfg, grafanaClient, *deleteRemoved)
-		break
-	case "git-pull":
-		err = poller.Setup(cfg, grafanaClient, *deleteRemoved, *singleShot)
+// loadFiles reads the JSON files in the given directory of the clone at the
+// given path, in the subdirectory of the organisation the configuration is
+// for, and in their own subdirectories too if recursive is true, into the
+// given contents.
+// Returns the names of the files, relative to the clone, and an error if the
+// directory or a file couldn't be read.
+func loadFiles(cfg *config.Config, syncPath string, dir string, recursive bool, contents map[string][]byte) (filenames []string, err error) {
+	subdir := filepath.Join(dir, cfg.OrgDir)
+	names, subdirContents, err := grafana.LoadFilesFromDirectory(cfg, syncPath, subdir, recursive)
+	filenames = make([]string, 0, len(names))
+	for _, name := range names {
+		filename := filepath.Join(subdir, name)
+		filenames = append(filenames, filename)
+		contents[filename] = subdirContents[name]
 	}
+	return
+}
 
+// headCommit returns the hash of the commit checked out in the clone at the
+// given path, or an empty string if it can't be read.
+func headCommit(clonePath string) string {
+	repo, err := gogit.PlainOpen(clonePath)
 	if err != nil {
-		logrus.Panic(err)
-		os.Exit(1)
+		return ""
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return ""
 	}
+	return head.Hash().String()
 }
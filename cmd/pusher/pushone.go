@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the push-one command.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// pushOne implements the push-one command, which pushes a single dashboard
+// read from a file or from the standard input, outside of any repository. Only
+// the Grafana settings are needed in the configuration file. Prints the URL and
+// version of the pushed dashboard on the given output.
+// Returns the process' exit code.
+func pushOne(ctx context.Context, configFile string, args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("push-one", flag.ContinueOnError)
+	folder := fs.String("folder", "", "Title or UID of the folder to push the dashboard to, created if missing. Defaults to the General folder")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pusher [-config file] push-one [-folder folder] [file]\n\n")
+		fmt.Fprintf(fs.Output(), "Pushes the dashboard described in the file, or read from the standard input if no file (or \"-\") is given.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	// Read the dashboard.
+	var (
+		content []byte
+		err     error
+	)
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		content, err = ioutil.ReadAll(stdin)
+	} else {
+		content, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to read the dashboard")
+		return exitError
+	}
+
+	cfg, err := config.LoadGrafanaOnly(configFile)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to load the configuration")
+		return exitError
+	}
+	client, err := grafana.NewClientFromSettings(cfg.Grafana)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create the Grafana client")
+		return exitError
+	}
+	if err = client.CheckConnection(ctx); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to connect to Grafana")
+		return exitError
+	}
+	if err = client.SelectOrg(ctx); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to select the organisation")
+		return exitError
+	}
+
+	prepared, uid, err := client.PrepareDashboard(ctx, content)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to prepare the dashboard")
+		return exitError
+	}
+
+	folderUID, err := client.ResolveFolder(ctx, *folder)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"folder": *folder,
+		}).Error("Failed to find or create the folder")
+		return exitError
+	}
+
+	if err = client.CreateOrUpdateDashboard(ctx, prepared, folderUID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"uid":   uid,
+		}).Error("Failed to push the dashboard")
+		return exitError
+	}
+
+	// Grafana sets the version, so it has to be read back.
+	dashboard, err := client.GetDashboard(ctx, "uid/"+uid)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"uid":   uid,
+		}).Error("Failed to retrieve the pushed dashboard")
+		return exitError
+	}
+
+	fmt.Fprintf(stdout, "URL: %s\nVersion: %d\n", client.DashboardURL(uid), dashboard.Version)
+	return exitOK
+}
+
+// runPushOne runs the push-one command if it's the one given on the command
+// line, and exits with its exit code.
+func runPushOne(ctx context.Context, configFile string) {
+	if flag.Arg(0) != "push-one" {
+		return
+	}
+	os.Exit(pushOne(ctx, configFile, flag.Args()[1:], os.Stdin, os.Stdout))
+}
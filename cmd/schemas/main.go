@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// versionsFileFormat describes the versions file, which records the state of a
+// Grafana instance at the latest pull rather than a resource.
+var versionsFileFormat = format.Format{
+	Name:        "versions",
+	Path:        "<prefix>versions-metadata.json, at the root of the repository",
+	Description: "The versions and metadata of the dashboards, library panels and folders of a Grafana instance at the latest pull.",
+	Schema:      format.SchemaOf(grafana.DefsFile{}),
+}
+
+func main() {
+	outDir := flag.String("out", "", "Write each schema to <name>.schema.json in the given directory instead of printing all of them")
+	version := flag.Bool("version", false, "Print version info and exit")
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("BuildInfo: %v", utils.BuildInfoString())
+		os.Exit(0)
+	}
+
+	documents := make(map[string]interface{})
+	for _, f := range append(format.Formats(), versionsFileFormat) {
+		documents[f.Name] = f.Document()
+	}
+
+	if *outDir == "" {
+		if err := writeJSON(os.Stdout, documents); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for name, document := range documents {
+		out, err := os.Create(filepath.Join(*outDir, name+".schema.json"))
+		if err == nil {
+			err = writeJSON(out, document)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// writeJSON writes the indented JSON representation of the given value to the
+// given file.
+func writeJSON(out *os.File, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(v)
+}
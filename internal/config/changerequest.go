@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Providers of the merge requests opened by the puller, and of the events
+// received by the webhook pusher.
+const (
+	// ProviderGitLab opens GitLab merge requests, and receives GitLab push
+	// events.
+	ProviderGitLab = "gitlab"
+	// ProviderGitHub opens GitHub pull requests, and receives GitHub push
+	// events.
+	ProviderGitHub = "github"
+)
+
+// Defaults of the change request settings.
+const (
+	// DefaultChangeRequestBranchPrefix is the default prefix of the branches
+	// the puller pushes its commits to.
+	DefaultChangeRequestBranchPrefix = "grafana-sync/"
+	// DefaultChangeRequestTitle is the default title of the merge requests
+	// opened by the puller.
+	DefaultChangeRequestTitle = "Update the dashboards from Grafana"
+	// DefaultGitHubAPIURL is the default base URL of the GitHub API.
+	DefaultGitHubAPIURL = "https://api.github.com"
+)
+
+// ChangeRequestSettings makes the puller push its commits to a branch of their
+// own and open a merge request (or a pull request on GitHub) into the tracked
+// branch, instead of pushing to the tracked branch, e.g. if it's protected.
+type ChangeRequestSettings struct {
+	// Provider is the API the merge requests are opened with, ProviderGitLab
+	// or ProviderGitHub. Defaults to ProviderGitLab.
+	Provider string `yaml:"provider,omitempty"`
+	// APIURL is the base URL of the API, e.g.
+	// "https://gitlab.company.tld/api/v4". Defaults to DefaultGitHubAPIURL
+	// on GitHub, required on GitLab.
+	APIURL string `yaml:"api_url,omitempty"`
+	// Token is the access token used to open the merge requests. Defaults to
+	// the Git token.
+	Token string `yaml:"token,omitempty" secret:"true"`
+	// ProjectID is the ID of the GitLab project. Required on GitLab.
+	ProjectID int `yaml:"project_id,omitempty"`
+	// Repository is the GitHub repository, as "owner/name". Required on
+	// GitHub.
+	Repository string `yaml:"repository,omitempty"`
+	// TargetBranch is the branch the merge requests are opened into.
+	// Defaults to the branch tracked by the clone.
+	TargetBranch string `yaml:"target_branch,omitempty"`
+	// BranchPrefix is the prefix of the branches the commits are pushed to,
+	// which the merge requests opened by the puller are recognised by.
+	// Defaults to DefaultChangeRequestBranchPrefix.
+	BranchPrefix string `yaml:"branch_prefix,omitempty"`
+	// Title is the title of the merge requests. Defaults to
+	// DefaultChangeRequestTitle.
+	Title string `yaml:"title,omitempty"`
+}
+
+// ChangeRequestProvider returns the provider of the merge requests, defaulting
+// to ProviderGitLab.
+func (c *ChangeRequestSettings) ChangeRequestProvider() string {
+	if c.Provider == "" {
+		return ProviderGitLab
+	}
+	return c.Provider
+}
+
+// validateChangeRequest checks that the change request settings, if any, have
+// a known provider and identify the project on it.
+// Returns an error if the settings are incomplete or the provider isn't known.
+func validateChangeRequest(g *GitSettings) error {
+	if g == nil || g.ChangeRequest == nil {
+		return nil
+	}
+
+	cr := g.ChangeRequest
+	switch cr.ChangeRequestProvider() {
+	case ProviderGitLab:
+		if cr.APIURL == "" || cr.ProjectID == 0 {
+			return fmt.Errorf("The change_request settings need an api_url and a project_id on GitLab")
+		}
+	case ProviderGitHub:
+		if strings.Count(cr.Repository, "/") != 1 {
+			return fmt.Errorf("The change_request settings need a repository, as \"owner/name\", on GitHub")
+		}
+	default:
+		return fmt.Errorf("Invalid change_request provider %q, it must be %q or %q", cr.Provider, ProviderGitLab, ProviderGitHub)
+	}
+	return nil
+}
@@ -2,18 +2,32 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/gosimple/slug"
 	"github.com/sirupsen/logrus"
 )
 
 var (
 	ErrPusherInvalidSyncMode   = errors.New("Invalid sync mode in the pusher settings")
 	ErrPusherConfigNotMatching = errors.New("The pusher config doesn't match with the one expected from the pusher sync mode")
+	ErrPusherInvalidProvider   = errors.New("Invalid webhook provider in the pusher config, must be gitlab, github, gitea or generic")
+	ErrPusherBranchMismatch    = errors.New("The pusher config's branch must be the same as the git settings' branch")
+	ErrPusherTLSIncomplete     = errors.New("Both tls_cert and tls_key must be set in the pusher config to serve the webhook over HTTPS")
+	ErrPusherGitLabOnly        = errors.New("The merge_requests, commit_status and deploy label settings are only supported with GitLab webhooks")
 	ErrNoSyncSettings          = errors.New("At least one of the simple_sync or the git settings must be set")
+	ErrDeployNoTarget          = errors.New("The deploy settings must include a target")
+	ErrMergeRequestsNoAPIURL   = errors.New("The merge requests settings must include the GitLab API URL")
+	ErrOAuth2WithCredentials   = errors.New("The oauth2 settings can't be used along with an API key or a username and password")
+	ErrOAuth2Incomplete        = errors.New("The oauth2 settings must include the token URL and the client ID")
 )
 
 // Config is the Go representation of the configuration file. It is filled when
@@ -23,16 +37,171 @@ type Config struct {
 	SimpleSync *SimpleSyncSettings `yaml:"simple_sync,omitempty"`
 	Git        *GitSettings        `yaml:"git,omitempty"`
 	Pusher     *PusherSettings     `yaml:"pusher,omitempty"`
+	// Metrics sets up exposing the metrics for Prometheus. Optional.
+	Metrics *MetricsSettings `yaml:"metrics,omitempty"`
+
+	// OrgDir is the subdirectory of the dashboards, folders and libraries
+	// directories holding the files of the organisation the configuration
+	// is for. It isn't read from the configuration file but set on the
+	// configurations of the organisations from GrafanaSettings.OrgIDs. An
+	// empty value means the files are directly in these directories.
+	OrgDir string `yaml:"-"`
+
+	// ForceFullPull makes the puller retrieve every dashboard, instead of
+	// reusing the ones retrieved by previous pulls which haven't changed
+	// since. It isn't read from the configuration file but set from the
+	// command line.
+	ForceFullPull bool `yaml:"-"`
+
+	// FilePath and FileModTime describe the configuration file the
+	// configuration was loaded from.
+	FilePath    string    `yaml:"-"`
+	FileModTime time.Time `yaml:"-"`
+}
+
+// DefaultPullConcurrency is the default number of dashboards requested at once
+// when pulling.
+const DefaultPullConcurrency = 8
+
+// OAuth2Settings contains the data required to get access tokens with the
+// OAuth2 client credentials flow.
+type OAuth2Settings struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret" secret:"true"`
+	Scopes       []string `yaml:"scopes,omitempty"`
 }
 
 // GrafanaSettings contains the data required to talk to the Grafana HTTP API.
 type GrafanaSettings struct {
-	BaseURL      string `yaml:"base_url"`
-	APIKey       string `yaml:"api_key"`
-	Username     string `yaml:"username"`
-	Password     string `"yaml:password"`
+	BaseURL  string `yaml:"base_url"`
+	APIKey   string `yaml:"api_key" secret:"true"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	// APIKeyFile is the path to a file holding the API key, which takes
+	// precedence over APIKey. The file is read again whenever Grafana
+	// rejects the key, so a rotated key is picked up without a restart.
+	APIKeyFile string `yaml:"api_key_file,omitempty"`
+	// OAuth2 authenticates the requests with the OAuth2 client credentials
+	// flow, e.g. for a Grafana behind an OAuth2 proxy, instead of an API key
+	// or basic auth.
+	OAuth2 *OAuth2Settings `yaml:"oauth2,omitempty"`
+	// OrgID is the ID of the organisation the manager works in. Defaults to
+	// the credentials' default organisation.
+	OrgID int64 `yaml:"org_id,omitempty"`
+	// OrgIDs lists the IDs of the organisations synchronised, each in its own
+	// subdirectory of the repository and with its own versions file. Takes
+	// precedence over OrgID.
+	OrgIDs []int64 `yaml:"org_ids,omitempty"`
+	// IgnorePrefix is deprecated in favour of IgnoreRules, and converted to a
+	// prefix rule when the configuration is loaded.
 	IgnorePrefix string `yaml:"ignore_prefix,omitempty"`
-	SkipVerify   bool   `default:"false" yaml:"insecureSkipVerify"`
+	// IgnoreRules describe the dashboards and library elements ignored by
+	// both the puller and the pusher.
+	IgnoreRules []IgnoreRule `yaml:"ignore_rules,omitempty"`
+	// IgnoreTags lists tags ignoring the dashboards tagged with them. They're
+	// converted to tag rules when the configuration is loaded.
+	IgnoreTags []string `yaml:"ignore_tags,omitempty"`
+	// IgnorePatterns lists regular expressions ignoring the dashboards and
+	// library elements which title or slug matches them. They're converted
+	// to regex rules when the configuration is loaded.
+	IgnorePatterns []string `yaml:"ignore_patterns,omitempty"`
+	// FoldersInclude and FoldersExclude restrict the dashboards pulled,
+	// pushed and deleted to the ones in some folders, given by UID or
+	// title, along with their subfolders. See FolderScope.
+	FoldersInclude []string `yaml:"folders_include,omitempty"`
+	FoldersExclude []string `yaml:"folders_exclude,omitempty"`
+	SkipVerify     bool     `default:"false" yaml:"insecureSkipVerify"`
+	// CACertPath is the path to a PEM file holding the certificate authority
+	// Grafana's certificate is checked against, along with the system's.
+	CACertPath string `yaml:"ca_cert_path,omitempty"`
+	// ClientCertPath and ClientKeyPath are the paths to the PEM files
+	// holding the certificate presented to Grafana and its key.
+	ClientCertPath string `yaml:"client_cert_path,omitempty"`
+	ClientKeyPath  string `yaml:"client_key_path,omitempty"`
+	// SelfDashboard enables the "Dashboards Manager Status" dashboard the
+	// manager maintains on the Grafana instance.
+	SelfDashboard bool `yaml:"self_dashboard,omitempty"`
+	// SelfDashboardDatasource is the UID of the Prometheus datasource
+	// scraping the manager's metrics, which the status dashboard's panels
+	// query. Empty uses the instance's default datasource.
+	SelfDashboardDatasource string `yaml:"self_dashboard_datasource,omitempty"`
+	// IncludePlugins lists the IDs of the app plugins which dashboards must be
+	// managed like any other dashboard. Dashboards owned by other plugins are
+	// left alone.
+	IncludePlugins []string `yaml:"include_plugins,omitempty"`
+	// DashboardsAPI selects the API used to manage dashboards: "legacy",
+	// "k8s" or "auto" (the default) to detect it from the instance.
+	DashboardsAPI string `yaml:"dashboards_api,omitempty"`
+	// Namespace is the namespace used with the "k8s" dashboards API. Defaults
+	// to the organisation's namespace, i.e. "default" for the main one.
+	Namespace string `yaml:"namespace,omitempty"`
+	// RetryAttempts is the number of attempts made for requests failing with
+	// a network error or a 5xx response. POST requests are only retried if
+	// they couldn't reach Grafana. Defaults to 3.
+	RetryAttempts int `yaml:"retry_attempts,omitempty"`
+	// RetryMaxBackoff is the maximum delay between two attempts, in
+	// seconds. Defaults to 10.
+	RetryMaxBackoff int64 `yaml:"retry_max_backoff,omitempty"`
+	// PullConcurrency is the number of dashboards requested at once when
+	// pulling. Defaults to DefaultPullConcurrency.
+	PullConcurrency int `yaml:"pull_concurrency,omitempty"`
+	// RateLimit is the maximum number of requests sent to the Grafana API
+	// per second. Zero, the default, disables the limit.
+	RateLimit float64 `yaml:"rate_limit,omitempty"`
+	// RateLimitBurst is the number of requests which can be sent at once
+	// before RateLimit applies. Defaults to 1.
+	RateLimitBurst int `yaml:"rate_limit_burst,omitempty"`
+	// AllowSchemaDowngrade allows pushing dashboards which schemaVersion is
+	// lower than the one of the dashboard on the Grafana instance. Such
+	// dashboards are skipped by default.
+	AllowSchemaDowngrade bool `yaml:"allow_schema_downgrade,omitempty"`
+	// ForceDeleteRules allows deleting a removed folder which still holds
+	// alert rules, deleting the rules with it. Grafana refuses to delete
+	// such folders by default.
+	ForceDeleteRules bool `yaml:"force_delete_rules,omitempty"`
+	// StrictFolders refuses to push a dashboard or library panel which file
+	// gives the UID of a folder which doesn't exist on the Grafana instance.
+	// Such folders are created by default, titled with the file's __folder
+	// if it has one, or else with their UID.
+	StrictFolders bool `yaml:"strict_folders,omitempty"`
+	// DatasourceAliases maps the UIDs of datasources to the placeholders,
+	// e.g. "${DS_PROMETHEUS}", the puller replaces their references with in
+	// the dashboards and library panels. The pusher replaces the
+	// placeholders with the UIDs of the matching datasources of the
+	// instance it pushes to.
+	DatasourceAliases map[string]string `yaml:"datasource_aliases,omitempty"`
+	// SyncDatasources enables the synchronisation of the datasources along
+	// with the dashboards. Their secrets are never synchronised.
+	SyncDatasources bool `yaml:"sync_datasources,omitempty"`
+	// SyncAlertRules enables the synchronisation of the unified alerting
+	// rules along with the dashboards.
+	SyncAlertRules bool `yaml:"sync_alert_rules,omitempty"`
+	// SyncNotifications enables the synchronisation of the alerting contact
+	// points and notification policy tree along with the dashboards.
+	SyncNotifications bool `yaml:"sync_notifications,omitempty"`
+	// SyncFolderPermissions enables the synchronisation of the folders'
+	// permissions along with the folders.
+	SyncFolderPermissions bool `yaml:"sync_folder_permissions,omitempty"`
+	// SyncDashboardPermissions enables the synchronisation of the
+	// dashboards' permissions along with the dashboards.
+	SyncDashboardPermissions bool `yaml:"sync_dashboard_permissions,omitempty"`
+	// ComplexityLimits sets the thresholds above which a dashboard is
+	// considered too complex.
+	ComplexityLimits *ComplexityLimits `yaml:"complexity_limits,omitempty"`
+}
+
+// ComplexityLimits contains the thresholds dashboards are checked against when
+// they're pulled. A zero value disables the matching check.
+type ComplexityLimits struct {
+	MaxFileSize        int `yaml:"max_file_size,omitempty"`
+	MaxPanels          int `yaml:"max_panels,omitempty"`
+	MaxQueriesPerPanel int `yaml:"max_queries_per_panel,omitempty"`
+	MaxVariables       int `yaml:"max_variables,omitempty"`
+	// Report adds the dashboards over the limits to the summary of the run.
+	Report bool `yaml:"report,omitempty"`
+	// Strict refuses to push the dashboards over the limits.
+	Strict bool `yaml:"strict,omitempty"`
 }
 
 // SimpleSyncSettings contains minimal data on the synchronisation process. It is
@@ -54,7 +223,146 @@ type GitSettings struct {
 	DontCommit          bool                `yaml:"dont_commit"`
 	VersionsFilePrefix  string              `yaml:"versions_file_prefix"`
 	ApplyManagerCommits bool                `yaml:"apply_manager_commits"`
-	Token               string              `yaml:"token"`
+	Token               string              `yaml:"token" secret:"true"`
+	// SigningKeyPath is the path to the PGP private key the manager's
+	// commits are signed with, armored or not. The commits aren't signed if
+	// it's empty.
+	SigningKeyPath string `yaml:"signing_key,omitempty"`
+	// SigningKeyPassphrasePath is the path to the file holding the
+	// passphrase of the signing key, if it's encrypted.
+	SigningKeyPassphrasePath string `yaml:"signing_key_passphrase_file,omitempty"`
+	// FolderBranchMap maps Grafana folders (by title or UID) to the branch
+	// their dashboards, libraries and folder definitions are committed to.
+	// Nested folders follow their nearest mapped ancestor. Everything else
+	// goes to the default branch.
+	FolderBranchMap map[string]string `yaml:"folder_branch_map,omitempty"`
+	// Layout is how the dashboards' files are laid out in the repository,
+	// LayoutFlat or LayoutByFolder. Defaults to LayoutFlat.
+	Layout string `yaml:"layout,omitempty"`
+	// VersionsLayout is how the versions file is laid out,
+	// VersionsLayoutFile or VersionsLayoutPerDashboard. Defaults to
+	// VersionsLayoutFile.
+	VersionsLayout string `yaml:"versions_layout,omitempty"`
+	// FilenameTemplate is the Go template the names of the dashboards'
+	// files are generated from, given the FilenameFields. Defaults to
+	// DefaultFilenameTemplate.
+	FilenameTemplate string `yaml:"filename_template,omitempty"`
+	// JSONIndent is what each level of nesting of the JSON files written by
+	// the puller is indented with, spaces or tabs. Defaults to a tab.
+	JSONIndent string `yaml:"json_indent,omitempty"`
+	// FinalNewline ends the JSON files written by the puller with a newline.
+	FinalNewline bool `yaml:"final_newline,omitempty"`
+	// Branch is the branch tracked by the clone, pulled and pushed to. It's
+	// created on the remote by the first push if it doesn't exist there. It's
+	// replaced on the settings of the clones of the branches from
+	// FolderBranchMap. An empty value means the remote's default branch.
+	Branch string `yaml:"branch,omitempty"`
+	// FolderBranch is the branch from FolderBranchMap the clone is for. It
+	// isn't read from the configuration file but set on the settings of the
+	// clones of these branches, and empty for the main clone.
+	FolderBranch string `yaml:"-"`
+	// SelfHeal sets up how a broken clone is replaced with a new one.
+	SelfHeal *SelfHealSettings `yaml:"self_heal,omitempty"`
+	// VersionHistory sets up committing the versions Grafana has of the
+	// changed dashboards between the ones of their files and their latest
+	// ones, one commit per version. Nil only commits the latest versions.
+	VersionHistory *VersionHistorySettings `yaml:"version_history,omitempty"`
+	// CommitPerDashboard makes the puller commit each changed dashboard
+	// separately, then the folders, the libraries and the other files, rather
+	// than everything at once.
+	CommitPerDashboard bool `yaml:"commit_per_dashboard,omitempty"`
+	// ChangeRequest makes the puller open a merge request with its commits
+	// instead of pushing them to the tracked branch. Nil pushes them.
+	ChangeRequest *ChangeRequestSettings `yaml:"change_request,omitempty"`
+	// Provisioning makes the puller also write the dashboards for Grafana's
+	// file provisioning, in the provisioning directory. Nil doesn't.
+	Provisioning *ProvisioningSettings `yaml:"provisioning,omitempty"`
+}
+
+// DefaultMaxHistoryVersions is the default maximum number of intermediate
+// versions of a dashboard committed by a pull.
+const DefaultMaxHistoryVersions = 20
+
+// VersionHistorySettings sets up importing the history of the dashboards'
+// versions from Grafana into the repository.
+type VersionHistorySettings struct {
+	// MaxVersions is the maximum number of intermediate versions of a
+	// dashboard committed by a pull, the latest ones. Defaults to
+	// DefaultMaxHistoryVersions.
+	MaxVersions int `yaml:"max_versions,omitempty"`
+}
+
+// SelfHealSettings sets up moving a broken clone aside, e.g. after an
+// interrupted operation or a corrupted index, and cloning the repository
+// again, instead of failing every synchronisation until someone intervenes.
+type SelfHealSettings struct {
+	// Disabled turns self-healing off, leaving broken clones to be fixed by
+	// hand.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// MaxFailures is the number of consecutive failed synchronisations of a
+	// broken clone before it's cloned again. Defaults to 3.
+	MaxFailures int `yaml:"max_failures,omitempty"`
+	// KeepBroken is the number of broken clones kept aside for
+	// investigation. Defaults to 2.
+	KeepBroken int `yaml:"keep_broken,omitempty"`
+}
+
+// MappedBranches returns the sorted list of distinct branches found in
+// FolderBranchMap.
+func (g *GitSettings) MappedBranches() (branches []string) {
+	seen := make(map[string]bool)
+	for _, branch := range g.FolderBranchMap {
+		if !seen[branch] {
+			seen[branch] = true
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	return
+}
+
+// ForBranch returns a copy of the Git settings for a clone of the given
+// branch. Each branch is cloned next to the main clone path, in a directory
+// suffixed with the branch's name.
+func (g *GitSettings) ForBranch(branch string) *GitSettings {
+	branchSettings := *g
+	branchSettings.Branch = branch
+	branchSettings.FolderBranch = branch
+	branchSettings.ClonePath = strings.TrimSuffix(g.ClonePath, "/") + "-" + strings.ReplaceAll(branch, "/", "_")
+	return &branchSettings
+}
+
+// validateFolderBranchMap checks that no folder is mapped to the branch of the
+// main clone, which would then be tracked by two clones.
+// Returns an error if a folder is mapped to this branch.
+func validateFolderBranchMap(g *GitSettings) error {
+	if g == nil || g.Branch == "" {
+		return nil
+	}
+	for folder, branch := range g.FolderBranchMap {
+		if branch == g.Branch {
+			return fmt.Errorf("The folder %q is mapped to the branch %q, which is already the main one, it mustn't be in folder_branch_map", folder, branch)
+		}
+	}
+	return nil
+}
+
+// BranchConfigs returns the configuration to use for each clone of the
+// repository: the given configuration for the default branch first, then a
+// copy of it with the Git settings of each branch from the folder to branch
+// mapping.
+func (cfg *Config) BranchConfigs() (configs []*Config) {
+	configs = append(configs, cfg)
+	if cfg.Git == nil {
+		return
+	}
+
+	for _, branch := range cfg.Git.MappedBranches() {
+		branchCfg := *cfg
+		branchCfg.Git = cfg.Git.ForBranch(branch)
+		configs = append(configs, &branchCfg)
+	}
+	return
 }
 
 // CommitsAuthorConfig contains the configuration (name + email address) to use
@@ -73,20 +381,216 @@ type PusherConfig struct {
 	Interface string `yaml:"interface,omitempty"`
 	Port      string `yaml:"port,omitempty"`
 	Path      string `yaml:"path,omitempty"`
-	Secret    string `yaml:"secret,omitempty"`
+	Secret    string `yaml:"secret,omitempty" secret:"true"`
 	Interval  int64  `yaml:"interval,omitempty"`
+	// Provider is the Git forge sending the events to the webhook,
+	// ProviderGitLab, ProviderGitHub or ProviderGitea, or ProviderGeneric
+	// for any client triggering a poll. Defaults to ProviderGitLab.
+	Provider string `yaml:"provider,omitempty"`
+	// Branch is the branch the webhook processes push events of, which the
+	// clone then tracks, as if set in the Git settings. Defaults to the
+	// branch set in the Git settings.
+	Branch string `yaml:"branch,omitempty"`
+	// TLSCert and TLSKey are the paths to the PEM files holding the
+	// certificate and key the webhook is served over HTTPS with, reloaded
+	// when they change. The webhook is served over HTTP if they're unset.
+	TLSCert string `yaml:"tls_cert,omitempty"`
+	TLSKey  string `yaml:"tls_key,omitempty"`
+	// MaxBodySize is the maximum size, in bytes, of the body of a request to
+	// the webhook. Larger requests are rejected. Defaults to
+	// DefaultWebhookMaxBodySize.
+	MaxBodySize int64 `yaml:"max_body_size,omitempty"`
+	// AllowedCIDRs are the networks the requests to the webhook may come
+	// from, e.g. "10.0.0.0/8". The requests are accepted from anywhere if
+	// it's empty.
+	AllowedCIDRs []string `yaml:"allowed_cidrs,omitempty"`
+	// TrustedProxies are the networks of the proxies which X-Forwarded-For
+	// header is trusted to give the address the requests come from. The
+	// header is ignored if it's empty.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
 }
 
+// DefaultWebhookMaxBodySize is the default maximum size, in bytes, of the body
+// of a request to the webhook.
+const DefaultWebhookMaxBodySize = 25 << 20
+
+// WebhookMaxBodySize returns the maximum size, in bytes, of the body of a
+// request to the webhook, defaulting to DefaultWebhookMaxBodySize.
+func (c *PusherConfig) WebhookMaxBodySize() int64 {
+	if c.MaxBodySize <= 0 {
+		return DefaultWebhookMaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+// ParseCIDRs parses the given networks in the CIDR notation, e.g.
+// "10.0.0.0/8". A single address, e.g. "10.0.0.1", is a network of its own.
+// Returns an error naming the network which couldn't be parsed.
+func ParseCIDRs(cidrs []string) (networks []*net.IPNet, err error) {
+	networks = make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+				continue
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q in the pusher config: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// Providers of the events received by the webhook pusher only, which can't open
+// merge requests.
+const (
+	// ProviderGitea receives the push events of Gitea, or Forgejo.
+	ProviderGitea = "gitea"
+	// ProviderGeneric receives requests, from any client, which each
+	// trigger an iteration of the poller.
+	ProviderGeneric = "generic"
+)
+
 // PusherSettings contains the settings to configure the Git->Grafana pusher.
 type PusherSettings struct {
-	Mode   string       `yaml:"sync_mode"`
-	Config PusherConfig `yaml:"config"`
+	Mode   string          `yaml:"sync_mode"`
+	Config PusherConfig    `yaml:"config"`
+	Deploy *DeploySettings `yaml:"deploy,omitempty"`
+	// MergeRequests enables comments on the GitLab merge requests describing
+	// what would change in Grafana if they were merged.
+	MergeRequests *MergeRequestSettings `yaml:"merge_requests,omitempty"`
+	// CommitStatus enables the GitLab commit statuses reporting whether the
+	// changes pushed on the webhook were applied.
+	CommitStatus *CommitStatusSettings `yaml:"commit_status,omitempty"`
+	// QuietHours sets the windows during which the changes aren't applied to
+	// Grafana, but deferred until the window ends.
+	QuietHours *QuietHoursSettings `yaml:"quiet_hours,omitempty"`
+	// Annotate creates a Grafana annotation marking each push, giving the
+	// pushed commit and the number of dashboards updated.
+	Annotate bool `yaml:"annotate,omitempty"`
+	// HealthListen is the address (e.g. ":8081") of a listener of its own
+	// the pusher exposes its liveness and readiness probes on in the
+	// "git-pull" mode. No listener is started if it's empty. The webhook
+	// exposes them on its own listener.
+	HealthListen string `yaml:"health_listen,omitempty"`
+}
+
+// MergeRequestSettings contains the settings required to comment on GitLab
+// merge requests.
+type MergeRequestSettings struct {
+	// GitLabAPIURL is the base URL of the GitLab API, e.g.
+	// "https://gitlab.company.tld/api/v4".
+	GitLabAPIURL string `yaml:"gitlab_api_url"`
+	// Token is the GitLab access token used to comment. Defaults to the Git
+	// token.
+	Token string `yaml:"token,omitempty" secret:"true"`
+}
+
+// CommitStatusSettings contains the settings to report the processing of
+// webhook push events as GitLab commit statuses.
+type CommitStatusSettings struct {
+	// GitLabAPIURL is the base URL of the GitLab API, e.g.
+	// "https://gitlab.company.tld/api/v4".
+	GitLabAPIURL string `yaml:"gitlab_api_url"`
+	// Token is the GitLab access token used to set the statuses. Defaults to
+	// the Git token.
+	Token string `yaml:"token,omitempty" secret:"true"`
+	// ProjectID is the ID of the GitLab project. Defaults to the one of the
+	// push event.
+	ProjectID int `yaml:"project_id,omitempty"`
+	// Name is the name of the status. Defaults to
+	// "grafana-dashboards-manager".
+	Name string `yaml:"name,omitempty"`
+	// TargetURL is the URL the status links to. Defaults to the Grafana
+	// instance's.
+	TargetURL string `yaml:"target_url,omitempty"`
+}
+
+// QuietHoursSettings describes the quiet hours of the pusher.
+type QuietHoursSettings struct {
+	// Timezone is the name of the time zone the windows are in, e.g.
+	// "Europe/Amsterdam". Defaults to the local time zone.
+	Timezone string `yaml:"timezone,omitempty"`
+	// Windows lists the quiet windows.
+	Windows []QuietWindow `yaml:"windows"`
+}
+
+// QuietWindow is a time range, repeated on some days of the week, during which
+// the changes aren't applied to Grafana.
+type QuietWindow struct {
+	// Days lists the days the window starts on, e.g. "mon" or "monday".
+	// Defaults to every day.
+	Days []string `yaml:"days,omitempty"`
+	// Start and End are the times of day the window starts and ends at, in
+	// the "15:04" format. A window ending before it starts ends the next day.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+// DeploySettings contains the settings of the partial pushes mode, in which
+// only the changes from commits marked for the pusher's target are pushed to
+// Grafana. A commit is marked either with a "Deploy-To: <target>" trailer in
+// its message, or by merging a GitLab merge request with the configured label.
+// Unmarked changes are pushed later on, once a commit with a "Deploy-All"
+// trailer lands.
+type DeploySettings struct {
+	// Target is the name of the Grafana instance the pusher deploys to, as
+	// used in the "Deploy-To" trailers.
+	Target string `yaml:"target"`
+	// Label is the merge request label marking merged changes for
+	// deployment. Optional.
+	Label string `yaml:"label,omitempty"`
+	// StateFile is the path to the file recording the last deployed commit.
+	// Defaults to a file in the clone's .git directory.
+	StateFile string `yaml:"state_file,omitempty"`
 }
 
 // Load opens a given configuration file and parses it into an instance of the
 // Config structure.
 // Returns an error if there was an issue whith reading or parsing the file.
 func Load(filename string) (cfg *Config, err error) {
+	if cfg, err = LoadGrafanaOnly(filename); err != nil {
+		return
+	}
+
+	// Check if at least one settings group exists for synchronisation settings.
+	if cfg.Git == nil && cfg.SimpleSync == nil {
+		err = ErrNoSyncSettings
+		return
+	}
+
+	if err = applyPusherBranch(cfg); err != nil {
+		return
+	}
+	if err = validateLayout(cfg.Git); err != nil {
+		return
+	}
+	if _, err = cfg.Git.ParseFilenameTemplate(); err != nil {
+		return
+	}
+	if err = validateFolderBranchMap(cfg.Git); err != nil {
+		return
+	}
+	if err = validateChangeRequest(cfg.Git); err != nil {
+		return
+	}
+	if err = validateProvisioning(cfg.Git); err != nil {
+		return
+	}
+
+	// Make sure the pusher's config is valid, as the parser can't do it.
+	err = validatePusherSettings(cfg.Pusher)
+	return
+}
+
+// LoadGrafanaOnly opens a given configuration file and parses it into an
+// instance of the Config structure, like Load, but only requires the Grafana
+// settings. It is meant for the commands which don't synchronise anything.
+// Returns an error if there was an issue whith reading or parsing the file.
+func LoadGrafanaOnly(filename string) (cfg *Config, err error) {
 	rawCfg, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
@@ -101,26 +605,96 @@ func Load(filename string) (cfg *Config, err error) {
 		return
 	}
 
-	// Check if at least one settings group exists for synchronisation settings.
-	if cfg.Git == nil && cfg.SimpleSync == nil {
-		err = ErrNoSyncSettings
+	if cfg.Grafana.BaseURL, err = NormalizeBaseURL(cfg.Grafana.BaseURL); err != nil {
+		return
+	}
+	// Report unusable certificates now rather than on the first request.
+	if _, err = cfg.Grafana.TLSConfig(); err != nil {
+		return
+	}
+	if err = validateOAuth2Settings(&cfg.Grafana); err != nil {
 		return
 	}
 
-	// Since we always compare the prefix against a slug, we need to make sure
-	// the prefix is a slug itself.
-	cfg.Grafana.IgnorePrefix = slug.Make(cfg.Grafana.IgnorePrefix)
-	// Make sure the pusher's config is valid, as the parser can't do it.
-	err = validatePusherSettings(cfg.Pusher)
+	cfg.FilePath = filename
+	if info, statErr := os.Stat(filename); statErr == nil {
+		cfg.FileModTime = info.ModTime()
+	}
+
+	err = cfg.Grafana.loadIgnoreRules()
 	return
 }
 
+// NormalizeBaseURL checks the given Grafana base URL and returns it without
+// its trailing slashes. The URL must have an http or https scheme and a host,
+// and keeps its path, if any, for Grafana instances served under a sub-path.
+// Returns an error if the URL is invalid.
+func NormalizeBaseURL(baseURL string) (normalized string, err error) {
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil {
+		return "", fmt.Errorf("Invalid Grafana base URL %q: %w", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid Grafana base URL %q: it must start with http:// or https://", baseURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid Grafana base URL %q: it has no host", baseURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid Grafana base URL %q: it can't have a query or a fragment", baseURL)
+	}
+
+	// Grafana doesn't support double slashes in the API routes, and the
+	// routes are appended with a leading slash.
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String(), nil
+}
+
+// validateOAuth2Settings checks that the OAuth2 settings, if any, are complete
+// and aren't mixed with the other authentication modes. An API key takes
+// precedence over a username and password, so both can be set.
+// Returns an error if the OAuth2 settings are incomplete or used along with
+// other credentials.
+func validateOAuth2Settings(cfg *GrafanaSettings) error {
+	if cfg.OAuth2 == nil {
+		return nil
+	}
+	if cfg.APIKey != "" || cfg.APIKeyFile != "" || cfg.Username != "" || cfg.Password != "" {
+		return ErrOAuth2WithCredentials
+	}
+	if cfg.OAuth2.TokenURL == "" || cfg.OAuth2.ClientID == "" {
+		return ErrOAuth2Incomplete
+	}
+	return nil
+}
+
+// applyPusherBranch makes the clone track the branch the pusher's config gives,
+// if any, so the webhook processes its push events.
+// Returns an error if the Git settings give another branch.
+func applyPusherBranch(cfg *Config) error {
+	if cfg.Pusher == nil || cfg.Git == nil || len(cfg.Pusher.Config.Branch) == 0 {
+		return nil
+	}
+
+	if len(cfg.Git.Branch) > 0 && cfg.Git.Branch != cfg.Pusher.Config.Branch {
+		return ErrPusherBranchMismatch
+	}
+	cfg.Git.Branch = cfg.Pusher.Config.Branch
+	return nil
+}
+
 // validatePusherSettings checks the pusher config against the one expected from
 // looking at its sync mode.
 // Returns an error if the sync mode isn't in the allowed modes, or if at least
 // one of the fields expected to hold a non-zero-value holds the zero-value for
 // its type.
 func validatePusherSettings(cfg *PusherSettings) error {
+	// The pusher's settings are only needed by the pusher.
+	if cfg == nil {
+		return nil
+	}
+
 	config := cfg.Config
 	var configValid bool
 	switch cfg.Mode {
@@ -139,5 +713,35 @@ func validatePusherSettings(cfg *PusherSettings) error {
 		return ErrPusherConfigNotMatching
 	}
 
+	if (len(config.TLSCert) > 0) != (len(config.TLSKey) > 0) {
+		return ErrPusherTLSIncomplete
+	}
+	if _, err := ParseCIDRs(config.AllowedCIDRs); err != nil {
+		return err
+	}
+	if _, err := ParseCIDRs(config.TrustedProxies); err != nil {
+		return err
+	}
+
+	switch config.Provider {
+	case "", ProviderGitLab:
+	case ProviderGitHub, ProviderGitea, ProviderGeneric:
+		// Merge requests and commit statuses are GitLab's.
+		if cfg.MergeRequests != nil || cfg.CommitStatus != nil ||
+			(cfg.Deploy != nil && len(cfg.Deploy.Label) > 0) {
+			return ErrPusherGitLabOnly
+		}
+	default:
+		return ErrPusherInvalidProvider
+	}
+
+	if cfg.Deploy != nil && len(cfg.Deploy.Target) == 0 {
+		return ErrDeployNoTarget
+	}
+
+	if cfg.MergeRequests != nil && len(cfg.MergeRequests.GitLabAPIURL) == 0 {
+		return ErrMergeRequestsNoAPIURL
+	}
+
 	return nil
 }
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// DefaultFilenameTemplate is the template the names of the dashboards' files
+// are generated from if none is configured.
+const DefaultFilenameTemplate = "{{.UID}}:{{.Title}}"
+
+// FilenameFields are the fields the template the names of the dashboards'
+// files are generated from is given. The characters other than letters,
+// digits, "_" and "-" are replaced with "_" in the titles.
+type FilenameFields struct {
+	UID   string
+	Title string
+	// FolderTitle is the title of the dashboard's folder, GeneralFolder if
+	// it isn't in any folder.
+	FolderTitle string
+}
+
+// ParseFilenameTemplate returns the template the names of the dashboards'
+// files, without their extension, are generated from, or nil if none is
+// configured, in which case DefaultFilenameTemplate is used.
+// Returns an error if the template can't be parsed, or doesn't give a file
+// name for a sample dashboard.
+func (g *GitSettings) ParseFilenameTemplate() (tmpl *template.Template, err error) {
+	if g == nil || g.FilenameTemplate == "" {
+		return nil, nil
+	}
+
+	tmpl, err = template.New("filename").Option("missingkey=error").Parse(g.FilenameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filename template %q: %w", g.FilenameTemplate, err)
+	}
+
+	sample := new(bytes.Buffer)
+	if err = tmpl.Execute(sample, FilenameFields{UID: "uid", Title: "Title", FolderTitle: GeneralFolder}); err != nil {
+		return nil, fmt.Errorf("Invalid filename template %q: %w", g.FilenameTemplate, err)
+	}
+	if name := sample.String(); name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("Invalid filename template %q: it gives %q, which isn't a file name", g.FilenameTemplate, name)
+	}
+	return
+}
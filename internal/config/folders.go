@@ -0,0 +1,52 @@
+package config
+
+// GeneralFolder is the title the dashboards which aren't in any folder are
+// matched against by the folders to include or exclude.
+const GeneralFolder = "General"
+
+// FolderScope restricts the dashboards managed by the puller and the pusher to
+// the ones in some folders. Folders are given by UID or title, and take their
+// subfolders along.
+type FolderScope struct {
+	// Include lists the folders the managed dashboards are in. Every
+	// folder is included if it's empty.
+	Include []string
+	// Exclude lists the folders which dashboards are never managed, even
+	// if they're in an included folder.
+	Exclude []string
+}
+
+// FolderScope returns the folders the dashboards managed by the puller and
+// the pusher are in, or nil if they aren't restricted to some folders.
+func (g GrafanaSettings) FolderScope() *FolderScope {
+	if len(g.FoldersInclude) == 0 && len(g.FoldersExclude) == 0 {
+		return nil
+	}
+	return &FolderScope{Include: g.FoldersInclude, Exclude: g.FoldersExclude}
+}
+
+// Allows returns true if the dashboards in a folder with the given UIDs and
+// titles, which are the folder's and its ancestors', are managed. A nil scope
+// allows every folder.
+func (s *FolderScope) Allows(folder []string) bool {
+	if s == nil {
+		return true
+	}
+	if matchesFolder(s.Exclude, folder) {
+		return false
+	}
+	return len(s.Include) == 0 || matchesFolder(s.Include, folder)
+}
+
+// matchesFolder returns true if one of the given folder UIDs or titles is in
+// the given list.
+func matchesFolder(list []string, folder []string) bool {
+	for _, listed := range list {
+		for _, key := range folder {
+			if listed == key {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Types of ignore rules.
+const (
+	// IgnorePrefix ignores the dashboards which title starts with the value.
+	IgnorePrefix = "prefix"
+	// IgnoreSuffix ignores the dashboards which title ends with the value.
+	IgnoreSuffix = "suffix"
+	// IgnoreRegex ignores the dashboards which title or slug matches the
+	// value.
+	IgnoreRegex = "regex"
+	// IgnoreTag ignores the dashboards tagged with the value.
+	IgnoreTag = "tag"
+)
+
+// IgnoreRule describes dashboards and library elements ignored by both the
+// puller and the pusher. The title of a library element is its name, and it
+// has no tags. Prefixes, suffixes and tags are compared case-insensitively.
+type IgnoreRule struct {
+	Type  string `yaml:"type"`
+	Value string `yaml:"value"`
+
+	// regex is the compiled value of a regex rule.
+	regex *regexp.Regexp
+}
+
+// compile checks the rule, and compiles its value if it's a regex.
+// Returns an error if the rule's type is unknown, if its value is empty or if
+// it isn't a valid regex.
+func (r *IgnoreRule) compile() (err error) {
+	if len(r.Value) == 0 {
+		return fmt.Errorf("The %s ignore rule has no value", r.Type)
+	}
+
+	switch r.Type {
+	case IgnorePrefix, IgnoreSuffix, IgnoreTag:
+	case IgnoreRegex:
+		if r.regex, err = regexp.Compile(r.Value); err != nil {
+			return fmt.Errorf("The regex ignore rule %q is invalid: %v", r.Value, err)
+		}
+	default:
+		return fmt.Errorf("The ignore rule %q has an unknown type %q", r.Value, r.Type)
+	}
+	return
+}
+
+// Matches returns true if a dashboard or library element with the given title,
+// slug (the name of its file, without the extension) and tags is ignored by
+// the rule.
+func (r IgnoreRule) Matches(title string, slug string, tags []string) bool {
+	switch r.Type {
+	case IgnorePrefix:
+		return strings.HasPrefix(strings.ToLower(title), strings.ToLower(r.Value))
+	case IgnoreSuffix:
+		return strings.HasSuffix(strings.ToLower(title), strings.ToLower(r.Value))
+	case IgnoreRegex:
+		return r.regex != nil && (r.regex.MatchString(title) || (slug != "" && r.regex.MatchString(slug)))
+	case IgnoreTag:
+		for _, tag := range tags {
+			if strings.EqualFold(tag, r.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String implements fmt.Stringer.
+func (r IgnoreRule) String() string {
+	return r.Type + " " + r.Value
+}
+
+// IgnoredBy returns the first ignore rule ignoring a dashboard or library
+// element with the given title, slug and tags, and true if there's one. Any
+// matching rule ignores it, so the order of the rules doesn't change what is
+// ignored.
+func (g GrafanaSettings) IgnoredBy(title string, slug string, tags []string) (rule IgnoreRule, ignored bool) {
+	for _, rule = range g.IgnoreRules {
+		if rule.Matches(title, slug, tags) {
+			return rule, true
+		}
+	}
+	return IgnoreRule{}, false
+}
+
+// loadIgnoreRules converts the deprecated ignore prefix into a prefix rule,
+// the ignored tags into tag rules and the ignored patterns into regex rules,
+// then checks and compiles all the ignore rules.
+// Returns an error if a rule is invalid.
+func (g *GrafanaSettings) loadIgnoreRules() (err error) {
+	if len(g.IgnorePrefix) > 0 {
+		g.IgnoreRules = append(g.IgnoreRules, IgnoreRule{Type: IgnorePrefix, Value: g.IgnorePrefix})
+	}
+	for _, tag := range g.IgnoreTags {
+		g.IgnoreRules = append(g.IgnoreRules, IgnoreRule{Type: IgnoreTag, Value: tag})
+	}
+	for _, pattern := range g.IgnorePatterns {
+		g.IgnoreRules = append(g.IgnoreRules, IgnoreRule{Type: IgnoreRegex, Value: pattern})
+	}
+
+	for i := range g.IgnoreRules {
+		if err = g.IgnoreRules[i].compile(); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Layouts of the dashboards' files in the repository.
+const (
+	// LayoutFlat stores every dashboard directly in the dashboards
+	// directory.
+	LayoutFlat = "flat"
+	// LayoutByFolder stores each dashboard in a subdirectory of the
+	// dashboards directory named after its folder's title.
+	LayoutByFolder = "by-folder"
+)
+
+// Layouts of the versions file.
+const (
+	// VersionsLayoutFile stores the versions in a single file at the root
+	// of the repository.
+	VersionsLayoutFile = "file"
+	// VersionsLayoutPerDashboard stores the version of each dashboard in a
+	// file of its own, named after its UID, in a directory of the versions
+	// directory, and the other versions in a file next to this directory.
+	VersionsLayoutPerDashboard = "per-dashboard"
+)
+
+// ByFolder returns true if the dashboards' files are stored in subdirectories
+// named after their folders. Dashboards are stored flat without Git settings.
+func (g *GitSettings) ByFolder() bool {
+	return g != nil && g.Layout == LayoutByFolder
+}
+
+// PerDashboardVersions returns true if the versions are stored in a file per
+// dashboard. They're stored in a single file without Git settings.
+func (g *GitSettings) PerDashboardVersions() bool {
+	return g != nil && g.VersionsLayout == VersionsLayoutPerDashboard
+}
+
+// validateLayout checks that the layouts of the dashboards' files and of the
+// versions file, if any, are known ones, and that the JSON files are indented
+// with whitespace.
+// Returns an error if a layout isn't known or the indentation isn't only made
+// of spaces and tabs.
+func validateLayout(g *GitSettings) error {
+	if g == nil {
+		return nil
+	}
+	if g.Layout != "" && g.Layout != LayoutFlat && g.Layout != LayoutByFolder {
+		return fmt.Errorf("Invalid layout %q in the git settings, it must be %q or %q", g.Layout, LayoutFlat, LayoutByFolder)
+	}
+	if g.VersionsLayout != "" && g.VersionsLayout != VersionsLayoutFile && g.VersionsLayout != VersionsLayoutPerDashboard {
+		return fmt.Errorf("Invalid versions_layout %q in the git settings, it must be %q or %q", g.VersionsLayout, VersionsLayoutFile, VersionsLayoutPerDashboard)
+	}
+	if strings.Trim(g.JSONIndent, " \t") != "" {
+		return fmt.Errorf("Invalid json_indent %q in the git settings, it must only contain spaces and tabs", g.JSONIndent)
+	}
+	return nil
+}
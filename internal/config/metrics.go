@@ -0,0 +1,21 @@
+package config
+
+// DefaultPushgatewayJob is the default job the metrics are pushed to the
+// Pushgateway in.
+const DefaultPushgatewayJob = "grafana-dashboards-manager"
+
+// MetricsSettings sets up exposing the metrics of the manager for Prometheus,
+// besides the webhook's listener which always exposes them.
+type MetricsSettings struct {
+	// Listen is the address (e.g. ":9102") of a listener of its own the
+	// pusher exposes the metrics on, including the ones of the pulls it runs.
+	// No listener is started if it's empty.
+	Listen string `yaml:"listen,omitempty"`
+	// PushgatewayURL is the base URL of a Prometheus Pushgateway the puller
+	// pushes the metrics to once it's done, since it doesn't run long enough
+	// to be scraped. They aren't pushed if it's empty.
+	PushgatewayURL string `yaml:"pushgateway_url,omitempty"`
+	// PushgatewayJob is the job the metrics are pushed in. Defaults to
+	// DefaultPushgatewayJob.
+	PushgatewayJob string `yaml:"pushgateway_job,omitempty"`
+}
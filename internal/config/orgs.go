@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OrgDirPrefix prefixes the name of the subdirectories holding the files of
+// each organisation, when several organisations are synchronised.
+const OrgDirPrefix = "org-"
+
+// OrgConfigs returns the configuration to use for each organisation
+// synchronised: the given configuration if no list of organisations is
+// configured, else a copy of it for each organisation, which files are stored
+// in a subdirectory named after the organisation's ID, and which versions file
+// name is prefixed with it.
+func (cfg *Config) OrgConfigs() (configs []*Config) {
+	if len(cfg.Grafana.OrgIDs) == 0 {
+		return []*Config{cfg}
+	}
+
+	for _, orgID := range cfg.Grafana.OrgIDs {
+		orgCfg := *cfg
+		orgCfg.Grafana.OrgID = orgID
+		orgCfg.Grafana.OrgIDs = nil
+		orgCfg.OrgDir = OrgDirPrefix + strconv.FormatInt(orgID, 10)
+		if cfg.Git != nil {
+			orgGit := *cfg.Git
+			orgGit.VersionsFilePrefix = orgCfg.OrgVersionsFilePrefix(cfg.Git.VersionsFilePrefix)
+			orgCfg.Git = &orgGit
+		}
+		configs = append(configs, &orgCfg)
+	}
+	return
+}
+
+// OrgVersionsFilePrefix returns the versions file prefix to use for the
+// organisation of the configuration, from the given prefix. The "hostname"
+// prefix is resolved first, since it's only special on its own.
+func (cfg *Config) OrgVersionsFilePrefix(prefix string) string {
+	if len(cfg.OrgDir) == 0 {
+		return prefix
+	}
+	if prefix == "hostname" {
+		hostname, _ := os.Hostname()
+		prefix = hostname + "-"
+	}
+	return prefix + cfg.OrgDir + "-"
+}
+
+// OrgFiles returns the paths, relative to the root of the repository, of the
+// given files which belong to the organisation of the configuration, i.e. the
+// ones in its subdirectory of the dashboards, folders and libraries
+// directories, or its subdirectories for the dashboards laid out by folder.
+// Returns all the files if organisations aren't synchronised separately.
+func (cfg *Config) OrgFiles(paths []string) (owned []string) {
+	if len(cfg.OrgDir) == 0 {
+		return paths
+	}
+
+	owned = make([]string, 0)
+	for _, path := range paths {
+		parts := strings.Split(filepath.ToSlash(path), "/")
+		if len(parts) >= 3 && parts[1] == cfg.OrgDir {
+			owned = append(owned, path)
+		}
+	}
+	return
+}
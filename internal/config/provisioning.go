@@ -0,0 +1,34 @@
+package config
+
+import "fmt"
+
+// ProvisioningSettings makes the puller also write the dashboards in the
+// layout Grafana's file provisioning reads, along with the definition of the
+// providers, so the repository can be used by a Grafana instance provisioned
+// from files as well as by the pusher.
+type ProvisioningSettings struct {
+	// Path is the path the provisioning directory of the repository (the
+	// organisation's subdirectory of it, if any) is available at for the
+	// provisioned Grafana instance, e.g. "/etc/grafana/dashboards". The
+	// providers' paths are relative to it.
+	Path string `yaml:"path"`
+	// AllowUIUpdates lets the dashboards be changed from Grafana's
+	// interface. They're overwritten by the next provisioning anyway.
+	AllowUIUpdates bool `yaml:"allow_ui_updates,omitempty"`
+	// DisableDeletion keeps the dashboards in Grafana when their files are
+	// removed.
+	DisableDeletion bool `yaml:"disable_deletion,omitempty"`
+}
+
+// validateProvisioning checks that the provisioning settings, if any, give the
+// path the providers point to.
+// Returns an error if the path is missing.
+func validateProvisioning(g *GitSettings) error {
+	if g == nil || g.Provisioning == nil {
+		return nil
+	}
+	if g.Provisioning.Path == "" {
+		return fmt.Errorf("The provisioning settings need the path the provisioning directory is available at for Grafana")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretTag is the struct tag marking the configuration fields holding
+// secrets, which must never be displayed. Every field holding a secret must
+// carry `secret:"true"`.
+const secretTag = "secret"
+
+// Redacted returns a copy of the configuration in which the values of the
+// fields tagged as secrets are replaced with their length and the prefix of
+// their SHA-256 hash, so two values can be compared without being revealed.
+func (cfg *Config) Redacted() *Config {
+	return redactValue(reflect.ValueOf(cfg)).Interface().(*Config)
+}
+
+// RedactedYAML returns the redacted configuration (see Redacted) as YAML,
+// preceded by a comment giving the path and modification time of the file it
+// was loaded from.
+// Returns an error if the configuration couldn't be marshalled.
+func (cfg *Config) RedactedYAML() (out []byte, err error) {
+	body, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return
+	}
+
+	header := fmt.Sprintf("# Loaded from %s", cfg.FilePath)
+	if !cfg.FileModTime.IsZero() {
+		header += fmt.Sprintf(", modified on %s", cfg.FileModTime.UTC().Format(time.RFC3339))
+	}
+
+	return append([]byte(header+"\n"), body...), nil
+}
+
+// LogEffective logs the redacted configuration, so misconfigurations can be
+// spotted from the logs.
+func (cfg *Config) LogEffective() {
+	out, err := cfg.RedactedYAML()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to render the effective configuration")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"config": "\n" + string(out),
+	}).Info("Effective configuration")
+}
+
+// redactSecret returns the redacted form of a secret.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("<redacted, %d characters, sha256 %s...>", len(secret), hex.EncodeToString(sum[:])[:8])
+}
+
+// redactValue returns a deep copy of the given value in which the string
+// fields tagged as secrets are redacted.
+func redactValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Elem().Type())
+		out.Elem().Set(redactValue(v.Elem()))
+		return out
+
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if field.Tag.Get(secretTag) == "true" && field.Type.Kind() == reflect.String {
+				out.Field(i).SetString(redactSecret(v.Field(i).String()))
+				continue
+			}
+			out.Field(i).Set(redactValue(v.Field(i)))
+		}
+		return out
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), redactValue(iter.Value()))
+		}
+		return out
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return out
+	}
+
+	return v
+}
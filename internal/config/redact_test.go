@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// secretName matches the names of the fields which look like they hold a
+// secret.
+var secretName = regexp.MustCompile(`(?i)token|secret|password|key`)
+
+// notSecrets are the fields which names look like they hold a secret, but
+// which only hold the path to a file, or a URL, by type and field name. A
+// field must only be added here once checked.
+var notSecrets = map[string]bool{
+	"GrafanaSettings.APIKeyFile":           true,
+	"GrafanaSettings.ClientKeyPath":        true,
+	"OAuth2Settings.TokenURL":              true,
+	"GitSettings.PrivateKeyPath":           true,
+	"GitSettings.SigningKeyPath":           true,
+	"GitSettings.SigningKeyPassphrasePath": true,
+	"PusherConfig.TLSKey":                  true,
+}
+
+// stringFields walks the given type, and calls the given function with the
+// path, the type of the structure and the field of each of the string fields
+// of the structures it contains.
+func stringFields(
+	typ reflect.Type, path string, seen map[reflect.Type]bool, fn func(path string, owner reflect.Type, field reflect.StructField),
+) {
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		stringFields(typ.Elem(), path, seen, fn)
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if seen[typ] {
+		return
+	}
+	seen[typ] = true
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldPath := path + "." + field.Name
+		if field.Type.Kind() == reflect.String {
+			fn(fieldPath, typ, field)
+			continue
+		}
+		stringFields(field.Type, fieldPath, seen, fn)
+	}
+}
+
+// Every field which looks like it holds a secret must be redacted.
+func TestSecretFieldsTagged(t *testing.T) {
+	checked := 0
+	fn := func(path string, owner reflect.Type, field reflect.StructField) {
+		checked++
+		if field.Tag.Get(secretTag) == "true" || !secretName.MatchString(field.Name) {
+			return
+		}
+		if notSecrets[owner.Name()+"."+field.Name] {
+			return
+		}
+		t.Errorf("%s looks like a secret but isn't tagged with `secret:\"true\"`", path)
+	}
+	stringFields(reflect.TypeOf(Config{}), "Config", make(map[reflect.Type]bool), fn)
+	if checked == 0 {
+		t.Fatalf("no field checked")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := &Config{
+		Grafana: GrafanaSettings{BaseURL: "http://grafana", APIKey: "glsa_secret"},
+		Git:     &GitSettings{URL: "git@example.com:dashboards.git"},
+	}
+	redacted := cfg.Redacted()
+
+	if redacted.Grafana.APIKey == cfg.Grafana.APIKey {
+		t.Errorf("the API key isn't redacted")
+	}
+	if !strings.Contains(redacted.Grafana.APIKey, "11 characters") {
+		t.Errorf("redacted API key %q doesn't give its length", redacted.Grafana.APIKey)
+	}
+	if redacted.Grafana.BaseURL != cfg.Grafana.BaseURL || redacted.Git.URL != cfg.Git.URL {
+		t.Errorf("a field which isn't secret was changed")
+	}
+
+	// The original configuration is left untouched.
+	if cfg.Grafana.APIKey != "glsa_secret" {
+		t.Errorf("the original configuration was redacted")
+	}
+	if redacted.Git == cfg.Git {
+		t.Errorf("the redacted configuration shares the Git settings")
+	}
+
+	out, err := cfg.RedactedYAML()
+	if err != nil {
+		t.Fatalf("RedactedYAML: %v", err)
+	}
+	if strings.Contains(string(out), "glsa_secret") {
+		t.Errorf("the YAML dump reveals the API key:\n%s", out)
+	}
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig returns the TLS configuration of the connections to Grafana:
+// Grafana's certificate is checked against the system's certificate
+// authorities and the one in CACertPath, if set, and the certificate in
+// ClientCertPath is presented to Grafana, if set. SkipVerify disables the
+// checks of Grafana's certificate.
+// Returns an error naming the file which couldn't be read or parsed, or if
+// only one of the client certificate and key is set.
+func (g *GrafanaSettings) TLSConfig() (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{InsecureSkipVerify: g.SkipVerify}
+
+	if g.CACertPath != "" {
+		pem, err := os.ReadFile(g.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the Grafana CA certificate %s: %w", g.CACertPath, err)
+		}
+		// Keep trusting the system's certificate authorities, if they
+		// can be loaded.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("The Grafana CA certificate %s doesn't hold any PEM certificate", g.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if g.ClientCertPath == "" && g.ClientKeyPath == "" {
+		return
+	}
+	if g.ClientCertPath == "" || g.ClientKeyPath == "" {
+		return nil, fmt.Errorf("Both client_cert_path and client_key_path must be set to use a client certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(g.ClientCertPath, g.ClientKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the client certificate %s with the key %s: %w", g.ClientCertPath, g.ClientKeyPath, err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return
+}
@@ -0,0 +1,193 @@
+package deploy
+
+import (
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Changes describes the files to push to, or delete from, Grafana after
+// applying the deployment markers to a range of commits.
+type Changes struct {
+	// Modified and Removed contain the names of the files added or modified,
+	// and removed, by the commits marked for deployment.
+	Modified []string
+	Removed  []string
+	// Contents maps the name of each file from Modified to its content at the
+	// latest marked commit modifying it, and the name of each file from
+	// Removed to its content before it was removed.
+	Contents map[string][]byte
+	// DeployedAll is the hash of the latest commit marked with a
+	// "Deploy-All" trailer, or an empty string if there isn't any.
+	DeployedAll string
+
+	modified map[string]bool
+	removed  map[string]bool
+}
+
+func newChanges() *Changes {
+	return &Changes{
+		Contents: make(map[string][]byte),
+		modified: make(map[string]bool),
+		removed:  make(map[string]bool),
+	}
+}
+
+// add records the changes introduced between the "before" and "after"
+// commits. Later changes to a file override the earlier ones.
+// Returns an error if a file's content couldn't be read.
+func (c *Changes) add(
+	modified []string, removed []string, before *object.Commit, after *object.Commit,
+) (err error) {
+	for _, filename := range modified {
+		var content []byte
+		var found bool
+		if content, found, err = git.FileContentAtCommit(after, filename); err != nil {
+			return
+		}
+
+		// A file modified by an older commit of a catch-up diff may have been
+		// removed since.
+		if !found {
+			removed = append(removed, filename)
+			continue
+		}
+
+		c.Contents[filename] = content
+		c.modified[filename] = true
+		delete(c.removed, filename)
+	}
+
+	for _, filename := range removed {
+		var content []byte
+		var found bool
+		if content, found, err = git.FileContentAtCommit(before, filename); err != nil {
+			return
+		}
+
+		// Files added then removed within the range were never deployed.
+		if !found {
+			continue
+		}
+
+		c.Contents[filename] = content
+		c.removed[filename] = true
+		delete(c.modified, filename)
+	}
+
+	return
+}
+
+// finalise fills the lists of modified and removed files in.
+func (c *Changes) finalise() {
+	c.Modified = utils.SortedKeys(c.modified)
+	c.Removed = utils.SortedKeys(c.removed)
+}
+
+// PlanRange looks at the commits made after "from" and up to "to", and
+// computes the changes to deploy to the target from the configuration: the
+// changes from the commits with a "Deploy-To" trailer mentioning the target,
+// and, for a commit with a "Deploy-All" trailer, all of the changes since the
+// last deployed commit recorded in the state. Unmarked commits are skipped.
+// The state isn't modified; once the changes are deployed, the caller should
+// record Changes.DeployedAll in it, if set.
+// Returns an error if there was an issue reading the repository.
+func PlanRange(
+	repo *git.Repository, settings *config.DeploySettings, state *State,
+	from *object.Commit, to *object.Commit,
+) (changes *Changes, err error) {
+	changes = newChanges()
+
+	commits, err := repo.GetCommitsBetween(from, to)
+	if err != nil {
+		return
+	}
+
+	// The base of a catch-up diff is the last deployed commit, or the
+	// previous commit if it isn't known (e.g. the history was rewritten).
+	base := from
+	if state != nil && len(state.LastDeployedCommit) > 0 {
+		var lastDeployed *object.Commit
+		if lastDeployed, err = repo.GetCommit(state.LastDeployedCommit); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"commit": state.LastDeployedCommit,
+			}).Warn("Last deployed commit not found, catching up from the previous commit instead")
+			err = nil
+		} else {
+			base = lastDeployed
+		}
+	}
+
+	for _, commit := range commits {
+		fields := logrus.Fields{
+			"hash":   commit.Hash.String(),
+			"target": settings.Target,
+		}
+
+		switch CommitMarker(commit.Message, settings.Target) {
+		case MarkedForAll:
+			logrus.WithFields(fields).Info("Commit marked for deployment of all changes")
+
+			var modified, removed []string
+			if modified, removed, err = repo.GetModifiedAndRemovedFiles(base, commit); err != nil {
+				return
+			}
+			if err = changes.add(modified, removed, base, commit); err != nil {
+				return
+			}
+
+			base = commit
+			changes.DeployedAll = commit.Hash.String()
+
+		case MarkedForTarget:
+			logrus.WithFields(fields).Info("Commit marked for deployment")
+
+			if err = addCommit(repo, changes, commit); err != nil {
+				return
+			}
+
+		default:
+			logrus.WithFields(fields).Info("Commit not marked for deployment, its changes will wait for a Deploy-All")
+		}
+	}
+
+	changes.finalise()
+	return
+}
+
+// PlanCommit computes the changes introduced by a single commit, compared to
+// its first parent. This is used to deploy merge commits from merge requests
+// carrying the configured label.
+// Returns an error if there was an issue reading the repository.
+func PlanCommit(repo *git.Repository, commit *object.Commit) (changes *Changes, err error) {
+	changes = newChanges()
+
+	if err = addCommit(repo, changes, commit); err != nil {
+		return
+	}
+
+	changes.finalise()
+	return
+}
+
+// addCommit records the changes introduced by a commit compared to its first
+// parent.
+func addCommit(repo *git.Repository, changes *Changes, commit *object.Commit) (err error) {
+	modified, removed, err := repo.CommitFiles(commit)
+	if err != nil {
+		return
+	}
+
+	var parent *object.Commit
+	if commit.NumParents() > 0 {
+		if parent, err = commit.Parent(0); err != nil {
+			return
+		}
+	}
+
+	return changes.add(modified, removed, parent, commit)
+}
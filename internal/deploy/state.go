@@ -0,0 +1,95 @@
+package deploy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+)
+
+// State records the deployment progress of the pusher for a target, so
+// accumulated changes can be deployed once a "Deploy-All" trailer lands, even
+// after a restart.
+type State struct {
+	Target string `json:"target"`
+	// LastDeployedCommit is the hash of the latest commit which changes, as
+	// well as all of the previous commits' changes, have been deployed.
+	LastDeployedCommit string    `json:"lastDeployedCommit"`
+	DeployedAt         time.Time `json:"deployedAt"`
+}
+
+// StatePath returns the path of the state file for the given configuration.
+// Unless set in the configuration, the file lives in the .git directory of the
+// clone, so it's never committed.
+func StatePath(cfg *config.Config) string {
+	if len(cfg.Pusher.Deploy.StateFile) > 0 {
+		return cfg.Pusher.Deploy.StateFile
+	}
+
+	return filepath.Join(
+		cfg.Git.ClonePath, ".git", "dashboards-manager",
+		"deploy-"+filepath.Base(cfg.Pusher.Deploy.Target)+".json",
+	)
+}
+
+// LoadState reads the state file at the given path.
+// Returns a nil state and no error if the file doesn't exist.
+// Returns an error if the file couldn't be read or parsed.
+func LoadState(path string) (state *State, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	state = new(State)
+	err = json.Unmarshal(data, state)
+	return
+}
+
+// Save writes the state to the file at the given path, creating its directory
+// if needed. The file is replaced atomically so a crash can't corrupt it.
+// Returns an error if the file couldn't be written.
+func (s *State) Save(path string) (err error) {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadOrInitState reads the state file at the given path. If it doesn't exist
+// yet, i.e. the partial pushes mode was just enabled, a new state is created
+// with the given commit as the last deployed one, and saved.
+// Returns an error if the file couldn't be read, parsed or written.
+func LoadOrInitState(path string, target string, head string) (state *State, err error) {
+	if state, err = LoadState(path); err != nil || state != nil {
+		return
+	}
+
+	state = &State{Target: target}
+	err = state.MarkDeployed(head, path)
+	return
+}
+
+// MarkDeployed records the commit with the given hash as the last deployed
+// one, and saves the state to the file at the given path.
+// Returns an error if the file couldn't be written.
+func (s *State) MarkDeployed(hash string, path string) error {
+	s.LastDeployedCommit = hash
+	s.DeployedAt = time.Now().UTC()
+	return s.Save(path)
+}
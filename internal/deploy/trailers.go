@@ -0,0 +1,103 @@
+package deploy
+
+import (
+	"strings"
+)
+
+const (
+	// TrailerDeployTo is the commit message trailer marking the changes of a
+	// commit for deployment to one or more targets, e.g. "Deploy-To: prod" or
+	// "Deploy-To: staging, prod".
+	TrailerDeployTo = "Deploy-To"
+	// TrailerDeployAll is the commit message trailer asking for all of the
+	// changes not deployed yet to be deployed, e.g. "Deploy-All: true".
+	TrailerDeployAll = "Deploy-All"
+)
+
+// Marker describes how a commit is marked for deployment.
+type Marker int
+
+const (
+	// Unmarked commits aren't deployed, their changes accumulate until a
+	// commit is marked with a "Deploy-All" trailer.
+	Unmarked Marker = iota
+	// MarkedForTarget commits have their own changes deployed.
+	MarkedForTarget
+	// MarkedForAll commits have all of the changes since the last deployed
+	// commit deployed.
+	MarkedForAll
+)
+
+// ParseTrailers parses the trailers of a commit message, i.e. the "Key: value"
+// lines of its last paragraph, and returns their values by key. Keys are
+// case-insensitive, and are returned in their canonical form when they're known
+// trailers. If the last paragraph contains a line that isn't a trailer, the
+// message is considered not to have any trailer, as Git does.
+func ParseTrailers(message string) (trailers map[string][]string) {
+	trailers = make(map[string][]string)
+
+	paragraphs := strings.Split(strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n")), "\n\n")
+	// The subject line can't hold trailers.
+	if len(paragraphs) < 2 {
+		return
+	}
+
+	last := paragraphs[len(paragraphs)-1]
+	for _, line := range strings.Split(last, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !found || len(key) == 0 || strings.ContainsAny(key, " \t") {
+			return make(map[string][]string)
+		}
+
+		switch {
+		case strings.EqualFold(key, TrailerDeployTo):
+			key = TrailerDeployTo
+		case strings.EqualFold(key, TrailerDeployAll):
+			key = TrailerDeployAll
+		}
+
+		trailers[key] = append(trailers[key], strings.TrimSpace(value))
+	}
+
+	return
+}
+
+// CommitMarker looks at the trailers of the given commit message to tell how
+// the commit is marked for deployment to the given target. A "Deploy-All"
+// trailer takes precedence over a "Deploy-To" one.
+func CommitMarker(message string, target string) Marker {
+	trailers := ParseTrailers(message)
+
+	for _, value := range trailers[TrailerDeployAll] {
+		if !strings.EqualFold(value, "false") && !strings.EqualFold(value, "no") {
+			return MarkedForAll
+		}
+	}
+
+	for _, value := range trailers[TrailerDeployTo] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), target) {
+				return MarkedForTarget
+			}
+		}
+	}
+
+	return Unmarked
+}
+
+// HasLabel returns true if the given label is part of the given list of labels.
+// Labels are compared case-insensitively.
+func HasLabel(labels []string, label string) bool {
+	if len(label) == 0 {
+		return false
+	}
+
+	for _, l := range labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+
+	return false
+}
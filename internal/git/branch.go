@@ -0,0 +1,219 @@
+package git
+
+import (
+	"github.com/sirupsen/logrus"
+	gogit "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	transport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// fallbackRef is the reference of the branch tracked by a clone which follows
+// the remote's default branch, if the clone's HEAD doesn't give it.
+const fallbackRef = "refs/heads/master"
+
+// BranchRef returns the reference of the branch the clone tracks, e.g.
+// "refs/heads/main": the configured branch, or else the remote's default
+// branch the clone's HEAD is on.
+func (r *Repository) BranchRef() string {
+	if r.cfg.Branch != "" {
+		return plumbing.NewBranchReferenceName(r.cfg.Branch).String()
+	}
+	if r.Repo != nil {
+		if head, err := r.Repo.Head(); err == nil && head.Name().IsBranch() {
+			return head.Name().String()
+		}
+	}
+	return fallbackRef
+}
+
+// remoteHasBranch checks whether the configured branch exists on the remote.
+// Returns an error if the remote's references couldn't be listed, except if
+// the remote is empty.
+func (r *Repository) remoteHasBranch() (found bool, err error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{r.cfg.URL},
+	})
+	refs, err := remote.List(&gogit.ListOptions{Auth: r.auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	name := plumbing.NewBranchReferenceName(r.cfg.Branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkoutBranch checks the configured branch out in the given clone if it's
+// on another one, creating the local branch from the remote's if it exists
+// there, or else from the clone's HEAD, in which case the branch is created on
+// the remote by the next push.
+// Returns an error if the branch couldn't be fetched or checked out.
+func (r *Repository) checkoutBranch(repo *gogit.Repository, w *gogit.Worktree, onRemote bool) (err error) {
+	name := plumbing.NewBranchReferenceName(r.cfg.Branch)
+	if head, headErr := repo.Head(); headErr == nil && head.Name() == name {
+		return nil
+	}
+
+	logFields := logrus.Fields{
+		"clone_path": r.cfg.ClonePath,
+		"branch":     r.cfg.Branch,
+	}
+
+	// The local branch exists already.
+	if _, err = repo.Reference(name, true); err == nil {
+		logrus.WithFields(logFields).Info("Checking the branch out")
+		return w.Checkout(&gogit.CheckoutOptions{Branch: name})
+	}
+
+	checkout := &gogit.CheckoutOptions{Branch: name, Create: true}
+	if onRemote {
+		remoteName := plumbing.NewRemoteReferenceName("origin", r.cfg.Branch)
+		err = repo.Fetch(&gogit.FetchOptions{
+			RemoteName: "origin",
+			Auth:       r.auth,
+			RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + name + ":" + remoteName)},
+		})
+		if err = checkRemoteErrors(err, logrus.Fields{
+			"clone_path": r.cfg.ClonePath,
+			"branch":     r.cfg.Branch,
+			"error":      err,
+		}); err != nil {
+			return
+		}
+		var remoteRef *plumbing.Reference
+		if remoteRef, err = repo.Reference(remoteName, true); err != nil {
+			return
+		}
+		checkout.Hash = remoteRef.Hash()
+		logrus.WithFields(logFields).Info("Checking the branch out from the remote")
+	} else {
+		logrus.WithFields(logFields).Info("The branch doesn't exist on the remote, creating it from the default branch")
+	}
+
+	if err = w.Checkout(checkout); err != nil {
+		return
+	}
+
+	// Track the remote's branch, like git does.
+	err = repo.CreateBranch(&gitconfig.Branch{Name: r.cfg.Branch, Remote: "origin", Merge: name})
+	if err == gogit.ErrBranchExists {
+		err = nil
+	}
+	return
+}
+
+// HeadCommit loads the commit the clone's HEAD points to.
+// Returns an error if HEAD couldn't be resolved or the commit loaded.
+func (r *Repository) HeadCommit() (*object.Commit, error) {
+	head, err := r.Repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	return r.Repo.CommitObject(head.Hash())
+}
+
+// FetchBranch fetches a branch of the remote into a local reference, without
+// touching the worktree nor the branches, and returns its head commit. The
+// fetch is forced, so a branch which was force-pushed is fetched properly.
+// Returns an error if there was an issue fetching from the remote or loading
+// the commit.
+func (r *Repository) FetchBranch(branch string) (*object.Commit, error) {
+	local := plumbing.ReferenceName("refs/dashboards-manager/branches/" + branch)
+	remote := plumbing.NewBranchReferenceName(branch)
+
+	err := r.Repo.Fetch(&gogit.FetchOptions{
+		RemoteName: "origin",
+		Auth:       r.auth,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + remote + ":" + local)},
+		Force:      true,
+	})
+	if err = checkRemoteErrors(err, logrus.Fields{
+		"clone_path": r.cfg.ClonePath,
+		"branch":     branch,
+		"error":      err,
+	}); err != nil {
+		return nil, err
+	}
+
+	ref, err := r.Repo.Reference(local, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Repo.CommitObject(ref.Hash())
+}
+
+// PushCommitToBranch points the given branch at the given commit, locally and
+// on the remote, replacing its history on the remote, without checking it out.
+// Returns an error if there was an issue updating the local branch or pushing
+// to the remote. In the latter case, if the error is a known non-error,
+// doesn't return any error.
+func (r *Repository) PushCommitToBranch(hash plumbing.Hash, branch string) (err error) {
+	ref := plumbing.NewBranchReferenceName(branch)
+	if err = r.Repo.Storer.SetReference(plumbing.NewHashReference(ref, hash)); err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"repo":       r.cfg.User + "@" + r.cfg.URL,
+		"clone_path": r.cfg.ClonePath,
+		"branch":     branch,
+	}).Info("Pushing to a branch of the remote")
+
+	err = r.Repo.Push(&gogit.PushOptions{
+		Auth:     r.auth,
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec("+" + ref + ":" + ref)},
+	})
+	return checkRemoteErrors(err, logrus.Fields{
+		"repo":       r.cfg.User + "@" + r.cfg.URL,
+		"clone_path": r.cfg.ClonePath,
+		"branch":     branch,
+		"error":      err,
+	})
+}
+
+// ResetTo points the branch the clone is on back to the given commit, and
+// resets the worktree to it, dropping the commits made after it.
+// Returns an error if there was an issue resetting the worktree.
+func (r *Repository) ResetTo(hash plumbing.Hash) error {
+	w, err := r.Repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset})
+}
+
+// UnstageAll resets the index to the commit HEAD points to, or empties it if
+// there's no commit yet, leaving the worktree as is.
+// Returns an error if there was an issue resetting the index.
+func (r *Repository) UnstageAll() error {
+	head, err := r.Repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		idx, err := r.Repo.Storer.Index()
+		if err != nil {
+			return err
+		}
+		idx.Entries = nil
+		return r.Repo.Storer.SetIndex(idx)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Reset(&gogit.ResetOptions{Commit: head.Hash(), Mode: gogit.MixedReset})
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	gogit "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	transport "gopkg.in/src-d/go-git.v4/plumbing/transport"
@@ -94,7 +95,9 @@ func (r *Repository) Sync(dontClone bool) (err error) {
 
 	// If the clone path already exists, pull from the remote, else clone it.
 	if exists {
-		err = r.pull()
+		// A pull can succeed on a broken clone, e.g. if there was nothing
+		// to pull, so the clone is checked either way.
+		err = r.heal(r.pull())
 	} else if !dontClone {
 		err = r.clone()
 	}
@@ -114,10 +117,20 @@ func (r *Repository) Push() (err error) {
 		"clone_path": r.cfg.ClonePath,
 	}).Info("Pushing to the remote")
 
-	// Push to remote.
-	if err = r.Repo.Push(&gogit.PushOptions{
+	pushOptions := &gogit.PushOptions{
 		Auth: r.auth,
-	}); err != nil {
+	}
+	// Only push the tracked branch if the clone isn't on the default one,
+	// which creates it on the remote if it isn't there yet.
+	if r.cfg.Branch != "" {
+		ref := plumbing.NewBranchReferenceName(r.cfg.Branch)
+		pushOptions.RefSpecs = []gitconfig.RefSpec{
+			gitconfig.RefSpec(ref + ":" + ref),
+		}
+	}
+
+	// Push to remote.
+	if err = r.Repo.Push(pushOptions); err != nil {
 		// Check error against known non-errors.
 		err = checkRemoteErrors(err, logrus.Fields{
 			"repo":       r.cfg.User + "@" + r.cfg.URL,
@@ -133,26 +146,19 @@ func (r *Repository) Push() (err error) {
 	return err
 }
 
-// GetLatestCommit retrieves the latest commit from the local Git repository and
-// returns it.
-// Returns an error if there was an issue fetching the references or loading the
-// latest one.
+// GetLatestCommit retrieves the latest commit from the local Git repository,
+// i.e. the one HEAD points to, and returns it. The first reference listed
+// isn't necessarily HEAD, e.g. once the clone holds other references such as
+// the backup of a rewritten branch.
+// Returns an error if there was an issue resolving HEAD or loading the commit.
 func (r *Repository) GetLatestCommit() (*object.Commit, error) {
-	// Retrieve the list of references from the repository.
-	refs, err := r.Repo.References()
-	if err != nil {
-		return nil, err
-	}
-
-	// Extract the latest reference.
-	ref, err := refs.Next()
+	ref, err := r.Repo.Head()
 	if err != nil {
 		return nil, err
 	}
 
 	// Load the commit matching the reference's hash and return it.
-	hash := ref.Hash()
-	return r.Repo.CommitObject(hash)
+	return r.Repo.CommitObject(ref.Hash())
 }
 
 // Log loads the Git repository's log, with the most recent commit having the
@@ -183,6 +189,7 @@ func (r *Repository) GetModifiedAndRemovedFiles(
 	// Initialise the slices.
 	modified = make([]string, 0)
 	removed = make([]string, 0)
+	seen := make(map[string]bool)
 
 	// We expect "from" to be the oldest commit, and "to" to be the most recent
 	// one. Because Log() works the other way (in anti-chronological order),
@@ -213,28 +220,23 @@ func (r *Repository) GetModifiedAndRemovedFiles(
 			"msg":  commit.Message,
 		}).Info("Scanning git entry ")
 
-		// Load stats from the current commit.
-		stats, err := commit.Stats()
+		commitModified, commitRemoved, err := r.CommitFiles(commit)
 		if err != nil {
 			return err
 		}
-
-		// Iterate over the files contained in the commit's stats.
-		for _, stat := range stats {
-			// Try to access the file's content.
-			_, err := commit.File(stat.Name)
-			if err != nil && err != object.ErrFileNotFound {
-				return err
+		// The commits are walked from the most recent one, so a file
+		// changed by several of them is only listed once, as changed by
+		// the most recent one.
+		for _, filename := range commitModified {
+			if !seen[filename] {
+				seen[filename] = true
+				modified = append(modified, filename)
 			}
-			// If the content couldn't be retrieved, it means the file was
-			// removed in this commit, else it means that it was either added or
-			// modified.
-			if err == object.ErrFileNotFound {
-				removed = append(removed, stat.Name)
-				logrus.Info("Git entry removed: ", stat.Name)
-			} else {
-				modified = append(modified, stat.Name)
-				logrus.Info("Git entry modified: ", stat.Name)
+		}
+		for _, filename := range commitRemoved {
+			if !seen[filename] {
+				seen[filename] = true
+				removed = append(removed, filename)
 			}
 		}
 
@@ -244,6 +246,111 @@ func (r *Repository) GetModifiedAndRemovedFiles(
 	return
 }
 
+// CommitFiles returns the name of the files that were added or modified, and
+// the name of the files that were removed, by the given commit. For a merge
+// commit, the changes are the ones introduced compared to its first parent.
+// Returns an error if there was an issue loading the commit's stats or
+// retrieving a file from the repository.
+func (r *Repository) CommitFiles(commit *object.Commit) (modified []string, removed []string, err error) {
+	modified = make([]string, 0)
+	removed = make([]string, 0)
+
+	// Load stats from the commit.
+	stats, err := commit.Stats()
+	if err != nil {
+		return
+	}
+
+	// Iterate over the files contained in the commit's stats.
+	for _, stat := range stats {
+		// Try to access the file's content.
+		_, err = commit.File(stat.Name)
+		if err != nil && err != object.ErrFileNotFound {
+			return
+		}
+		// If the content couldn't be retrieved, it means the file was
+		// removed in this commit, else it means that it was either added or
+		// modified.
+		if err == object.ErrFileNotFound {
+			removed = append(removed, stat.Name)
+			logrus.Info("Git entry removed: ", stat.Name)
+		} else {
+			modified = append(modified, stat.Name)
+			logrus.Info("Git entry modified: ", stat.Name)
+		}
+	}
+
+	return modified, removed, nil
+}
+
+// FileContentAtCommit returns the content of a file at the given commit, and
+// whether the file exists at this commit. A nil commit doesn't contain any
+// file.
+// Returns an error if the file couldn't be read.
+func FileContentAtCommit(commit *object.Commit, filename string) (content []byte, found bool, err error) {
+	if commit == nil {
+		return
+	}
+
+	file, err := commit.File(filename)
+	if err == object.ErrFileNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return
+	}
+
+	contentStr, err := file.Contents()
+	if err != nil {
+		return
+	}
+
+	return []byte(contentStr), true, nil
+}
+
+// GetCommit loads the commit with the given hash from the local Git
+// repository.
+// Returns an error if the commit couldn't be found or loaded.
+func (r *Repository) GetCommit(hash string) (*object.Commit, error) {
+	return r.Repo.CommitObject(plumbing.NewHash(hash))
+}
+
+// GetCommitsBetween returns the commits made after "from" and up to "to", in
+// chronological order. Commits made by the manager are excluded, unless the
+// configuration asks for them to be applied.
+// Returns an error if there was an issue loading the repository's log.
+func (r *Repository) GetCommitsBetween(
+	from *object.Commit, to *object.Commit,
+) (commits []*object.Commit, err error) {
+	commits = make([]*object.Commit, 0)
+
+	iter, err := r.Log(to.Hash.String())
+	if err != nil {
+		return
+	}
+
+	err = iter.ForEach(func(commit *object.Commit) error {
+		if commit.Hash.String() == from.Hash.String() {
+			return storer.ErrStop
+		}
+
+		if !r.cfg.ApplyManagerCommits &&
+			commit.Author.Email == r.cfg.CommitsAuthor.Email &&
+			commit.Author.Name == r.cfg.CommitsAuthor.Name {
+			return nil
+		}
+
+		commits = append(commits, commit)
+		return nil
+	})
+
+	// The log is in anti-chronological order.
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+
+	return
+}
+
 // GetFilesContentsAtCommit retrieves the state of the repository at a given
 // commit, and returns a map contaning the contents of all files in the repository
 // at this time.
@@ -312,20 +419,45 @@ func (r *Repository) getAuth() error {
 	return nil
 }
 
-// clone clones a Git repository into a given path, using a given auth.
+// clone clones a Git repository into a given path, using a given auth. If a
+// branch is configured, it's checked out, and created from the default branch
+// if it doesn't exist on the remote yet.
 // Returns the go-git representation of the Git repository.
 // Returns an error if there was an issue cloning the repository.
 func (r *Repository) clone() (err error) {
-	r.Repo, err = gogit.PlainClone(r.cfg.ClonePath, false, &gogit.CloneOptions{
+	cloneOptions := &gogit.CloneOptions{
 		URL:  r.cfg.URL,
 		Auth: r.auth,
-	})
+	}
 
-	return err
+	// If the branch doesn't exist on the remote yet, clone the default one
+	// and create the branch from it.
+	onRemote := true
+	if r.cfg.Branch != "" {
+		if onRemote, err = r.remoteHasBranch(); err != nil {
+			return
+		}
+		if onRemote {
+			cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(r.cfg.Branch)
+			cloneOptions.SingleBranch = true
+		}
+	}
+
+	if r.Repo, err = gogit.PlainClone(r.cfg.ClonePath, false, cloneOptions); err != nil || onRemote {
+		return err
+	}
+
+	w, err := r.Repo.Worktree()
+	if err != nil {
+		return
+	}
+	return r.checkoutBranch(r.Repo, w, false)
 }
 
 // pull opens the repository located at a given path, and pulls it from the
-// remote using a given auth, in order to be up to date with the remote.
+// remote using a given auth, in order to be up to date with the remote. If a
+// branch is configured, it's checked out first, and isn't pulled if it doesn't
+// exist on the remote yet.
 // Returns with the go-git representation of the repository.
 // Returns an error if there was an issue opening the repo, getting its work
 // tree or pulling from the remote. In the latter case, if the error is a known
@@ -343,11 +475,45 @@ func (r *Repository) pull() error {
 		return err
 	}
 
-	// Pull from remote.
-	if err = w.Pull(&gogit.PullOptions{
+	pullOptions := &gogit.PullOptions{
 		RemoteName: "origin",
 		Auth:       r.auth,
-	}); err != nil {
+	}
+	if r.cfg.Branch != "" {
+		// Make sure the clone is on the branch, e.g. if the setting was
+		// changed since it was cloned.
+		var onRemote bool
+		if onRemote, err = r.remoteHasBranch(); err != nil {
+			return err
+		}
+		if err = r.checkoutBranch(repo, w, onRemote); err != nil {
+			return err
+		}
+		r.Repo = repo
+
+		// There's nothing to pull until the branch is created on the
+		// remote by the next push.
+		if !onRemote {
+			logrus.WithFields(logrus.Fields{
+				"clone_path": r.cfg.ClonePath,
+				"branch":     r.cfg.Branch,
+			}).Info("The branch doesn't exist on the remote yet, not pulling")
+			return nil
+		}
+
+		pullOptions.ReferenceName = plumbing.NewBranchReferenceName(r.cfg.Branch)
+		pullOptions.SingleBranch = true
+	}
+
+	// Pull from remote, remembering where the remote branch was before, so a
+	// rewritten history can be told from commits made on both sides.
+	previousRemote := remoteHead(repo)
+	if err = w.Pull(pullOptions); err == gogit.ErrNonFastForwardUpdate {
+		// The branch can't be fast-forwarded if it has commits which
+		// weren't pushed, or if the remote's history was rewritten, e.g.
+		// force-pushed.
+		err = r.resetToRemote(repo, w, previousRemote)
+	} else if err != nil {
 		// Check error against known non-errors.
 		err = checkRemoteErrors(err, logrus.Fields{
 			"clone_path": r.cfg.ClonePath,
@@ -360,6 +526,178 @@ func (r *Repository) pull() error {
 	return err
 }
 
+// resetToRemote resets the branch the clone is on, and its worktree, to the
+// head of the same branch on the remote, as fetched by the latest pull, when
+// the branch can't be fast-forwarded to it because its history was rewritten,
+// e.g. by a force-push, i.e. when the given head of the remote branch before
+// the pull isn't an ancestor of its new head anymore. The local head is kept
+// under refs/dashboards-manager/backups/<branch> first, so the local commits
+// which aren't on the remote can still be recovered. A branch which is only
+// ahead of the remote, with commits which weren't pushed yet, is left as it
+// is, and so is a branch which diverged from a remote branch which history
+// wasn't rewritten, e.g. with commits which couldn't be pushed because others
+// were pushed meanwhile.
+// Returns an error if the clone isn't on a branch, if it diverged from the
+// remote branch, if the remote branch couldn't be found, or if the worktree
+// couldn't be reset.
+func (r *Repository) resetToRemote(repo *gogit.Repository, w *gogit.Worktree, previousRemote plumbing.Hash) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if !head.Name().IsBranch() {
+		return gogit.ErrNonFastForwardUpdate
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		return err
+	}
+
+	fields := logrus.Fields{
+		"clone_path":  r.cfg.ClonePath,
+		"branch":      head.Name().Short(),
+		"local_head":  head.Hash().String(),
+		"remote_head": remoteRef.Hash().String(),
+	}
+
+	localCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	remoteCommit, err := repo.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return err
+	}
+	ahead, err := remoteCommit.IsAncestor(localCommit)
+	if err != nil {
+		return err
+	}
+	if ahead {
+		logrus.WithFields(fields).Info("The local branch has commits which weren't pushed yet, not resetting it")
+		return nil
+	}
+
+	// Without a rewrite, the remote branch only moved forward from where it
+	// was, and the local commits are kept, to be dealt with by a human.
+	rewritten, err := remoteRewritten(repo, previousRemote, remoteCommit)
+	if err != nil {
+		return err
+	}
+	if !rewritten {
+		fields["previous_remote_head"] = previousRemote.String()
+		logrus.WithFields(fields).Error("The local branch and the remote one diverged, not resetting the clone")
+		return gogit.ErrNonFastForwardUpdate
+	}
+
+	backup := plumbing.ReferenceName("refs/dashboards-manager/backups/" + head.Name().Short())
+	if err = repo.Storer.SetReference(plumbing.NewHashReference(backup, head.Hash())); err != nil {
+		return err
+	}
+	fields["backup"] = backup.String()
+	logrus.WithFields(fields).Error("The history of the remote branch was rewritten (e.g. force-pushed), resetting the clone to it")
+
+	return w.Reset(&gogit.ResetOptions{Commit: remoteRef.Hash(), Mode: gogit.HardReset})
+}
+
+// remoteHead returns the hash of the head of the remote branch tracked by the
+// branch the given repository is on, as fetched by the latest pull, or a zero
+// hash if it isn't known.
+func remoteHead(repo *gogit.Repository) plumbing.Hash {
+	head, err := repo.Head()
+	if err != nil || !head.Name().IsBranch() {
+		return plumbing.ZeroHash
+	}
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return ref.Hash()
+}
+
+// remoteRewritten returns true if the given previous head of the remote branch
+// isn't an ancestor of its given new head, i.e. if the remote branch's history
+// was rewritten. A previous head which isn't known isn't considered as
+// rewritten, so nothing is reset without a proof.
+// Returns an error if the history couldn't be walked.
+func remoteRewritten(repo *gogit.Repository, previous plumbing.Hash, latest *object.Commit) (bool, error) {
+	if previous.IsZero() || previous == latest.Hash {
+		return false, nil
+	}
+	previousCommit, err := repo.CommitObject(previous)
+	if err != nil {
+		return false, err
+	}
+	isAncestor, err := previousCommit.IsAncestor(latest)
+	return !isAncestor, err
+}
+
+// FetchMergeRequest fetches the head of a GitLab merge request into a local
+// reference, without touching the worktree, and returns the head commit. The
+// fetch is forced, so a merge request which branch was force-pushed is fetched
+// properly.
+// Returns an error if there was an issue fetching from the remote or loading
+// the commit.
+func (r *Repository) FetchMergeRequest(iid int) (*object.Commit, error) {
+	local := plumbing.ReferenceName(fmt.Sprintf("refs/dashboards-manager/merge-requests/%d", iid))
+	remote := plumbing.ReferenceName(fmt.Sprintf("refs/merge-requests/%d/head", iid))
+
+	err := r.Repo.Fetch(&gogit.FetchOptions{
+		RemoteName: "origin",
+		Auth:       r.auth,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + remote + ":" + local)},
+		Force:      true,
+	})
+	if err = checkRemoteErrors(err, logrus.Fields{
+		"clone_path":    r.cfg.ClonePath,
+		"merge_request": iid,
+		"error":         err,
+	}); err != nil {
+		return nil, err
+	}
+
+	ref, err := r.Repo.Reference(local, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Repo.CommitObject(ref.Hash())
+}
+
+// GetChangedFilesBetweenTrees returns the name of the files that were added or
+// modified, and the name of the files that were removed, in the "to" commit's
+// tree compared to the "from" commit's tree.
+// Returns an error if there was an issue loading the trees or comparing them.
+func (r *Repository) GetChangedFilesBetweenTrees(
+	from *object.Commit, to *object.Commit,
+) (modified []string, removed []string, err error) {
+	modified = make([]string, 0)
+	removed = make([]string, 0)
+
+	fromTree, err := from.Tree()
+	if err != nil {
+		return
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return
+	}
+
+	changes, err := fromTree.Diff(toTree)
+	if err != nil {
+		return
+	}
+
+	for _, change := range changes {
+		if change.To.Name == "" {
+			removed = append(removed, change.From.Name)
+		} else {
+			modified = append(modified, change.To.Name)
+		}
+	}
+
+	return
+}
+
 // dirExists is a snippet checking if a directory exists on the disk.
 // Returns with a boolean set to true if the directory exists, false if not.
 // Returns with an error if there was an issue checking the directory's
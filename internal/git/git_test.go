@@ -0,0 +1,156 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// newTestRepository returns a clone of the given remote, synchronised.
+func newTestRepository(t *testing.T, remote *gittest.Remote) *Repository {
+	t.Helper()
+
+	r, _, err := NewRepository(remote.Settings())
+	if err != nil {
+		t.Fatalf("NewRepository: %v", err)
+	}
+	if err = r.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	return r
+}
+
+// head returns the hash of the commit the given clone is on.
+func head(t *testing.T, r *Repository) plumbing.Hash {
+	t.Helper()
+
+	ref, err := r.Repo.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	return ref.Hash()
+}
+
+// exists returns true if the given file exists in the given clone.
+func exists(r *Repository, filename string) bool {
+	_, err := os.Stat(filepath.Join(r.cfg.ClonePath, filename))
+	return err == nil
+}
+
+// A clone of a branch which was force-pushed is reset to it, its previous head
+// being kept.
+func TestSyncForcePushed(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	first := remote.Commit("Add a", map[string]string{"dashboards/a.json": `{"uid":"a"}`}, nil, false)
+	dropped := remote.Commit("Add b", map[string]string{"dashboards/b.json": `{"uid":"b"}`}, nil, false)
+	r := newTestRepository(t, remote)
+	if h := head(t, r); h != dropped {
+		t.Fatalf("cloned at %s, want %s", h, dropped)
+	}
+
+	remote.ResetTo(first)
+	rewritten := remote.Commit("Add c", map[string]string{"dashboards/c.json": `{"uid":"c"}`}, nil, true)
+	if err := r.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	if h := head(t, r); h != rewritten {
+		t.Errorf("the clone is at %s, want the remote's head %s", h, rewritten)
+	}
+	if exists(r, "dashboards/b.json") || !exists(r, "dashboards/c.json") {
+		t.Errorf("the worktree wasn't reset to the remote's head")
+	}
+	backup, err := r.Repo.Reference("refs/dashboards-manager/backups/master", true)
+	if err != nil {
+		t.Fatalf("the previous head wasn't kept: %v", err)
+	}
+	if backup.Hash() != dropped {
+		t.Errorf("kept %s as the previous head, want %s", backup.Hash(), dropped)
+	}
+
+	// The backup isn't taken for the latest commit.
+	latest, err := r.GetLatestCommit()
+	if err != nil {
+		t.Fatalf("GetLatestCommit: %v", err)
+	}
+	if latest.Hash != rewritten {
+		t.Errorf("the latest commit is %s, want %s", latest.Hash, rewritten)
+	}
+}
+
+// commitVersions commits a versions file to the clone, as the manager does,
+// without pushing it. Returns the hash of the new commit.
+func commitVersions(t *testing.T, r *Repository) plumbing.Hash {
+	t.Helper()
+
+	w, err := r.Repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(r.cfg.ClonePath, "versions.json"), []byte("{}"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err = w.Add("versions.json"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	hash, err := w.Commit("Update the versions", &gogit.CommitOptions{Author: &object.Signature{
+		Name: gittest.ManagerAuthor.Name, Email: gittest.ManagerAuthor.Email, When: time.Now(),
+	}})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	return hash
+}
+
+// A clone with commits which weren't pushed isn't reset.
+func TestSyncLocalAhead(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Add a", map[string]string{"dashboards/a.json": `{"uid":"a"}`}, nil, false)
+	r := newTestRepository(t, remote)
+
+	local := commitVersions(t, r)
+	if err := r.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if h := head(t, r); h != local {
+		t.Errorf("the clone is at %s, want its own commit %s", h, local)
+	}
+	if !exists(r, "versions.json") {
+		t.Errorf("the committed file was removed")
+	}
+	if _, err := r.Repo.Reference("refs/dashboards-manager/backups/master", true); err == nil {
+		t.Errorf("the clone was backed up although it wasn't reset")
+	}
+}
+
+// A clone with commits which weren't pushed, while others were pushed to the
+// remote without rewriting its history, isn't reset, as nothing was
+// force-pushed.
+func TestSyncDiverged(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Add a", map[string]string{"dashboards/a.json": `{"uid":"a"}`}, nil, false)
+	r := newTestRepository(t, remote)
+
+	local := commitVersions(t, r)
+	remote.Commit("Add b", map[string]string{"dashboards/b.json": `{"uid":"b"}`}, nil, false)
+	if err := r.Sync(false); err == nil {
+		t.Errorf("Sync didn't fail although the branches diverged")
+	}
+
+	if h := head(t, r); h != local {
+		t.Errorf("the clone is at %s, want its own commit %s", h, local)
+	}
+	if !exists(r, "versions.json") {
+		t.Errorf("the committed file was removed")
+	}
+	if _, err := r.Repo.Reference("refs/dashboards-manager/backups/master", true); err == nil {
+		t.Errorf("the clone was backed up although it wasn't reset")
+	}
+}
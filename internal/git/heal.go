@@ -0,0 +1,198 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	gogit "gopkg.in/src-d/go-git.v4"
+)
+
+const (
+	// defaultHealMaxFailures is the default number of consecutive failed
+	// synchronisations of a broken clone before it's cloned again.
+	defaultHealMaxFailures = 3
+	// defaultHealKeepBroken is the default number of broken clones kept
+	// aside.
+	defaultHealKeepBroken = 2
+	// brokenCloneSuffix is appended to the clone path, followed by a
+	// timestamp, to name a broken clone moved aside.
+	brokenCloneSuffix = ".broken-"
+)
+
+// lockFiles are the files Git leaves in the .git directory of a clone when an
+// operation is interrupted, and which prevent any further one.
+var lockFiles = []string{"index.lock", "HEAD.lock", "MERGE_HEAD", "shallow.lock"}
+
+// errInterruptedOperation is returned when a clone holds the leftovers of an
+// interrupted Git operation.
+var errInterruptedOperation = errors.New("the clone holds the leftovers of an interrupted Git operation")
+
+// heal checks the clone after a pull which ended with the given error, if any.
+// If the clone itself is broken, i.e. it can't be read or holds the leftovers
+// of an interrupted operation, the failure is counted, and the clone is moved
+// aside and cloned again from the remote once the configured number of
+// consecutive failures is reached. Failures because of the remote aren't
+// counted. Does nothing if self-healing is disabled.
+// Returns the given error, an error describing the problem if the pull
+// succeeded on a broken clone, or the error cloning the repository again.
+func (r *Repository) heal(syncErr error) error {
+	settings := r.cfg.SelfHeal
+	if settings != nil && settings.Disabled {
+		return syncErr
+	}
+
+	problem := checkClone(r.cfg.ClonePath, syncErr)
+	if problem == nil {
+		// The clone is fine, the remote is at fault if anything.
+		clearHealFailures(r.cfg.ClonePath)
+		return syncErr
+	}
+	if syncErr == nil {
+		syncErr = fmt.Errorf("The clone of the Git repository is broken: %w", problem)
+	}
+
+	maxFailures := defaultHealMaxFailures
+	keepBroken := defaultHealKeepBroken
+	if settings != nil && settings.MaxFailures > 0 {
+		maxFailures = settings.MaxFailures
+	}
+	if settings != nil && settings.KeepBroken > 0 {
+		keepBroken = settings.KeepBroken
+	}
+
+	failures := readHealFailures(r.cfg.ClonePath) + 1
+	logrus.WithFields(logrus.Fields{
+		"clone_path":   r.cfg.ClonePath,
+		"error":        syncErr,
+		"problem":      problem,
+		"failures":     failures,
+		"max_failures": maxFailures,
+	}).Error("The clone of the Git repository is broken")
+
+	if failures < maxFailures {
+		writeHealFailures(r.cfg.ClonePath, failures)
+		return syncErr
+	}
+
+	brokenPath := strings.TrimSuffix(r.cfg.ClonePath, "/") + brokenCloneSuffix + time.Now().UTC().Format("20060102T150405Z")
+	if err := os.Rename(r.cfg.ClonePath, brokenPath); err != nil {
+		writeHealFailures(r.cfg.ClonePath, failures)
+		return fmt.Errorf("Failed to move the broken clone aside: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"clone_path":  r.cfg.ClonePath,
+		"broken_path": brokenPath,
+	}).Error("Moved the broken clone aside, cloning the repository again")
+
+	pruneBrokenClones(r.cfg.ClonePath, keepBroken)
+	clearHealFailures(r.cfg.ClonePath)
+
+	return r.clone()
+}
+
+// checkClone checks whether the clone at the given path can be read, and
+// isn't stuck because of an interrupted operation.
+// Returns a description of the problem found, or nil if there's none.
+func checkClone(clonePath string, syncErr error) error {
+	// A worktree left dirty, e.g. by a pull interrupted while writing files,
+	// prevents any further pull.
+	if syncErr == gogit.ErrUnstagedChanges || syncErr == gogit.ErrWorktreeNotClean {
+		return syncErr
+	}
+
+	for _, name := range lockFiles {
+		if _, err := os.Stat(filepath.Join(clonePath, ".git", name)); err == nil {
+			return fmt.Errorf("%w: %s exists", errInterruptedOperation, name)
+		}
+	}
+
+	repo, err := gogit.PlainOpen(clonePath)
+	if err != nil {
+		return err
+	}
+	if _, err = repo.Storer.Index(); err != nil {
+		return fmt.Errorf("unreadable index: %w", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("unreadable HEAD: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("unreadable HEAD commit: %w", err)
+	}
+	if _, err = commit.Tree(); err != nil {
+		return fmt.Errorf("unreadable HEAD tree: %w", err)
+	}
+
+	return nil
+}
+
+// pruneBrokenClones removes the oldest broken clones moved aside from the
+// given clone path, so only the given number of them are kept.
+func pruneBrokenClones(clonePath string, keep int) {
+	matches, err := filepath.Glob(strings.TrimSuffix(clonePath, "/") + brokenCloneSuffix + "*")
+	if err != nil {
+		return
+	}
+
+	// Timestamps sort chronologically.
+	sort.Strings(matches)
+	for len(matches) > keep {
+		logrus.WithFields(logrus.Fields{
+			"broken_path": matches[0],
+		}).Warn("Removing an old broken clone")
+		if err = os.RemoveAll(matches[0]); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"broken_path": matches[0],
+				"error":       err,
+			}).Error("Failed to remove an old broken clone")
+		}
+		matches = matches[1:]
+	}
+}
+
+// healFailuresFile returns the path of the file counting the consecutive
+// failed synchronisations of a broken clone. It lives next to the clone, so
+// the count survives both the clone being moved aside and the manager being
+// restarted.
+func healFailuresFile(clonePath string) string {
+	return strings.TrimSuffix(clonePath, "/") + ".heal-failures"
+}
+
+// readHealFailures returns the number of consecutive failed synchronisations
+// of the broken clone at the given path, zero if there aren't any.
+func readHealFailures(clonePath string) int {
+	content, err := ioutil.ReadFile(healFailuresFile(clonePath))
+	if err != nil {
+		return 0
+	}
+	failures, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	return failures
+}
+
+// writeHealFailures records the number of consecutive failed synchronisations
+// of the broken clone at the given path.
+func writeHealFailures(clonePath string, failures int) {
+	err := ioutil.WriteFile(healFailuresFile(clonePath), []byte(strconv.Itoa(failures)+"\n"), 0644)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"clone_path": clonePath,
+			"error":      err,
+		}).Warn("Failed to record the failed synchronisation of the broken clone")
+	}
+}
+
+// clearHealFailures resets the number of consecutive failed synchronisations
+// of the clone at the given path.
+func clearHealFailures(clonePath string) {
+	os.Remove(healFailuresFile(clonePath))
+}
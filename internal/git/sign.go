@@ -0,0 +1,103 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// signingKeys holds the signing keys already loaded, by path, so each key is
+// only read and decrypted once.
+var signingKeys = struct {
+	sync.Mutex
+	entities map[string]*openpgp.Entity
+}{entities: make(map[string]*openpgp.Entity)}
+
+// SigningKey returns the PGP key the manager's commits are signed with, loaded
+// from the file given in the settings, armored or not, and decrypted with the
+// passphrase from the file given in the settings, if any. Returns nil if the
+// commits aren't signed. The key is only loaded once per path.
+// Returns an error if the key couldn't be read, has no private key, or
+// couldn't be decrypted.
+func SigningKey(cfg *config.GitSettings) (entity *openpgp.Entity, err error) {
+	if cfg == nil || cfg.SigningKeyPath == "" {
+		return nil, nil
+	}
+
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+
+	if entity, ok := signingKeys.entities[cfg.SigningKeyPath]; ok {
+		return entity, nil
+	}
+	if entity, err = loadSigningKey(cfg.SigningKeyPath, cfg.SigningKeyPassphrasePath); err != nil {
+		return nil, fmt.Errorf("Failed to load the signing key %s: %w", cfg.SigningKeyPath, err)
+	}
+	signingKeys.entities[cfg.SigningKeyPath] = entity
+	return
+}
+
+// loadSigningKey reads the first key with a private key from the key ring in
+// the file at the given path, and decrypts it with the passphrase read from
+// the file at the other given path, if it's encrypted.
+// Returns an error if the key couldn't be read or decrypted.
+func loadSigningKey(keyPath string, passphrasePath string) (entity *openpgp.Entity, err error) {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return
+	}
+
+	var entities openpgp.EntityList
+	if bytes.Contains(content, []byte("-----BEGIN PGP")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return
+	}
+	for _, candidate := range entities {
+		if candidate.PrivateKey != nil {
+			entity = candidate
+			break
+		}
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("the file has no private key")
+	}
+
+	keys := []*packet.PrivateKey{entity.PrivateKey}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil {
+			keys = append(keys, subkey.PrivateKey)
+		}
+	}
+
+	var passphrase []byte
+	for _, key := range keys {
+		if !key.Encrypted {
+			continue
+		}
+		if passphrase == nil {
+			if passphrasePath == "" {
+				return nil, fmt.Errorf("the private key is encrypted and no passphrase file is set")
+			}
+			var raw []byte
+			if raw, err = os.ReadFile(passphrasePath); err != nil {
+				return nil, err
+			}
+			passphrase = []byte(strings.TrimRight(string(raw), "\r\n"))
+		}
+		if err = key.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("failed to decrypt the private key: %w", err)
+		}
+	}
+	return
+}
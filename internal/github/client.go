@@ -0,0 +1,164 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Client implements a minimal GitHub API client, and contains the API base URL
+// (e.g. "https://api.github.com") and access token, along with an HTTP client
+// used to request the API.
+type Client struct {
+	BaseURL    string
+	Token      string
+	httpClient *http.Client
+}
+
+// PullRequest represents a GitHub pull request.
+type PullRequest struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	Head    struct {
+		Ref string `json:"ref"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+// NewClient returns a new GitHub API client from a given API base URL and
+// access token.
+func NewClient(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// request performs an HTTP request on a given endpoint of the GitHub API, or
+// on a given absolute URL, with a given method and body. If the request
+// doesn't require a body, the function has to be called with "nil" as the
+// "body" parameter.
+// Returns the response body and headers.
+// Returns an error if there was an issue performing the request or reading the
+// response body, or if the response status code isn't a 2xx one.
+func (c *Client) request(method string, endpoint string, body interface{}) (respBody []byte, header http.Header, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		var data []byte
+		if data, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	target := endpoint
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		target = c.BaseURL + "/" + endpoint
+	}
+	req, err := http.NewRequest(method, target, reqBody)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	logrus.WithFields(logrus.Fields{
+		"endpoint": endpoint,
+		"method":   method,
+		"code":     resp.StatusCode,
+	}).Debug("GitHub API response")
+
+	if respBody, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("GitHub API responded to %s %s with status %d: %s", method, endpoint, resp.StatusCode, string(respBody))
+	}
+
+	return respBody, resp.Header, err
+}
+
+// nextPage returns the URL of the next page given in a Link header, or an
+// empty string if it's the last page.
+func nextPage(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// OpenPullRequests retrieves the open pull requests of a repository, given as
+// "owner/name", into the given base branch, following the pagination.
+// Returns an error if there was an issue requesting the API or parsing its
+// responses.
+func (c *Client) OpenPullRequests(repository string, baseBranch string) (prs []PullRequest, err error) {
+	prs = make([]PullRequest, 0)
+	endpoint := "repos/" + repository + "/pulls?state=open&per_page=100&base=" + url.QueryEscape(baseBranch)
+	for endpoint != "" {
+		var body []byte
+		var header http.Header
+		if body, header, err = c.request("GET", endpoint, nil); err != nil {
+			return
+		}
+
+		var pagePRs []PullRequest
+		if err = json.Unmarshal(body, &pagePRs); err != nil {
+			return
+		}
+		prs = append(prs, pagePRs...)
+
+		endpoint = nextPage(header)
+	}
+
+	return
+}
+
+// CreatePullRequest opens a pull request from the given head branch into the
+// given base branch of a repository, given as "owner/name".
+// Returns an error if there was an issue requesting the API or parsing its
+// response.
+func (c *Client) CreatePullRequest(
+	repository string, headBranch string, baseBranch string, title string, description string,
+) (pr PullRequest, err error) {
+	body, _, err := c.request("POST", "repos/"+repository+"/pulls", map[string]string{
+		"head":  headBranch,
+		"base":  baseBranch,
+		"title": title,
+		"body":  description,
+	})
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(body, &pr)
+	return
+}
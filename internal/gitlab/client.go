@@ -0,0 +1,263 @@
+package gitlab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Client implements a minimal GitLab API client, and contains the instance's
+// API base URL (e.g. "https://gitlab.company.tld/api/v4") and access token,
+// along with an HTTP client used to request the API.
+type Client struct {
+	BaseURL    string
+	Token      string
+	httpClient *http.Client
+}
+
+// Note represents a comment on a GitLab merge request.
+type Note struct {
+	ID   int    `json:"id"`
+	Body string `json:"body"`
+}
+
+// NewClient returns a new GitLab API client from a given API base URL and
+// access token.
+func NewClient(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// request performs an HTTP request on a given endpoint of the GitLab API, with
+// a given method and body. If the request doesn't require a body, the function
+// has to be called with "nil" as the "body" parameter.
+// Returns the response body and headers.
+// Returns an error if there was an issue performing the request or reading the
+// response body, or if the response status code isn't a 2xx one.
+func (c *Client) request(method string, endpoint string, body interface{}) (respBody []byte, header http.Header, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		var data []byte
+		if data, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+"/"+endpoint, reqBody)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	logrus.WithFields(logrus.Fields{
+		"endpoint": endpoint,
+		"method":   method,
+		"code":     resp.StatusCode,
+	}).Debug("GitLab API response")
+
+	if respBody, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("GitLab API responded to %s %s with status %d: %s", method, endpoint, resp.StatusCode, string(respBody))
+	}
+
+	return respBody, resp.Header, err
+}
+
+// Commit status states.
+const (
+	CommitStatusPending = "pending"
+	CommitStatusRunning = "running"
+	CommitStatusSuccess = "success"
+	CommitStatusFailed  = "failed"
+)
+
+// CommitStatus represents the status of an external job on a commit, as shown
+// in GitLab's pipelines and merge requests.
+type CommitStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// maxStatusDescription is the maximum length of a commit status' description
+// GitLab accepts.
+const maxStatusDescription = 255
+
+// SetCommitStatus sets the status with the given status' name on a commit,
+// replacing the previous one with the same name.
+// Returns an error if there was an issue requesting the API.
+func (c *Client) SetCommitStatus(projectID int, sha string, status CommitStatus) (err error) {
+	if len(status.Description) > maxStatusDescription {
+		status.Description = status.Description[:maxStatusDescription-3] + "..."
+	}
+	_, _, err = c.request("POST", "projects/"+strconv.Itoa(projectID)+"/statuses/"+sha, status)
+	return
+}
+
+// mergeRequestNotesEndpoint returns the API endpoint for the notes of a merge
+// request.
+func mergeRequestNotesEndpoint(projectID int, mrIID int) string {
+	return "projects/" + strconv.Itoa(projectID) +
+		"/merge_requests/" + strconv.Itoa(mrIID) + "/notes"
+}
+
+// MergeRequestNotes retrieves all the notes of a merge request, following the
+// pagination.
+// Returns an error if there was an issue requesting the API or parsing its
+// responses.
+func (c *Client) MergeRequestNotes(projectID int, mrIID int) (notes []Note, err error) {
+	notes = make([]Note, 0)
+	for page := "1"; page != ""; {
+		var body []byte
+		var header http.Header
+		body, header, err = c.request(
+			"GET", mergeRequestNotesEndpoint(projectID, mrIID)+"?per_page=100&page="+page, nil,
+		)
+		if err != nil {
+			return
+		}
+
+		var pageNotes []Note
+		if err = json.Unmarshal(body, &pageNotes); err != nil {
+			return
+		}
+		notes = append(notes, pageNotes...)
+
+		page = header.Get("X-Next-Page")
+	}
+
+	return
+}
+
+// CreateMergeRequestNote adds a note with the given body to a merge request.
+// Returns an error if there was an issue requesting the API.
+func (c *Client) CreateMergeRequestNote(projectID int, mrIID int, body string) (err error) {
+	_, _, err = c.request("POST", mergeRequestNotesEndpoint(projectID, mrIID), map[string]string{
+		"body": body,
+	})
+	return
+}
+
+// UpdateMergeRequestNote replaces the body of an existing note of a merge
+// request.
+// Returns an error if there was an issue requesting the API.
+func (c *Client) UpdateMergeRequestNote(projectID int, mrIID int, noteID int, body string) (err error) {
+	_, _, err = c.request(
+		"PUT", mergeRequestNotesEndpoint(projectID, mrIID)+"/"+strconv.Itoa(noteID),
+		map[string]string{"body": body},
+	)
+	return
+}
+
+// UpsertMergeRequestNote makes sure a merge request has a single note
+// containing the given marker, with the given body: the existing note is
+// updated if there's one, else a new one is created. The marker should be
+// something invisible once rendered, such as an HTML comment, and is added to
+// the body if missing.
+// Returns an error if there was an issue requesting the API.
+func (c *Client) UpsertMergeRequestNote(projectID int, mrIID int, marker string, body string) (err error) {
+	if !strings.Contains(body, marker) {
+		body = marker + "\n" + body
+	}
+
+	notes, err := c.MergeRequestNotes(projectID, mrIID)
+	if err != nil {
+		return
+	}
+
+	for _, note := range notes {
+		if strings.Contains(note.Body, marker) {
+			if note.Body == body {
+				return nil
+			}
+			return c.UpdateMergeRequestNote(projectID, mrIID, note.ID, body)
+		}
+	}
+
+	return c.CreateMergeRequestNote(projectID, mrIID, body)
+}
+
+// MergeRequest represents a GitLab merge request.
+type MergeRequest struct {
+	IID          int    `json:"iid"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	WebURL       string `json:"web_url"`
+}
+
+// OpenMergeRequests retrieves the open merge requests of a project into the
+// given target branch, following the pagination.
+// Returns an error if there was an issue requesting the API or parsing its
+// responses.
+func (c *Client) OpenMergeRequests(projectID int, targetBranch string) (mrs []MergeRequest, err error) {
+	mrs = make([]MergeRequest, 0)
+	for page := "1"; page != ""; {
+		var body []byte
+		var header http.Header
+		body, header, err = c.request(
+			"GET", "projects/"+strconv.Itoa(projectID)+"/merge_requests?state=opened&per_page=100"+
+				"&target_branch="+url.QueryEscape(targetBranch)+"&page="+page, nil,
+		)
+		if err != nil {
+			return
+		}
+
+		var pageMRs []MergeRequest
+		if err = json.Unmarshal(body, &pageMRs); err != nil {
+			return
+		}
+		mrs = append(mrs, pageMRs...)
+
+		page = header.Get("X-Next-Page")
+	}
+
+	return
+}
+
+// CreateMergeRequest opens a merge request from the given source branch into
+// the given target branch, which removes the source branch once merged.
+// Returns an error if there was an issue requesting the API or parsing its
+// response.
+func (c *Client) CreateMergeRequest(
+	projectID int, sourceBranch string, targetBranch string, title string, description string,
+) (mr MergeRequest, err error) {
+	body, _, err := c.request("POST", "projects/"+strconv.Itoa(projectID)+"/merge_requests", map[string]interface{}{
+		"source_branch":        sourceBranch,
+		"target_branch":        targetBranch,
+		"title":                title,
+		"description":          description,
+		"remove_source_branch": true,
+	})
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(body, &mr)
+	return
+}
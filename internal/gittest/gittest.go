@@ -0,0 +1,246 @@
+// Package gittest provides a local Git remote and the settings of a clone of
+// it, for the tests of the packages working with the Git repository.
+package gittest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	gogit "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Author is the author of the commits made with Remote.Commit.
+var Author = config.CommitsAuthorConfig{Name: "Test", Email: "test@example.com"}
+
+// ManagerAuthor is the author of the commits made by the manager in the clones
+// Settings describes.
+var ManagerAuthor = config.CommitsAuthorConfig{Name: "Dashboards Manager", Email: "manager@example.com"}
+
+// Remote is a bare repository in a temporary directory, standing for the Git
+// remote, along with a clone of its own the tests commit to it from.
+type Remote struct {
+	// Path is the path to the bare repository, which is also its URL.
+	Path string
+
+	t    *testing.T
+	dir  string
+	work *gogit.Repository
+}
+
+// NewRemote creates an empty remote, removed at the end of the test.
+func NewRemote(t *testing.T) *Remote {
+	t.Helper()
+
+	r := &Remote{
+		Path: filepath.Join(t.TempDir(), "remote.git"),
+		t:    t,
+		dir:  filepath.Join(t.TempDir(), "work"),
+	}
+	if _, err := gogit.PlainInit(r.Path, true); err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+	var err error
+	if r.work, err = gogit.PlainInit(r.dir, false); err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+	if _, err = r.work.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{r.Path}}); err != nil {
+		t.Fatalf("CreateRemote: %v", err)
+	}
+	return r
+}
+
+// Commit writes the given files, removes the given ones, commits the changes
+// and pushes them to the remote's master branch, force-pushing if asked to.
+// Returns the hash of the new commit.
+func (r *Remote) Commit(message string, files map[string]string, removed []string, force bool) plumbing.Hash {
+	r.t.Helper()
+
+	w, err := r.work.Worktree()
+	if err != nil {
+		r.t.Fatalf("Worktree: %v", err)
+	}
+
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		path := filepath.Join(r.dir, filename)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatalf("MkdirAll: %v", err)
+		}
+		if err = os.WriteFile(path, []byte(files[filename]), 0644); err != nil {
+			r.t.Fatalf("WriteFile: %v", err)
+		}
+		if _, err = w.Add(filename); err != nil {
+			r.t.Fatalf("Add: %v", err)
+		}
+	}
+	for _, filename := range removed {
+		if _, err = w.Remove(filename); err != nil {
+			r.t.Fatalf("Remove: %v", err)
+		}
+	}
+
+	hash, err := w.Commit(message, &gogit.CommitOptions{Author: &object.Signature{
+		Name: Author.Name, Email: Author.Email, When: time.Now(),
+	}})
+	if err != nil {
+		r.t.Fatalf("Commit: %v", err)
+	}
+
+	r.push(force)
+	return hash
+}
+
+// ResetTo moves the branch of the remote's own clone back to the given commit,
+// so the next commit rewrites the history once force-pushed.
+func (r *Remote) ResetTo(hash plumbing.Hash) {
+	r.t.Helper()
+
+	w, err := r.work.Worktree()
+	if err != nil {
+		r.t.Fatalf("Worktree: %v", err)
+	}
+	if err = w.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset}); err != nil {
+		r.t.Fatalf("Reset: %v", err)
+	}
+}
+
+// Fetch updates the remote's own clone with the commits pushed to the remote
+// by others, e.g. the manager, and moves its branch to the remote's.
+func (r *Remote) Fetch() {
+	r.t.Helper()
+
+	err := r.work.Fetch(&gogit.FetchOptions{RefSpecs: []gitconfig.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		r.t.Fatalf("Fetch: %v", err)
+	}
+	r.ResetTo(r.Head())
+}
+
+// Head returns the hash of the latest commit of the remote's master branch.
+func (r *Remote) Head() plumbing.Hash {
+	r.t.Helper()
+
+	repo, err := gogit.PlainOpen(r.Path)
+	if err != nil {
+		r.t.Fatalf("PlainOpen: %v", err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		r.t.Fatalf("Reference: %v", err)
+	}
+	return ref.Hash()
+}
+
+// CommitObject returns the commit with the given hash from the remote.
+func (r *Remote) CommitObject(hash plumbing.Hash) *object.Commit {
+	r.t.Helper()
+
+	repo, err := gogit.PlainOpen(r.Path)
+	if err != nil {
+		r.t.Fatalf("PlainOpen: %v", err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		r.t.Fatalf("CommitObject: %v", err)
+	}
+	return commit
+}
+
+// push pushes the master branch of the remote's own clone to the remote.
+func (r *Remote) push(force bool) {
+	refSpec := gitconfig.RefSpec("refs/heads/master:refs/heads/master")
+	if force {
+		refSpec = "+" + refSpec
+	}
+	if err := r.work.Push(&gogit.PushOptions{RefSpecs: []gitconfig.RefSpec{refSpec}}); err != nil {
+		r.t.Fatalf("Push: %v", err)
+	}
+}
+
+// Settings returns the Git settings of a new clone of the remote, in a
+// temporary directory, committing as ManagerAuthor. The clone doesn't exist
+// until it's synchronised.
+func (r *Remote) Settings() *config.GitSettings {
+	r.t.Helper()
+
+	return &config.GitSettings{
+		URL:            r.Path,
+		ClonePath:      filepath.Join(r.t.TempDir(), "clone"),
+		PrivateKeyPath: KeyPath(r.t),
+		CommitsAuthor:  ManagerAuthor,
+	}
+}
+
+// KeyPath returns the path to a new SSH private key, which the clones need to
+// be loaded, but which a local remote doesn't check.
+func KeyPath(t *testing.T) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id_rsa")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// SigningKey writes a new PGP private key, armored, for ManagerAuthor.
+// Returns the path to the private key, and the armored public key to verify
+// the signatures with.
+func SigningKey(t *testing.T) (path string, public string) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity(ManagerAuthor.Name, "", ManagerAuthor.Email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("NewEntity: %v", err)
+	}
+
+	private := new(bytes.Buffer)
+	w, err := armor.Encode(private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err = entity.SerializePrivate(w, nil); err != nil {
+		t.Fatalf("SerializePrivate: %v", err)
+	}
+	w.Close()
+
+	buf := new(bytes.Buffer)
+	if w, err = armor.Encode(buf, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err = entity.Serialize(w); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	w.Close()
+
+	path = filepath.Join(t.TempDir(), "signing.asc")
+	if err = os.WriteFile(path, private.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path, buf.String()
+}
@@ -0,0 +1,131 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// alertRuleInstanceKeys are the keys of an alert rule's description which are
+// specific to a Grafana instance, and are never written to nor pushed from the
+// repository.
+var alertRuleInstanceKeys = []string{"id", "orgID", "updated", "provenance"}
+
+// errNoAlertRuleUID is returned when pushing an alert rule which description
+// has no UID, since it couldn't be told apart from the other ones.
+var errNoAlertRuleUID = errors.New("The alert rule has no UID")
+
+// AlertRule represents a unified alerting rule retrieved from the Grafana
+// provisioning API.
+type AlertRule struct {
+	UID       string
+	Title     string
+	FolderUID string
+	RuleGroup string
+	// Version is the time of the rule's latest update, as a Unix timestamp,
+	// since the provisioning API doesn't expose a version number.
+	Version int64
+	// RawJSON is the rule's description, with the keys specific to the
+	// instance removed.
+	RawJSON []byte
+}
+
+// GetAlertRules requests the Grafana provisioning API for the description of
+// every alert rule.
+// Returns an error if there was an issue requesting the rules or parsing the
+// response body.
+func (c *Client) GetAlertRules(ctx context.Context) (rules []*AlertRule, err error) {
+	body, err := c.request(ctx, "GET", "v1/provisioning/alert-rules", nil)
+	if err != nil {
+		return
+	}
+
+	var list []json.RawMessage
+	if err = json.Unmarshal(body, &list); err != nil {
+		return
+	}
+
+	rules = make([]*AlertRule, 0, len(list))
+	for _, item := range list {
+		var rule *AlertRule
+		if rule, err = parseAlertRule(item); err != nil {
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// parseAlertRule parses an alert rule's description as returned by the
+// Grafana provisioning API.
+// Returns an error if the description couldn't be parsed.
+func parseAlertRule(body []byte) (rule *AlertRule, err error) {
+	var description map[string]interface{}
+	if err = json.Unmarshal(body, &description); err != nil {
+		return
+	}
+
+	var meta struct {
+		UID       string    `json:"uid"`
+		Title     string    `json:"title"`
+		FolderUID string    `json:"folderUID"`
+		RuleGroup string    `json:"ruleGroup"`
+		Updated   time.Time `json:"updated"`
+	}
+	if err = json.Unmarshal(body, &meta); err != nil {
+		return
+	}
+
+	rule = &AlertRule{
+		UID:       meta.UID,
+		Title:     meta.Title,
+		FolderUID: meta.FolderUID,
+		RuleGroup: meta.RuleGroup,
+		Version:   meta.Updated.Unix(),
+	}
+
+	for _, key := range alertRuleInstanceKeys {
+		delete(description, key)
+	}
+	rule.RawJSON, err = json.Marshal(description)
+	return
+}
+
+// CreateOrUpdateAlertRule takes a given JSON content (as []byte) and creates
+// the alert rule if it doesn't exist on the Grafana instance, else updates the
+// existing one, identified by its UID. The folder the rule references must
+// already exist.
+// Returns an error if the content has no UID, or if there was an issue
+// generating the request body or performing the requests.
+func (c *Client) CreateOrUpdateAlertRule(ctx context.Context, contentJSON []byte) (err error) {
+	var description map[string]interface{}
+	if err = json.Unmarshal(contentJSON, &description); err != nil {
+		return
+	}
+
+	uid, _ := description["uid"].(string)
+	if len(uid) == 0 {
+		return errNoAlertRuleUID
+	}
+
+	for _, key := range alertRuleInstanceKeys {
+		delete(description, key)
+	}
+	reqBody, err := json.Marshal(description)
+	if err != nil {
+		return
+	}
+
+	_, err = c.request(ctx, "GET", "v1/provisioning/alert-rules/"+url.PathEscape(uid), nil)
+	if isNotFound(err) {
+		_, err = c.request(ctx, "POST", "v1/provisioning/alert-rules", reqBody)
+		return
+	} else if err != nil {
+		return
+	}
+
+	_, err = c.request(ctx, "PUT", "v1/provisioning/alert-rules/"+url.PathEscape(uid), reqBody)
+	return
+}
@@ -0,0 +1,151 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// AliasDatasources replaces, in the given JSON description of a dashboard or a
+// library panel, the references to the datasources which UIDs are keys of the
+// given aliases with the matching placeholders, e.g. "${DS_PROMETHEUS}", so the
+// description doesn't depend on the instance it was retrieved from. The
+// references of the panels, targets, annotations and template variables are
+// replaced, as well as the current value of the datasource template variables.
+// The description is returned as it is if there are no aliases.
+// Returns an error if the description couldn't be parsed.
+func AliasDatasources(content []byte, aliases map[string]string) (aliased []byte, err error) {
+	if len(aliases) == 0 {
+		return content, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var description interface{}
+	if err = decoder.Decode(&description); err != nil {
+		return
+	}
+
+	if !aliasDatasourceReferences(description, aliases) {
+		return content, nil
+	}
+	return json.Marshal(description)
+}
+
+// aliasDatasourceReferences walks a JSON description and replaces the aliased
+// datasource UIDs found under "datasource" keys, and in the current value of
+// datasource template variables.
+// Returns true if something was replaced.
+func aliasDatasourceReferences(node interface{}, aliases map[string]string) (replaced bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if v["type"] == "datasource" {
+			if current, ok := v["current"].(map[string]interface{}); ok {
+				if value, ok := current["value"].(string); ok && aliases[value] != "" {
+					current["value"] = aliases[value]
+					replaced = true
+				}
+			}
+		}
+
+		for key, child := range v {
+			if key != "datasource" {
+				replaced = aliasDatasourceReferences(child, aliases) || replaced
+				continue
+			}
+
+			switch ds := child.(type) {
+			case string:
+				// Datasource referenced by UID or name, in older
+				// dashboards.
+				if alias := aliases[ds]; alias != "" {
+					v[key] = alias
+					replaced = true
+				}
+			case map[string]interface{}:
+				if uid, ok := ds["uid"].(string); ok && aliases[uid] != "" {
+					ds["uid"] = aliases[uid]
+					replaced = true
+				}
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			replaced = aliasDatasourceReferences(child, aliases) || replaced
+		}
+	}
+	return
+}
+
+// resolveDatasourceAliases replaces, in the given JSON description of a
+// dashboard or a library panel, the placeholders of the client's datasource
+// aliases with the UIDs of the matching datasources of the Grafana instance,
+// requested once through the given checker. A placeholder resolves to the
+// datasource with one of the UIDs aliased to it if the instance has one, else
+// to the datasource named like the placeholder, e.g. "DS_PROMETHEUS" for
+// "${DS_PROMETHEUS}". Only whole JSON strings are replaced.
+// Returns an error if the datasources couldn't be requested, or if a
+// placeholder the description uses can't be resolved.
+func (c *Client) resolveDatasourceAliases(ctx context.Context, content []byte, checker *datasourceChecker) (resolved []byte, err error) {
+	resolved = content
+
+	// Several UIDs, e.g. from several instances, can have the same
+	// placeholder.
+	uidsByPlaceholder := make(map[string][]string)
+	for _, uid := range utils.SortedKeys(c.DatasourceAliases) {
+		placeholder := c.DatasourceAliases[uid]
+		uidsByPlaceholder[placeholder] = append(uidsByPlaceholder[placeholder], uid)
+	}
+
+	for _, placeholder := range utils.SortedKeys(uidsByPlaceholder) {
+		quoted, _ := json.Marshal(placeholder)
+		if !bytes.Contains(resolved, quoted) {
+			continue
+		}
+
+		var datasources []datasourceResponse
+		if datasources, err = checker.list(ctx); err != nil {
+			return
+		}
+
+		uid, found := pickAliasedDatasource(datasources, placeholder, uidsByPlaceholder[placeholder])
+		if !found {
+			return nil, fmt.Errorf("No datasource found for the placeholder %s", placeholder)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"placeholder": placeholder,
+			"uid":         uid,
+		}).Debug("Resolved datasource placeholder")
+
+		quotedUID, _ := json.Marshal(uid)
+		resolved = bytes.ReplaceAll(resolved, quoted, quotedUID)
+	}
+	return
+}
+
+// pickAliasedDatasource returns the UID of the datasource the given
+// placeholder, which the given UIDs are aliased to, resolves to among the
+// given datasources. See resolveDatasourceAliases.
+func pickAliasedDatasource(datasources []datasourceResponse, placeholder string, uids []string) (uid string, found bool) {
+	for _, aliased := range uids {
+		for _, ds := range datasources {
+			if ds.UID == aliased {
+				return ds.UID, true
+			}
+		}
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(placeholder, "${"), "}")
+	for _, ds := range datasources {
+		if ds.Name == name {
+			return ds.UID, true
+		}
+	}
+	return "", false
+}
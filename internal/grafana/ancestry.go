@@ -0,0 +1,198 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// FolderRef identifies a folder in the ancestor chain of another folder.
+type FolderRef struct {
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+// folderResponse represents the response to a folder query. All fields
+// described from the Grafana documentation aren't located in this structure
+// because there are some we don't need.
+type folderResponse struct {
+	UID       string `json:"uid"`
+	Title     string `json:"title"`
+	ParentUID string `json:"parentUid"`
+	// Parents is the full ancestor chain, root first, returned by Grafana
+	// versions supporting nested folders.
+	Parents []FolderRef `json:"parents"`
+}
+
+// ancestryResolver computes the ancestor chains of folders, caching the
+// folders it had to request from the Grafana API.
+type ancestryResolver struct {
+	c       *Client
+	folders map[string]folderResponse
+	// missing records the folders the Grafana API doesn't know about, e.g.
+	// because they were deleted during the pull.
+	missing map[string]bool
+}
+
+// LoadFolderAncestry computes the ancestor chain of each folder found in the
+// definitions and records it in the folders' metadata. Parent folders are
+// looked up in the definitions first, then requested from the Grafana API.
+// Chains are cut, with a warning, on a cycle or on a parent the Grafana API
+// doesn't know about.
+// Returns an error if a parent folder couldn't be requested.
+func (c *Client) LoadFolderAncestry(ctx context.Context, defs *DefsFile) (err error) {
+	r := &ancestryResolver{
+		c:       c,
+		folders: make(map[string]folderResponse),
+		missing: make(map[string]bool),
+	}
+
+	for _, meta := range defs.FoldersMetaByUID {
+		r.folders[meta.UID] = folderResponse{
+			UID:       meta.UID,
+			Title:     meta.Title,
+			ParentUID: meta.FolderUID,
+		}
+	}
+
+	for _, id := range utils.SortedKeys(defs.FoldersMetaByUID) {
+		meta := defs.FoldersMetaByUID[id]
+		if meta.Ancestors, err = r.ancestors(ctx, meta.UID); err != nil {
+			return
+		}
+		defs.FoldersMetaByUID[id] = meta
+	}
+
+	return
+}
+
+// ancestors returns the ancestor chain, root first, of the folder with the
+// given UID.
+func (r *ancestryResolver) ancestors(ctx context.Context, uid string) (chain []FolderRef, err error) {
+	visited := map[string]bool{uid: true}
+
+	folder, found, err := r.folder(ctx, uid)
+	if err != nil || !found {
+		return
+	}
+
+	// Grafana may give the full chain right away.
+	if len(folder.Parents) > 0 {
+		return folder.Parents, nil
+	}
+
+	for parentUID := folder.ParentUID; parentUID != ""; {
+		if visited[parentUID] {
+			logrus.WithFields(logrus.Fields{
+				"folder": uid,
+				"parent": parentUID,
+			}).Warn("Cycle found in the folders tree, cutting the folder's ancestry")
+			break
+		}
+		visited[parentUID] = true
+
+		var parent folderResponse
+		if parent, found, err = r.folder(ctx, parentUID); err != nil {
+			return
+		}
+		if !found {
+			logrus.WithFields(logrus.Fields{
+				"folder": uid,
+				"parent": parentUID,
+			}).Warn("Parent folder not found, cutting the folder's ancestry")
+			break
+		}
+
+		chain = append([]FolderRef{{UID: parent.UID, Title: parent.Title}}, chain...)
+		parentUID = parent.ParentUID
+	}
+
+	return
+}
+
+// folder returns the folder with the given UID, requesting it from the
+// Grafana API if it isn't known yet. Returns false if the Grafana API doesn't
+// know about the folder.
+func (r *ancestryResolver) folder(ctx context.Context, uid string) (folder folderResponse, found bool, err error) {
+	if folder, found = r.folders[uid]; found || r.missing[uid] {
+		return
+	}
+
+	body, err := r.c.request(ctx, "GET", "folders/"+url.PathEscape(uid), nil)
+	if isNotFound(err) {
+		r.missing[uid] = true
+		return folder, false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(body, &folder); err != nil {
+		return
+	}
+
+	r.folders[uid] = folder
+	return folder, true, nil
+}
+
+// FolderByUID returns the metadata of the folder with the given UID.
+func (d DefsFile) FolderByUID(uid string) (folder DbSearchResponse, found bool) {
+	for _, id := range utils.SortedKeys(d.FoldersMetaByUID) {
+		if folder = d.FoldersMetaByUID[id]; folder.UID == uid {
+			return folder, true
+		}
+	}
+	return DbSearchResponse{}, false
+}
+
+// FolderLineage returns the folder with the given UID followed by its
+// ancestors, nearest first. Returns an empty slice if the folder is unknown.
+func (d DefsFile) FolderLineage(uid string) (lineage []FolderRef) {
+	folder, found := d.FolderByUID(uid)
+	if !found {
+		return
+	}
+
+	lineage = append(lineage, FolderRef{UID: folder.UID, Title: folder.Title})
+	for i := len(folder.Ancestors) - 1; i >= 0; i-- {
+		lineage = append(lineage, folder.Ancestors[i])
+	}
+	return
+}
+
+// FolderPath returns the titles of the ancestors of the folder with the given
+// UID and of the folder itself, joined with slashes, e.g.
+// "Platform/Databases/PostgreSQL". Returns an empty string if the folder is
+// unknown.
+func (d DefsFile) FolderPath(uid string) string {
+	lineage := d.FolderLineage(uid)
+	titles := make([]string, len(lineage))
+	for i, ref := range lineage {
+		titles[len(lineage)-1-i] = ref.Title
+	}
+	return strings.Join(titles, "/")
+}
+
+// FolderKeys returns the UIDs and titles of the folder with the given UID and
+// of its ancestors, nearest first, to match the folder against a
+// config.FolderScope. The dashboards outside of any folder are in the
+// config.GeneralFolder folder. An unknown folder only has its UID.
+func (d DefsFile) FolderKeys(uid string) (keys []string) {
+	if uid == "" {
+		return []string{config.GeneralFolder}
+	}
+
+	lineage := d.FolderLineage(uid)
+	if len(lineage) == 0 {
+		return []string{uid}
+	}
+	for _, ref := range lineage {
+		keys = append(keys, ref.UID, ref.Title)
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PushAnnotationTag tags the annotations marking the pushes, so they can be
+// shown on any dashboard with an annotation query on this tag.
+const PushAnnotationTag = "dashboards-manager"
+
+// Annotation represents an annotation, as sent to the Grafana API to create
+// it. An annotation without a dashboard is an organisation annotation.
+type Annotation struct {
+	// Time is the time of the annotation, in milliseconds since the epoch.
+	// Grafana uses the current time if it's zero.
+	Time         int64    `json:"time,omitempty"`
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+// annotationResponse represents the response sent by the Grafana API to an
+// annotation creation.
+type annotationResponse struct {
+	ID int64 `json:"id"`
+}
+
+// CreateAnnotation creates the given annotation.
+// Returns the ID of the annotation, and an error if there was an issue
+// generating the request body, performing the request or decoding the
+// response's body.
+func (c *Client) CreateAnnotation(ctx context.Context, annotation *Annotation) (id int64, err error) {
+	reqBody, err := json.Marshal(annotation)
+	if err != nil {
+		return
+	}
+
+	respBody, err := c.request(ctx, "POST", "annotations", reqBody)
+	if err != nil {
+		return
+	}
+
+	resp := new(annotationResponse)
+	if err = json.Unmarshal(respBody, resp); err != nil {
+		return
+	}
+	return resp.ID, nil
+}
+
+// AnnotatePush creates an annotation marking the push of the given commit,
+// giving the number of dashboards the given results updated. Failing to create
+// it doesn't fail the push, so the error is only logged. Nothing is pushed on a
+// dry run, so nothing is annotated either.
+func (c *Client) AnnotatePush(ctx context.Context, commit string, run *results.RunResult) {
+	if c.DryRun {
+		return
+	}
+	updated := 0
+	for _, item := range run.Items() {
+		if item.Kind == results.KindDashboard && item.Action == results.ActionPush &&
+			item.Outcome != results.OutcomeSkipped && item.Outcome != results.OutcomeFailed &&
+			!format.IsPermissionsFile(item.Slug) {
+			updated++
+		}
+	}
+
+	text := fmt.Sprintf("Pushed %d dashboards from the Git repository", updated)
+	if len(commit) > 0 {
+		text = fmt.Sprintf("Pushed %d dashboards from commit %s", updated, commit)
+	}
+
+	id, err := c.CreateAnnotation(ctx, &Annotation{
+		Tags: []string{PushAnnotationTag},
+		Text: text,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"commit": commit,
+		}).Warn("Failed to create the annotation marking the push")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":     id,
+		"commit": commit,
+	}).Debug("Created the annotation marking the push")
+}
@@ -0,0 +1,159 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DashboardsAPILegacy selects the /api/dashboards routes.
+	DashboardsAPILegacy = "legacy"
+	// DashboardsAPIK8s selects the apiserver-style routes under
+	// /apis/dashboard.grafana.app, introduced with Grafana 11.
+	DashboardsAPIK8s = "k8s"
+	// DashboardsAPIAuto selects the apiserver-style routes if the instance
+	// serves them in a stable version, else the legacy routes.
+	DashboardsAPIAuto = "auto"
+)
+
+// stableK8sDashboardsVersions are the versions of the apiserver-style
+// dashboards API which are selected automatically, by order of preference.
+var stableK8sDashboardsVersions = []string{"v1", "v1beta1"}
+
+// dashboardBackend implements the dashboards operations against one of the
+// flavours of the Grafana API. Backends map between the API's representation
+// of a dashboard and the legacy JSON description, so the files in the
+// repository stay identical whichever backend is used.
+type dashboardBackend interface {
+	// name returns the name of the backend, for logging purposes.
+	name() string
+	// listDashboards returns the metadata of all the dashboards.
+	listDashboards(ctx context.Context) ([]DbSearchResponse, error)
+	// getDashboard returns the dashboard with the given UID.
+	getDashboard(ctx context.Context, uid string) (*Dashboard, error)
+	// saveDashboard creates or overwrites a dashboard from its JSON
+	// description, in the folder with the given UID.
+	saveDashboard(ctx context.Context, contentJSON []byte, folderUID string) error
+	// deleteDashboard deletes the dashboard with the given UID.
+	deleteDashboard(ctx context.Context, uid string) error
+}
+
+// dashboardsBackend returns the backend used for dashboards, selecting it on
+// the first call according to the client's DashboardsAPI setting and, if
+// needed, to the APIs served by the Grafana instance.
+func (c *Client) dashboardsBackend(ctx context.Context) dashboardBackend {
+	c.dashboardsLock.Lock()
+	defer c.dashboardsLock.Unlock()
+
+	if c.dashboards != nil {
+		return c.dashboards
+	}
+
+	switch c.DashboardsAPI {
+	case DashboardsAPILegacy:
+		c.dashboards = &legacyBackend{c: c}
+	case DashboardsAPIK8s:
+		version, versions := c.detectK8sDashboardsAPI(ctx)
+		if len(version) == 0 && len(versions) > 0 {
+			version = versions[0]
+		}
+		if len(version) == 0 {
+			version = stableK8sDashboardsVersions[len(stableK8sDashboardsVersions)-1]
+		}
+		c.dashboards = newK8sBackend(c, version)
+	default:
+		c.dashboards = &legacyBackend{c: c}
+		preferred, versions := c.detectK8sDashboardsAPI(ctx)
+		for _, version := range append([]string{preferred}, versions...) {
+			if isStableK8sDashboardsVersion(version) {
+				c.dashboards = newK8sBackend(c, version)
+				break
+			}
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend": c.dashboards.name(),
+	}).Info("Selected the dashboards API")
+
+	return c.dashboards
+}
+
+// detectK8sDashboardsAPI asks the Grafana instance which versions of the
+// apiserver-style dashboards API it serves.
+// Returns the preferred version and all the served versions, or empty values
+// if the instance doesn't serve this API.
+func (c *Client) detectK8sDashboardsAPI(ctx context.Context) (preferred string, versions []string) {
+	body, err := c.requestRoute(ctx, "GET", "/apis/"+k8sDashboardsGroup, nil)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Debug("The apiserver-style dashboards API isn't available")
+		return
+	}
+
+	var group struct {
+		Versions []struct {
+			Version string `json:"version"`
+		} `json:"versions"`
+		PreferredVersion struct {
+			Version string `json:"version"`
+		} `json:"preferredVersion"`
+	}
+	if err = json.Unmarshal(body, &group); err != nil {
+		return
+	}
+
+	for _, v := range group.Versions {
+		versions = append(versions, v.Version)
+	}
+	return group.PreferredVersion.Version, versions
+}
+
+// isStableK8sDashboardsVersion returns true if the given version of the
+// apiserver-style dashboards API can be selected automatically.
+func isStableK8sDashboardsVersion(version string) bool {
+	for _, v := range stableK8sDashboardsVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyBackend implements the dashboards operations against the
+// /api/dashboards routes.
+type legacyBackend struct {
+	c *Client
+}
+
+func (b *legacyBackend) name() string {
+	return DashboardsAPILegacy
+}
+
+func (b *legacyBackend) listDashboards(ctx context.Context) (dashboards []DbSearchResponse, err error) {
+	return b.c.search(ctx, url.Values{"type": []string{"dash-db"}})
+}
+
+func (b *legacyBackend) getDashboard(ctx context.Context, uid string) (db *Dashboard, err error) {
+	body, err := b.c.request(ctx, "GET", "dashboards/uid/"+uid, nil)
+	if err != nil {
+		return
+	}
+
+	db = new(Dashboard)
+	err = json.Unmarshal(body, db)
+	return
+}
+
+func (b *legacyBackend) saveDashboard(ctx context.Context, contentJSON []byte, folderUID string) error {
+	return b.c.createOrUpdateDashboardLegacy(ctx, contentJSON, folderUID)
+}
+
+func (b *legacyBackend) deleteDashboard(ctx context.Context, uid string) (err error) {
+	_, err = b.c.request(ctx, "DELETE", "dashboards/uid/"+uid, nil)
+	return
+}
@@ -2,91 +2,335 @@ package grafana
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
 // Client implements a Grafana API client, and contains the instance's base URL
-// and API key, along with an HTTP client used to request the API.
-// use either APIKey or Username/Password
+// and credentials, along with an HTTP client used to request the API.
+// use either an API token or Username/Password
 type Client struct {
 	BaseURL    string
-	APIKey     string
 	Username   string
 	Password   string
 	SkipVerify bool
+	// OrgID is the ID of the organisation the requests are made in, sent in
+	// the X-Grafana-Org-Id header. Zero uses the credentials' default
+	// organisation.
+	OrgID int64
+	// DashboardsAPI selects the API used for dashboards: "legacy" for the
+	// /api/dashboards routes, "k8s" for the apiserver-style routes under
+	// /apis/dashboard.grafana.app, or "auto" (or empty) to detect it.
+	DashboardsAPI string
+	// Namespace is the namespace of the apiserver-style routes.
+	Namespace string
+	// RetryAttempts is the number of attempts made for requests failing
+	// with a transient error (see isTransient). Defaults to
+	// DefaultRetryAttempts.
+	RetryAttempts int
+	// RetryMaxBackoff caps the delay between two attempts. Defaults to
+	// DefaultRetryMaxBackoff.
+	RetryMaxBackoff time.Duration
+	// StrictDatasources prevents dashboards from being pushed if the
+	// instance doesn't have the datasources they need.
+	StrictDatasources bool
+	// ComplexityLimits are the limits dashboards are checked against. Nil
+	// disables the checks.
+	ComplexityLimits *config.ComplexityLimits
+	// DatasourceAliases maps the UIDs of datasources to the placeholders
+	// the dashboards and library panels pushed may use instead.
+	DatasourceAliases map[string]string
+	// FolderScope restricts the dashboards pushed and deleted to the ones in
+	// some folders. Nil allows every folder.
+	FolderScope *config.FolderScope
+	// AllowSchemaDowngrade allows pushing dashboards which schemaVersion is
+	// lower than the one of the dashboard on the instance.
+	AllowSchemaDowngrade bool
+	// DeleteRemovedFolders allows deleting the folders removed from the
+	// repository, if they're empty, along with the dashboards.
+	DeleteRemovedFolders bool
+	// ForceDeleteRules allows deleting the removed folders which hold alert
+	// rules, along with the rules.
+	ForceDeleteRules bool
+	// StrictFolders prevents dashboards and library panels from being
+	// pushed if the folder their file gives doesn't exist, instead of
+	// creating it.
+	StrictFolders bool
+	// FilenameTemplate generates the names of the dashboards' files, which
+	// key their metadata. Nil uses config.DefaultFilenameTemplate.
+	FilenameTemplate *template.Template
+	// SelfDashboardDatasource is the UID of the Prometheus datasource the
+	// status dashboard's panels query. Empty uses the default datasource.
+	SelfDashboardDatasource string
+	// DryRun makes the pushes and deletions only log and record what they
+	// would do. The requests which would change something on the instance
+	// are never sent.
+	DryRun bool
+	// Metrics records the requests sent to the API, if it isn't nil.
+	Metrics    RequestMetrics
 	httpClient *http.Client
+	// token holds the API token, nil if basic auth is used instead.
+	token *tokenCache
+	// limiter limits the rate of the requests, nil if they aren't limited.
+	limiter *rateLimiter
+	// version holds the version of the Grafana instance.
+	version *versionCache
+
+	// dashboards is the backend selected for the dashboards API, protected
+	// by dashboardsLock.
+	dashboards     dashboardBackend
+	dashboardsLock sync.Mutex
 }
 
-// NewClient returns a new Grafana API client from a given base URL and API key.
-func NewClient(baseURL string, apiKey string, username string, password string, SkipVerify bool) (c *Client) {
+const (
+	// DefaultRetryAttempts is the default number of attempts made for a
+	// request.
+	DefaultRetryAttempts = 3
+	// DefaultRetryMaxBackoff is the default maximum delay between two
+	// attempts.
+	DefaultRetryMaxBackoff = 10 * time.Second
+	// retryBaseBackoff is the delay before the first retry, doubled for each
+	// subsequent one.
+	retryBaseBackoff = 500 * time.Millisecond
+)
+
+// NewClient returns a new Grafana API client from a given base URL, source of
+// the API token or, if it's nil, username and password, and organisation ID
+// (zero for the default one).
+func NewClient(baseURL string, token TokenSource, username string, password string, orgID int64, SkipVerify bool) (c *Client) {
+	c = newClient(baseURL, token, username, password, orgID, &tls.Config{InsecureSkipVerify: SkipVerify})
+	c.SkipVerify = SkipVerify
+	return
+}
+
+// newClient implements NewClient, with the given TLS configuration.
+func newClient(baseURL string, token TokenSource, username string, password string, orgID int64, tlsConfig *tls.Config) (c *Client) {
 	// Grafana doesn't support double slashes in the API routes, so we strip the
-	// last slash if there's one, because request() will append one anyway.
-	if strings.HasSuffix(baseURL, "/") {
-		baseURL = baseURL[:len(baseURL)-1]
+	// trailing slashes, because request() will append one anyway. The URL
+	// is normally checked when loading the configuration already.
+	if normalized, err := config.NormalizeBaseURL(baseURL); err == nil {
+		baseURL = normalized
+	} else {
+		baseURL = strings.TrimRight(baseURL, "/")
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: SkipVerify},
-	}
+	// Start from the default transport so its settings (proxy from the
+	// environment, timeouts, transparent decompression) are kept.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
 
 	return &Client{
 		BaseURL:    baseURL,
-		APIKey:     apiKey,
 		Username:   username,
 		Password:   password,
+		OrgID:      orgID,
 		httpClient: &http.Client{Transport: tr},
+		token:      newTokenCache(token),
+		version:    new(versionCache),
+	}
+}
+
+// NewClientFromSettings returns a new Grafana API client configured from the
+// given Grafana settings. The certificates are normally checked when loading
+// the configuration already, but could have been removed or replaced since.
+// Returns an error if the certificates can't be loaded, rather than connecting
+// to Grafana without them.
+func NewClientFromSettings(settings config.GrafanaSettings) (c *Client, err error) {
+	var token TokenSource
+	if settings.APIKeyFile != "" {
+		token = FileToken(settings.APIKeyFile)
+	} else if settings.APIKey != "" {
+		token = StaticToken(settings.APIKey)
+	}
+
+	tlsConfig, err := settings.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c = newClient(settings.BaseURL, token, settings.Username, settings.Password, settings.OrgID, tlsConfig)
+	// The OAuth2 access tokens replace the basic auth credentials, which are
+	// empty.
+	if settings.OAuth2 != nil {
+		c.httpClient.Transport = newOAuth2Transport(c.httpClient.Transport, *settings.OAuth2)
 	}
+	c.SkipVerify = settings.SkipVerify
+	c.DashboardsAPI = settings.DashboardsAPI
+	c.Namespace = settings.Namespace
+	c.RetryAttempts = settings.RetryAttempts
+	c.RetryMaxBackoff = time.Duration(settings.RetryMaxBackoff) * time.Second
+	c.ComplexityLimits = settings.ComplexityLimits
+	c.FolderScope = settings.FolderScope()
+	c.DatasourceAliases = settings.DatasourceAliases
+	c.AllowSchemaDowngrade = settings.AllowSchemaDowngrade
+	c.ForceDeleteRules = settings.ForceDeleteRules
+	c.StrictFolders = settings.StrictFolders
+	c.SelfDashboardDatasource = settings.SelfDashboardDatasource
+	c.limiter = newRateLimiter(settings.RateLimit, settings.RateLimitBurst)
+	return
 }
 
-// request preforms an HTTP request on a given endpoint, with a given method and
-// body. The endpoint is the Grafana API route to request, without the "/api/"
-// part. If the request doesn't require a body, the function has to be called
-// with "nil" as the "body" parameter.
+// request performs an HTTP request on a given endpoint of the Grafana API, with
+// a given method and body. The endpoint is the route to request, without the
+// "/api/" part. If the request doesn't require a body, the function has to be
+// called with "nil" as the "body" parameter. See requestRoute for details.
+func (c *Client) request(ctx context.Context, method string, endpoint string, body []byte) ([]byte, error) {
+	return c.requestRoute(ctx, method, "/api/"+endpoint, body)
+}
+
+// requestRoute performs an HTTP request on a given route of the Grafana
+// instance, such as "/api/search" or "/apis/dashboard.grafana.app", with a
+// given method and body. The request is aborted if the given context is
+// cancelled, and made again if it fails with a transient error (see
+// isTransient).
 // Returns the response body (as a []byte containing JSON data).
 // Returns an error if there was an issue initialising the request, performing
-// it or reading the response body. Also returns an error on non-200 response
-// status codes. If the status code is 404, a standard error is returned, if the
-// status code is neither 200 nor 404 an error of type httpUnknownError is
-// returned.
-func (c *Client) request(method string, endpoint string, body []byte) ([]byte, error) {
-	route := "/api/" + endpoint
-
+// it or reading the response body. Also returns an error if the status code
+// isn't a 2xx one: an error of type httpNotFoundError if it's 404, and of type
+// httpUnknownError otherwise.
+func (c *Client) requestRoute(ctx context.Context, method string, route string, body []byte) ([]byte, error) {
 	logrus.WithFields(logrus.Fields{
 		"route":  route,
 		"method": method,
 	}).Debug("Querying the Grafana HTTP API")
 
-	url := c.BaseURL + route
+	// Never send a deletion request to a collection, which could happen if
+	// the identifier of the resource to delete is empty.
+	if method == "DELETE" && strings.HasSuffix(strings.SplitN(route, "?", 2)[0], "/") {
+		return nil, errEmptyIdentifier
+	}
+	// Whatever the dry run doesn't plan mustn't change the instance either.
+	if c.DryRun && method != "GET" {
+		logrus.WithFields(logrus.Fields{
+			"route":  route,
+			"method": method,
+		}).Warn("Dry run: not sending a request which would change Grafana")
+		return nil, errDryRun
+	}
+
+	url := c.routeURL(route)
+
+	attempts := c.RetryAttempts
+	if attempts < 1 {
+		attempts = DefaultRetryAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		respBody, err := c.authenticatedRequest(ctx, method, route, url, body)
+		if err == nil || attempt >= attempts || !isTransient(method, err) || ctx.Err() != nil {
+			return respBody, err
+		}
+
+		wait := c.backoff(attempt)
+		logrus.WithFields(logrus.Fields{
+			"route":   route,
+			"method":  method,
+			"error":   err,
+			"attempt": attempt,
+			"wait":    wait,
+		}).Warn("Transient error from the Grafana HTTP API, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// routeURL returns the URL of the given route of the Grafana instance. The path
+// of the base URL is kept, for instances served under a sub-path, and exactly
+// one slash separates it from the route.
+func (c *Client) routeURL(route string) string {
+	return strings.TrimRight(c.BaseURL, "/") + "/" + strings.TrimLeft(route, "/")
+}
+
+// authenticatedRequest performs a single HTTP request on the given URL of the
+// Grafana instance with the current API token, if there's one. If Grafana
+// rejects the token and its source gives another one, e.g. because the token
+// was rotated, the request is made again once with the new token.
+func (c *Client) authenticatedRequest(ctx context.Context, method string, route string, url string, body []byte) ([]byte, error) {
+	if c.token == nil {
+		return c.requestOnce(ctx, method, route, url, body, "")
+	}
+
+	token, err := c.token.get()
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := c.requestOnce(ctx, method, route, url, body, token)
+	if isUnauthorized(err) && c.token.refresh(token) {
+		if token, err = c.token.get(); err != nil {
+			return nil, err
+		}
+		respBody, err = c.requestOnce(ctx, method, route, url, body, token)
+	}
+	return respBody, err
+}
+
+// requestOnce performs a single HTTP request on the given URL of the Grafana
+// instance, authenticated with the given API token or, if it's empty, with
+// basic auth. See requestRoute. Waits first for the rate limit to allow the
+// request, if there's one.
+func (c *Client) requestOnce(ctx context.Context, method string, route string, url string, body []byte, token string) ([]byte, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
 
 	// Create the request
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 
 	// Add the API key to the request as an Authorization HTTP header
-	if c.APIKey != "" {
-		authHeader := fmt.Sprintf("Bearer %s", c.APIKey)
+	if token != "" {
+		authHeader := fmt.Sprintf("Bearer %s", token)
 		req.Header.Add("Authorization", authHeader)
 	} else {
 		req.SetBasicAuth(c.Username, c.Password)
 	}
 
+	// Make the request in the configured organisation
+	if c.OrgID > 0 {
+		req.Header.Set("X-Grafana-Org-Id", strconv.FormatInt(c.OrgID, 10))
+	}
+
 	// If the request isn't a GET, the body will be sent as JSON, so we need to
 	// append the appropriate header
 	if method != "GET" {
 		req.Header.Add("Content-Type", "application/json")
 	}
 
+	// Resources created through the provisioning API can't be edited in the
+	// UI by default, which would prevent the changes the puller relies on.
+	if method != "GET" && strings.HasPrefix(route, "/api/v1/provisioning/") {
+		req.Header.Set("X-Disable-Provenance", "true")
+	}
+
 	// Perform the request
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		c.observeRequest(route, 0, start)
 		return nil, err
 	}
 
@@ -96,18 +340,20 @@ func (c *Client) request(method string, endpoint string, body []byte) ([]byte, e
 		"code":   resp.StatusCode,
 	}).Info("Grafana API response")
 
-	// Read the response body
-	respBody, err := io.ReadAll(resp.Body)
+	// Read the response body. Errors reading it are reported the way the
+	// HTTP client reports the ones sending the request.
+	respBody, err := readBody(resp)
+	c.observeRequest(route, resp.StatusCode, start)
 	if err != nil {
-		return nil, err
+		return nil, &neturl.Error{Op: method, URL: url, Err: err}
 	}
 
 	// Return an error if the Grafana API responded with a non-200 status code.
 	// We perform this here because http.Client.Do() doesn't return with an
 	// error on non-200 status codes.
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		if resp.StatusCode == http.StatusNotFound {
-			err = fmt.Errorf("%s not found (404)", url)
+			err = &httpNotFoundError{URL: url}
 		} else {
 			// Return an httpUnknownError error if the status code is neither 200
 			// nor 404
@@ -115,12 +361,159 @@ func (c *Client) request(method string, endpoint string, body []byte) ([]byte, e
 		}
 	}
 
+	// A successful response which isn't JSON is most likely mangled by a
+	// proxy, which is easier to diagnose here than in the callers.
+	if err == nil && len(respBody) > 0 && !json.Valid(respBody) {
+		err = newInvalidBodyError(url, resp.Header.Get("Content-Encoding"), respBody)
+	}
+
 	// Return the response body along with the error. This allows callers to
 	// process httpUnknownError errors by displaying an error message located in
 	// the response body along with the data contained in the error.
 	return respBody, err
 }
 
+// isTransient returns true if the given error, which a request with the given
+// method failed with, may not happen again: a 5xx response, or a network error
+// such as a refused connection, a timeout or a connection closed in the middle
+// of the response. Errors which happened before anything was sent, e.g. while
+// reading the token file, and certificate errors aren't transient. Since a
+// request which isn't idempotent, e.g. a POST creating a folder, must not be
+// sent twice, it's only retried if it never reached the server.
+func isTransient(method string, err error) bool {
+	if e, ok := err.(*httpUnknownError); ok {
+		return isIdempotent(method) && e.StatusCode >= 500
+	}
+
+	// Only the errors sending the request or reading the response come from
+	// the network.
+	var urlErr *neturl.Error
+	if !errors.As(err, &urlErr) || isCertificateError(err) {
+		return false
+	}
+
+	if !isIdempotent(method) {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(urlErr.Err, &netErr)
+}
+
+// isIdempotent returns true if sending a request with the given method several
+// times has the same effect as sending it once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isCertificateError returns true if the given error comes from the
+// verification of Grafana's certificate, or of the client's certificate by
+// Grafana, which retrying won't fix.
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		recordHeader     tls.RecordHeaderError
+		opErr            *net.OpError
+	)
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) ||
+		errors.As(err, &recordHeader) ||
+		// TLS alerts sent by Grafana, e.g. rejecting the client's
+		// certificate.
+		(errors.As(err, &opErr) && opErr.Op == "remote error")
+}
+
+// backoff returns how long to wait before retrying a request after the given
+// failed attempt: an exponentially growing delay capped by the client's maximum
+// backoff, with jitter so clients don't retry all at once.
+func (c *Client) backoff(attempt int) time.Duration {
+	maxBackoff := c.RetryMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+
+	wait := retryBaseBackoff << uint(attempt-1)
+	if wait > maxBackoff || wait <= 0 {
+		wait = maxBackoff
+	}
+
+	// Wait between half and all of the delay.
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// utf8BOM is the byte order mark some proxies prepend to UTF-8 bodies.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// readBody reads the body of a response, decompressing it if it's gzipped but
+// the transport didn't do it (e.g. because a proxy compressed it without the
+// client asking for it), and stripping the UTF-8 byte order mark if there's
+// one.
+// Returns an error if the body couldn't be read or decompressed.
+func readBody(resp *http.Response) (body []byte, err error) {
+	defer resp.Body.Close()
+
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	isGzip := strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") ||
+		bytes.HasPrefix(body, []byte{0x1f, 0x8b})
+	if !resp.Uncompressed && isGzip && len(body) > 0 {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return
+		}
+		defer zr.Close()
+		if body, err = io.ReadAll(zr); err != nil {
+			return
+		}
+	}
+
+	return bytes.TrimPrefix(body, utf8BOM), nil
+}
+
+// invalidBodyError represents a successful response which body isn't valid
+// JSON. It gives the body's encoding and first bytes to help understanding
+// what happened to it.
+type invalidBodyError struct {
+	URL             string
+	ContentEncoding string
+	Prefix          []byte
+}
+
+// newInvalidBodyError creates and returns a new invalidBodyError error for the
+// given URL, content encoding and body.
+func newInvalidBodyError(url string, contentEncoding string, body []byte) *invalidBodyError {
+	prefix := body
+	if len(prefix) > 16 {
+		prefix = prefix[:16]
+	}
+	return &invalidBodyError{
+		URL:             url,
+		ContentEncoding: contentEncoding,
+		Prefix:          prefix,
+	}
+}
+
+// Error implements error.Error().
+func (e *invalidBodyError) Error() string {
+	encoding := e.ContentEncoding
+	if encoding == "" {
+		encoding = "none"
+	}
+	return fmt.Sprintf("%s returned a body which isn't JSON (content encoding: %s, first bytes: %s)", e.URL, encoding, hex.EncodeToString(e.Prefix))
+}
+
+// errEmptyIdentifier is returned when a resource would have to be deleted
+// without an identifier, i.e. by requesting the collection it belongs to.
+var errEmptyIdentifier = errors.New("refusing to delete a resource with an empty identifier")
+
 // httpUnknownError represents an HTTP error, created from an HTTP response where
 // the status code is neither 200 nor 404.
 type httpUnknownError struct {
@@ -139,3 +532,28 @@ func newHttpUnknownError(statusCode int) *httpUnknownError {
 func (e *httpUnknownError) Error() string {
 	return fmt.Sprintf("Unknown HTTP error: %d", e.StatusCode)
 }
+
+// httpNotFoundError represents an HTTP error, created from an HTTP response
+// with a 404 status code.
+type httpNotFoundError struct {
+	URL string
+}
+
+// Error implements error.Error().
+func (e *httpNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found (404)", e.URL)
+}
+
+// isNotFound returns true if the error was created from an HTTP response with
+// a 404 status code.
+func isNotFound(err error) bool {
+	_, notFound := err.(*httpNotFoundError)
+	return notFound
+}
+
+// isUnauthorized returns true if the given error is an HTTP error with a 401
+// status code, i.e. Grafana rejected the credentials.
+func isUnauthorized(err error) bool {
+	e, ok := err.(*httpUnknownError)
+	return ok && e.StatusCode == http.StatusUnauthorized
+}
@@ -0,0 +1,300 @@
+package grafana
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+)
+
+// gzipped returns the given data compressed with gzip.
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// bodyServer answers every request with the given body and Content-Encoding
+// header, if any.
+func bodyServer(body []byte, contentEncoding string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentEncoding != "" {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+func TestRequestDecodesBodies(t *testing.T) {
+	const want = `{"database":"ok"}`
+	for _, tc := range []struct {
+		name            string
+		body            []byte
+		contentEncoding string
+		// proxied disables the transport's own compression, as when a
+		// proxy compresses the responses without the client asking for it.
+		proxied bool
+	}{
+		{"plain", []byte(want), "", false},
+		{"gzip", gzipped(t, want), "gzip", false},
+		{"gzip added by a proxy", gzipped(t, want), "gzip", true},
+		{"gzip without header", gzipped(t, want), "", true},
+		{"BOM", append([]byte("\xef\xbb\xbf"), want...), "", false},
+		{"gzipped BOM", gzipped(t, "\xef\xbb\xbf"+want), "gzip", true},
+	} {
+		client := newTestClient(t, bodyServer(tc.body, tc.contentEncoding))
+		if tc.proxied {
+			client.httpClient.Transport.(*http.Transport).DisableCompression = true
+		}
+
+		body, err := client.request(context.Background(), "GET", "health", nil)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(body) != want {
+			t.Errorf("%s: body = %q, want %q", tc.name, body, want)
+		}
+	}
+}
+
+func TestRequestInvalidBody(t *testing.T) {
+	client := newTestClient(t, bodyServer([]byte("\x00\x01garbage"), "br"))
+	client.httpClient.Transport.(*http.Transport).DisableCompression = true
+
+	_, err := client.request(context.Background(), "GET", "health", nil)
+	if _, ok := err.(*invalidBodyError); !ok {
+		t.Fatalf("got %v, want an invalidBodyError", err)
+	}
+	for _, want := range []string{"/api/health", "content encoding: br", "first bytes: 000167617262616765"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+// No deletion request may target a collection, whichever the empty identifier.
+func TestDeleteWithEmptyIdentifier(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	for name, del := range map[string]func() error{
+		"DeleteDashboard":      func() error { return client.DeleteDashboard(ctx, "") },
+		"DeleteDashboardByUID": func() error { return client.DeleteDashboardByUID(ctx, "") },
+		"DeleteFolder":         func() error { return client.DeleteFolder(ctx, "", false) },
+		"DeleteLibrary":        func() error { return client.DeleteLibrary(ctx, "") },
+		"DeleteMuteTiming":     func() error { return client.DeleteMuteTiming(ctx, "") },
+	} {
+		if err := del(); err != errEmptyIdentifier {
+			t.Errorf("%s: got %v, want errEmptyIdentifier", name, err)
+		}
+	}
+
+	// Whatever the caller, the client refuses to send them.
+	for _, route := range []string{"/api/dashboards/uid/", "/api/folders/?forceDeleteRules=false", "/api/library-elements/"} {
+		if _, err := client.requestRoute(ctx, "DELETE", route, nil); err != errEmptyIdentifier {
+			t.Errorf("DELETE %s: got %v, want errEmptyIdentifier", route, err)
+		}
+	}
+
+	// Files without a title nor a UID aren't deleted.
+	contents := map[string][]byte{
+		"dashboards/untitled.json": []byte(`{"title":"🔥"}`),
+		"libraries/untitled.json":  []byte(`{"name":"panel"}`),
+	}
+	DeleteDashboards(ctx, []string{"dashboards/untitled.json"}, contents, DefsFile{}, client)
+	DeleteLibraries(ctx, []string{"libraries/untitled.json"}, contents, DefsFile{}, client)
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "DELETE ") && strings.HasSuffix(request, "/") {
+			t.Errorf("sent %s", request)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	reset := &url.Error{Op: "Get", URL: "http://grafana", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	refused := &url.Error{Op: "Post", URL: "http://grafana", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	for _, tc := range []struct {
+		name   string
+		method string
+		err    error
+		want   bool
+	}{
+		{"5xx", "GET", newHttpUnknownError(http.StatusBadGateway), true},
+		{"4xx", "GET", newHttpUnknownError(http.StatusBadRequest), false},
+		{"not found", "GET", &httpNotFoundError{URL: "http://grafana"}, false},
+		{"invalid body", "GET", &invalidBodyError{}, false},
+		{"connection reset", "GET", reset, true},
+		{"unexpected EOF", "GET", &url.Error{Op: "Get", URL: "http://grafana", Err: io.ErrUnexpectedEOF}, true},
+		{"connection refused", "DELETE", refused, true},
+		{"empty identifier", "DELETE", errEmptyIdentifier, false},
+		{"token file", "GET", &os.PathError{Op: "open", Path: "/run/secrets/token", Err: os.ErrNotExist}, false},
+		{"unknown authority", "GET", &url.Error{Op: "Get", URL: "https://grafana", Err: x509.UnknownAuthorityError{}}, false},
+		{"hostname", "GET", &url.Error{Op: "Get", URL: "https://grafana", Err: x509.HostnameError{}}, false},
+		{"TLS alert", "GET", &url.Error{Op: "Get", URL: "https://grafana", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}}, false},
+		// A POST which may have reached Grafana isn't sent again.
+		{"POST 5xx", "POST", newHttpUnknownError(http.StatusServiceUnavailable), false},
+		{"POST connection reset", "POST", reset, false},
+		{"POST unexpected EOF", "POST", io.ErrUnexpectedEOF, false},
+		{"POST connection refused", "POST", refused, true},
+	} {
+		if got := isTransient(tc.method, tc.err); got != tc.want {
+			t.Errorf("%s: isTransient = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// statusServer answers every request with the given status code, and counts
+// them.
+func statusServer(status int, count *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"message":"status"}`))
+	})
+}
+
+func TestRequestRetries(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		status int
+		want   int32
+	}{
+		{"GET", http.StatusServiceUnavailable, 3},
+		{"DELETE", http.StatusBadGateway, 3},
+		{"GET", http.StatusBadRequest, 1},
+		{"POST", http.StatusServiceUnavailable, 1},
+	} {
+		var count int32
+		client := newTestClient(t, statusServer(tc.status, &count))
+		client.RetryAttempts = 3
+		client.RetryMaxBackoff = time.Millisecond
+
+		if _, err := client.request(context.Background(), tc.method, "dashboards/uid/ops", nil); err == nil {
+			t.Errorf("%s %d: no error", tc.method, tc.status)
+		}
+		if n := atomic.LoadInt32(&count); n != tc.want {
+			t.Errorf("%s %d: sent %d requests, want %d", tc.method, tc.status, n, tc.want)
+		}
+	}
+}
+
+// A response cut short is retried, unless the request was a POST.
+func TestRequestRetriesTruncatedBody(t *testing.T) {
+	for method, want := range map[string]int32{"GET": 3, "POST": 1} {
+		var count int32
+		client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&count, 1)
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte(`{"dashboard":`))
+		}))
+		client.RetryAttempts = 3
+		client.RetryMaxBackoff = time.Millisecond
+
+		if _, err := client.request(context.Background(), method, "dashboards/db", nil); err == nil {
+			t.Errorf("%s: no error", method)
+		}
+		if n := atomic.LoadInt32(&count); n != want {
+			t.Errorf("%s: sent %d requests, want %d", method, n, want)
+		}
+	}
+}
+
+// Local failures are reported right away.
+func TestRequestLocalErrorsNotRetried(t *testing.T) {
+	var count int32
+	server := httptest.NewUnstartedServer(statusServer(http.StatusOK, &count))
+	var conns int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	// The test server's certificate isn't trusted.
+	client := NewClient(server.URL, StaticToken("test"), "", "", 0, false)
+	client.RetryAttempts = 3
+	client.RetryMaxBackoff = time.Millisecond
+	if _, err := client.request(context.Background(), "GET", "health", nil); err == nil {
+		t.Fatalf("no error with an untrusted certificate")
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("connected %d times with an untrusted certificate, want once", n)
+	}
+
+	client = NewClient(server.URL, FileToken(filepath.Join(t.TempDir(), "missing")), "", "", 0, true)
+	client.RetryAttempts = 3
+	client.RetryMaxBackoff = time.Second
+	start := time.Now()
+	if _, err := client.request(context.Background(), "GET", "health", nil); err == nil {
+		t.Fatalf("no error with a missing token file")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second/2 {
+		t.Errorf("took %s to report a missing token file, it was retried", elapsed)
+	}
+	if n := atomic.LoadInt32(&count); n != 0 {
+		t.Errorf("sent %d requests without a token", n)
+	}
+}
+
+// The certificates in the settings are used, and a client isn't created
+// without them if they can't be loaded.
+func TestNewClientFromSettingsTLS(t *testing.T) {
+	var count int32
+	server := httptest.NewTLSServer(statusServer(http.StatusOK, &count))
+	t.Cleanup(server.Close)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	client, err := NewClientFromSettings(config.GrafanaSettings{BaseURL: server.URL, APIKey: "test", CACertPath: caPath})
+	if err != nil {
+		t.Fatalf("NewClientFromSettings: %v", err)
+	}
+	if _, err = client.request(context.Background(), "GET", "health", nil); err != nil {
+		t.Errorf("request with the CA certificate: %v", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	client, err = NewClientFromSettings(config.GrafanaSettings{BaseURL: server.URL, APIKey: "test", CACertPath: missing, SkipVerify: true})
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("got %v, want an error naming %s", err, missing)
+	}
+	if client != nil {
+		t.Errorf("a client was created without the CA certificate")
+	}
+}
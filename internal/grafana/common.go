@@ -1,26 +1,36 @@
 package grafana
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana/helpers"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+	"io/fs"
 	"io/ioutil"
-	"os"
+	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/gosimple/slug"
 	"github.com/sirupsen/logrus"
 )
 
 // FilterIgnored takes a map mapping files' names to their contents and remove
 // all the files that are supposed to be ignored by the dashboard manager.
-// An ignored file is either named "versions.json" or describing a dashboard
-// which slug starts with a given prefix.
-// Returns an error if the slug couldn't be tested against the prefix.
+// An ignored file is either named "versions.json" or describing a dashboard or
+// a library element matching one of the ignore rules.
 func FilterIgnored(
 	filesToPush *map[string][]byte, cfg *config.Config,
 ) (err error) {
-	for filename, content := range *filesToPush {
+	ignoredFiles := make(map[string]bool)
+	for _, filename := range utils.SortedKeys(*filesToPush) {
+		content := (*filesToPush)[filename]
 		max := len(content)
 		if max > 40 {
 			max = 40
@@ -29,14 +39,23 @@ func FilterIgnored(
 			"filename": filename,
 			"content":  string(content[:max]),
 		}).Debug("Checking whether to ignore")
-		// Don't set versions.json to be pushed
-		if strings.HasSuffix(filename, "versions-metadata.json") {
+		// Don't set versions.json nor the teams to be pushed
+		if strings.HasSuffix(filename, "versions-metadata.json") || format.IsTeamsFile(filename) {
 			delete(*filesToPush, filename)
 			continue
 		}
 
+		// Permissions aren't dashboards, but follow the dashboard they
+		// sit next to, which sorts before them.
+		if format.IsPermissionsFile(filename) {
+			if ignoredFiles[format.PermissionsTarget(filename)] {
+				delete(*filesToPush, filename)
+			}
+			continue
+		}
+
 		// Check if dashboard is ignored
-		ignored, err := isIgnored(content, cfg)
+		ignored, err := isIgnored(filename, content, cfg)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"filename": filename,
@@ -48,6 +67,7 @@ func FilterIgnored(
 
 		if ignored {
 			delete(*filesToPush, filename)
+			ignoredFiles[filename] = true
 		}
 	}
 	return
@@ -59,20 +79,91 @@ func FilterIgnored(
 // an update of an existing dashboard.
 // Logs any errors encountered during an iteration, but doesn't return until all
 // creation and/or update requests have been performed.
-func PushDashboardFiles(filenames []string, contents map[string][]byte, versionsFile DefsFile, grafanaVersionFile DefsFile, client *Client) {
-	// Push all files to the Grafana API
+// Returns the result of each push. Its error is the last error encountered, if
+// any, so callers can retry later.
+func PushDashboardFiles(ctx context.Context, filenames []string, contents map[string][]byte, versionsFile DefsFile, grafanaVersionFile DefsFile, client *Client) (run *results.RunResult) {
+	run = results.NewRunResult()
+	checker := &datasourceChecker{c: client}
+	folders := &folderChecker{c: client}
+
+	// Push all files to the Grafana API, then the permissions of the
+	// dashboards, which must exist by then.
+	permissions := make([]string, 0)
+	failed := make(map[string]bool)
 	for _, filename := range filenames {
+		if format.IsPermissionsFile(filename) {
+			permissions = append(permissions, filename)
+			continue
+		}
 		_, err := helpers.GetSlug(contents[filename])
 		folderUID := ""
-		if _, ok := contents[filename]; !ok {
+		content, ok := contents[filename]
+		if !ok {
+			continue
+		}
+		uid, _, _ := UIDNameFromRawJSON(content)
+		item := results.NewItem(results.KindDashboard, results.ActionPush, uid, filename)
+		if err == helpers.ErrNoSlug {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Dashboard has neither a title nor a UID, not pushing it")
+			run.Add(item.Finish(err))
 			continue
 		}
 		if err == nil {
-			var fld struct {
-				FolderUID string `json:"__folderUID"`
+			// Dashboards owned by plugins are managed by the plugins.
+			if pluginID, unmanaged := grafanaVersionFile.UnmanagedPluginOwner(uid); unmanaged {
+				logrus.WithFields(logrus.Fields{
+					"filename": filename,
+					"plugin":   pluginID,
+				}).Info("Dashboard is owned by a plugin, not pushing it")
+				run.Add(item.Skip("owned by the plugin " + pluginID))
+				continue
+			}
+			if !dashboardInScope(content, uid, grafanaVersionFile, client) {
+				logrus.WithFields(logrus.Fields{
+					"filename": filename,
+				}).Info("Dashboard is outside of the managed folders, not pushing it")
+				run.Add(item.Skip("outside of the managed folders"))
+				continue
+			}
+			if folderUID, err = fileFolderUID(ctx, content, client, folders); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":    err,
+					"filename": filename,
+				}).Error("Failed to resolve the dashboard's folder, not pushing it")
+				run.Add(item.Finish(err))
+				continue
+			}
+			// Placeholders of datasource aliases are replaced before the
+			// datasources are checked.
+			if content, err = client.resolveDatasourceAliases(ctx, content, checker); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":    err,
+					"filename": filename,
+				}).Error("Failed to resolve the dashboard's datasource placeholders, not pushing it")
+				run.Add(item.Finish(err))
+				continue
+			}
+			unmet, ok := checkDatasources(ctx, filename, content, checker)
+			if !ok {
+				item.Details = unmet
+				run.Add(item.Finish(fmt.Errorf("The datasource requirements of %s aren't met", filename)))
+				continue
+			}
+			if unmet != "" {
+				item.Warn(unmet)
+			}
+			if exceeded := overStrictLimits(filename, content, client); len(exceeded) > 0 {
+				item.Details = strings.Join(exceeded, ", ")
+				run.Add(item.Finish(fmt.Errorf("%s is over the complexity limits", filename)))
+				continue
+			}
+			if downgrade := schemaDowngrade(ctx, filename, uid, content, grafanaVersionFile, client); downgrade != "" {
+				run.Add(item.SkipFor(results.ReasonSchemaDowngrade, downgrade))
+				continue
 			}
-			err = json.Unmarshal(contents[filename], &fld)
-			folderUID = fld.FolderUID
 			logrus.WithFields(logrus.Fields{
 				"folderUID": folderUID,
 				"filename":  filename,
@@ -87,30 +178,302 @@ func PushDashboardFiles(filenames []string, contents map[string][]byte, versions
 			"folderUID": folderUID,
 			"filename":  filename,
 		}).Debug("Grafana: Create/Upload folderID")
-		if err := client.CreateOrUpdateDashboard(contents[filename], folderUID); err != nil {
+		if client.DryRun {
+			run.Add(planPush(ctx, item, folderTarget(folderUID), logrus.Fields{"folderUID": folderUID}, client.dashboardExists))
+			continue
+		}
+		err = client.CreateOrUpdateDashboard(ctx, content, folderUID)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
 			}).Error("Failed to push the file to Grafana")
+			failed[filename] = true
+		}
+		run.Add(item.Finish(err))
+	}
+
+	for _, filename := range permissions {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		var perms format.DashboardPermissions
+		err := json.Unmarshal(contents[filename], &perms)
+		item := results.NewItem(results.KindDashboard, results.ActionPush, perms.DashboardUID, filename)
+		if failed[format.PermissionsTarget(filename)] {
+			run.Add(item.Skip("the dashboard couldn't be pushed"))
+			continue
+		}
+		if err == nil && client.DryRun {
+			run.Add(planned(item, "apply the permissions", "", logrus.Fields{}))
+			continue
+		}
+		if err == nil {
+			err = client.UpdateDashboardPermissions(ctx, perms.DashboardUID, perms.Items)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to apply the dashboard permissions")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// PushDatasourceFiles pushes the datasources described by the given files to
+// Grafana, as a creation or an update of an existing datasource. The secrets
+// set on the instance are kept.
+// Logs any errors encountered during an iteration, but doesn't return until all
+// creation and/or update requests have been performed.
+// Returns the result of each push.
+func PushDatasourceFiles(ctx context.Context, filenames []string, contents map[string][]byte, client *Client) (run *results.RunResult) {
+	if run, skipped := client.skipOnDryRun(results.KindDatasource, results.ActionPush, filenames); skipped {
+		return run
+	}
+	run = results.NewRunResult()
+
+	for _, filename := range filenames {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		var ds struct {
+			UID string `json:"uid"`
+		}
+		_ = json.Unmarshal(contents[filename], &ds)
+		item := results.NewItem(results.KindDatasource, results.ActionPush, ds.UID, filename)
+
+		err := client.CreateOrUpdateDatasource(ctx, contents[filename])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to push the datasource to Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// PushAlertRuleFiles pushes the alert rules described by the given files to
+// Grafana, as a creation or an update of an existing rule. The folders the
+// rules belong to must already exist.
+// Logs any errors encountered during an iteration, but doesn't return until all
+// creation and/or update requests have been performed.
+// Returns the result of each push.
+func PushAlertRuleFiles(ctx context.Context, filenames []string, contents map[string][]byte, client *Client) (run *results.RunResult) {
+	if run, skipped := client.skipOnDryRun(results.KindAlertRule, results.ActionPush, filenames); skipped {
+		return run
+	}
+	run = results.NewRunResult()
+
+	for _, filename := range filenames {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		var rule struct {
+			UID string `json:"uid"`
 		}
+		_ = json.Unmarshal(contents[filename], &rule)
+		item := results.NewItem(results.KindAlertRule, results.ActionPush, rule.UID, filename)
+
+		err := client.CreateOrUpdateAlertRule(ctx, contents[filename])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to push the alert rule to Grafana")
+		}
+		run.Add(item.Finish(err))
 	}
+	return
 }
 
-func PushLibraryFiles(filenames []string, contents map[string][]byte, versionsFile DefsFile, grafanaVersionFile DefsFile, client *Client) {
+// PushNotificationFiles pushes the contact points and the mute timings
+// described by the given files to Grafana, as a creation or an update of an
+// existing one, then the notification policy tree described by the given
+// policies files, which refers to both.
+// Logs any errors encountered during an iteration, but doesn't return until all
+// creation and/or update requests have been performed.
+// Returns the result of each push.
+func PushNotificationFiles(
+	ctx context.Context, contactPointFiles []string, muteTimingFiles []string, policiesFiles []string,
+	contents map[string][]byte, client *Client,
+) (run *results.RunResult) {
+	if run, skipped := client.skipOnDryRun(results.KindContactPoint, results.ActionPush, contactPointFiles); skipped {
+		muteTimings, _ := client.skipOnDryRun(results.KindMuteTiming, results.ActionPush, muteTimingFiles)
+		policies, _ := client.skipOnDryRun(results.KindNotificationPolicy, results.ActionPush, policiesFiles)
+		run.Merge(muteTimings, policies)
+		return run
+	}
+	run = results.NewRunResult()
+
+	existing := make(map[string]bool)
+	contactPoints, listErr := client.GetContactPoints(ctx)
+	for _, cp := range contactPoints {
+		existing[cp.UID] = true
+	}
+
+	for _, filename := range contactPointFiles {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		var cp struct {
+			UID string `json:"uid"`
+		}
+		_ = json.Unmarshal(contents[filename], &cp)
+		item := results.NewItem(results.KindContactPoint, results.ActionPush, cp.UID, filename)
+
+		// Without the existing contact points, a creation can't be told
+		// apart from an update.
+		err := listErr
+		if err == nil {
+			err = client.CreateOrUpdateContactPoint(ctx, contents[filename], existing)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to push the contact point to Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+
+	if len(muteTimingFiles) > 0 {
+		run.Merge(pushMuteTimingFiles(ctx, muteTimingFiles, contents, client))
+	}
+
+	for _, filename := range policiesFiles {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		item := results.NewItem(results.KindNotificationPolicy, results.ActionPush, "", filename)
+		err := client.UpdateNotificationPolicies(ctx, contents[filename])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to push the notification policies to Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// pushMuteTimingFiles pushes the mute timings described by the given files to
+// Grafana, as a creation or an update of an existing one.
+// Returns the result of each push.
+func pushMuteTimingFiles(ctx context.Context, filenames []string, contents map[string][]byte, client *Client) (run *results.RunResult) {
+	run = results.NewRunResult()
+
+	existing := make(map[string]bool)
+	muteTimings, listErr := client.GetMuteTimings(ctx)
+	for _, mt := range muteTimings {
+		existing[mt.Name] = true
+	}
+
+	for _, filename := range filenames {
+		if _, ok := contents[filename]; !ok {
+			continue
+		}
+
+		var mt struct {
+			Name string `json:"name"`
+		}
+		_ = json.Unmarshal(contents[filename], &mt)
+		item := results.NewItem(results.KindMuteTiming, results.ActionPush, mt.Name, filename)
+
+		// Without the existing mute timings, a creation can't be told
+		// apart from an update.
+		err := listErr
+		if err == nil {
+			err = client.CreateOrUpdateMuteTiming(ctx, contents[filename], existing)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to push the mute timing to Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// DeleteMuteTimings deletes from Grafana the mute timings described by the
+// given files, identified by their names.
+// Returns the result of each deletion.
+func DeleteMuteTimings(ctx context.Context, filenames []string, contents map[string][]byte, client *Client) (run *results.RunResult) {
+	if run, skipped := client.skipOnDryRun(results.KindMuteTiming, results.ActionDelete, filenames); skipped {
+		return run
+	}
+	run = results.NewRunResult()
+
+	for _, filename := range filenames {
+		var mt struct {
+			Name string `json:"name"`
+		}
+		err := json.Unmarshal(contents[filename], &mt)
+		item := results.NewItem(results.KindMuteTiming, results.ActionDelete, mt.Name, filename)
+		if err != nil || mt.Name == "" {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to find the mute timing name, not deleting it")
+			if err == nil {
+				err = errEmptyIdentifier
+			}
+			run.Add(item.Finish(err))
+			continue
+		}
+
+		err = client.DeleteMuteTiming(ctx, mt.Name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+				"name":     mt.Name,
+			}).Error("Failed to remove the mute timing from Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// PushLibraryFiles pushes the library panels described by the given files to
+// Grafana, the same way PushDashboardFiles does for dashboards.
+// Returns the result of each push.
+func PushLibraryFiles(ctx context.Context, filenames []string, contents map[string][]byte, versionsFile DefsFile, grafanaVersionFile DefsFile, client *Client) (run *results.RunResult) {
+	run = results.NewRunResult()
+	checker := &datasourceChecker{c: client}
+	folders := &folderChecker{c: client}
+
 	// Push all files to the Grafana API
 	for _, filename := range filenames {
-		_, err := helpers.GetSlug(contents[filename])
 		if _, ok := contents[filename]; !ok {
 			continue
 		}
 
-		var fld struct {
-			FolderUID string `json:"__folderUID"`
-			UID       string `json:"uid"`
+		var lib format.LibraryFile
+		err := json.Unmarshal(contents[filename], &lib)
+		uid := lib.UID
+		item := results.NewItem(results.KindLibrary, results.ActionPush, uid, filename)
+
+		folderUID, folderErr := fileFolderUID(ctx, contents[filename], client, folders)
+		if err == nil && folderErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    folderErr,
+				"filename": filename,
+			}).Error("Failed to resolve the library's folder, not pushing it")
+			run.Add(item.Finish(folderErr))
+			continue
 		}
-		err = json.Unmarshal(contents[filename], &fld)
-		folderUID := fld.FolderUID
-		uid := fld.UID
 
 		if err == nil {
 			logrus.WithFields(logrus.Fields{
@@ -123,104 +486,560 @@ func PushLibraryFiles(filenames []string, contents map[string][]byte, versionsFi
 				"filename": filename,
 			}).Error("Failed to find title")
 		}
+		content := contents[filename]
+		if err == nil {
+			// Placeholders of datasource aliases are replaced before the
+			// datasources are checked.
+			if content, err = client.resolveDatasourceAliases(ctx, content, checker); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":    err,
+					"filename": filename,
+				}).Error("Failed to resolve the library's datasource placeholders, not pushing it")
+				run.Add(item.Finish(err))
+				continue
+			}
+			unmet, ok := checkLibraryDatasources(ctx, filename, uid, content, checker, grafanaVersionFile)
+			if !ok {
+				item.Details = unmet
+				run.Add(item.Finish(fmt.Errorf("The datasource requirements of %s aren't met", filename)))
+				continue
+			}
+			if unmet != "" {
+				item.Warn(unmet)
+			}
+		}
 		libVersion, _ := versionsFile.LibraryVersionByUID[uid]
+		if client.DryRun {
+			run.Add(planPush(ctx, item, folderTarget(folderUID), logrus.Fields{"folderUID": folderUID}, client.libraryExists))
+			continue
+		}
 
-		if err := client.CreateOrUpdateLibrary(contents[filename], folderUID, libVersion); err != nil {
+		err = client.CreateOrUpdateLibrary(ctx, content, folderUID, libVersion)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
 			}).Error("Failed to push the file to Grafana")
 		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// overStrictLimits returns the complexity limits the given dashboard exceeds,
+// if the client is strict about them. Returns nil otherwise, or if the
+// dashboard couldn't be measured.
+func overStrictLimits(filename string, content []byte, client *Client) (exceeded []string) {
+	if client.ComplexityLimits == nil || !client.ComplexityLimits.Strict {
+		return
+	}
+
+	cx, err := MeasureComplexity(content)
+	if err != nil {
+		return
+	}
+	exceeded = cx.Exceeded(client.ComplexityLimits)
+	if len(exceeded) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"filename": filename,
+			"exceeded": exceeded,
+		}).Error("Dashboard is over the complexity limits, not pushing it")
+	}
+	return
+}
+
+// schemaDowngrade checks whether pushing the given dashboard would lower the
+// schemaVersion of the dashboard with the given UID on the Grafana instance,
+// which is looked up in the given definitions, or requested if it isn't there.
+// Grafana migrates dashboards to newer schemas, but never back, so their
+// panels could break. Logs a warning if it would, unless the client allows
+// it. The check is skipped if either side has no schemaVersion.
+// Returns a description of the downgrade, or an empty string if the dashboard
+// can be pushed.
+func schemaDowngrade(ctx context.Context, filename string, uid string, content []byte, grafanaVersionFile DefsFile, client *Client) string {
+	if client.AllowSchemaDowngrade || uid == "" {
+		return ""
+	}
+
+	payload, ok := schemaVersion(content)
+	if !ok {
+		return ""
+	}
+
+	var target *Dashboard
+	for _, dashboard := range grafanaVersionFile.DashboardBySlug {
+		if dashboard != nil && dashboard.UID == uid {
+			target = dashboard
+			break
+		}
+	}
+	if target == nil {
+		var err error
+		if target, err = client.GetRawDashboard(ctx, "uid/"+uid); err != nil {
+			if !isNotFound(err) {
+				logrus.WithFields(logrus.Fields{
+					"error":    err,
+					"filename": filename,
+				}).Warn("Failed to retrieve the dashboard from Grafana, not checking its schemaVersion")
+			}
+			return ""
+		}
+	}
+
+	current, ok := schemaVersion(target.RawJSON)
+	if !ok || payload >= current {
+		return ""
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"filename": filename,
+		"uid":      uid,
+		"payload":  payload,
+		"current":  current,
+	}).Warn("Dashboard would downgrade the schemaVersion of the one on Grafana, not pushing it")
+	return fmt.Sprintf("schemaVersion %v is lower than %v on Grafana", payload, current)
+}
+
+// schemaVersion returns the schemaVersion of the given dashboard, and false if
+// it has none.
+func schemaVersion(content []byte) (version float64, ok bool) {
+	var dashboard format.DashboardFile
+	if err := json.Unmarshal(content, &dashboard); err != nil || dashboard.SchemaVersion == nil {
+		return 0, false
+	}
+	return *dashboard.SchemaVersion, true
+}
+
+// checkDatasources checks that the Grafana instance has the datasources the
+// given dashboard needs. Logs the unmet requirements, if any, as a warning or,
+// if the client is strict about datasources, as an error.
+// Returns the unmet requirements, and false if the dashboard mustn't be pushed
+// because of them.
+func checkDatasources(ctx context.Context, filename string, content []byte, checker *datasourceChecker) (unmet string, ok bool) {
+	types, refs, err := DatasourceRequirements(content)
+	if err == nil {
+		unmet, err = checker.unmet(ctx, types, refs)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"filename": filename,
+		}).Warn("Failed to check the dashboard's datasources")
+		return "", true
+	}
+	if unmet == "" {
+		return "", true
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"filename": filename,
+		"unmet":    unmet,
+	})
+	return unmet, reportUnmetDatasources(entry, "dashboard", checker.c.StrictDatasources)
+}
+
+// checkLibraryDatasources checks that the Grafana instance has the datasources
+// the given library panel needs, the same way checkDatasources does for
+// dashboards. Since a library panel breaks every dashboard using it, the
+// dashboards connected to it are logged along with the unmet requirements.
+// Returns the unmet requirements, and false if the library panel mustn't be
+// pushed because of them.
+func checkLibraryDatasources(ctx context.Context, filename string, uid string, content []byte, checker *datasourceChecker, grafanaVersionFile DefsFile) (unmet string, ok bool) {
+	types, refs, err := LibraryDatasourceRequirements(content)
+	if err == nil {
+		unmet, err = checker.unmet(ctx, types, refs)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"filename": filename,
+		}).Warn("Failed to check the library's datasources")
+		return "", true
+	}
+	if unmet == "" {
+		return "", true
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"filename":   filename,
+		"unmet":      unmet,
+		"dashboards": connectedDashboards(ctx, uid, checker.c, grafanaVersionFile),
+	})
+	return unmet, reportUnmetDatasources(entry, "library", checker.c.StrictDatasources)
+}
+
+// reportUnmetDatasources logs the unmet datasource requirements of a dashboard
+// or library described by the given entry. Returns false if it mustn't be
+// pushed because the client is strict about datasources.
+func reportUnmetDatasources(entry *logrus.Entry, kind string, strict bool) (ok bool) {
+	if strict {
+		entry.Error("The Grafana instance doesn't have the datasources the " + kind + " needs, not pushing it")
+		return false
+	}
+	entry.Warn("The Grafana instance doesn't have the datasources the " + kind + " needs")
+	return true
+}
+
+// connectedDashboards returns the titles of the dashboards the library with
+// the given UID is connected to, as a single description. Falls back on the
+// dashboards' UIDs for the ones missing from the given definitions.
+func connectedDashboards(ctx context.Context, uid string, client *Client, grafanaVersionFile DefsFile) (dashboards string) {
+	if uid == "" {
+		return
+	}
+	dashboardUIDs, err := client.GetLibraryConnections(ctx, uid)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"uid":   uid,
+		}).Warn("Failed to retrieve the dashboards connected to the library")
+		return
+	}
+
+	titles := make(map[string]string)
+	for _, meta := range grafanaVersionFile.DashboardMetaBySlug {
+		titles[meta.UID] = meta.Title
+	}
+	names := make([]string, 0, len(dashboardUIDs))
+	for _, dbUID := range dashboardUIDs {
+		if title, ok := titles[dbUID]; ok {
+			names = append(names, title)
+		} else {
+			names = append(names, dbUID)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// fileFolderUID returns the UID of the folder a dashboard or library file
+// belongs to. Files written by the puller give it with the "__folderUID" key,
+// while files written by hand can give the folder's title with the "__folder"
+// key instead, in which case the folder is looked up (and created if missing)
+// on the Grafana instance. "__folderUID" wins if both are present, and the
+// folder it gives is made sure to exist with the given checker.
+// Returns an error if the file couldn't be parsed, or if the folder couldn't be
+// resolved, e.g. because several folders have the given title.
+func fileFolderUID(ctx context.Context, content []byte, client *Client, folders *folderChecker) (folderUID string, err error) {
+	var placement format.Placement
+	if err = json.Unmarshal(content, &placement); err != nil {
+		return
+	}
+
+	if placement.FolderUID != "" || placement.Folder == "" {
+		return placement.FolderUID, folders.ensure(ctx, placement.FolderUID, placement.Folder)
+	}
+
+	return client.ResolveFolderByTitle(ctx, placement.Folder)
+}
+
+// dashboardInScope returns true if the dashboard with the given UID, described
+// by the given file, is in the folders the client manages: both the folder the
+// file puts it in and, if it exists on Grafana according to the given
+// definitions, the folder it's in there, so a dashboard is never moved into or
+// out of a folder which isn't managed.
+func dashboardInScope(content []byte, uid string, grafanaVersionFile DefsFile, client *Client) bool {
+	if client.FolderScope == nil {
+		return true
+	}
+
+	// A file which can't be parsed is in the General folder, the push
+	// reports the error.
+	var placement format.Placement
+	json.Unmarshal(content, &placement)
+
+	folder := grafanaVersionFile.FolderKeys(placement.FolderUID)
+	if placement.FolderUID == "" && placement.Folder != "" {
+		folder = []string{placement.Folder}
+		for _, id := range utils.SortedKeys(grafanaVersionFile.FoldersMetaByUID) {
+			if meta := grafanaVersionFile.FoldersMetaByUID[id]; meta.Title == placement.Folder {
+				folder = grafanaVersionFile.FolderKeys(meta.UID)
+				break
+			}
+		}
 	}
+	if !client.FolderScope.Allows(folder) {
+		return false
+	}
+
+	for _, meta := range grafanaVersionFile.DashboardMetaBySlug {
+		if uid != "" && meta.UID == uid {
+			return client.FolderScope.Allows(grafanaVersionFile.FolderKeys(meta.FolderUID))
+		}
+	}
+	return true
+}
+
+// WithoutMovedDashboards returns the given removed dashboard files, except the
+// ones describing a dashboard, by UID, which one of the given added or
+// modified files describes too, i.e. which file was only moved, e.g. to the
+// directory of another folder. Deleting it would delete the dashboard the
+// moved file describes.
+func WithoutMovedDashboards(removed []string, changed []string, contents map[string][]byte) (deleted []string) {
+	moved := make(map[string]bool)
+	for _, filename := range changed {
+		if uid, _, _ := UIDNameFromRawJSON(contents[filename]); uid != "" {
+			moved[uid] = true
+		}
+	}
+
+	deleted = make([]string, 0, len(removed))
+	for _, filename := range removed {
+		if uid, _, _ := UIDNameFromRawJSON(contents[filename]); uid != "" && moved[uid] {
+			logrus.WithFields(logrus.Fields{
+				"filename": filename,
+				"uid":      uid,
+			}).Info("The dashboard's file was moved, not deleting the dashboard")
+			continue
+		}
+		deleted = append(deleted, filename)
+	}
+	return
+}
+
+// errAmbiguousSlug is returned when deleting a dashboard by a slug several
+// dashboards have.
+var errAmbiguousSlug = errors.New("several dashboards have the slug")
+
+// removedDashboardUID returns the UID of the dashboard described by the given
+// removed file: the one in its content, or if it has none, the one of the
+// dashboard the given definitions retrieved from the Grafana API have under
+// the file's name. Returns an empty string if neither is known.
+func removedDashboardUID(filename string, content []byte, grafanaVersionFile DefsFile) string {
+	if uid, _, _ := UIDNameFromRawJSON(content); uid != "" {
+		return uid
+	}
+	name := strings.TrimSuffix(filepath.Base(filename), ".json")
+	return grafanaVersionFile.DashboardMetaBySlug[name].UID
+}
+
+// dashboardUIDsByTitleSlug returns the sorted UIDs of the dashboards which
+// titles give the given slug.
+func (d DefsFile) dashboardUIDsByTitleSlug(dbSlug string) (uids []string) {
+	for _, meta := range d.DashboardMetaBySlug {
+		if slug.Make(meta.Title) == dbSlug {
+			uids = append(uids, meta.UID)
+		}
+	}
+	sort.Strings(uids)
+	return
 }
 
 // DeleteDashboards takes a slice of files' names and a map mapping a file's name
 // to its content, and iterates over the first slice. For each file name, extract
-// a dashboard's slug from the content, in the map, that matches the name, and
-// will use it to send a deletion request to the Grafana API.
+// a dashboard's UID from the content, in the map, that matches the name, or
+// failing that from the definitions retrieved from the Grafana API for the
+// file's name, and will use it to send a deletion request to the Grafana API.
+// Files without a known UID fall back to the slug of their title, unless
+// several dashboards have it.
+// Dashboards which don't exist on Grafana anymore are skipped, they may have
+// been deleted by hand already.
 // Logs any errors encountered during an iteration, but doesn't return until all
-// deletion requests have been performed.
-func DeleteDashboards(filenames []string, contents map[string][]byte, client *Client) {
+// deletion requests have been performed. Dashboards owned by plugins, according
+// to the definitions retrieved from the Grafana API, or outside of the folders
+// the client manages, are never deleted.
+// Returns the result of each deletion.
+func DeleteDashboards(ctx context.Context, filenames []string, contents map[string][]byte, grafanaVersionFile DefsFile, client *Client) (run *results.RunResult) {
+	run = results.NewRunResult()
+
 	for _, filename := range filenames {
+		// Removing the permissions of a dashboard leaves them as they are.
+		if format.IsPermissionsFile(filename) {
+			continue
+		}
+		// Never delete the status dashboard maintained by the manager.
+		uid := removedDashboardUID(filename, contents[filename], grafanaVersionFile)
+		if IsSelfDashboard(uid) {
+			continue
+		}
+		item := results.NewItem(results.KindDashboard, results.ActionDelete, uid, filename)
+		if pluginID, unmanaged := grafanaVersionFile.UnmanagedPluginOwner(uid); unmanaged {
+			logrus.WithFields(logrus.Fields{
+				"filename": filename,
+				"plugin":   pluginID,
+			}).Info("Dashboard is owned by a plugin, not deleting it")
+			run.Add(item.Skip("owned by the plugin " + pluginID))
+			continue
+		}
+		if !dashboardInScope(contents[filename], uid, grafanaVersionFile, client) {
+			logrus.WithFields(logrus.Fields{
+				"filename": filename,
+			}).Info("Dashboard is outside of the managed folders, not deleting it")
+			run.Add(item.Skip("outside of the managed folders"))
+			continue
+		}
+
+		// Dashboards are identified by their UID, if the file provides one.
+		if uid != "" && client.DryRun {
+			run.Add(planDelete(ctx, item, logrus.Fields{}, client.dashboardExists))
+			continue
+		}
+		if uid != "" {
+			err := client.DeleteDashboardByUID(ctx, uid)
+			if isNotFound(err) {
+				logrus.WithFields(logrus.Fields{
+					"filename": filename,
+					"uid":      uid,
+				}).Info("The dashboard doesn't exist on Grafana anymore")
+				run.Add(item.Skip("already deleted"))
+				continue
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":    err,
+					"filename": filename,
+					"uid":      uid,
+				}).Error("Failed to remove the dashboard from Grafana")
+			}
+			run.Add(item.Finish(err))
+			continue
+		}
+
 		// Retrieve dashboard slug because we need it in the deletion request.
 		slug, err := helpers.GetSlug(contents[filename])
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
-			}).Error("Failed to compute the dashboard's slug")
+			}).Error("Failed to compute the dashboard's slug, not deleting it")
+			run.Add(item.Finish(err))
+			continue
+		}
+		// The slug is computed from the title, don't risk deleting another
+		// dashboard with the same title.
+		if uids := grafanaVersionFile.dashboardUIDsByTitleSlug(slug); len(uids) > 1 {
+			logrus.WithFields(logrus.Fields{
+				"filename": filename,
+				"slug":     slug,
+				"uids":     strings.Join(uids, ","),
+			}).Error("Several dashboards have the slug of the dashboard, not deleting it")
+			run.Add(item.Finish(errAmbiguousSlug))
+			continue
+		}
+		if client.DryRun {
+			run.Add(planned(item, dryRunDelete, "", logrus.Fields{"slug": slug}))
+			continue
 		}
 
-		if err := client.DeleteDashboard(slug); err != nil {
+		err = client.DeleteDashboard(ctx, slug)
+		if isNotFound(err) {
+			logrus.WithFields(logrus.Fields{
+				"filename": filename,
+				"slug":     slug,
+			}).Info("The dashboard doesn't exist on Grafana anymore")
+			run.Add(item.Skip("already deleted"))
+			continue
+		}
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
 				"slug":     slug,
 			}).Error("Failed to remove the dashboard from Grafana")
 		}
+		run.Add(item.Finish(err))
 	}
+	return
 }
 
-func DeleteLibraries(filenames []string, contents map[string][]byte, client *Client) {
+// DeleteLibraries deletes from Grafana the libraries described by the given
+// files, the same way DeleteDashboards does for dashboards. Grafana refuses to
+// delete a library which dashboards still use, in which case the dashboards,
+// looked up in the given definitions, are logged.
+// Returns the result of each deletion.
+func DeleteLibraries(ctx context.Context, filenames []string, contents map[string][]byte, grafanaVersionFile DefsFile, client *Client) (run *results.RunResult) {
+	run = results.NewRunResult()
+
 	for _, filename := range filenames {
-		var fld struct {
-			UID string `json:"uid"`
-		}
-		err := json.Unmarshal(contents[filename], &fld)
-		uid := fld.UID
-		if err != nil {
+		var lib format.LibraryFile
+		err := json.Unmarshal(contents[filename], &lib)
+		uid := lib.UID
+		item := results.NewItem(results.KindLibrary, results.ActionDelete, uid, filename)
+		if err != nil || uid == "" {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
-			}).Error("Failed to find the library UID")
+			}).Error("Failed to find the library UID, not deleting it")
+			if err == nil {
+				err = errEmptyIdentifier
+			}
+			run.Add(item.Finish(err))
+			continue
+		}
+		if client.DryRun {
+			run.Add(planDelete(ctx, item, logrus.Fields{}, client.libraryExists))
+			continue
 		}
 
-		if err := client.DeleteLibrary(uid); err != nil {
+		err = client.DeleteLibrary(ctx, uid)
+		if e, ok := err.(*httpUnknownError); ok && e.StatusCode == http.StatusForbidden {
+			if dashboards := connectedDashboards(ctx, uid, client, grafanaVersionFile); dashboards != "" {
+				logrus.WithFields(logrus.Fields{
+					"filename":   filename,
+					"uid":        uid,
+					"dashboards": dashboards,
+				}).Error("The library is still used by dashboards, Grafana refused to delete it")
+				item.Details = "used by " + dashboards
+				run.Add(item.Finish(err))
+				continue
+			}
+		}
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"filename": filename,
 				"uid":      uid,
-			}).Error("Failed to remove the dashboard from Grafana")
+			}).Error("Failed to remove the library from Grafana")
 		}
+		run.Add(item.Finish(err))
 	}
+	return
 }
 
-// isIgnored checks whether the file must be ignored, by checking if there's an
-// prefix for ignored files set in the configuration file, and if the dashboard
-// described in the file has a name that starts with this prefix. Returns an
-// error if there was an issue reading or decoding the file.
-func isIgnored(dashboardJSON []byte, cfg *config.Config) (bool, error) {
-	// If there's no prefix set, no file is ignored
-	if len(cfg.Grafana.IgnorePrefix) == 0 {
-		return false, nil
+// isIgnored checks whether the file with the given name must be ignored, by
+// checking the dashboard or library element described in the file against the
+// ignore rules from the configuration file. The status dashboard maintained by
+// the manager is always ignored. Returns an error if there was an issue reading
+// or decoding the file.
+func isIgnored(filename string, content []byte, cfg *config.Config) (bool, error) {
+	slug := strings.TrimSuffix(filepath.Base(filename), ".json")
+
+	if strings.HasPrefix(filename, "libraries") {
+		var lib format.LibraryFile
+		if err := json.Unmarshal(content, &lib); err != nil {
+			return false, err
+		}
+
+		rule, ignored := cfg.Grafana.IgnoredBy(lib.Name, slug, nil)
+		if ignored {
+			logrus.WithFields(logrus.Fields{
+				"uid":  lib.UID,
+				"name": lib.Name,
+				"rule": rule.String(),
+			}).Info("Library matches an ignore rule, ignoring it")
+		}
+		return ignored, nil
 	}
 
-	// Parse the file's content to extract its slug
-	slug, err := helpers.GetSlug(dashboardJSON)
-	if err != nil {
+	var dashboard format.DashboardFile
+	if err := json.Unmarshal(content, &dashboard); err != nil {
 		return false, err
 	}
 
-	// Compare the slug against the prefix
-	if strings.HasPrefix(slug, cfg.Grafana.IgnorePrefix) {
+	// The status dashboard is maintained by the manager itself
+	if IsSelfDashboard(dashboard.UID) {
 		return true, nil
 	}
 
-	return false, nil
-}
-
-func Push(cfg *config.Config, fileVersionFile DefsFile, grafanaVersionFile DefsFile,
-	dashboardFiles []string, dashboardContents map[string][]byte, client *Client) (err error) {
-	// Filter out all dashboardFiles that are supposed to be ignored by the
-	// dashboard manager.
-	if err = FilterIgnored(&dashboardContents, cfg); err != nil {
-		return err
+	rule, ignored := cfg.Grafana.IgnoredBy(dashboard.Title, slug, dashboard.Tags)
+	if ignored {
+		logrus.WithFields(logrus.Fields{
+			"uid":   dashboard.UID,
+			"title": dashboard.Title,
+			"rule":  rule.String(),
+		}).Info("Dashboard matches an ignore rule, ignoring it")
 	}
-
-	// Push the dashboardContents of the dashboardFiles that were added or modified to the
-	// Grafana API.
-	PushDashboardFiles(dashboardFiles, dashboardContents, fileVersionFile, grafanaVersionFile, client)
-	return
+	return ignored, nil
 }
 
 // getFilesContents takes a slice of files' names and a map mapping a file's name
@@ -246,18 +1065,37 @@ func GetFilesContents(
 	return
 }
 
-func LoadFilesFromDirectory(cfg *config.Config, dir string, subdir string) (filenames []string, contents map[string][]byte, err error) {
+// LoadFilesFromDirectory returns the names, relative to the given
+// subdirectory of the given directory, of the JSON files in the subdirectory,
+// and their contents. The files of the subdirectory's own subdirectories are
+// included if recursive is true, e.g. for the dashboards laid out by folder.
+// Returns an error if a directory or a file couldn't be read.
+func LoadFilesFromDirectory(cfg *config.Config, dir string, subdir string, recursive bool) (filenames []string, contents map[string][]byte, err error) {
 	filenames = make([]string, 0)
 	contents = make(map[string][]byte)
-	files, err := os.ReadDir(filepath.Join(dir, subdir))
+	root := filepath.Join(dir, subdir)
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != root && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(entry.Name(), ".json") {
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			filenames = append(filenames, name)
+		}
+		return nil
+	})
 	if err != nil {
 		return
 	}
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".json") {
-			filenames = append(filenames, file.Name())
-		}
-	}
 	err = GetFilesContents(filenames, &contents, subdir, cfg)
 	return
 }
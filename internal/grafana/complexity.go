@@ -0,0 +1,91 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+)
+
+// Complexity describes how big a dashboard is.
+type Complexity struct {
+	// Size is the size of the dashboard's JSON description, in bytes.
+	Size int
+	// Panels is the number of panels, including the ones inside rows.
+	Panels int
+	// MaxQueries is the number of queries of the panel having the most.
+	MaxQueries int
+	// Variables is the number of templating variables.
+	Variables int
+}
+
+// complexityPanel represents the parts of a panel needed to measure a
+// dashboard's complexity. Collapsed rows hold their panels.
+type complexityPanel struct {
+	Targets []json.RawMessage `json:"targets"`
+	Panels  []complexityPanel `json:"panels"`
+}
+
+// MeasureComplexity measures the complexity of the dashboard described by the
+// given JSON. Panels are counted recursively, both in collapsed rows and in the
+// rows of the pre-5.0 schema.
+// Returns an error if the JSON couldn't be parsed.
+func MeasureComplexity(rawJSON []byte) (cx Complexity, err error) {
+	var dashboard struct {
+		Panels []complexityPanel `json:"panels"`
+		Rows   []struct {
+			Panels []complexityPanel `json:"panels"`
+		} `json:"rows"`
+		Templating struct {
+			List []json.RawMessage `json:"list"`
+		} `json:"templating"`
+	}
+	if err = json.Unmarshal(rawJSON, &dashboard); err != nil {
+		return
+	}
+
+	cx.Size = len(rawJSON)
+	cx.Variables = len(dashboard.Templating.List)
+	cx.countPanels(dashboard.Panels)
+	for _, row := range dashboard.Rows {
+		cx.countPanels(row.Panels)
+	}
+	return
+}
+
+// countPanels adds the given panels and the panels they hold to the
+// complexity.
+func (cx *Complexity) countPanels(panels []complexityPanel) {
+	for _, panel := range panels {
+		cx.Panels++
+		if len(panel.Targets) > cx.MaxQueries {
+			cx.MaxQueries = len(panel.Targets)
+		}
+		cx.countPanels(panel.Panels)
+	}
+}
+
+// Exceeded returns a description of each of the given limits the complexity
+// is over, e.g. "panels: 1200 > 300". Returns nil if limits is nil.
+func (cx Complexity) Exceeded(limits *config.ComplexityLimits) (exceeded []string) {
+	if limits == nil {
+		return
+	}
+
+	checks := []struct {
+		name  string
+		value int
+		limit int
+	}{
+		{"file size", cx.Size, limits.MaxFileSize},
+		{"panels", cx.Panels, limits.MaxPanels},
+		{"queries per panel", cx.MaxQueries, limits.MaxQueriesPerPanel},
+		{"variables", cx.Variables, limits.MaxVariables},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.value > check.limit {
+			exceeded = append(exceeded, fmt.Sprintf("%s: %d > %d", check.name, check.value, check.limit))
+		}
+	}
+	return
+}
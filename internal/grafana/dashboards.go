@@ -1,15 +1,25 @@
 package grafana
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana/helpers"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
 	"github.com/icza/dyno"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // DbSearchResponse represents an element of the response to a dashboard search
@@ -24,6 +34,14 @@ type DbSearchResponse struct {
 	UID       string   `json:"uid"`
 	FolderUID string   `json:"folderUid,omitEmpty"`
 	FolderID  int      `json:"folderId,omitEmpty"`
+	// Ancestors is the ancestor chain of a folder, root first. It's only
+	// set on folders.
+	Ancestors []FolderRef `json:"ancestors,omitempty"`
+	// Updated changes whenever the dashboard is saved: it's the time of its
+	// latest update, or the version of its resource with the Kubernetes-style
+	// API. It's empty if Grafana doesn't give it. It isn't written to the
+	// versions files, which would then change with it.
+	Updated string `json:"-"`
 }
 
 // dbCreateOrUpdateRequest represents the request sent to create or update a
@@ -32,6 +50,9 @@ type dbCreateOrUpdateRequest struct {
 	Dashboard rawJSON `json:"dashboard"`
 	Overwrite bool    `json:"overwrite"`
 	FolderUID string  `json:"folderUid"`
+	// FolderID is only set for the Grafana versions which don't support
+	// folder UIDs.
+	FolderID int `json:"folderId,omitempty"`
 }
 
 // dbCreateOrUpdateResponse represents the response sent by the Grafana API to
@@ -51,15 +72,9 @@ type Dashboard struct {
 	Name    string
 	UID     string `json:"uid"`
 	Version int
-}
-
-type Folder struct {
-	Title     string   `json:"title"`
-	UID       string   `json:"uid"`
-	URI       string   `json:"uri"`
-	Tags      []string `json:"tags"`
-	Starred   bool     `json:"isStarred"`
-	FolderUID string   `json:"folderUid,omitEmpty"`
+	// FolderUID is the UID of the folder the dashboard is in, as given by
+	// the dashboard's metadata.
+	FolderUID string
 }
 
 type DashboardVersion struct {
@@ -77,6 +92,42 @@ type DefsFile struct {
 	FoldersMetaByUID      map[string]DbSearchResponse `json:"foldersMetaByUID"`
 	DashboardVersionByUID map[string]int              `json:"dashboardVersionByUID"`
 	LibraryVersionByUID   map[string]int              `json:"libraryVersionByUID"`
+
+	// DatasourceByUID and DatasourceVersionByUID describe the datasources,
+	// when they're synchronised.
+	DatasourceByUID        map[string]*Datasource `json:"-"`
+	DatasourceVersionByUID map[string]int         `json:"datasourceVersionByUID,omitempty"`
+
+	// AlertRuleByUID and AlertRuleVersionByUID describe the alert rules, when
+	// they're synchronised. See AlertRule for what their versions are.
+	AlertRuleByUID        map[string]*AlertRule `json:"-"`
+	AlertRuleVersionByUID map[string]int64      `json:"alertRuleVersionByUID,omitempty"`
+
+	// ContactPointByUID, MuteTimingByName and NotificationPolicies
+	// describe the alerting contact points, mute timings and notification
+	// policy tree, when they're synchronised. They aren't versioned by
+	// Grafana, so they're only compared with the files.
+	ContactPointByUID    map[string]*ContactPoint `json:"-"`
+	MuteTimingByName     map[string]*MuteTiming   `json:"-"`
+	NotificationPolicies []byte                   `json:"-"`
+
+	// FolderPermissionsByUID maps the UIDs of the folders to their
+	// permissions, when they're synchronised.
+	FolderPermissionsByUID map[string]*format.FolderPermissions `json:"-"`
+	// DashboardPermissionsByUID maps the UIDs of the dashboards to their
+	// permissions, when they're synchronised.
+	DashboardPermissionsByUID map[string]*format.DashboardPermissions `json:"-"`
+	// Teams describes the teams the permissions reference, when they're
+	// synchronised.
+	Teams format.TeamsFile `json:"-"`
+
+	// UnmanagedPluginDashboards maps the UIDs of the dashboards owned by
+	// plugins which aren't included in the configuration to the plugins' IDs.
+	UnmanagedPluginDashboards map[string]string `json:"-"`
+
+	// OverComplexityLimits maps the UIDs of the dashboards over the complexity
+	// limits to the description of the limits they exceed.
+	OverComplexityLimits map[string][]string `json:"overComplexityLimits,omitempty"`
 }
 
 // UnmarshalJSON tells the JSON parser how to unmarshal JSON data into an
@@ -87,7 +138,8 @@ func (d *Dashboard) UnmarshalJSON(b []byte) (err error) {
 	var body struct {
 		Dashboard rawJSON `json:"dashboard"`
 		Meta      struct {
-			Version int `json:"version"`
+			Version   int    `json:"version"`
+			FolderUID string `json:"folderUid"`
 		} `json:"meta"`
 		UID string `json:"uid"`
 	}
@@ -98,6 +150,7 @@ func (d *Dashboard) UnmarshalJSON(b []byte) (err error) {
 	}
 	// Define all fields with their corresponding value.
 	d.Version = body.Meta.Version
+	d.FolderUID = body.Meta.FolderUID
 	d.RawJSON = body.Dashboard
 
 	// Define the dashboard's name from the previously extracted JSON description
@@ -126,35 +179,132 @@ func GetSluglikeName(UID, Title string) string {
 	return UID + ":" + replacementForSlug.ReplaceAllString(Title, "_")
 }
 
+// dashboardFilename returns the name, without its extension, of the file of
+// the given dashboard, in the folder with the given title, generated from the
+// client's filename template. The default scheme, GetSluglikeName, is used if
+// there's no template, or if the template doesn't give a file name for this
+// dashboard.
+func (c *Client) dashboardFilename(db DbSearchResponse, folderTitle string) string {
+	if c.FilenameTemplate == nil {
+		return GetSluglikeName(db.UID, db.Title)
+	}
+
+	name := new(bytes.Buffer)
+	err := c.FilenameTemplate.Execute(name, config.FilenameFields{
+		UID:         db.UID,
+		Title:       replacementForSlug.ReplaceAllString(db.Title, "_"),
+		FolderTitle: replacementForSlug.ReplaceAllString(folderTitle, "_"),
+	})
+	if err == nil && name.Len() > 0 && !strings.ContainsAny(name.String(), `/\`) {
+		return name.String()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"error": err,
+		"uid":   db.UID,
+		"title": db.Title,
+		"name":  name.String(),
+	}).Warn("The filename template doesn't give a file name for the dashboard, using the default one")
+	return GetSluglikeName(db.UID, db.Title)
+}
+
+// disambiguateSlug returns the given slug-like name of the given dashboard,
+// which is also the name of its file in the repository, generated by
+// dashboardFilename. If another dashboard from the
+// given map of taken slugs already uses it (case-insensitively, since the
+// repository may be cloned on a case-insensitive file system), e.g. because
+// their titles only differ by characters replaced in the slug, the slug is
+// suffixed with a short hash of the dashboard's UID and title, so one file
+// doesn't overwrite the other. The slug is then recorded as taken. The
+// disambiguated slug is the key of the dashboard's metadata in the versions
+// file, which keeps the link between the file and the dashboard.
+func disambiguateSlug(db DbSearchResponse, base string, taken map[string]DbSearchResponse) (slug string) {
+	slug = base
+
+	for attempt := 0; ; attempt++ {
+		other, collides := taken[strings.ToLower(slug)]
+		if !collides {
+			break
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"slug":        slug,
+			"uid":         db.UID,
+			"title":       db.Title,
+			"other_uid":   other.UID,
+			"other_title": other.Title,
+		}).Warn("Dashboard slug collides with another dashboard's, disambiguating it")
+
+		// Identical UIDs and titles only differ by the instance-specific ID.
+		seed := db.UID + "/" + db.Title
+		if attempt > 0 {
+			seed += "/" + strconv.Itoa(db.ID) + "/" + strconv.Itoa(attempt)
+		}
+		sum := sha1.Sum([]byte(seed))
+		slug = base + "-" + hex.EncodeToString(sum[:])[:8]
+	}
+
+	taken[strings.ToLower(slug)] = db
+	return
+}
+
 // GetDashboardsURIs requests the Grafana API for the list of all dashboards,
 // then returns the dashboards' URIs. An URI will look like "uid/[UID]".
 // Returns an error if there was an issue requesting the URIs or parsing the
 // response body.
-func (c *Client) GetDashboardsURIs() (dashboardMetaBySlug map[string]DbSearchResponse, FoldersMetaByUID map[string]DbSearchResponse, Folders []DbSearchResponse, err error) {
+func (c *Client) GetDashboardsURIs(ctx context.Context) (dashboardMetaBySlug map[string]DbSearchResponse, FoldersMetaByUID map[string]DbSearchResponse, Folders []DbSearchResponse, err error) {
 
 	FoldersMetaByUID = make(map[string]DbSearchResponse, 0)
 	dashboardMetaBySlug = make(map[string]DbSearchResponse, 0)
 
-	resp, err := c.request("GET", "search", nil)
-	if err != nil {
-		return
+	// The apiserver-style API only lists dashboards, so the folders are still
+	// retrieved with a search.
+	backend := c.dashboardsBackend(ctx)
+	query := url.Values{}
+	_, isLegacy := backend.(*legacyBackend)
+	if !isLegacy {
+		query.Set("type", "dash-folder")
 	}
 
-	var respBody []DbSearchResponse
-
-	if err = json.Unmarshal(resp, &respBody); err != nil {
+	respBody, err := c.search(ctx, query)
+	if err != nil {
 		return
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"json": string(resp),
-	}).Debug("JSON")
+	if !isLegacy {
+		var dashboards []DbSearchResponse
+		if dashboards, err = backend.listDashboards(ctx); err != nil {
+			return
+		}
+		respBody = append(respBody, dashboards...)
+	}
 
 	Folders = make([]DbSearchResponse, 0)
 
+	// Process the dashboards in a stable order, so colliding slugs are always
+	// disambiguated the same way.
+	sort.SliceStable(respBody, func(i, j int) bool {
+		if respBody[i].UID != respBody[j].UID {
+			return respBody[i].UID < respBody[j].UID
+		}
+		if respBody[i].Title != respBody[j].Title {
+			return respBody[i].Title < respBody[j].Title
+		}
+		return respBody[i].ID < respBody[j].ID
+	})
+
+	// The folders' titles may be part of the dashboards' file names.
+	folderTitles := map[string]string{"": config.GeneralFolder}
+	for _, db := range respBody {
+		if db.Type == "dash-folder" {
+			folderTitles[db.UID] = db.Title
+		}
+	}
+
+	takenSlugs := make(map[string]DbSearchResponse)
 	for _, db := range respBody {
-		slug := GetSluglikeName(db.UID, db.Title)
 		if db.Type == "dash-db" {
+			slug := disambiguateSlug(db, c.dashboardFilename(db, folderTitles[db.FolderUID]), takenSlugs)
 			dashboardMetaBySlug[slug] = db
 			logrus.WithFields(logrus.Fields{
 				"db": db,
@@ -174,25 +324,192 @@ func (c *Client) GetDashboardsURIs() (dashboardMetaBySlug map[string]DbSearchRes
 	return
 }
 
+// searchPageLimit is the number of results requested per page of a search.
+// Grafana caps it to 5000, and returns 1000 results when it isn't set.
+const searchPageLimit = 1000
+
+// search requests the Grafana API for all the results of the search described
+// by the given query, requesting one page after the other until a page isn't
+// full.
+// Returns an error if there was an issue requesting a page or parsing the
+// response body.
+func (c *Client) search(ctx context.Context, query url.Values) (results []DbSearchResponse, err error) {
+	results = make([]DbSearchResponse, 0)
+	query.Set("limit", strconv.Itoa(searchPageLimit))
+
+	var firstUID string
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var resp []byte
+		if resp, err = c.request(ctx, "GET", "search?"+query.Encode(), nil); err != nil {
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"json": string(resp),
+			"page": page,
+		}).Debug("JSON")
+
+		var pageResults []DbSearchResponse
+		if err = json.Unmarshal(resp, &pageResults); err != nil {
+			return
+		}
+		var updates []struct {
+			Updated string `json:"updated"`
+		}
+		if err = json.Unmarshal(resp, &updates); err != nil {
+			return
+		}
+		for i := range pageResults {
+			pageResults[i].Updated = updates[i].Updated
+		}
+		if len(pageResults) == 0 {
+			return
+		}
+
+		// Grafana versions which don't support pagination return the first
+		// page again.
+		if page == 1 {
+			firstUID = pageResults[0].UID
+		} else if pageResults[0].UID == firstUID {
+			logrus.WithFields(logrus.Fields{
+				"page": page,
+			}).Warn("The Grafana API ignored the search page, some results may be missing")
+			return
+		}
+
+		results = append(results, pageResults...)
+		if len(pageResults) < searchPageLimit {
+			return
+		}
+	}
+}
+
 // GetDashboard requests the Grafana API for a dashboard identified by a given
 // URI (using the same format as GetDashboardsURIs).
 // Returns the dashboard as an instance of the Dashboard structure.
 // Returns an error if there was an issue requesting the dashboard or parsing
 // the response body.
-func (c *Client) GetDashboard(URI string) (db *Dashboard, err error) {
-	body, err := c.request("GET", "dashboards/"+URI, nil)
+func (c *Client) GetDashboard(ctx context.Context, URI string) (db *Dashboard, err error) {
+	if db, err = c.GetRawDashboard(ctx, URI); err != nil {
+		return
+	}
+
+	db.RawJSON = NormalizeDashboardJSON(db.RawJSON)
+	return
+}
+
+// DashboardVersionInfo describes a version of a dashboard, as listed by
+// Grafana, without the dashboard's JSON description.
+type DashboardVersionInfo struct {
+	ID        int       `json:"id"`
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy"`
+	Message   string    `json:"message"`
+}
+
+// dashboardVersionsResponse represents the response to a request for the
+// versions of a dashboard. Grafana 11 wraps the versions in an object, the
+// older versions return them as an array.
+type dashboardVersionsResponse struct {
+	Versions []DashboardVersionInfo `json:"versions"`
+}
+
+// GetDashboardVersions requests the Grafana API for the latest versions of the
+// dashboard with the given UID, up to the given number of versions, latest
+// first.
+// Returns an error if there was an issue requesting the versions or parsing
+// the response body.
+func (c *Client) GetDashboardVersions(ctx context.Context, uid string, limit int) (versions []DashboardVersionInfo, err error) {
+	body, err := c.request(ctx, "GET", "dashboards/uid/"+url.PathEscape(uid)+"/versions?limit="+strconv.Itoa(limit), nil)
+	if err != nil {
+		return
+	}
+
+	var resp dashboardVersionsResponse
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &resp.Versions)
+	} else {
+		err = json.Unmarshal(body, &resp)
+	}
+	return resp.Versions, err
+}
+
+// GetDashboardLatestVersion requests the Grafana API for the version of the
+// dashboard with the given UID, without its JSON description.
+// Returns an error if there was an issue requesting the versions or parsing
+// the response body, or if the dashboard has no version.
+func (c *Client) GetDashboardLatestVersion(ctx context.Context, uid string) (version int, err error) {
+	versions, err := c.GetDashboardVersions(ctx, uid, 1)
+	if err != nil {
+		return
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("The dashboard %s has no version", uid)
+	}
+	return versions[0].Version, nil
+}
+
+// GetDashboardAtVersion requests the Grafana API for the given version of the
+// dashboard with the given UID, as listed by GetDashboardVersions. Grafana 11
+// identifies the version by its number, the older versions by its ID.
+// Returns the dashboard as it was at this version, normalised like
+// GetDashboard does.
+// Returns an error if there was an issue requesting the version or parsing
+// the response body.
+func (c *Client) GetDashboardAtVersion(ctx context.Context, uid string, version DashboardVersionInfo) (db *Dashboard, err error) {
+	id := version.ID
+	if grafanaVersion, known := c.Version(ctx); known && grafanaVersion.AtLeast(11, 0) {
+		id = version.Version
+	}
+	body, err := c.request(ctx, "GET", "dashboards/uid/"+url.PathEscape(uid)+"/versions/"+strconv.Itoa(id), nil)
 	if err != nil {
 		return
 	}
 
-	db = new(Dashboard)
-	err = json.Unmarshal(body, db)
-	dashRaw := string(db.RawJSON)
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("Grafana returned no content for the version %d of the dashboard %s", version.Version, uid)
+	}
+
+	db = &Dashboard{RawJSON: NormalizeDashboardJSON(resp.Data), Version: version.Version}
+	db.UID, db.Name, err = UIDNameFromRawJSON(db.RawJSON)
+	return
+}
+
+// GetRawDashboard retrieves a dashboard like GetDashboard does, but leaves its
+// JSON description as the Grafana API returned it.
+// Returns an error if there was an issue requesting the dashboard or parsing
+// the response body.
+func (c *Client) GetRawDashboard(ctx context.Context, URI string) (db *Dashboard, err error) {
+	if uid := strings.TrimPrefix(URI, "uid/"); uid != URI {
+		db, err = c.dashboardsBackend(ctx).getDashboard(ctx, uid)
+	} else {
+		var body []byte
+		if body, err = c.request(ctx, "GET", "dashboards/"+URI, nil); err == nil {
+			db = new(Dashboard)
+			err = json.Unmarshal(body, db)
+		}
+	}
+	return
+}
+
+// NormalizeDashboardJSON removes from a dashboard's JSON description the
+// metadata which changes without the dashboard itself changing, such as the
+// versions and timestamps of the library panels it uses.
+func NormalizeDashboardJSON(raw []byte) []byte {
+	dashRaw := string(raw)
 	result := gjson.Get(dashRaw, "panels")
 	changed := false
 	for i, _ := range result.Array() {
 		dashRaw, _ = sjson.Delete(dashRaw, "panels."+strconv.Itoa(i)+".libraryPanel.version")
-		if dashRaw != string(db.RawJSON) {
+		if dashRaw != string(raw) {
 			changed = true
 			dashRaw, _ = sjson.Delete(dashRaw, "panels."+strconv.Itoa(i)+".libraryPanel.meta.created")
 			dashRaw, _ = sjson.Delete(dashRaw, "panels."+strconv.Itoa(i)+".libraryPanel.meta.createdBy")
@@ -204,14 +521,12 @@ func (c *Client) GetDashboard(URI string) (db *Dashboard, err error) {
 	dashRaw, _ = sjson.Delete(dashRaw, "meta.updated")
 	if changed {
 		var m interface{}
-		err = json.Unmarshal([]byte(dashRaw), &m)
+		json.Unmarshal([]byte(dashRaw), &m)
 		prettyStr, _ := json.MarshalIndent(m, "", "  ")
 		logrus.Debugf("rawJSON dashboard %v", string(prettyStr))
 	}
 
-	db.RawJSON = []byte(dashRaw)
-
-	return
+	return []byte(dashRaw)
 }
 
 // CreateOrUpdateDashboard takes a given JSON content (as []byte) and create the
@@ -221,12 +536,21 @@ func (c *Client) GetDashboard(URI string) (db *Dashboard, err error) {
 // creation, else it's an update.
 // Returns an error if there was an issue generating the request body, performing
 // the request or decoding the response's body.
-func (c *Client) CreateOrUpdateDashboard(contentJSON []byte, folderUID string) (err error) {
+func (c *Client) CreateOrUpdateDashboard(ctx context.Context, contentJSON []byte, folderUID string) (err error) {
+	return c.dashboardsBackend(ctx).saveDashboard(ctx, contentJSON, folderUID)
+}
+
+// createOrUpdateDashboardLegacy creates or updates a dashboard using the
+// /api/dashboards/db route.
+func (c *Client) createOrUpdateDashboardLegacy(ctx context.Context, contentJSON []byte, folderUID string) (err error) {
 	reqBody := dbCreateOrUpdateRequest{
 		Dashboard: rawJSON(contentJSON),
 		Overwrite: true,
 		FolderUID: folderUID,
 	}
+	if reqBody.FolderID, err = c.legacyFolderID(ctx, folderUID); err != nil {
+		return
+	}
 
 	// Generate the request body's JSON
 	reqBodyJSON, err := json.Marshal(reqBody)
@@ -239,7 +563,9 @@ func (c *Client) CreateOrUpdateDashboard(contentJSON []byte, folderUID string) (
 
 	err2 := dyno.Set(v, nil, "dashboard", "id")
 	idv, err3 := dyno.Get(v, "dashboard", "id")
-	dyno.Delete(v, "__folderUID")
+	// The folder is given in the request.
+	dyno.Delete(v, format.FolderUIDKey, "dashboard")
+	dyno.Delete(v, format.FolderKey, "dashboard")
 
 	reqBodyJSON, err = json.Marshal(v)
 	logrus.WithFields(logrus.Fields{
@@ -252,21 +578,21 @@ func (c *Client) CreateOrUpdateDashboard(contentJSON []byte, folderUID string) (
 	if err != nil {
 		return
 	}
-	err = c.createOrUpdateDashboardFolder(reqBodyJSON, contentJSON, "dashboards/db")
+	err = c.createOrUpdateDashboardFolder(ctx, reqBodyJSON, contentJSON, "dashboards/db")
 	return
 }
 
-func (c *Client) createOrUpdateDashboardFolder(reqBodyJSON []byte, contentJSON []byte, apiPath string) (err error) {
-	err = c.createOrUpdateDashboardFolderMethod(reqBodyJSON, contentJSON, apiPath, "POST")
+func (c *Client) createOrUpdateDashboardFolder(ctx context.Context, reqBodyJSON []byte, contentJSON []byte, apiPath string) (err error) {
+	err = c.createOrUpdateDashboardFolderMethod(ctx, reqBodyJSON, contentJSON, apiPath, "POST")
 	return
 }
 
-func (c *Client) createOrUpdateDashboardFolderMethod(reqBodyJSON []byte, contentJSON []byte, apiPath string, method string) (err error) {
+func (c *Client) createOrUpdateDashboardFolderMethod(ctx context.Context, reqBodyJSON []byte, contentJSON []byte, apiPath string, method string) (err error) {
 
 	var httpError *httpUnknownError
 	var isHttpUnknownError bool
 	// Send the request
-	respBodyJSON, err := c.request(method, apiPath, reqBodyJSON)
+	respBodyJSON, err := c.request(ctx, method, apiPath, reqBodyJSON)
 	if err != nil {
 		// Check the error against the httpUnknownError type in order to decide
 		// how to process the error
@@ -284,11 +610,11 @@ func (c *Client) createOrUpdateDashboardFolderMethod(reqBodyJSON []byte, content
 	}
 
 	if respBody.Status != "success" && isHttpUnknownError {
-		// Get the dashboard/folders's slug for logging
-		var slug string
-		slug, err = helpers.GetSlug(contentJSON)
-		if err != nil {
-			return
+		// Get the dashboard/folders's slug for logging, without hiding the
+		// HTTP error if it can't be computed.
+		slug, slugErr := helpers.GetSlug(contentJSON)
+		if slugErr != nil {
+			slug = "(" + slugErr.Error() + ")"
 		}
 
 		return fmt.Errorf(
@@ -301,9 +627,23 @@ func (c *Client) createOrUpdateDashboardFolderMethod(reqBodyJSON []byte, content
 }
 
 // DeleteDashboard deletes the dashboard identified by a given slug on the
-// Grafana API.
+// Grafana API. Grafana removed this route in v8, so it's only used for the
+// dashboards which don't have a UID; see DeleteDashboardByUID.
 // Returns an error if the process failed.
-func (c *Client) DeleteDashboard(slug string) (err error) {
-	_, err = c.request("DELETE", "dashboards/db/"+slug, nil)
+func (c *Client) DeleteDashboard(ctx context.Context, slug string) (err error) {
+	if slug == "" {
+		return errEmptyIdentifier
+	}
+	_, err = c.request(ctx, "DELETE", "dashboards/db/"+slug, nil)
 	return
 }
+
+// DeleteDashboardByUID deletes the dashboard identified by a given UID on the
+// Grafana API, using the dashboards API selected for the instance.
+// Returns an error if the process failed.
+func (c *Client) DeleteDashboardByUID(ctx context.Context, uid string) (err error) {
+	if uid == "" {
+		return errEmptyIdentifier
+	}
+	return c.dashboardsBackend(ctx).deleteDashboard(ctx, uid)
+}
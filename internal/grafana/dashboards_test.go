@@ -0,0 +1,123 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeSearch fakes the search API of a Grafana instance holding the given
+// numbers of dashboards and folders, paginating the results like Grafana, or
+// returning the first page whichever the page asked for if ignorePage is set,
+// like the versions which don't paginate. It counts the pages requested.
+type fakeSearch struct {
+	dashboards int
+	folders    int
+	ignorePage bool
+
+	lock  sync.Mutex
+	pages int
+}
+
+func (f *fakeSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/search" {
+		http.NotFound(w, r)
+		return
+	}
+	f.lock.Lock()
+	f.pages++
+	f.lock.Unlock()
+
+	hits := make([]DbSearchResponse, 0)
+	for i := 0; i < f.folders; i++ {
+		hits = append(hits, DbSearchResponse{ID: i + 1, UID: fmt.Sprintf("folder-%04d", i), Title: fmt.Sprintf("Folder %d", i), Type: "dash-folder"})
+	}
+	for i := 0; i < f.dashboards; i++ {
+		hits = append(hits, DbSearchResponse{ID: f.folders + i + 1, UID: fmt.Sprintf("db-%04d", i), Title: fmt.Sprintf("Dashboard %d", i), Type: "dash-db"})
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if limit <= 0 || limit > 5000 {
+		limit = 1000
+	}
+	if page < 1 || f.ignorePage {
+		page = 1
+	}
+	start, end := (page-1)*limit, page*limit
+	if start > len(hits) {
+		start = len(hits)
+	}
+	if end > len(hits) {
+		end = len(hits)
+	}
+	json.NewEncoder(w).Encode(hits[start:end])
+}
+
+func TestGetDashboardsURIsPaginates(t *testing.T) {
+	fake := &fakeSearch{dashboards: 2500, folders: 20}
+	client := newTestClient(t, fake)
+
+	dashboards, foldersByID, folders, err := client.GetDashboardsURIs(context.Background())
+	if err != nil {
+		t.Fatalf("GetDashboardsURIs: %v", err)
+	}
+	if len(dashboards) != 2500 {
+		t.Errorf("got %d dashboards, want 2500", len(dashboards))
+	}
+	if len(folders) != 20 || len(foldersByID) != 20 {
+		t.Errorf("got %d folders (%d by ID), want 20", len(folders), len(foldersByID))
+	}
+
+	uids := make(map[string]bool)
+	for _, db := range dashboards {
+		uids[db.UID] = true
+	}
+	for i := 0; i < 2500; i++ {
+		if uid := fmt.Sprintf("db-%04d", i); !uids[uid] {
+			t.Errorf("dashboard %s dropped", uid)
+		}
+	}
+	// 2520 results take 3 pages, the last one not being full.
+	if fake.pages != 3 {
+		t.Errorf("requested %d pages, want 3", fake.pages)
+	}
+}
+
+// A full last page is followed by an empty one.
+func TestGetDashboardsURIsFullLastPage(t *testing.T) {
+	fake := &fakeSearch{dashboards: 2000}
+	client := newTestClient(t, fake)
+
+	dashboards, _, _, err := client.GetDashboardsURIs(context.Background())
+	if err != nil {
+		t.Fatalf("GetDashboardsURIs: %v", err)
+	}
+	if len(dashboards) != 2000 {
+		t.Errorf("got %d dashboards, want 2000", len(dashboards))
+	}
+	if fake.pages != 3 {
+		t.Errorf("requested %d pages, want 3", fake.pages)
+	}
+}
+
+// An instance ignoring the page parameter doesn't loop forever.
+func TestGetDashboardsURIsIgnoredPage(t *testing.T) {
+	fake := &fakeSearch{dashboards: 1500, ignorePage: true}
+	client := newTestClient(t, fake)
+
+	dashboards, _, _, err := client.GetDashboardsURIs(context.Background())
+	if err != nil {
+		t.Fatalf("GetDashboardsURIs: %v", err)
+	}
+	if len(dashboards) != 1000 {
+		t.Errorf("got %d dashboards, want the 1000 of the first page", len(dashboards))
+	}
+	if fake.pages != 2 {
+		t.Errorf("requested %d pages, want 2", fake.pages)
+	}
+}
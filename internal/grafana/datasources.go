@@ -0,0 +1,398 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+	"github.com/sirupsen/logrus"
+)
+
+// variableReference matches the template variable references Grafana
+// interpolates, such as "${DS}", "$DS" or the deprecated "[[DS]]".
+var variableReference = regexp.MustCompile(`\$\{[^}]+\}|\$\w+|\[\[[^\]]+\]\]`)
+
+// builtinDatasources are the UIDs and names of the datasources every Grafana
+// instance provides.
+var builtinDatasources = map[string]bool{
+	"grafana":         true,
+	"-- Grafana --":   true,
+	"-- Mixed --":     true,
+	"-- Dashboard --": true,
+	"dashboard":       true,
+}
+
+// datasourceResponse represents an element of the response to a datasources
+// listing query. All fields described from the Grafana documentation aren't
+// located in this structure because there are some we don't need.
+type datasourceResponse struct {
+	UID       string `json:"uid"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	IsDefault bool   `json:"isDefault"`
+}
+
+// getDatasources requests the Grafana API for the list of all datasources.
+// Returns an error if there was an issue requesting the datasources or parsing
+// the response body.
+func (c *Client) getDatasources(ctx context.Context) (datasources []datasourceResponse, err error) {
+	body, err := c.request(ctx, "GET", "datasources", nil)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(body, &datasources)
+	return
+}
+
+// pickDatasource returns the default datasource of the given type if there's
+// one, else the first one by name.
+func pickDatasource(datasources []datasourceResponse, dsType string) (ds datasourceResponse, found bool) {
+	candidates := make([]datasourceResponse, 0)
+	for _, candidate := range datasources {
+		if candidate.Type != dsType {
+			continue
+		}
+		if candidate.IsDefault {
+			return candidate, true
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0], true
+}
+
+// IsVariableReference returns true if the given datasource reference is a
+// template variable reference, which is resolved by Grafana when rendering
+// the dashboard and must therefore be left untouched.
+func IsVariableReference(ref string) bool {
+	return variableReference.MatchString(ref)
+}
+
+// DatasourceRequirements lists the datasources a dashboard needs to render:
+// the types of datasources (e.g. "prometheus") required by its datasource
+// template variables and by the panels, targets and annotations giving a
+// datasource type, and the datasources (by UID or name) they reference
+// directly. References to template variables and to the built-in datasources
+// aren't requirements.
+// Returns an error if the dashboard's JSON description couldn't be parsed.
+func DatasourceRequirements(content []byte) (types []string, refs []string, err error) {
+	var dashboard map[string]interface{}
+	if err = json.Unmarshal(content, &dashboard); err != nil {
+		return
+	}
+	// The inputs of dashboards exported for sharing describe datasources to
+	// choose, not references.
+	delete(dashboard, "__inputs")
+	delete(dashboard, "__requires")
+
+	typeSet := make(map[string]bool)
+	refSet := make(map[string]bool)
+
+	// Datasource variables list the datasources of a given type.
+	if templating, ok := dashboard["templating"].(map[string]interface{}); ok {
+		list, _ := templating["list"].([]interface{})
+		for _, item := range list {
+			variable, ok := item.(map[string]interface{})
+			if !ok || variable["type"] != "datasource" {
+				continue
+			}
+			if query, ok := variable["query"].(string); ok && query != "" && !IsVariableReference(query) {
+				typeSet[query] = true
+			}
+		}
+	}
+
+	collectDatasourceReferences(dashboard, typeSet, refSet)
+
+	return utils.SortedKeys(typeSet), utils.SortedKeys(refSet), nil
+}
+
+// LibraryDatasourceRequirements lists the datasources a library panel needs to
+// render, from the datasources its panel model and the model's targets give,
+// the same way DatasourceRequirements does for dashboards.
+// Returns an error if the library panel's JSON description couldn't be parsed.
+func LibraryDatasourceRequirements(content []byte) (types []string, refs []string, err error) {
+	var library struct {
+		Model interface{} `json:"model"`
+	}
+	if err = json.Unmarshal(content, &library); err != nil {
+		return
+	}
+
+	typeSet := make(map[string]bool)
+	refSet := make(map[string]bool)
+	collectDatasourceReferences(library.Model, typeSet, refSet)
+
+	return utils.SortedKeys(typeSet), utils.SortedKeys(refSet), nil
+}
+
+// collectDatasourceReferences walks a JSON description, such as a dashboard's
+// or a panel model, and records the types and references of the datasources
+// found under "datasource" keys, including the ones of nested panels and
+// targets.
+func collectDatasourceReferences(node interface{}, types map[string]bool, refs map[string]bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if key != "datasource" {
+				collectDatasourceReferences(child, types, refs)
+				continue
+			}
+
+			switch ds := child.(type) {
+			case string:
+				// Datasource referenced by name, in older dashboards.
+				if ds != "" && !IsVariableReference(ds) && !builtinDatasources[ds] {
+					refs[ds] = true
+				}
+			case map[string]interface{}:
+				dsType, _ := ds["type"].(string)
+				uid, _ := ds["uid"].(string)
+				if dsType == "datasource" || dsType == "grafana" || builtinDatasources[uid] {
+					continue
+				}
+				if dsType != "" && !IsVariableReference(dsType) {
+					types[dsType] = true
+				}
+				if uid != "" && !IsVariableReference(uid) {
+					refs[uid] = true
+				}
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			collectDatasourceReferences(child, types, refs)
+		}
+	}
+}
+
+// UnmetDatasourceRequirements checks the datasource requirements of a
+// dashboard (see DatasourceRequirements) against the given datasources.
+// Returns a description of each requirement no datasource meets.
+// Returns an error if the dashboard's JSON description couldn't be parsed.
+func UnmetDatasourceRequirements(content []byte, datasources []datasourceResponse) (unmet []string, err error) {
+	types, refs, err := DatasourceRequirements(content)
+	if err != nil {
+		return
+	}
+
+	return unmetRequirements(types, refs, datasources), nil
+}
+
+// unmetRequirements checks the given datasource types and references against
+// the given datasources.
+// Returns a description of each requirement no datasource meets.
+func unmetRequirements(types []string, refs []string, datasources []datasourceResponse) (unmet []string) {
+	availableTypes := make(map[string]bool)
+	availableRefs := make(map[string]bool)
+	for _, ds := range datasources {
+		availableTypes[ds.Type] = true
+		availableRefs[ds.UID] = true
+		availableRefs[ds.Name] = true
+	}
+
+	for _, dsType := range types {
+		if !availableTypes[dsType] {
+			unmet = append(unmet, "no datasource of type "+dsType)
+		}
+	}
+	for _, ref := range refs {
+		if !availableRefs[ref] {
+			unmet = append(unmet, "no datasource with the UID or name "+ref)
+		}
+	}
+	return
+}
+
+// datasourceChecker checks the datasource requirements of the dashboards and
+// library panels pushed to a Grafana instance, requesting its datasources
+// once.
+type datasourceChecker struct {
+	c           *Client
+	datasources []datasourceResponse
+	loaded      bool
+	loadErr     error
+}
+
+// list returns the datasources of the Grafana instance, requesting them on the
+// first call.
+// Returns an error if the datasources couldn't be requested.
+func (d *datasourceChecker) list(ctx context.Context) ([]datasourceResponse, error) {
+	if !d.loaded {
+		d.datasources, d.loadErr = d.c.getDatasources(ctx)
+		d.loaded = true
+	}
+	return d.datasources, d.loadErr
+}
+
+// unmet returns the given datasource requirements which the Grafana instance
+// doesn't meet, as a single description.
+// Returns an error if the datasources couldn't be requested.
+func (d *datasourceChecker) unmet(ctx context.Context, types []string, refs []string) (unmet string, err error) {
+	datasources, err := d.list(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	requirements := unmetRequirements(types, refs, datasources)
+	sort.Strings(requirements)
+	return strings.Join(requirements, ", "), nil
+}
+
+// datasourceInstanceKeys are the keys of a datasource's description which are
+// specific to a Grafana instance, or hold its secrets, and are never written
+// to nor pushed from the repository. Grafana never returns the secrets
+// themselves, only the names of the secret fields which are set.
+var datasourceInstanceKeys = []string{"id", "orgId", "version", "readOnly", "secureJsonData", "secureJsonFields"}
+
+// DatasourceSecureFieldsKey is the key under which the names of the secret
+// fields set on a datasource are kept in its file, so they can be set by hand
+// on an instance the datasource is created on.
+const DatasourceSecureFieldsKey = format.SecureJSONFieldsKey
+
+// errNoDatasourceUID is returned when pushing a datasource which description
+// has no UID, since it couldn't be told apart from the other ones.
+var errNoDatasourceUID = errors.New("The datasource has no UID")
+
+// Datasource represents a datasource retrieved from the Grafana API.
+type Datasource struct {
+	UID     string
+	Name    string
+	Type    string
+	Version int
+	// ReadOnly is true for provisioned datasources, which can't be changed
+	// through the API.
+	ReadOnly bool
+	// SecureFields lists the names of the secret fields set on the
+	// datasource.
+	SecureFields []string
+	// RawJSON is the datasource's description, with the keys specific to
+	// the instance removed.
+	RawJSON []byte
+}
+
+// GetDatasources requests the Grafana API for the full description of every
+// datasource.
+// Returns an error if there was an issue requesting the datasources or parsing
+// the response bodies.
+func (c *Client) GetDatasources(ctx context.Context) (datasources []*Datasource, err error) {
+	list, err := c.getDatasources(ctx)
+	if err != nil {
+		return
+	}
+
+	datasources = make([]*Datasource, 0, len(list))
+	for _, item := range list {
+		var body []byte
+		if body, err = c.request(ctx, "GET", "datasources/uid/"+url.PathEscape(item.UID), nil); err != nil {
+			return
+		}
+
+		var ds *Datasource
+		if ds, err = parseDatasource(body); err != nil {
+			return
+		}
+		datasources = append(datasources, ds)
+	}
+	return
+}
+
+// parseDatasource parses a datasource's description as returned by the
+// Grafana API.
+// Returns an error if the description couldn't be parsed.
+func parseDatasource(body []byte) (ds *Datasource, err error) {
+	var description map[string]interface{}
+	if err = json.Unmarshal(body, &description); err != nil {
+		return
+	}
+
+	var meta struct {
+		UID              string          `json:"uid"`
+		Name             string          `json:"name"`
+		Type             string          `json:"type"`
+		Version          int             `json:"version"`
+		ReadOnly         bool            `json:"readOnly"`
+		SecureJSONFields map[string]bool `json:"secureJsonFields"`
+	}
+	if err = json.Unmarshal(body, &meta); err != nil {
+		return
+	}
+
+	ds = &Datasource{
+		UID:      meta.UID,
+		Name:     meta.Name,
+		Type:     meta.Type,
+		Version:  meta.Version,
+		ReadOnly: meta.ReadOnly,
+	}
+	for field, set := range meta.SecureJSONFields {
+		if set {
+			ds.SecureFields = append(ds.SecureFields, field)
+		}
+	}
+	sort.Strings(ds.SecureFields)
+
+	for _, key := range datasourceInstanceKeys {
+		delete(description, key)
+	}
+	ds.RawJSON, err = json.Marshal(description)
+	return
+}
+
+// CreateOrUpdateDatasource takes a given JSON content (as []byte) and creates
+// the datasource if it doesn't exist on the Grafana instance, else updates the
+// existing one, identified by its UID. The secrets are never sent, so the
+// ones set on the instance are kept, and have to be set by hand on the
+// datasources created.
+// Returns an error if the content has no UID, or if there was an issue
+// generating the request body or performing the requests.
+func (c *Client) CreateOrUpdateDatasource(ctx context.Context, contentJSON []byte) (err error) {
+	var description map[string]interface{}
+	if err = json.Unmarshal(contentJSON, &description); err != nil {
+		return
+	}
+
+	uid, _ := description["uid"].(string)
+	if len(uid) == 0 {
+		return errNoDatasourceUID
+	}
+	secureFields := description[DatasourceSecureFieldsKey]
+
+	for _, key := range append(datasourceInstanceKeys, DatasourceSecureFieldsKey) {
+		delete(description, key)
+	}
+	reqBody, err := json.Marshal(description)
+	if err != nil {
+		return
+	}
+
+	_, err = c.request(ctx, "GET", "datasources/uid/"+url.PathEscape(uid), nil)
+	if isNotFound(err) {
+		if _, err = c.request(ctx, "POST", "datasources", reqBody); err == nil && secureFields != nil {
+			logrus.WithFields(logrus.Fields{
+				"uid":           uid,
+				"secure_fields": secureFields,
+			}).Warn("Created a datasource which secrets have to be set on the Grafana instance")
+		}
+		return
+	} else if err != nil {
+		return
+	}
+
+	_, err = c.request(ctx, "PUT", "datasources/uid/"+url.PathEscape(uid), reqBody)
+	return
+}
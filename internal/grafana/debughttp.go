@@ -0,0 +1,151 @@
+package grafana
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDebugHTTPMaxBody is the default size, in bytes, above which the
+// bodies written by DebugHTTP are truncated.
+const DefaultDebugHTTPMaxBody = 64 * 1024
+
+// debugHTTPRedactedHeaders are the headers never written by DebugHTTP, since
+// they hold credentials.
+var debugHTTPRedactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// debugHTTPUnsafeChars matches the characters replaced in the names of the
+// files written by DebugHTTP.
+var debugHTTPUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// debugTransport writes each request sent through it, along with its
+// response, to a numbered file.
+type debugTransport struct {
+	base    http.RoundTripper
+	dir     string
+	maxBody int
+	count   int64
+}
+
+// DebugHTTP makes the client write each request it sends to Grafana and the
+// response it gets, with their headers except the credentials and their bodies
+// truncated to the given size (DefaultDebugHTTPMaxBody if it isn't positive),
+// to a numbered file in the given directory. It applies to the clients of all
+// the organisations created from this one afterwards.
+// Returns an error if the directory couldn't be created.
+func (c *Client) DebugHTTP(dir string, maxBody int) (err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultDebugHTTPMaxBody
+	}
+
+	c.httpClient.Transport = &debugTransport{
+		base:    c.httpClient.Transport,
+		dir:     dir,
+		maxBody: maxBody,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dir": dir,
+	}).Warn("Writing the requests to Grafana and their responses to files")
+	return
+}
+
+// RoundTrip implements http.RoundTripper. Failing to write the file doesn't
+// fail the request, the error is only logged.
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddInt64(&t.count, 1)
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		// A RoundTripper mustn't modify the request it's given.
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	dump := new(bytes.Buffer)
+	fmt.Fprintf(dump, "%s %s\n", req.Method, req.URL.String())
+	t.writeHeaders(dump, req.Header)
+	t.writeBody(dump, reqBody)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(dump, "\nerror: %v\n", err)
+	} else {
+		var respBody []byte
+		respBody, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		fmt.Fprintf(dump, "\n%s %s\n", resp.Proto, resp.Status)
+		t.writeHeaders(dump, resp.Header)
+		t.writeBody(dump, respBody)
+		if err != nil {
+			fmt.Fprintf(dump, "\nerror reading the body: %v\n", err)
+			err = nil
+		}
+	}
+
+	name := fmt.Sprintf("%05d-%s-%s.txt", n, req.Method, debugHTTPUnsafeChars.ReplaceAllString(strings.Trim(req.URL.Path, "/"), "_"))
+	if writeErr := os.WriteFile(filepath.Join(t.dir, name), dump.Bytes(), 0600); writeErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": writeErr,
+			"file":  name,
+		}).Warn("Failed to write the request to Grafana")
+	}
+	return resp, err
+}
+
+// writeHeaders writes the given headers, sorted, except the ones holding
+// credentials.
+func (t *debugTransport) writeHeaders(w io.Writer, headers http.Header) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if debugHTTPRedactedHeaders[http.CanonicalHeaderKey(name)] {
+			fmt.Fprintf(w, "%s: <redacted>\n", name)
+			continue
+		}
+		for _, value := range headers[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+}
+
+// writeBody writes the given body, truncated to the transport's maximum size.
+func (t *debugTransport) writeBody(w io.Writer, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	if len(body) > t.maxBody {
+		w.Write(body[:t.maxBody])
+		fmt.Fprintf(w, "\n<truncated, %d bytes in total>\n", len(body))
+		return
+	}
+	w.Write(body)
+	fmt.Fprintln(w)
+}
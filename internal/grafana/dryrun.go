@@ -0,0 +1,167 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errDryRun is returned for the requests which would change something on the
+// Grafana instance, which a dry run never sends.
+var errDryRun = errors.New("not sending a request changing Grafana on a dry run")
+
+// Actions a dry run plans.
+const (
+	dryRunCreate = "create"
+	dryRunUpdate = "update"
+	dryRunDelete = "delete"
+)
+
+// planned records that the operation on the given item wasn't run since it's a
+// dry run, and logs it along with the given fields. The given action is what
+// would be done, e.g. dryRunCreate, and the given target what it would be done
+// in, e.g. a folder, if anything.
+func planned(item *results.ItemResult, action string, target string, fields logrus.Fields) *results.ItemResult {
+	details := "would " + action
+	if target != "" {
+		details += " in " + target
+	}
+	fields["action"] = action
+	fields["filename"] = item.Slug
+	if item.UID != "" {
+		fields["uid"] = item.UID
+	}
+	logrus.WithFields(fields).Info("Dry run: " + details + ", not sending it to Grafana")
+	return item.SkipFor(results.ReasonDryRun, details)
+}
+
+// planPush records what pushing the given item would do, in the given target
+// if any: create or update it, depending on whether it exists on the Grafana
+// instance according to the given lookup. See planned.
+func planPush(
+	ctx context.Context, item *results.ItemResult, target string, fields logrus.Fields,
+	exists func(ctx context.Context, uid string) (bool, error),
+) *results.ItemResult {
+	found, err := exists(ctx, item.UID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"filename": item.Slug,
+		}).Error("Dry run: failed to look the item up on Grafana")
+		return item.Finish(err)
+	}
+	return planned(item, upsertAction(found), target, fields)
+}
+
+// planDelete records that deleting the given item would delete it if it exists
+// on the Grafana instance according to the given lookup, or else skips it as
+// already deleted. See planned.
+func planDelete(
+	ctx context.Context, item *results.ItemResult, fields logrus.Fields,
+	exists func(ctx context.Context, uid string) (bool, error),
+) *results.ItemResult {
+	found, err := exists(ctx, item.UID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"filename": item.Slug,
+		}).Error("Dry run: failed to look the item up on Grafana")
+		return item.Finish(err)
+	}
+	if !found {
+		logrus.WithFields(logrus.Fields{
+			"filename": item.Slug,
+			"uid":      item.UID,
+		}).Info("The item doesn't exist on Grafana anymore")
+		return item.Skip("already deleted")
+	}
+	return planned(item, dryRunDelete, "", fields)
+}
+
+// folderTarget describes the folder with the given UID for the details of a
+// planned item.
+func folderTarget(folderUID string) string {
+	if folderUID == "" {
+		return "the General folder"
+	}
+	return fmt.Sprintf("the folder %s", folderUID)
+}
+
+// upsertAction returns whether pushing an item which exists, or doesn't, on the
+// Grafana instance creates or updates it.
+func upsertAction(exists bool) string {
+	if exists {
+		return dryRunUpdate
+	}
+	return dryRunCreate
+}
+
+// dashboardExists searches the Grafana instance for the dashboard with the
+// given UID. A dashboard without a UID is created.
+// Returns an error if the search failed.
+func (c *Client) dashboardExists(ctx context.Context, uid string) (exists bool, err error) {
+	if uid == "" {
+		return
+	}
+	found, err := c.search(ctx, url.Values{"type": []string{"dash-db"}, "dashboardUIDs": []string{uid}})
+	for _, result := range found {
+		if result.UID == uid {
+			return true, err
+		}
+	}
+	return
+}
+
+// folderExists requests the Grafana instance for the folder with the given
+// UID.
+// Returns an error if the request failed.
+func (c *Client) folderExists(ctx context.Context, uid string) (exists bool, err error) {
+	if uid == "" {
+		return
+	}
+	_, err = c.request(ctx, "GET", "folders/"+url.PathEscape(uid), nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// libraryExists requests the Grafana instance for the library with the given
+// UID.
+// Returns an error if the request failed.
+func (c *Client) libraryExists(ctx context.Context, uid string) (exists bool, err error) {
+	if uid == "" {
+		return
+	}
+	_, err = c.GetLibrary(ctx, url.PathEscape(uid))
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// skipOnDryRun records the given files as not handled, if it's a dry run,
+// which only plans the changes of the folders, dashboards and libraries.
+// Returns the result of each file, and true if they mustn't be handled.
+func (c *Client) skipOnDryRun(kind results.Kind, action results.Action, filenames []string) (run *results.RunResult, skipped bool) {
+	if !c.DryRun {
+		return nil, false
+	}
+
+	run = results.NewRunResult()
+	for _, filename := range filenames {
+		run.Add(results.NewItem(kind, action, "", filename).SkipFor(results.ReasonDryRun, "not planned by the dry run"))
+	}
+	if len(filenames) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"kind":  kind,
+			"files": len(filenames),
+		}).Info("Dry run: not planning these changes, nor sending them to Grafana")
+	}
+	return run, true
+}
@@ -1,7 +1,17 @@
 package grafana
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
 	"github.com/sirupsen/logrus"
 )
 
@@ -11,31 +21,96 @@ type folderCreateOrUpdateRequest struct {
 	Uid       string `json:"uid"`
 	Title     string `json:"title"`
 	Overwrite bool   `json:"overwrite,omitempty"`
+	// ParentUID is the UID of the parent folder, for Grafana versions
+	// supporting nested folders.
+	ParentUID string `json:"parentUid,omitempty"`
+}
+
+// folderMoveRequest represents the request sent to move a folder under
+// another parent, or to the root if the parent is empty.
+type folderMoveRequest struct {
+	ParentUID string `json:"parentUid"`
 }
 
-func (c *Client) CreateFolders(folders []string, contents map[string][]byte) (err error) {
+// folderEntry is a folder file to push, along with its decoded content.
+type folderEntry struct {
+	filename string
+	folder   format.FolderFile
+}
+
+// CreateFolders creates or updates on Grafana the folders described by the
+// given files, then applies the permissions described by the given
+// permissions files.
+// Logs any errors encountered during an iteration, but doesn't return until all
+// folders have been handled. Returns the result for each folder.
+func (c *Client) CreateFolders(ctx context.Context, folders []string, contents map[string][]byte) (run *results.RunResult) {
 	logrus.Info("Create folders")
+	run = results.NewRunResult()
 
+	permissions := make([]string, 0)
+	entries := make([]folderEntry, 0, len(folders))
 	for _, folderName := range folders {
-		var folder Folder
-		err = json.Unmarshal(contents[folderName], &folder)
+		if format.IsPermissionsFile(folderName) {
+			permissions = append(permissions, folderName)
+			continue
+		}
+		var folder format.FolderFile
+		err := json.Unmarshal(contents[folderName], &folder)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":    err,
 				"contents": string(contents[folderName]),
 			}).Info("Unable to unmarshall folder")
 		}
+		entries = append(entries, folderEntry{filename: folderName, folder: folder})
+	}
+
+	// Nested folders can only be created under an existing parent.
+	for _, entry := range sortFoldersParentsFirst(entries) {
+		folder := entry.folder
+		item := results.NewItem(results.KindFolder, results.ActionPush, folder.UID, entry.filename)
 		logrus.WithFields(logrus.Fields{
 			"title": folder.Title,
 			//	"contents": contents,
-			"UID": folder.UID,
+			"UID":    folder.UID,
+			"parent": folder.FolderUID,
 		}).Info("Create folders")
-		err = c.CreateOrUpdateFolder(folder.Title, folder.UID)
+		if c.DryRun {
+			target := ""
+			if folder.FolderUID != "" {
+				target = folderTarget(folder.FolderUID)
+			}
+			run.Add(planPush(ctx, item, target, logrus.Fields{"title": folder.Title}, c.folderExists))
+			continue
+		}
+		err := c.CreateOrUpdateFolder(ctx, folder.Title, folder.UID, folder.FolderUID)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Info("Unable to create folder")
 		}
+		run.Add(item.Finish(err))
+	}
+
+	// The folders exist by now, even if they were just created.
+	for _, filename := range permissions {
+		var perms format.FolderPermissions
+		err := json.Unmarshal(contents[filename], &perms)
+		item := results.NewItem(results.KindFolder, results.ActionPush, perms.FolderUID, filename)
+		if err == nil && c.DryRun {
+			run.Add(planned(item, "apply the permissions", "", logrus.Fields{}))
+			continue
+		}
+		if err == nil {
+			err = c.UpdateFolderPermissions(ctx, perms.FolderUID, perms.Items)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to apply the folder permissions")
+		}
+		run.Add(item.Finish(err))
 	}
 	return
 }
@@ -45,32 +120,338 @@ func (c *Client) CreateFolders(folders []string, contents map[string][]byte) (er
 // existing one. The Grafana API decides whether to create or update based on the
 // "id" attribute in the dashboard's JSON: If it's unkown or null, it's a
 // creation, else it's an update.
+// The folder is created under the folder with the given parent UID, or at the
+// root if it's empty. An existing folder is moved under this parent if it's
+// elsewhere.
 // Returns an error if there was an issue generating the request body, performing
 // the request or decoding the response's body.
-func (c *Client) CreateOrUpdateFolder(title string, uid string) (err error) {
+func (c *Client) CreateOrUpdateFolder(ctx context.Context, title string, uid string, parentUID string) (err error) {
 	reqBody := folderCreateOrUpdateRequest{
 		Title:     title,
 		Uid:       uid,
 		Overwrite: true,
+		ParentUID: parentUID,
 	}
 	// Generate the request body's JSON
 	reqBodyJSON, err := json.Marshal(reqBody)
 	if err != nil {
 		return
 	}
-	err = c.createOrUpdateDashboardFolder(reqBodyJSON, reqBodyJSON, "folders")
+	err = c.createOrUpdateDashboardFolder(ctx, reqBodyJSON, reqBodyJSON, "folders")
 	if err != nil {
 		logrus.Info("Failed to recreate dashboard - trying again")
 
-		err = c.createOrUpdateDashboardFolderMethod(reqBodyJSON, reqBodyJSON, "folders/"+uid, "PUT")
+		err = c.createOrUpdateDashboardFolderMethod(ctx, reqBodyJSON, reqBodyJSON, "folders/"+uid, "PUT")
+		if err == nil {
+			// The parent can't be changed by an update.
+			err = c.moveFolderIfNeeded(ctx, uid, parentUID)
+		}
 	}
 	return
 }
 
-// DeleteFolder deletes the dashboard identified by a given uid on the
-// Grafana API. NB this also deletes all graphs stored inside!
-// Returns an error if the process failed.
-func (c *Client) DeleteFolder(uid string) (err error) {
-	_, err = c.request("DELETE", "dashboards/db/"+uid, nil)
+// moveFolderIfNeeded moves the existing folder with the given UID under the
+// folder with the given parent UID, or to the root if it's empty, unless it's
+// already there. Grafana versions without nested folders don't give any
+// parent, so folders are never moved to the root on them.
+// Returns an error if the folder couldn't be requested or moved.
+func (c *Client) moveFolderIfNeeded(ctx context.Context, uid string, parentUID string) (err error) {
+	body, err := c.request(ctx, "GET", "folders/"+url.PathEscape(uid), nil)
+	if err != nil {
+		return
+	}
+	var current folderResponse
+	if err = json.Unmarshal(body, &current); err != nil {
+		return
+	}
+	if current.ParentUID == parentUID {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"uid":        uid,
+		"fromParent": current.ParentUID,
+		"toParent":   parentUID,
+	}).Info("Moving the folder under its new parent")
+
+	reqBodyJSON, err := json.Marshal(folderMoveRequest{ParentUID: parentUID})
+	if err != nil {
+		return
+	}
+	_, err = c.request(ctx, "POST", "folders/"+url.PathEscape(uid)+"/move", reqBodyJSON)
+	return
+}
+
+// sortFoldersParentsFirst returns the given folders ordered so that each
+// folder comes after its parent, if the parent is among them. Folders
+// otherwise keep their order. Cycles are cut, with a warning.
+func sortFoldersParentsFirst(entries []folderEntry) (sorted []folderEntry) {
+	byUID := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if entry.folder.UID != "" {
+			byUID[entry.folder.UID] = i
+		}
+	}
+
+	done := make([]bool, len(entries))
+	visiting := make([]bool, len(entries))
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] {
+			return
+		}
+		if visiting[i] {
+			logrus.WithFields(logrus.Fields{
+				"folder": entries[i].folder.UID,
+				"parent": entries[i].folder.FolderUID,
+			}).Warn("Cycle found in the folders tree, creating the folder without waiting for its parent")
+			return
+		}
+		visiting[i] = true
+		if parent, ok := byUID[entries[i].folder.FolderUID]; ok && parent != i {
+			visit(parent)
+		}
+		visiting[i] = false
+		if !done[i] {
+			done[i] = true
+			sorted = append(sorted, entries[i])
+		}
+	}
+
+	for i := range entries {
+		visit(i)
+	}
+	return
+}
+
+// DeleteFolders deletes from Grafana the folders described by the given
+// files, which were removed from the repository. Deleting a folder deletes
+// everything in it, so a folder is only deleted if the search API doesn't find
+// anything in it, apart from the dashboards and folders described by the given
+// removed files, which were removed in the same change. The folders left
+// alone are reported with what they still hold, telling the dashboards and
+// folders tracked by the repository, according to the given versions file,
+// from the ones which aren't. Nested folders are deleted before their parents.
+// Logs any errors encountered during an iteration, but doesn't return until all
+// folders have been handled. Returns the result of each deletion.
+func DeleteFolders(
+	ctx context.Context, filenames []string, dashboardsRemoved []string, contents map[string][]byte,
+	versionsFile DefsFile, client *Client,
+) (run *results.RunResult) {
+	if run, skipped := client.skipOnDryRun(results.KindFolder, results.ActionDelete, filenames); skipped {
+		return run
+	}
+	run = results.NewRunResult()
+
+	removedUIDs := make(map[string]bool)
+	for _, filename := range dashboardsRemoved {
+		if uid, _, err := UIDNameFromRawJSON(contents[filename]); err == nil && uid != "" {
+			removedUIDs[uid] = true
+		}
+	}
+
+	trackedUIDs := make(map[string]bool)
+	for _, meta := range versionsFile.DashboardMetaBySlug {
+		trackedUIDs[meta.UID] = true
+	}
+	for uid := range versionsFile.FoldersMetaByUID {
+		trackedUIDs[uid] = true
+	}
+
+	entries := make([]folderEntry, 0, len(filenames))
+	for _, filename := range filenames {
+		// Removing the permissions of a folder leaves them as they are.
+		if format.IsPermissionsFile(filename) {
+			continue
+		}
+		var folder format.FolderFile
+		err := json.Unmarshal(contents[filename], &folder)
+		if err != nil || folder.UID == "" {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("Failed to find the folder UID, not deleting it")
+			if err == nil {
+				err = errEmptyIdentifier
+			}
+			run.Add(results.NewItem(results.KindFolder, results.ActionDelete, "", filename).Finish(err))
+			continue
+		}
+		removedUIDs[folder.UID] = true
+		entries = append(entries, folderEntry{filename: filename, folder: folder})
+	}
+
+	sorted := sortFoldersParentsFirst(entries)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		entry := sorted[i]
+		item := results.NewItem(results.KindFolder, results.ActionDelete, entry.folder.UID, entry.filename)
+
+		remaining, err := client.folderContents(ctx, entry.folder.UID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": entry.filename,
+				"uid":      entry.folder.UID,
+			}).Error("Failed to search the folder's contents, not deleting it")
+			run.Add(item.Finish(err))
+			continue
+		}
+
+		tracked, untracked := make([]string, 0), make([]string, 0)
+		for _, result := range remaining {
+			switch {
+			case removedUIDs[result.UID]:
+				// Deleted or moved elsewhere by the same change.
+			case trackedUIDs[result.UID]:
+				tracked = append(tracked, fmt.Sprintf("%s (%s)", result.Title, result.UID))
+			default:
+				untracked = append(untracked, fmt.Sprintf("%s (%s)", result.Title, result.UID))
+			}
+		}
+		if len(tracked)+len(untracked) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"filename":  entry.filename,
+				"uid":       entry.folder.UID,
+				"tracked":   strings.Join(tracked, ", "),
+				"untracked": strings.Join(untracked, ", "),
+			}).Warn("The folder still holds dashboards or folders, not deleting it")
+			details := make([]string, 0, 2)
+			if len(tracked) > 0 {
+				details = append(details, "holds "+strings.Join(tracked, ", ")+" from the repository")
+			}
+			if len(untracked) > 0 {
+				details = append(details, "holds "+strings.Join(untracked, ", ")+" not tracked by the repository")
+			}
+			run.Add(item.Skip(strings.Join(details, "; ")))
+			continue
+		}
+
+		err = client.DeleteFolder(ctx, entry.folder.UID, false)
+		var rulesErr *FolderAlertRulesError
+		if errors.As(err, &rulesErr) && client.ForceDeleteRules {
+			logrus.WithFields(logrus.Fields{
+				"filename": entry.filename,
+				"uid":      entry.folder.UID,
+			}).Warn("The folder holds alert rules, deleting them with it")
+			err = client.DeleteFolder(ctx, entry.folder.UID, true)
+		}
+		if isNotFound(err) {
+			logrus.WithFields(logrus.Fields{
+				"filename": entry.filename,
+				"uid":      entry.folder.UID,
+			}).Info("The folder doesn't exist on Grafana anymore")
+			err = nil
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"filename": entry.filename,
+				"uid":      entry.folder.UID,
+			}).Error("Failed to remove the folder from Grafana")
+		}
+		run.Add(item.Finish(err))
+	}
+	return
+}
+
+// folderContents returns the dashboards and folders the search API finds
+// directly in the folder with the given UID.
+// Returns an error if the search failed.
+func (c *Client) folderContents(ctx context.Context, uid string) (found []DbSearchResponse, err error) {
+	query := url.Values{}
+	query.Set("folderUIDs", uid)
+	return c.search(ctx, query)
+}
+
+// FolderAlertRulesError is returned when Grafana refuses to delete a folder
+// because it holds alert rules. The deletion can be requested again with
+// forceDeleteRules set, which deletes the rules too.
+type FolderAlertRulesError struct {
+	UID string
+}
+
+// Error implements error.Error().
+func (e *FolderAlertRulesError) Error() string {
+	return fmt.Sprintf("the folder %s holds alert rules (412)", e.UID)
+}
+
+// DeleteFolder deletes the folder identified by a given uid on the Grafana
+// API. NB this also deletes all graphs stored inside! If forceDeleteRules is
+// set, the folder's alert rules are deleted too, else Grafana refuses to
+// delete a folder holding alert rules.
+// Returns a *FolderAlertRulesError if the folder holds alert rules and
+// forceDeleteRules isn't set, and an error if the process failed.
+func (c *Client) DeleteFolder(ctx context.Context, uid string, forceDeleteRules bool) (err error) {
+	if uid == "" {
+		return errEmptyIdentifier
+	}
+	query := url.Values{}
+	query.Set("forceDeleteRules", strconv.FormatBool(forceDeleteRules))
+	_, err = c.request(ctx, "DELETE", "folders/"+url.PathEscape(uid)+"?"+query.Encode(), nil)
+	if e, ok := err.(*httpUnknownError); ok && e.StatusCode == http.StatusPreconditionFailed {
+		err = &FolderAlertRulesError{UID: uid}
+	}
+	return
+}
+
+// folderChecker makes sure the folders the dashboards and library panels
+// pushed to a Grafana instance are in exist, requesting the instance's folders
+// once.
+type folderChecker struct {
+	c       *Client
+	folders map[string]bool
+	loaded  bool
+	loadErr error
+}
+
+// ensure makes sure the folder with the given UID exists on the Grafana
+// instance, e.g. for a dashboard which file gives a folder without the
+// folder's own file. Unless the client is strict about folders, a missing
+// folder is created with the given title, or its UID if there's none. The
+// General folder, which UID is empty, always exists.
+// Returns an error if the folders couldn't be requested or the folder couldn't
+// be created, or if it doesn't exist and the client is strict about folders.
+func (f *folderChecker) ensure(ctx context.Context, uid string, title string) (err error) {
+	if uid == "" {
+		return
+	}
+	if !f.loaded {
+		f.folders = make(map[string]bool)
+		var found []DbSearchResponse
+		// The search finds the nested folders too.
+		found, f.loadErr = f.c.search(ctx, url.Values{"type": []string{"dash-folder"}})
+		for _, folder := range found {
+			f.folders[folder.UID] = true
+		}
+		f.loaded = true
+	}
+	if f.loadErr != nil || f.folders[uid] {
+		return f.loadErr
+	}
+
+	if f.c.StrictFolders {
+		logrus.WithFields(logrus.Fields{
+			"uid": uid,
+		}).Error("Folder not found, and strict_folders is set")
+		return fmt.Errorf("The folder %s doesn't exist on Grafana", uid)
+	}
+	if title == "" {
+		title = uid
+	}
+	if f.c.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"title": title,
+			"uid":   uid,
+		}).Info("Dry run: folder not found, an implicit folder would be created")
+		f.folders[uid] = true
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"title": title,
+		"uid":   uid,
+	}).Warn("Folder not found, creating an implicit folder")
+	if err = f.c.CreateOrUpdateFolder(ctx, title, uid, ""); err == nil {
+		f.folders[uid] = true
+	}
 	return
 }
@@ -0,0 +1,115 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFolders fakes the folders API of a Grafana instance, holding the folders
+// with the given UIDs, which hold alert rules if mapped to true. The folders
+// are empty as far as the search API is concerned. It records the deletion
+// requests it gets.
+type fakeFolders struct {
+	lock    sync.Mutex
+	folders map[string]bool
+	deletes []string
+}
+
+func (f *fakeFolders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/search":
+		w.Write([]byte(`[]`))
+
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/folders/"):
+		f.deletes = append(f.deletes, r.URL.RequestURI())
+		uid := strings.TrimPrefix(r.URL.Path, "/api/folders/")
+		rules, ok := f.folders[uid]
+		switch {
+		case !ok:
+			http.Error(w, `{"message":"folder not found"}`, http.StatusNotFound)
+		case rules && r.URL.Query().Get("forceDeleteRules") != "true":
+			http.Error(w, `{"message":"folder cannot be deleted: folder contains alert rules"}`, http.StatusPreconditionFailed)
+		default:
+			delete(f.folders, uid)
+			w.Write([]byte(`{"message":"Folder deleted","id":1}`))
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDeleteFolder(t *testing.T) {
+	fake := &fakeFolders{folders: map[string]bool{"ops": false, "alerting": true}}
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := client.DeleteFolder(ctx, "ops", false); err != nil {
+		t.Errorf("200: %v", err)
+	}
+
+	if err := client.DeleteFolder(ctx, "missing", false); !isNotFound(err) {
+		t.Errorf("404: got %v, want an httpNotFoundError", err)
+	}
+
+	err := client.DeleteFolder(ctx, "alerting", false)
+	var rulesErr *FolderAlertRulesError
+	if !errors.As(err, &rulesErr) {
+		t.Fatalf("412: got %v, want a *FolderAlertRulesError", err)
+	}
+	if rulesErr.UID != "alerting" {
+		t.Errorf("412: error for folder %q, want alerting", rulesErr.UID)
+	}
+	if err = client.DeleteFolder(ctx, "alerting", true); err != nil {
+		t.Errorf("412 forced: %v", err)
+	}
+
+	want := []string{
+		"/api/folders/ops?forceDeleteRules=false",
+		"/api/folders/missing?forceDeleteRules=false",
+		"/api/folders/alerting?forceDeleteRules=false",
+		"/api/folders/alerting?forceDeleteRules=true",
+	}
+	if strings.Join(fake.deletes, " ") != strings.Join(want, " ") {
+		t.Errorf("sent %v, want %v", fake.deletes, want)
+	}
+}
+
+// A removed folder holding alert rules is only deleted with them if the
+// client is allowed to.
+func TestDeleteFoldersAlertRules(t *testing.T) {
+	contents := map[string][]byte{"folders/alerting.json": []byte(`{"uid":"alerting","title":"Alerting"}`)}
+
+	for _, force := range []bool{false, true} {
+		fake := &fakeFolders{folders: map[string]bool{"alerting": true}}
+		client := newTestClient(t, fake)
+		client.ForceDeleteRules = force
+
+		run := DeleteFolders(context.Background(), []string{"folders/alerting.json"}, nil, contents, DefsFile{}, client)
+		_, kept := fake.folders["alerting"]
+		if force && (run.Err() != nil || kept) {
+			t.Errorf("forced: got %v, folder kept: %v", run.Err(), kept)
+		}
+		if !force && (run.Err() == nil || !kept) {
+			t.Errorf("not forced: got %v, folder kept: %v", run.Err(), kept)
+		}
+	}
+}
+
+// A folder already deleted from Grafana isn't an error.
+func TestDeleteFoldersNotFound(t *testing.T) {
+	client := newTestClient(t, &fakeFolders{folders: map[string]bool{}})
+	contents := map[string][]byte{"folders/ops.json": []byte(`{"uid":"ops","title":"Ops"}`)}
+
+	run := DeleteFolders(context.Background(), []string{"folders/ops.json"}, nil, contents, DefsFile{}, client)
+	if err := run.Err(); err != nil {
+		t.Errorf("DeleteFolders: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package grafana
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestClient returns a client of the Grafana instance the given handler
+// fakes, using the legacy dashboards API and making a single attempt per
+// request. The fake instance is stopped at the end of the test.
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c := NewClient(server.URL, StaticToken("test"), "", "", 0, false)
+	c.DashboardsAPI = DashboardsAPILegacy
+	c.RetryAttempts = 1
+	return c
+}
+
+// fakeDashboards fakes the dashboards API of a Grafana instance, keeping the
+// dashboards pushed to it by UID, and recording the requests it gets.
+type fakeDashboards struct {
+	lock       sync.Mutex
+	dashboards map[string]json.RawMessage
+	requests   []string
+}
+
+func newFakeDashboards() *fakeDashboards {
+	return &fakeDashboards{dashboards: make(map[string]json.RawMessage)}
+}
+
+// count returns the number of requests with the given method and path the
+// fake instance got.
+func (f *fakeDashboards) count(request string) (count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.requests {
+		if r == request {
+			count++
+		}
+	}
+	return
+}
+
+// dashboard returns the dashboard with the given UID, nil if there's none.
+func (f *fakeDashboards) dashboard(uid string) json.RawMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.dashboards[uid]
+}
+
+func (f *fakeDashboards) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/dashboards/db":
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Dashboard json.RawMessage `json:"dashboard"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var meta struct {
+			UID string `json:"uid"`
+		}
+		json.Unmarshal(req.Dashboard, &meta)
+		f.dashboards[meta.UID] = req.Dashboard
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "uid": meta.UID, "version": 1})
+
+	case strings.HasPrefix(r.URL.Path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(r.URL.Path, "/api/dashboards/uid/")
+		dashboard, ok := f.dashboards[uid]
+		if !ok {
+			http.Error(w, `{"message":"Dashboard not found"}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.dashboards, uid)
+			w.Write([]byte(`{"title":"deleted"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"dashboard": dashboard,
+			"meta":      map[string]interface{}{"version": 1},
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Health represents Grafana's health, as returned by its health endpoint.
+type Health struct {
+	Commit   string `json:"commit"`
+	Database string `json:"database"`
+	Version  string `json:"version"`
+}
+
+// Healthy returns true if Grafana's database is available, i.e. if Grafana
+// can be synchronised with.
+func (h *Health) Healthy() bool {
+	return h.Database == "ok"
+}
+
+// Health requests Grafana's health endpoint.
+// Returns Grafana's health, even if its database is failing, and an error if
+// the endpoint couldn't be requested or its response decoded.
+func (c *Client) Health(ctx context.Context) (health *Health, err error) {
+	body, err := c.request(ctx, "GET", "health", nil)
+	// Grafana answers with a 503 along with its health when its database is
+	// failing.
+	if e, ok := err.(*httpUnknownError); ok && e.StatusCode == http.StatusServiceUnavailable && len(body) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	health = new(Health)
+	err = json.Unmarshal(body, health)
+	return
+}
+
+// CheckHealth requests Grafana's health endpoint, so a synchronisation isn't
+// started while Grafana is unavailable, e.g. in the middle of an upgrade.
+// Returns Grafana's health, and an error if the endpoint couldn't be requested
+// or Grafana's database isn't available.
+func (c *Client) CheckHealth(ctx context.Context) (health *Health, err error) {
+	if health, err = c.Health(ctx); err != nil {
+		return
+	}
+	if !health.Healthy() {
+		err = fmt.Errorf("Grafana %s isn't healthy, its database is %q", health.Version, health.Database)
+	}
+	return
+}
+
+// CheckConnection requests Grafana's health endpoint through the configured
+// base URL, so a misconfigured base URL is reported once at startup instead of
+// as confusing errors on the first API requests. Grafana's version and health
+// are logged.
+// Returns an error if the endpoint couldn't be reached. The error suggests
+// including Grafana's sub-path in the base URL if the endpoint wasn't found.
+func (c *Client) CheckConnection(ctx context.Context) (err error) {
+	health, err := c.Health(ctx)
+
+	// A base URL missing Grafana's sub-path usually points at a server
+	// answering with a 404 or with an HTML page.
+	var invalidBody *invalidBodyError
+	if isNotFound(err) || errors.As(err, &invalidBody) {
+		return fmt.Errorf(
+			"Grafana's health endpoint wasn't found at %s. If Grafana is served under a sub-path (its root_url), the base URL must include it, e.g. https://example.com/grafana: %w",
+			c.routeURL("/api/health"), err,
+		)
+	} else if err != nil {
+		return fmt.Errorf("Failed to reach Grafana at %s: %w", c.BaseURL, err)
+	}
+
+	c.version.store(health.Version)
+	entry := logrus.WithFields(logrus.Fields{
+		"base_url": c.BaseURL,
+		"version":  health.Version,
+		"commit":   health.Commit,
+		"database": health.Database,
+	})
+	if health.Healthy() {
+		entry.Info("Connected to Grafana")
+	} else {
+		entry.Warn("Connected to Grafana, but its database isn't available")
+	}
+	return
+}
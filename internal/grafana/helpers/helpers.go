@@ -2,21 +2,43 @@ package helpers
 
 import (
 	"encoding/json"
+	"errors"
+	"strings"
 
 	"github.com/gosimple/slug"
 )
 
+// ErrNoSlug is returned by GetSlug when neither a title nor a UID could be
+// extracted from a JSON description to compute a slug from.
+var ErrNoSlug = errors.New("no title or uid to compute a slug from")
+
 // GetSlug reads the JSON description of a dashboard or folder and computes a
-// slug from its title.
-// Returns an error if there was an issue parsing the dashboard JSON description.
+// slug from its title. Non-ASCII characters (e.g. Cyrillic or CJK) are
+// transliterated. If the title doesn't produce any slug (e.g. if it only
+// contains emojis or whitespaces), the slug is computed from the UID instead.
+// Returns an error if there was an issue parsing the dashboard JSON description,
+// or ErrNoSlug if neither the title nor the UID produce a slug, so a slug is
+// never empty.
 func GetSlug(dbJSONDescription []byte) (dbSlug string, err error) {
 	// Parse the file's content to find the dashboard's title
 	var thingTitle struct {
 		Title string `json:"title"`
+		UID   string `json:"uid"`
+	}
+
+	if err = json.Unmarshal(dbJSONDescription, &thingTitle); err != nil {
+		return
 	}
 
-	err = json.Unmarshal(dbJSONDescription, &thingTitle)
 	// Compute the slug
-	dbSlug = slug.Make(thingTitle.Title)
+	if dbSlug = slug.Make(thingTitle.Title); dbSlug != "" {
+		return
+	}
+
+	// Fall back to the UID, which only contains alphanumeric characters,
+	// dashes and underscores in practice.
+	if dbSlug = slug.Make(strings.TrimSpace(thingTitle.UID)); dbSlug == "" {
+		err = ErrNoSlug
+	}
 	return
 }
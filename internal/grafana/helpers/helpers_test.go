@@ -0,0 +1,62 @@
+package helpers
+
+import (
+	"regexp"
+	"testing"
+)
+
+// validSlug matches the slugs which can be used in a route or a file name.
+var validSlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9_]+)*$`)
+
+func TestGetSlug(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		json string
+		// want is the expected slug, empty if any valid slug will do.
+		want string
+	}{
+		{"ascii", `{"title":"Ops Overview","uid":"ops"}`, "ops-overview"},
+		{"cyrillic", `{"title":"Мониторинг","uid":"mon"}`, "monitoring"},
+		{"cjk", `{"title":"监控面板","uid":"cjk"}`, ""},
+		{"emoji only", `{"title":"🔥🚀","uid":"fire-uid"}`, "fire-uid"},
+		{"whitespace only", `{"title":" \t ","uid":"blank-uid"}`, "blank-uid"},
+		{"no title", `{"uid":"untitled"}`, "untitled"},
+	} {
+		got, err := GetSlug([]byte(tc.json))
+		if err != nil {
+			t.Errorf("%s: GetSlug: %v", tc.name, err)
+			continue
+		}
+		if !validSlug.MatchString(got) {
+			t.Errorf("%s: slug %q isn't a valid slug", tc.name, got)
+		}
+		if tc.want != "" && got != tc.want {
+			t.Errorf("%s: slug = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// A transliterated title is preferred over the UID.
+func TestGetSlugTransliterates(t *testing.T) {
+	got, err := GetSlug([]byte(`{"title":"监控面板","uid":"cjk-uid"}`))
+	if err != nil {
+		t.Fatalf("GetSlug: %v", err)
+	}
+	if got == "cjk-uid" {
+		t.Errorf("the CJK title wasn't transliterated, got the UID")
+	}
+}
+
+func TestGetSlugNoTitleNorUID(t *testing.T) {
+	for _, json := range []string{`{}`, `{"title":"🔥","uid":""}`, `{"title":"","uid":"  "}`} {
+		if got, err := GetSlug([]byte(json)); err != ErrNoSlug {
+			t.Errorf("GetSlug(%s) = %q, %v, want ErrNoSlug", json, got, err)
+		}
+	}
+}
+
+func TestGetSlugInvalidJSON(t *testing.T) {
+	if _, err := GetSlug([]byte(`{"title":`)); err == nil || err == ErrNoSlug {
+		t.Errorf("GetSlug of invalid JSON returned %v, want the parsing error", err)
+	}
+}
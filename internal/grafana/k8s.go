@@ -0,0 +1,230 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+	"github.com/sirupsen/logrus"
+)
+
+// k8sDashboardsGroup is the API group of the apiserver-style dashboards API.
+const k8sDashboardsGroup = "dashboard.grafana.app"
+
+// k8sFolderAnnotation is the annotation holding the UID of a dashboard's
+// folder in the apiserver-style dashboards API.
+const k8sFolderAnnotation = "grafana.app/folder"
+
+// k8sListLimit is the number of dashboards requested per page when listing
+// dashboards.
+const k8sListLimit = 500
+
+// k8sMetadata represents the metadata of an object of the apiserver-style
+// API.
+type k8sMetadata struct {
+	Name            string            `json:"name,omitempty"`
+	GenerateName    string            `json:"generateName,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Generation      int               `json:"generation,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// k8sDashboard represents a dashboard object of the apiserver-style API. The
+// spec holds the dashboard's JSON description, without the UID (which is the
+// object's name) and the version (which is the object's generation).
+type k8sDashboard struct {
+	APIVersion string                 `json:"apiVersion,omitempty"`
+	Kind       string                 `json:"kind,omitempty"`
+	Metadata   k8sMetadata            `json:"metadata"`
+	Spec       map[string]interface{} `json:"spec"`
+}
+
+// k8sDashboardList represents a page of the list of dashboards.
+type k8sDashboardList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []k8sDashboard `json:"items"`
+}
+
+// k8sBackend implements the dashboards operations against the
+// apiserver-style routes.
+type k8sBackend struct {
+	c       *Client
+	version string
+}
+
+// newK8sBackend returns a backend using the given version of the
+// apiserver-style dashboards API.
+func newK8sBackend(c *Client, version string) *k8sBackend {
+	return &k8sBackend{c: c, version: version}
+}
+
+func (b *k8sBackend) name() string {
+	return DashboardsAPIK8s + " (" + b.version + ")"
+}
+
+// route returns the route of the dashboards collection, or of the dashboard
+// with the given name if it isn't empty.
+func (b *k8sBackend) route(name string) string {
+	namespace := b.c.Namespace
+	if len(namespace) == 0 && b.c.OrgID > 1 {
+		namespace = "org-" + strconv.FormatInt(b.c.OrgID, 10)
+	} else if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	route := "/apis/" + k8sDashboardsGroup + "/" + b.version + "/namespaces/" +
+		url.PathEscape(namespace) + "/dashboards"
+	if len(name) > 0 {
+		route += "/" + url.PathEscape(name)
+	}
+	return route
+}
+
+func (b *k8sBackend) listDashboards(ctx context.Context) (dashboards []DbSearchResponse, err error) {
+	dashboards = make([]DbSearchResponse, 0)
+
+	for cont, first := "", true; first || len(cont) > 0; first = false {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(k8sListLimit))
+		if len(cont) > 0 {
+			query.Set("continue", cont)
+		}
+
+		var body []byte
+		if body, err = b.c.requestRoute(ctx, "GET", b.route("")+"?"+query.Encode(), nil); err != nil {
+			return
+		}
+
+		var list k8sDashboardList
+		if err = json.Unmarshal(body, &list); err != nil {
+			return
+		}
+
+		for _, item := range list.Items {
+			title, _ := item.Spec["title"].(string)
+			db := DbSearchResponse{
+				Title:     title,
+				UID:       item.Metadata.Name,
+				Type:      "dash-db",
+				FolderUID: item.Metadata.Annotations[k8sFolderAnnotation],
+				Updated:   item.Metadata.ResourceVersion,
+			}
+			if tags, ok := item.Spec["tags"].([]interface{}); ok {
+				for _, tag := range tags {
+					if s, ok := tag.(string); ok {
+						db.Tags = append(db.Tags, s)
+					}
+				}
+			}
+			dashboards = append(dashboards, db)
+		}
+
+		cont = list.Metadata.Continue
+	}
+
+	return
+}
+
+// get retrieves the dashboard object with the given name.
+func (b *k8sBackend) get(ctx context.Context, name string) (obj *k8sDashboard, err error) {
+	body, err := b.c.requestRoute(ctx, "GET", b.route(name), nil)
+	if err != nil {
+		return
+	}
+
+	obj = new(k8sDashboard)
+	err = json.Unmarshal(body, obj)
+	return
+}
+
+func (b *k8sBackend) getDashboard(ctx context.Context, uid string) (db *Dashboard, err error) {
+	obj, err := b.get(ctx, uid)
+	if err != nil {
+		return
+	}
+
+	// Map the object to the legacy JSON description.
+	spec := obj.Spec
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	spec["uid"] = obj.Metadata.Name
+	spec["version"] = obj.Metadata.Generation
+
+	rawJSON, err := json.Marshal(spec)
+	if err != nil {
+		return
+	}
+
+	db = &Dashboard{
+		RawJSON:   rawJSON,
+		UID:       obj.Metadata.Name,
+		Version:   obj.Metadata.Generation,
+		FolderUID: obj.Metadata.Annotations[k8sFolderAnnotation],
+	}
+	db.Name, _ = spec["title"].(string)
+	return
+}
+
+func (b *k8sBackend) saveDashboard(ctx context.Context, contentJSON []byte, folderUID string) (err error) {
+	var spec map[string]interface{}
+	if err = json.Unmarshal(contentJSON, &spec); err != nil {
+		return
+	}
+
+	uid, _ := spec["uid"].(string)
+	// The instance-specific keys and the manager's metadata aren't part of
+	// the spec.
+	for _, key := range []string{"id", "uid", "version", format.FolderUIDKey, format.FolderKey} {
+		delete(spec, key)
+	}
+
+	obj := k8sDashboard{
+		APIVersion: k8sDashboardsGroup + "/" + b.version,
+		Kind:       "Dashboard",
+		Metadata:   k8sMetadata{Name: uid},
+		Spec:       spec,
+	}
+	if len(folderUID) > 0 {
+		obj.Metadata.Annotations = map[string]string{k8sFolderAnnotation: folderUID}
+	}
+
+	method := "POST"
+	route := b.route("")
+	if len(uid) == 0 {
+		obj.Metadata.GenerateName = "d"
+	} else {
+		// Overwrite the existing dashboard if there's one.
+		existing, getErr := b.get(ctx, uid)
+		if getErr == nil {
+			method = "PUT"
+			route = b.route(uid)
+			obj.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+		} else if !isNotFound(getErr) {
+			return getErr
+		}
+	}
+
+	reqBody, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"uid":    uid,
+		"method": method,
+	}).Debug("Saving dashboard with the apiserver-style API")
+
+	_, err = b.c.requestRoute(ctx, method, route, reqBody)
+	return
+}
+
+func (b *k8sBackend) deleteDashboard(ctx context.Context, uid string) (err error) {
+	_, err = b.c.requestRoute(ctx, "DELETE", b.route(uid), nil)
+	return
+}
@@ -1,9 +1,12 @@
 package grafana
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/sjson"
+	"net/url"
+	"strconv"
 )
 
 type LibraryElementResponse struct {
@@ -52,7 +55,7 @@ type Library struct {
 
 type libraryCreateOrUpdateRequest struct {
 	FolderUid string          `json:"folderUid"`
-	FolderId  int             `json:"folderId"`
+	FolderId  int             `json:"folderId,omitempty"`
 	Name      string          `json:"name"`
 	Model     json.RawMessage `json:"model"`
 	Kind      int             `json:"kind"`
@@ -85,26 +88,46 @@ func (d *Library) setLibraryNameFromRawJSON() (err error) {
 	return
 }
 
-// GetLibraryList requests the Grafana API for all library definitions.
+// libraryPageSize is the number of library elements requested per page.
+const libraryPageSize = 100
+
+// GetLibraryList requests the Grafana API for all library definitions, one
+// page after the other until all the elements counted by the API have been
+// retrieved. Each element of raw is the raw JSON of the element of lib with
+// the same index.
 // Returns the []library as an instance of the library structure.
 // Returns an error if there was an issue requesting the library or parsing
 // the response body.
-func (c *Client) GetLibraryList() (lib []LibraryElementResponse, raw []json.RawMessage, err error) {
-	body, err := c.request("GET", "library-elements/", nil)
-	if err != nil {
-		return
-	}
-	resp := new(LibraryElementsResponse)
-	err = json.Unmarshal(body, resp)
-	if err != nil {
-		return
-	}
-	respRaw := new(LibraryElementsResponseRaw)
-	err = json.Unmarshal(body, respRaw)
+func (c *Client) GetLibraryList(ctx context.Context) (lib []LibraryElementResponse, raw []json.RawMessage, err error) {
+	lib = make([]LibraryElementResponse, 0)
+	raw = make([]json.RawMessage, 0)
 
-	lib = resp.Result.Element
-	raw = respRaw.Result.Element
-	return
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("perPage", strconv.Itoa(libraryPageSize))
+
+		var body []byte
+		if body, err = c.request(ctx, "GET", "library-elements/?"+query.Encode(), nil); err != nil {
+			return
+		}
+		resp := new(LibraryElementsResponse)
+		if err = json.Unmarshal(body, resp); err != nil {
+			return
+		}
+		respRaw := new(LibraryElementsResponseRaw)
+		if err = json.Unmarshal(body, respRaw); err != nil {
+			return
+		}
+
+		lib = append(lib, resp.Result.Element...)
+		raw = append(raw, respRaw.Result.Element...)
+
+		// Stop on an empty page too, in case the total count is wrong.
+		if len(resp.Result.Element) == 0 || len(lib) >= resp.Result.TotalCount {
+			return
+		}
+	}
 }
 
 // GetLibrary requests the Grafana API for a library identified by a given
@@ -112,8 +135,8 @@ func (c *Client) GetLibraryList() (lib []LibraryElementResponse, raw []json.RawM
 // Returns the library as an instance of the library structure.
 // Returns an error if there was an issue requesting the library or parsing
 // the response body.
-func (c *Client) GetLibrary(URI string) (lib *Library, err error) {
-	body, err := c.request("GET", "library-elements/"+URI, nil)
+func (c *Client) GetLibrary(ctx context.Context, URI string) (lib *Library, err error) {
+	body, err := c.request(ctx, "GET", "library-elements/"+URI, nil)
 	if err != nil {
 		return
 	}
@@ -123,12 +146,39 @@ func (c *Client) GetLibrary(URI string) (lib *Library, err error) {
 	return
 }
 
+// GetLibraryConnections requests the Grafana API for the dashboards the
+// library with the given UID is connected to, i.e. the dashboards using it.
+// Returns the UIDs of the connected dashboards.
+// Returns an error if there was an issue requesting the connections or parsing
+// the response body.
+func (c *Client) GetLibraryConnections(ctx context.Context, uid string) (dashboardUIDs []string, err error) {
+	body, err := c.request(ctx, "GET", "library-elements/"+url.PathEscape(uid)+"/connections", nil)
+	if err != nil {
+		return
+	}
+
+	var resp struct {
+		Result []struct {
+			ConnectionUID string `json:"connectionUid"`
+		} `json:"result"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return
+	}
+
+	dashboardUIDs = make([]string, 0, len(resp.Result))
+	for _, conn := range resp.Result {
+		dashboardUIDs = append(dashboardUIDs, conn.ConnectionUID)
+	}
+	return
+}
+
 // CreateOrUpdateLibrary takes a given JSON content (as []byte) and create the
 // library if it doesn't exist on the Grafana instance, else updates the
 // existing one.
 // Returns an error if there was an issue generating the request body, performing
 // the request or decoding the response's body.
-func (c *Client) CreateOrUpdateLibrary(contentJSON []byte, folderUid string, libVersion int) (err error) {
+func (c *Client) CreateOrUpdateLibrary(ctx context.Context, contentJSON []byte, folderUid string, libVersion int) (err error) {
 	contentJSONstr := string(contentJSON)
 	contentJSONstr, err = sjson.Set(contentJSONstr, "model.libraryPanel.version", libVersion)
 	contentJSONstr, _ = sjson.Delete(contentJSONstr, "model.libraryPanel.created")
@@ -145,18 +195,11 @@ func (c *Client) CreateOrUpdateLibrary(contentJSON []byte, folderUid string, lib
 		return
 	}
 	reqBody.FolderUid = folderUid
-	// grafana 8.5 doesn't understand folderUIDs, only folderIDs. Look it up.
-	folders, err := c.GetFolderList()
-	if err != nil {
+	// grafana 8 doesn't understand folderUIDs, only folderIDs, which are
+	// looked up for it.
+	if reqBody.FolderId, err = c.legacyFolderID(ctx, folderUid); err != nil {
 		return
 	}
-	for _, folder := range folders {
-		if folder.Uid == folderUid {
-			reqBody.FolderId = folder.Id
-			logrus.Infof("Found folder ID %v for UID %v (%v)", folder.Id, folder.Uid, folder.Title)
-			break
-		}
-	}
 
 	var reqUpdateBody = new(libraryUpdateRequest)
 	reqUpdateBody.libraryCreateOrUpdateRequest = reqBody
@@ -175,19 +218,19 @@ func (c *Client) CreateOrUpdateLibrary(contentJSON []byte, folderUid string, lib
 	if err != nil {
 		return
 	}
-	err = c.createOrUpdateLibraryFolder(reqBodyJSON, reqUpdateBodyJSON, contentJSON, "library-elements", reqBody.UID)
+	err = c.createOrUpdateLibraryFolder(ctx, reqBodyJSON, reqUpdateBodyJSON, contentJSON, "library-elements", reqBody.UID)
 	return
 }
 
-func (c *Client) createOrUpdateLibraryFolder(reqBodyJSON []byte, reqUpdateBodyJSON []byte, contentJSON []byte, apiPath string, UID string) (err error) {
+func (c *Client) createOrUpdateLibraryFolder(ctx context.Context, reqBodyJSON []byte, reqUpdateBodyJSON []byte, contentJSON []byte, apiPath string, UID string) (err error) {
 	// try "create" first, if it already exists then create will return 400
-	err = c.createOrUpdateLibraryFolderMethod(reqBodyJSON, apiPath, "POST")
+	err = c.createOrUpdateLibraryFolderMethod(ctx, reqBodyJSON, apiPath, "POST")
 	if err != nil {
 		httpError, isHttpUnknownError := err.(*httpUnknownError)
 		if isHttpUnknownError {
 			if httpError.StatusCode == 400 { // can't update a library with a POST, try a PATCH to the UID
 				logrus.Infof("%v. %v", string(reqUpdateBodyJSON), err.Error())
-				err = c.createOrUpdateLibraryFolderMethod(reqUpdateBodyJSON, apiPath+"/"+UID, "PATCH")
+				err = c.createOrUpdateLibraryFolderMethod(ctx, reqUpdateBodyJSON, apiPath+"/"+UID, "PATCH")
 				if err != nil {
 					logrus.Warnf("Patch failed, %v", err.Error())
 				}
@@ -198,9 +241,9 @@ func (c *Client) createOrUpdateLibraryFolder(reqBodyJSON []byte, reqUpdateBodyJS
 	return
 }
 
-func (c *Client) createOrUpdateLibraryFolderMethod(reqBodyJSON []byte, apiPath string, method string) (err error) {
+func (c *Client) createOrUpdateLibraryFolderMethod(ctx context.Context, reqBodyJSON []byte, apiPath string, method string) (err error) {
 	// Send the request
-	respBodyJSON, err := c.request(method, apiPath, reqBodyJSON)
+	respBodyJSON, err := c.request(ctx, method, apiPath, reqBodyJSON)
 	if err != nil {
 		logrus.Warnf("Failed to create/update library method (%v) %v %v", method, apiPath, string(respBodyJSON))
 		return
@@ -221,8 +264,8 @@ type FolderResponse struct {
 type FoldersResponse []FolderResponse
 
 // GetFolderList requests the Grafana API for all folder definitions.
-func (c *Client) GetFolderList() (folders FoldersResponse, err error) {
-	body, err := c.request("GET", "folders", nil)
+func (c *Client) GetFolderList(ctx context.Context) (folders FoldersResponse, err error) {
+	body, err := c.request(ctx, "GET", "folders", nil)
 	if err != nil {
 		return
 	}
@@ -238,7 +281,10 @@ func (c *Client) GetFolderList() (folders FoldersResponse, err error) {
 }
 
 // DeleteLibrary deletes the library identified by a given UID.
-func (c *Client) DeleteLibrary(uid string) (err error) {
-	_, err = c.request("DELETE", "library-elements/"+uid, nil)
+func (c *Client) DeleteLibrary(ctx context.Context, uid string) (err error) {
+	if uid == "" {
+		return errEmptyIdentifier
+	}
+	_, err = c.request(ctx, "DELETE", "library-elements/"+uid, nil)
 	return
 }
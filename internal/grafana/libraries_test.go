@@ -0,0 +1,122 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeLibraries fakes the library elements API of a Grafana instance holding
+// the given number of elements, paginating them like Grafana. It records the
+// pages requested.
+type fakeLibraries struct {
+	elements int
+
+	lock  sync.Mutex
+	pages []int
+}
+
+func (f *fakeLibraries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/library-elements/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("perPage"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 100
+	}
+	f.lock.Lock()
+	f.pages = append(f.pages, page)
+	f.lock.Unlock()
+
+	elements := make([]map[string]interface{}, 0)
+	for i := (page - 1) * perPage; i < page*perPage && i < f.elements; i++ {
+		elements = append(elements, map[string]interface{}{
+			"id":      i + 1,
+			"uid":     fmt.Sprintf("lib-%04d", i),
+			"name":    fmt.Sprintf("Panel %d", i),
+			"version": i % 7,
+			"model":   map[string]interface{}{"title": fmt.Sprintf("Panel %d", i)},
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": map[string]interface{}{
+			"totalCount": f.elements,
+			"elements":   elements,
+			"page":       page,
+			"perPage":    perPage,
+		},
+	})
+}
+
+func TestGetLibraryListPaginates(t *testing.T) {
+	fake := &fakeLibraries{elements: 250}
+	client := newTestClient(t, fake)
+
+	lib, raw, err := client.GetLibraryList(context.Background())
+	if err != nil {
+		t.Fatalf("GetLibraryList: %v", err)
+	}
+	if len(lib) != 250 || len(raw) != 250 {
+		t.Fatalf("got %d elements and %d raw ones, want 250", len(lib), len(raw))
+	}
+
+	// Each raw element is the one of the typed element with the same index.
+	for i := range lib {
+		if want := fmt.Sprintf("lib-%04d", i); lib[i].Uid != want {
+			t.Errorf("element %d has UID %s, want %s", i, lib[i].Uid, want)
+		}
+		var element struct {
+			Uid string `json:"uid"`
+		}
+		if err = json.Unmarshal(raw[i], &element); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if element.Uid != lib[i].Uid {
+			t.Errorf("raw element %d has UID %s, want %s", i, element.Uid, lib[i].Uid)
+		}
+	}
+
+	if len(fake.pages) != 3 || fake.pages[0] != 1 || fake.pages[1] != 2 || fake.pages[2] != 3 {
+		t.Errorf("requested pages %v, want [1 2 3]", fake.pages)
+	}
+}
+
+// An instance with exactly one page of elements isn't asked for another one.
+func TestGetLibraryListSinglePage(t *testing.T) {
+	fake := &fakeLibraries{elements: libraryPageSize}
+	client := newTestClient(t, fake)
+
+	lib, raw, err := client.GetLibraryList(context.Background())
+	if err != nil {
+		t.Fatalf("GetLibraryList: %v", err)
+	}
+	if len(lib) != libraryPageSize || len(raw) != libraryPageSize {
+		t.Errorf("got %d elements and %d raw ones, want %d", len(lib), len(raw), libraryPageSize)
+	}
+	if len(fake.pages) != 1 {
+		t.Errorf("requested pages %v, want only the first one", fake.pages)
+	}
+}
+
+func TestGetLibraryListEmpty(t *testing.T) {
+	fake := &fakeLibraries{}
+	client := newTestClient(t, fake)
+
+	lib, raw, err := client.GetLibraryList(context.Background())
+	if err != nil {
+		t.Fatalf("GetLibraryList: %v", err)
+	}
+	if len(lib) != 0 || len(raw) != 0 {
+		t.Errorf("got %d elements and %d raw ones, want none", len(lib), len(raw))
+	}
+}
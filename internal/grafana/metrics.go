@@ -0,0 +1,65 @@
+package grafana
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestMetrics records the requests the client sends to the Grafana API.
+// It's called once per attempt, with the group of endpoints the request was
+// sent to (see endpointGroup), the class of its status code ("2xx", "4xx",
+// etc., or "error" if no response was received) and its duration. It must be
+// safe for concurrent use.
+type RequestMetrics interface {
+	ObserveRequest(group string, status string, duration time.Duration)
+}
+
+// endpointGroups maps the prefixes of the routes of the Grafana instance to
+// the group of endpoints they're recorded under. The first matching prefix
+// wins.
+var endpointGroups = []struct {
+	prefix string
+	group  string
+}{
+	{"/api/search", "search"},
+	{"/api/dashboards", "dashboards"},
+	{"/apis/dashboard.grafana.app", "dashboards"},
+	{"/api/library-elements", "library-elements"},
+	{"/api/folders", "folders"},
+	{"/apis/folder.grafana.app", "folders"},
+	{"/api/datasources", "datasources"},
+	{"/api/v1/provisioning/", "alerting"},
+	{"/api/health", "health"},
+}
+
+// endpointGroup returns the group of endpoints the given route belongs to, for
+// the metrics. Routes outside the known groups are grouped as "other", so the
+// number of groups stays small.
+func endpointGroup(route string) string {
+	for _, g := range endpointGroups {
+		if strings.HasPrefix(route, g.prefix) {
+			return g.group
+		}
+	}
+	return "other"
+}
+
+// statusClass returns the class of the given HTTP status code, e.g. "4xx".
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// observeRequest records a request sent to the given route, which got a
+// response with the given status code (zero if there was no response), if the
+// client has metrics.
+func (c *Client) observeRequest(route string, code int, start time.Time) {
+	if c.Metrics == nil {
+		return
+	}
+	status := "error"
+	if code > 0 {
+		status = statusClass(code)
+	}
+	c.Metrics.ObserveRequest(endpointGroup(route), status, time.Since(start))
+}
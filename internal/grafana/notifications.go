@@ -0,0 +1,237 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notificationInstanceKeys are the keys of the descriptions of contact points
+// and notification policies which are specific to a Grafana instance, and are
+// never written to nor pushed from the repository.
+var notificationInstanceKeys = []string{"provenance"}
+
+// muteTimingInstanceKeys are the keys of the descriptions of mute timings
+// which are specific to a Grafana instance. A mute timing's version is a hash
+// of its content used to detect concurrent updates.
+var muteTimingInstanceKeys = []string{"version", "provenance"}
+
+// redactedValue replaces the secrets of contact points in the responses of
+// the provisioning API. Grafana keeps the existing secret when it receives it
+// back in an update.
+var redactedValue = []byte(`"[REDACTED]"`)
+
+// errNoMuteTimingName is returned when pushing a mute timing which description
+// has no name, since it couldn't be told apart from the other ones.
+var errNoMuteTimingName = errors.New("The mute timing has no name")
+
+// errNoContactPointUID is returned when pushing a contact point which
+// description has no UID, since it couldn't be told apart from the other ones.
+var errNoContactPointUID = errors.New("The contact point has no UID")
+
+// ContactPoint represents a contact point, i.e. a single integration of a
+// notification receiver, retrieved from the Grafana provisioning API.
+type ContactPoint struct {
+	UID  string
+	Name string
+	Type string
+	// RawJSON is the contact point's description, with the keys specific to
+	// the instance removed. Its secrets are redacted.
+	RawJSON []byte
+}
+
+// GetContactPoints requests the Grafana provisioning API for the description
+// of every contact point.
+// Returns an error if there was an issue requesting the contact points or
+// parsing the response body.
+func (c *Client) GetContactPoints(ctx context.Context) (contactPoints []*ContactPoint, err error) {
+	body, err := c.request(ctx, "GET", "v1/provisioning/contact-points", nil)
+	if err != nil {
+		return
+	}
+
+	var list []json.RawMessage
+	if err = json.Unmarshal(body, &list); err != nil {
+		return
+	}
+
+	contactPoints = make([]*ContactPoint, 0, len(list))
+	for _, item := range list {
+		var meta struct {
+			UID  string `json:"uid"`
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+		if err = json.Unmarshal(item, &meta); err != nil {
+			return
+		}
+
+		cp := &ContactPoint{UID: meta.UID, Name: meta.Name, Type: meta.Type}
+		if cp.RawJSON, err = withoutKeys(item, notificationInstanceKeys); err != nil {
+			return
+		}
+		contactPoints = append(contactPoints, cp)
+	}
+	return
+}
+
+// CreateOrUpdateContactPoint takes a given JSON content (as []byte) and creates
+// the contact point if its UID isn't in the given set of existing contact
+// points, else updates the existing one. Redacted secrets are kept as they are
+// on the instance when updating, but have to be set by hand on the contact
+// points created.
+// Returns an error if the content has no UID, or if there was an issue
+// generating the request body or performing the request.
+func (c *Client) CreateOrUpdateContactPoint(ctx context.Context, contentJSON []byte, existing map[string]bool) (err error) {
+	var meta struct {
+		UID string `json:"uid"`
+	}
+	if err = json.Unmarshal(contentJSON, &meta); err != nil {
+		return
+	}
+	if len(meta.UID) == 0 {
+		return errNoContactPointUID
+	}
+
+	reqBody, err := withoutKeys(contentJSON, notificationInstanceKeys)
+	if err != nil {
+		return
+	}
+
+	if existing[meta.UID] {
+		_, err = c.request(ctx, "PUT", "v1/provisioning/contact-points/"+url.PathEscape(meta.UID), reqBody)
+		return
+	}
+
+	if _, err = c.request(ctx, "POST", "v1/provisioning/contact-points", reqBody); err == nil && bytes.Contains(reqBody, redactedValue) {
+		logrus.WithFields(logrus.Fields{
+			"uid": meta.UID,
+		}).Warn("Created a contact point which secrets have to be set on the Grafana instance")
+	}
+	return
+}
+
+// MuteTiming represents a mute timing, which notification policies refer to
+// by name, retrieved from the Grafana provisioning API.
+type MuteTiming struct {
+	Name string
+	// RawJSON is the mute timing's description, with the keys specific to
+	// the instance removed.
+	RawJSON []byte
+}
+
+// GetMuteTimings requests the Grafana provisioning API for the description of
+// every mute timing.
+// Returns an error if there was an issue requesting the mute timings or
+// parsing the response body.
+func (c *Client) GetMuteTimings(ctx context.Context) (muteTimings []*MuteTiming, err error) {
+	body, err := c.request(ctx, "GET", "v1/provisioning/mute-timings", nil)
+	if err != nil {
+		return
+	}
+
+	var list []json.RawMessage
+	if err = json.Unmarshal(body, &list); err != nil {
+		return
+	}
+
+	muteTimings = make([]*MuteTiming, 0, len(list))
+	for _, item := range list {
+		var meta struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(item, &meta); err != nil {
+			return
+		}
+
+		mt := &MuteTiming{Name: meta.Name}
+		if mt.RawJSON, err = withoutKeys(item, muteTimingInstanceKeys); err != nil {
+			return
+		}
+		muteTimings = append(muteTimings, mt)
+	}
+	return
+}
+
+// CreateOrUpdateMuteTiming takes a given JSON content (as []byte) and creates
+// the mute timing if its name isn't in the given set of existing mute
+// timings, else updates the existing one.
+// Returns an error if the content has no name, or if there was an issue
+// generating the request body or performing the request.
+func (c *Client) CreateOrUpdateMuteTiming(ctx context.Context, contentJSON []byte, existing map[string]bool) (err error) {
+	var meta struct {
+		Name string `json:"name"`
+	}
+	if err = json.Unmarshal(contentJSON, &meta); err != nil {
+		return
+	}
+	if len(meta.Name) == 0 {
+		return errNoMuteTimingName
+	}
+
+	reqBody, err := withoutKeys(contentJSON, muteTimingInstanceKeys)
+	if err != nil {
+		return
+	}
+
+	if existing[meta.Name] {
+		_, err = c.request(ctx, "PUT", "v1/provisioning/mute-timings/"+url.PathEscape(meta.Name), reqBody)
+	} else {
+		_, err = c.request(ctx, "POST", "v1/provisioning/mute-timings", reqBody)
+	}
+	return
+}
+
+// DeleteMuteTiming deletes the mute timing with the given name. Grafana
+// refuses to delete a mute timing notification policies still refer to.
+// Returns an error if there was an issue performing the request.
+func (c *Client) DeleteMuteTiming(ctx context.Context, name string) (err error) {
+	_, err = c.request(ctx, "DELETE", "v1/provisioning/mute-timings/"+url.PathEscape(name), nil)
+	return
+}
+
+// GetNotificationPolicies requests the Grafana provisioning API for the
+// notification policy tree.
+// Returns the tree's description, with the keys specific to the instance
+// removed, or an error if there was an issue requesting or parsing it.
+func (c *Client) GetNotificationPolicies(ctx context.Context) (rawJSON []byte, err error) {
+	body, err := c.request(ctx, "GET", "v1/provisioning/policies", nil)
+	if err != nil {
+		return
+	}
+
+	return withoutKeys(body, notificationInstanceKeys)
+}
+
+// UpdateNotificationPolicies replaces the notification policy tree with the
+// one described by the given JSON content (as []byte). The contact points it
+// routes to must already exist.
+// Returns an error if there was an issue generating the request body or
+// performing the request.
+func (c *Client) UpdateNotificationPolicies(ctx context.Context, contentJSON []byte) (err error) {
+	reqBody, err := withoutKeys(contentJSON, notificationInstanceKeys)
+	if err != nil {
+		return
+	}
+
+	_, err = c.request(ctx, "PUT", "v1/provisioning/policies", reqBody)
+	return
+}
+
+// withoutKeys returns the given JSON object without the given top-level keys.
+// Returns an error if the content isn't a JSON object.
+func withoutKeys(contentJSON []byte, keys []string) (rawJSON []byte, err error) {
+	var description map[string]interface{}
+	if err = json.Unmarshal(contentJSON, &description); err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		delete(description, key)
+	}
+	return json.Marshal(description)
+}
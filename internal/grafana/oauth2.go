@@ -0,0 +1,149 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// oauth2ExpiryDelta is how long before its expiry an access token is fetched
+// again, so it doesn't expire while a request is in flight.
+const oauth2ExpiryDelta = 10 * time.Second
+
+// oauth2Transport authenticates the requests it sends with an access token
+// obtained with the OAuth2 client credentials flow. The token is kept until
+// it's about to expire or is rejected. It's shared by the clients of all the
+// organisations, and safe for concurrent use.
+type oauth2Transport struct {
+	base     http.RoundTripper
+	settings config.OAuth2Settings
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// oauth2TokenResponse represents the response of the token endpoint.
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// newOAuth2Transport returns a transport authenticating the requests sent
+// through the given one with the given OAuth2 settings. The token endpoint is
+// requested through the given transport too.
+func newOAuth2Transport(base http.RoundTripper, settings config.OAuth2Settings) *oauth2Transport {
+	return &oauth2Transport{base: base, settings: settings}
+}
+
+// RoundTrip implements http.RoundTripper. The Authorization header set by the
+// client, if any, is replaced.
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.accessToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper mustn't modify the request it's given.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.base.RoundTrip(req)
+
+	// Fetch another token for the next request if this one was rejected,
+	// e.g. because it was revoked.
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.forget(token)
+	}
+	return resp, err
+}
+
+// accessToken returns the current access token, fetching a new one if there's
+// none or if it's about to expire.
+// Returns an error if the token endpoint couldn't be requested or didn't give
+// a token.
+func (t *oauth2Transport) accessToken(ctx context.Context) (token string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry.Add(-oauth2ExpiryDelta))) {
+		return t.token, nil
+	}
+
+	resp, err := t.fetchToken(ctx)
+	if err != nil {
+		return
+	}
+
+	t.token = resp.AccessToken
+	t.expiry = time.Time{}
+	if resp.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"token_url": t.settings.TokenURL,
+		"expiry":    t.expiry,
+	}).Debug("Fetched an OAuth2 access token")
+	return t.token, nil
+}
+
+// forget drops the given access token, unless another one was fetched in the
+// meantime.
+func (t *oauth2Transport) forget(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+// fetchToken requests the token endpoint for an access token, with the client
+// credentials grant. The lock must be held.
+// Returns an error if the endpoint couldn't be requested, answered with an
+// error or didn't give a token.
+func (t *oauth2Transport) fetchToken(ctx context.Context) (token *oauth2TokenResponse, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(t.settings.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.settings.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.settings.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.settings.ClientID), url.QueryEscape(t.settings.ClientSecret))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to request an OAuth2 access token from %s: %w", t.settings.TokenURL, err)
+	}
+	body, err := readBody(resp)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Failed to get an OAuth2 access token from %s (%d): %s", t.settings.TokenURL, resp.StatusCode, body)
+	}
+
+	token = new(oauth2TokenResponse)
+	if err = json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("Invalid OAuth2 token response from %s: %w", t.settings.TokenURL, err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("The OAuth2 token response from %s has no access token", t.settings.TokenURL)
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// orgResponse represents the response to a current organisation query.
+type orgResponse struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// ForOrg returns a client making the requests in the organisation with the
+// given ID, with the same settings and HTTP client as the client. Returns the
+// client itself if it already works in this organisation.
+func (c *Client) ForOrg(orgID int64) *Client {
+	if orgID == c.OrgID {
+		return c
+	}
+
+	return &Client{
+		BaseURL:       c.BaseURL,
+		Username:      c.Username,
+		Password:      c.Password,
+		SkipVerify:    c.SkipVerify,
+		OrgID:         orgID,
+		DashboardsAPI: c.DashboardsAPI,
+		// The namespace defaults to the organisation's.
+		RetryAttempts:        c.RetryAttempts,
+		RetryMaxBackoff:      c.RetryMaxBackoff,
+		StrictDatasources:    c.StrictDatasources,
+		ComplexityLimits:     c.ComplexityLimits,
+		FolderScope:          c.FolderScope,
+		DatasourceAliases:    c.DatasourceAliases,
+		AllowSchemaDowngrade: c.AllowSchemaDowngrade,
+		DeleteRemovedFolders: c.DeleteRemovedFolders,
+		ForceDeleteRules:     c.ForceDeleteRules,
+		StrictFolders:        c.StrictFolders,
+		FilenameTemplate:     c.FilenameTemplate,
+		DryRun:               c.DryRun,
+		Metrics:              c.Metrics,
+		httpClient:           c.httpClient,
+		token:                c.token,
+		limiter:              c.limiter,
+		version:              c.version,
+	}
+}
+
+// SelectOrg makes the organisation configured on the client the one the
+// requests are made in. API keys belong to a single organisation, and the
+// X-Grafana-Org-Id header the client sends is enough, but with basic auth the
+// user's current organisation is switched to the configured one, unless it's a
+// dry run, which relies on the header. Does nothing if no organisation is
+// configured.
+// Returns an error if the organisation doesn't exist, the credentials don't
+// give access to it, or it couldn't be checked.
+func (c *Client) SelectOrg(ctx context.Context) (err error) {
+	if c.OrgID <= 0 {
+		return
+	}
+
+	if c.token == nil && !c.DryRun {
+		if _, err = c.request(ctx, "POST", "user/using/"+strconv.FormatInt(c.OrgID, 10), nil); err != nil {
+			return fmt.Errorf("Failed to switch to the organisation %d: %w", c.OrgID, err)
+		}
+	}
+
+	body, err := c.request(ctx, "GET", "org", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve the organisation %d: %w", c.OrgID, err)
+	}
+
+	var org orgResponse
+	if err = json.Unmarshal(body, &org); err != nil {
+		return
+	}
+	// Grafana ignores the header for API keys belonging to another
+	// organisation, in which case the key's organisation is the current one.
+	if org.ID != c.OrgID {
+		return fmt.Errorf("The credentials give access to the organisation %d (%s), not %d", org.ID, org.Name, c.OrgID)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":   org.ID,
+		"org_name": org.Name,
+	}).Info("Using the Grafana organisation")
+	return
+}
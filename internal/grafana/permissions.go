@@ -0,0 +1,152 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// permissionItem represents a permission as sent to the Grafana API.
+type permissionItem struct {
+	Role       string `json:"role,omitempty"`
+	TeamID     int64  `json:"teamId,omitempty"`
+	UserID     int64  `json:"userId,omitempty"`
+	Permission int    `json:"permission"`
+}
+
+// GetFolderPermissions requests the Grafana API for the permissions of the
+// folder with the given UID. The permissions inherited from elsewhere aren't
+// returned, since they can't be set on the folder.
+// Returns an error if there was an issue requesting the permissions or parsing
+// the response body.
+func (c *Client) GetFolderPermissions(ctx context.Context, uid string) (perms *format.FolderPermissions, err error) {
+	if uid == "" {
+		return nil, errEmptyIdentifier
+	}
+
+	items, err := c.getPermissions(ctx, "folders/"+url.PathEscape(uid)+"/permissions")
+	if err != nil {
+		return
+	}
+	return &format.FolderPermissions{FolderUID: uid, Items: items}, nil
+}
+
+// UpdateFolderPermissions replaces the permissions of the folder with the
+// given UID with the given ones, looking the teams referenced by name up on
+// the Grafana instance.
+// Returns an error if a team couldn't be found, or if there was an issue
+// generating the request body or performing the requests.
+func (c *Client) UpdateFolderPermissions(ctx context.Context, uid string, perms []format.Permission) (err error) {
+	if uid == "" {
+		return errEmptyIdentifier
+	}
+	return c.updatePermissions(ctx, "folders/"+url.PathEscape(uid)+"/permissions", perms)
+}
+
+// GetDashboardPermissions requests the Grafana API for the permissions of the
+// dashboard with the given UID. The permissions inherited from its folder
+// aren't returned, since they're set on the folder.
+// Returns an error if there was an issue requesting the permissions or parsing
+// the response body.
+func (c *Client) GetDashboardPermissions(ctx context.Context, uid string) (perms *format.DashboardPermissions, err error) {
+	if uid == "" {
+		return nil, errEmptyIdentifier
+	}
+
+	items, err := c.getPermissions(ctx, "dashboards/uid/"+url.PathEscape(uid)+"/permissions")
+	if err != nil {
+		return
+	}
+	return &format.DashboardPermissions{DashboardUID: uid, Items: items}, nil
+}
+
+// UpdateDashboardPermissions replaces the permissions of the dashboard with
+// the given UID with the given ones, looking the teams referenced by name up
+// on the Grafana instance.
+// Returns an error if a team couldn't be found, or if there was an issue
+// generating the request body or performing the requests.
+func (c *Client) UpdateDashboardPermissions(ctx context.Context, uid string, perms []format.Permission) (err error) {
+	if uid == "" {
+		return errEmptyIdentifier
+	}
+	return c.updatePermissions(ctx, "dashboards/uid/"+url.PathEscape(uid)+"/permissions", perms)
+}
+
+// getPermissions requests the permissions at the given endpoint, leaving the
+// inherited ones out, and references the teams by name.
+// Returns an error if there was an issue requesting the permissions or parsing
+// the response body.
+func (c *Client) getPermissions(ctx context.Context, endpoint string) (perms []format.Permission, err error) {
+	body, err := c.request(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return
+	}
+
+	var items []struct {
+		Role       string `json:"role"`
+		TeamID     int64  `json:"teamId"`
+		Team       string `json:"team"`
+		UserID     int64  `json:"userId"`
+		UserLogin  string `json:"userLogin"`
+		Permission int    `json:"permission"`
+		Inherited  bool   `json:"inherited"`
+	}
+	if err = json.Unmarshal(body, &items); err != nil {
+		return
+	}
+
+	perms = make([]format.Permission, 0, len(items))
+	for _, item := range items {
+		if item.Inherited {
+			continue
+		}
+		perm := format.Permission{Role: item.Role, Permission: item.Permission}
+		if item.TeamID != 0 {
+			perm.Team = item.Team
+		} else if item.UserID != 0 {
+			perm.UserID = item.UserID
+			perm.UserLogin = item.UserLogin
+		}
+		perms = append(perms, perm)
+	}
+	return
+}
+
+// updatePermissions replaces the permissions at the given endpoint with the
+// given ones, looking the teams referenced by name up on the Grafana instance.
+// Returns an error if a team couldn't be found, or if there was an issue
+// generating the request body or performing the requests.
+func (c *Client) updatePermissions(ctx context.Context, endpoint string, perms []format.Permission) (err error) {
+	var reqBody struct {
+		Items []permissionItem `json:"items"`
+	}
+	reqBody.Items = make([]permissionItem, 0, len(perms))
+	// The teams are only retrieved if a permission references one.
+	var teams format.TeamsFile
+	for _, perm := range perms {
+		item := permissionItem{Role: perm.Role, TeamID: perm.TeamID, UserID: perm.UserID, Permission: perm.Permission}
+		if perm.Team != "" {
+			if teams == nil {
+				if teams, err = c.GetTeams(ctx); err != nil {
+					return
+				}
+			}
+			team, ok := teams[perm.Team]
+			if !ok {
+				return fmt.Errorf("No team named %q on the Grafana instance", perm.Team)
+			}
+			item.TeamID = team.ID
+		}
+		reqBody.Items = append(reqBody.Items, item)
+	}
+
+	reqBodyJSON, err := json.Marshal(reqBody)
+	if err != nil {
+		return
+	}
+	_, err = c.request(ctx, "POST", endpoint, reqBodyJSON)
+	return
+}
@@ -0,0 +1,127 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+// pluginResponse represents an element of the response to a plugins listing
+// query. All fields described from the Grafana documentation aren't located in
+// this structure because there are some we don't need.
+type pluginResponse struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// PluginDashboard represents a dashboard shipped by an app plugin, as listed by
+// the plugin's dashboards endpoint.
+type PluginDashboard struct {
+	PluginID    string `json:"pluginId"`
+	UID         string `json:"uid"`
+	Title       string `json:"title"`
+	Imported    bool   `json:"imported"`
+	ImportedURI string `json:"importedUri"`
+}
+
+// GetPluginDashboards requests the Grafana API for the dashboards installed by
+// each enabled app plugin, and returns the ones that have been imported on the
+// instance.
+// Returns an error if there was an issue requesting the plugins or their
+// dashboards, or parsing the response bodies.
+func (c *Client) GetPluginDashboards(ctx context.Context) (dashboards []PluginDashboard, err error) {
+	dashboards = make([]PluginDashboard, 0)
+
+	body, err := c.request(ctx, "GET", "plugins?type=app&enabled=1", nil)
+	if err != nil {
+		return
+	}
+
+	var plugins []pluginResponse
+	if err = json.Unmarshal(body, &plugins); err != nil {
+		return
+	}
+
+	for _, plugin := range plugins {
+		body, err = c.request(ctx, "GET", "plugins/"+url.PathEscape(plugin.ID)+"/dashboards", nil)
+		if err != nil {
+			return
+		}
+
+		var pluginDashboards []PluginDashboard
+		if err = json.Unmarshal(body, &pluginDashboards); err != nil {
+			return
+		}
+
+		for _, db := range pluginDashboards {
+			if !db.Imported {
+				continue
+			}
+			// Older Grafana versions don't always fill the plugin ID in.
+			db.PluginID = plugin.ID
+			dashboards = append(dashboards, db)
+		}
+	}
+
+	return
+}
+
+// pluginOwnersByUID matches the dashboards installed by plugins with the
+// dashboards found by a search, using the dashboard's UID or, if the plugin
+// dashboards endpoint doesn't provide it, its URI. Returns a map linking the
+// UID of each dashboard owned by a plugin to the plugin's ID.
+func pluginOwnersByUID(pluginDashboards []PluginDashboard, dashboardMetaBySlug map[string]DbSearchResponse) map[string]string {
+	ownerByUID := make(map[string]string)
+	ownerByURI := make(map[string]string)
+	for _, db := range pluginDashboards {
+		if db.UID != "" {
+			ownerByUID[db.UID] = db.PluginID
+		} else if db.ImportedURI != "" {
+			ownerByURI[db.ImportedURI] = db.PluginID
+		}
+	}
+
+	for _, meta := range dashboardMetaBySlug {
+		if pluginID, ok := ownerByURI[meta.URI]; ok {
+			ownerByUID[meta.UID] = pluginID
+		}
+	}
+
+	return ownerByUID
+}
+
+// LoadPluginOwners retrieves the dashboards installed by plugins and records
+// in the definitions the ones owned by a plugin which ID isn't part of the
+// given list of included plugins. Such dashboards aren't managed, i.e. they're
+// never pulled, pushed or deleted, so the manager doesn't fight with the
+// plugins installing them.
+// Returns an error if the plugin dashboards couldn't be retrieved.
+func (c *Client) LoadPluginOwners(ctx context.Context, defs *DefsFile, includePlugins []string) (err error) {
+	pluginDashboards, err := c.GetPluginDashboards(ctx)
+	if err != nil {
+		return
+	}
+
+	included := make(map[string]bool)
+	for _, pluginID := range includePlugins {
+		included[pluginID] = true
+	}
+
+	defs.UnmanagedPluginDashboards = make(map[string]string)
+	for uid, pluginID := range pluginOwnersByUID(pluginDashboards, defs.DashboardMetaBySlug) {
+		if !included[pluginID] {
+			defs.UnmanagedPluginDashboards[uid] = pluginID
+		}
+	}
+
+	return
+}
+
+// UnmanagedPluginOwner returns the ID of the plugin owning the dashboard with
+// the given UID, and true if the dashboard must be left alone because of it.
+func (d DefsFile) UnmanagedPluginOwner(uid string) (pluginID string, unmanaged bool) {
+	pluginID, unmanaged = d.UnmanagedPluginDashboards[uid]
+	return
+}
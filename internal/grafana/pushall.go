@@ -0,0 +1,212 @@
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// libraryPanelPaths are the paths of the UIDs of the library panels a
+// dashboard uses, including in collapsed rows.
+var libraryPanelPaths = []string{"panels.#.libraryPanel.uid", "panels.#.panels.#.libraryPanel.uid"}
+
+// PushFiles are the files of an organisation PushAll pushes to, or deletes
+// from, Grafana.
+type PushFiles struct {
+	// Folders, Datasources, Libraries and Dashboards are the added or
+	// modified files, including the permissions files.
+	Folders     []string
+	Datasources []string
+	Libraries   []string
+	Dashboards  []string
+	// RemovedDashboards and RemovedLibraries are the files removed from the
+	// repository, which dashboards and libraries are only deleted if Delete
+	// is true.
+	RemovedDashboards []string
+	RemovedLibraries  []string
+	Delete            bool
+	// Contents maps the files to their contents, the last known ones for
+	// the removed files.
+	Contents map[string][]byte
+}
+
+// PushAll pushes the given files to Grafana in the order they depend on each
+// other: the folders first, then the datasources if they're synchronised,
+// then the libraries, and the dashboards last. A dashboard using a library
+// panel which couldn't be pushed, or which doesn't exist on Grafana, isn't
+// pushed, so it doesn't render as broken, and fails so it's pushed again
+// later. The ignored files are filtered out first.
+// The definitions from Grafana are retrieved with the given function once the
+// folders exist. The dashboards removed from the repository are deleted before
+// the others are pushed, in case they were renamed, and the libraries after,
+// once no dashboard uses them anymore.
+// Returns the result of each push and deletion, the first error encountered
+// pushing the libraries or the dashboards, if any, and an error if the files
+// couldn't be filtered or the definitions retrieved.
+func PushAll(
+	ctx context.Context, cfg *config.Config, client *Client, files PushFiles, versionsFile DefsFile,
+	definitions func(ctx context.Context) (DefsFile, error),
+) (run *results.RunResult, pushErr error, err error) {
+	run = results.NewRunResult()
+	contents := files.Contents
+	if err = FilterIgnored(&contents, cfg); err != nil {
+		return
+	}
+
+	run.Merge(client.CreateFolders(ctx, withContents(files.Folders, contents), contents))
+	// The dashboards and libraries may need the datasources.
+	if cfg.Grafana.SyncDatasources {
+		run.Merge(PushDatasourceFiles(ctx, withContents(files.Datasources, contents), contents, client))
+	}
+
+	grafanaVersionFile, err := definitions(ctx)
+	if err != nil {
+		return
+	}
+
+	// Unless the file was only moved, deleting the dashboard would delete
+	// the one it moved to.
+	dashboards := withContents(files.Dashboards, contents)
+	if files.Delete {
+		deleted := WithoutMovedDashboards(withContents(files.RemovedDashboards, contents), dashboards, contents)
+		run.Merge(DeleteDashboards(ctx, deleted, contents, grafanaVersionFile, client))
+	}
+
+	libRun := PushLibraryFiles(ctx, withContents(files.Libraries, contents), contents, versionsFile, grafanaVersionFile, client)
+	dashboards, deferred := deferMissingLibraries(ctx, dashboards, contents, libRun, grafanaVersionFile, client)
+	dbRun := PushDashboardFiles(ctx, dashboards, contents, versionsFile, grafanaVersionFile, client)
+	run.Merge(libRun, deferred, dbRun)
+
+	if files.Delete {
+		run.Merge(DeleteLibraries(ctx, withContents(files.RemovedLibraries, contents), contents, grafanaVersionFile, client))
+	}
+
+	if pushErr = libRun.Err(); pushErr == nil {
+		pushErr = deferred.Err()
+	}
+	if pushErr == nil {
+		pushErr = dbRun.Err()
+	}
+	return
+}
+
+// withContents returns the given files which have a content in the given map,
+// i.e. which haven't been filtered out as ignored.
+func withContents(filenames []string, contents map[string][]byte) (present []string) {
+	present = make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if _, ok := contents[filename]; ok {
+			present = append(present, filename)
+		}
+	}
+	return
+}
+
+// deferMissingLibraries checks that the library panels used by the given
+// dashboard files are available, i.e. that they were pushed by the given run,
+// or that they already exist on Grafana, according to the given definitions
+// or else to the instance itself.
+// Returns the dashboard files which can be pushed, along with their
+// permissions files, and the results of the other ones, which are deferred.
+func deferMissingLibraries(
+	ctx context.Context, filenames []string, contents map[string][]byte, libRun *results.RunResult,
+	grafanaVersionFile DefsFile, client *Client,
+) (ready []string, deferred *results.RunResult) {
+	deferred = results.NewRunResult()
+
+	// The libraries skipped by a dry run would have been pushed.
+	available := make(map[string]bool)
+	for uid := range grafanaVersionFile.LibraryMetaByUID {
+		available[uid] = true
+	}
+	failed := make(map[string]bool)
+	for _, item := range libRun.Items() {
+		if item.UID != "" {
+			available[item.UID] = item.Outcome != results.OutcomeFailed
+			failed[item.UID] = item.Outcome == results.OutcomeFailed
+		}
+	}
+
+	missing := make(map[string]bool)
+	ready = make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if format.IsPermissionsFile(filename) {
+			continue
+		}
+
+		unavailable := make([]string, 0)
+		for _, uid := range libraryPanelUIDs(contents[filename]) {
+			if !available[uid] && !failed[uid] {
+				exists, err := client.libraryExists(ctx, uid)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"error":    err,
+						"filename": filename,
+						"library":  uid,
+					}).Error("Failed to look the dashboard's library panel up on Grafana")
+				}
+				available[uid], failed[uid] = exists, !exists
+			}
+			if failed[uid] {
+				unavailable = append(unavailable, uid)
+			}
+		}
+		if len(unavailable) == 0 {
+			ready = append(ready, filename)
+			continue
+		}
+
+		uid, _, _ := UIDNameFromRawJSON(contents[filename])
+		logrus.WithFields(logrus.Fields{
+			"filename":  filename,
+			"libraries": unavailable,
+		}).Error("Dashboard uses library panels which couldn't be pushed or don't exist on Grafana, not pushing it")
+		missing[filename] = true
+		deferred.Add(results.NewItem(results.KindDashboard, results.ActionPush, uid, filename).Finish(fmt.Errorf(
+			"The library panels %s used by %s aren't on Grafana", strings.Join(unavailable, ", "), filename,
+		)))
+	}
+
+	// The permissions follow the dashboard they're for.
+	for _, filename := range filenames {
+		if !format.IsPermissionsFile(filename) {
+			continue
+		}
+		if missing[format.PermissionsTarget(filename)] {
+			deferred.Add(results.NewItem(results.KindDashboard, results.ActionPush, "", filename).Skip("the dashboard couldn't be pushed"))
+			continue
+		}
+		ready = append(ready, filename)
+	}
+	return
+}
+
+// libraryPanelUIDs returns the UIDs of the library panels the dashboard with
+// the given JSON description uses, including in collapsed rows, sorted.
+func libraryPanelUIDs(content []byte) []string {
+	uids := make(map[string]bool)
+	for _, path := range libraryPanelPaths {
+		gjson.GetBytes(content, path).ForEach(func(_, uid gjson.Result) bool {
+			if uid.IsArray() {
+				uid.ForEach(func(_, nested gjson.Result) bool {
+					if nested.String() != "" {
+						uids[nested.String()] = true
+					}
+					return true
+				})
+			} else if uid.String() != "" {
+				uids[uid.String()] = true
+			}
+			return true
+		})
+	}
+	return utils.SortedKeys(uids)
+}
@@ -0,0 +1,200 @@
+package grafana
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// SelfDashboardUID is the UID of the "Dashboards Manager Status" dashboard the
+// manager maintains on the Grafana instance. This dashboard belongs to the
+// manager rather than to the repository, so it is never pulled, pushed from
+// the repository or deleted.
+const SelfDashboardUID = "dashboards-manager-status"
+
+// SelfDashboardPanel identifies a text panel of the status dashboard holding
+// the summary of the latest run of a kind.
+type SelfDashboardPanel int
+
+// IDs of the status dashboard's text panels. The pusher pulls after each push,
+// so the summaries of the pulls and of the pushes have panels of their own so
+// the latter isn't overwritten right away.
+const (
+	SelfDashboardPullPanel SelfDashboardPanel = 1
+	SelfDashboardPushPanel SelfDashboardPanel = 6
+)
+
+//go:embed selfdashboard.json
+var selfDashboardJSON []byte
+
+// IsSelfDashboard returns true if the given UID is the one of the status
+// dashboard maintained by the manager.
+func IsSelfDashboard(uid string) bool {
+	return uid == SelfDashboardUID
+}
+
+// PushSelfDashboard creates or overwrites the status dashboard on the Grafana
+// instance with the built-in definition.
+// Returns an error if the dashboard couldn't be pushed.
+func (c *Client) PushSelfDashboard(ctx context.Context) (err error) {
+	logrus.WithFields(logrus.Fields{
+		"uid":        SelfDashboardUID,
+		"datasource": c.SelfDashboardDatasource,
+	}).Info("Pushing the dashboards manager status dashboard")
+
+	dashJSON, err := selfDashboard(c.SelfDashboardDatasource)
+	if err != nil {
+		return
+	}
+
+	return c.CreateOrUpdateDashboard(ctx, dashJSON, "")
+}
+
+// selfDashboard returns the built-in definition of the status dashboard, which
+// panels querying the metrics use the Prometheus datasource with the given
+// UID, or the instance's default datasource if it's empty.
+// Returns an error if the definition couldn't be updated.
+func selfDashboard(datasourceUID string) (dashJSON []byte, err error) {
+	if datasourceUID == "" {
+		return selfDashboardJSON, nil
+	}
+
+	dashRaw := string(selfDashboardJSON)
+	for i, panel := range gjson.Get(dashRaw, "panels").Array() {
+		if !panel.Get("datasource").Exists() {
+			continue
+		}
+		path := "panels." + strconv.Itoa(i)
+		if dashRaw, err = sjson.Set(dashRaw, path+".datasource.uid", datasourceUID); err != nil {
+			return
+		}
+		for j := range panel.Get("targets").Array() {
+			targetPath := path + ".targets." + strconv.Itoa(j) + ".datasource.uid"
+			if dashRaw, err = sjson.Set(dashRaw, targetPath, datasourceUID); err != nil {
+				return
+			}
+		}
+	}
+
+	return []byte(dashRaw), nil
+}
+
+// UpdateSelfDashboardPush replaces the content of the status dashboard's push
+// panel with a summary of the push of the given commit, which gave the given
+// results and ended with the given error, if any. Failing to update it doesn't
+// fail the push, so the error is only logged. Nothing is pushed on a dry run,
+// so the dashboard isn't updated either.
+func (c *Client) UpdateSelfDashboardPush(ctx context.Context, commit string, run *results.RunResult, pushErr error) {
+	if c.DryRun {
+		return
+	}
+
+	summary := selfDashboardPushSummary(commit, run, pushErr)
+	if err := c.UpdateSelfDashboardSummary(ctx, SelfDashboardPushPanel, summary); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"commit": commit,
+		}).Warn("Failed to update the status dashboard")
+	}
+}
+
+// selfDashboardPushSummary renders the markdown summary of a push displayed in
+// the status dashboard's push panel.
+func selfDashboardPushSummary(commit string, run *results.RunResult, err error) string {
+	hostname, _ := os.Hostname()
+
+	summary := fmt.Sprintf("**Last push:** %s on %s\n\n", time.Now().UTC().Format(time.RFC3339), hostname)
+	if len(commit) > 0 {
+		summary += fmt.Sprintf("**Commit:** `%s`\n\n", commit)
+	}
+
+	pushed, deleted := 0, 0
+	for _, item := range run.Items() {
+		if item.Outcome == results.OutcomeSkipped || item.Outcome == results.OutcomeFailed {
+			continue
+		}
+		switch item.Action {
+		case results.ActionPush:
+			pushed++
+		case results.ActionDelete:
+			deleted++
+		}
+	}
+	summary += "| | Count |\n|---|---|\n"
+	summary += fmt.Sprintf("| Pushed | %d |\n", pushed)
+	summary += fmt.Sprintf("| Deleted | %d |\n", deleted)
+	summary += fmt.Sprintf("| Skipped | %d |\n", run.Count(results.OutcomeSkipped))
+	summary += fmt.Sprintf("| Failed | %d |\n", run.Count(results.OutcomeFailed))
+
+	if failed := run.Failed(); len(failed) > 0 {
+		summary += "\n**Failed:**\n\n"
+		for _, item := range failed {
+			summary += fmt.Sprintf("* %s %s: %s\n", item.Kind, item.Slug, item.Error)
+		}
+	}
+
+	if err != nil {
+		summary += fmt.Sprintf("\n**Error:** `%v`\n", err)
+	}
+
+	return summary
+}
+
+// UpdateSelfDashboardSummary replaces the content of the given text panel of
+// the status dashboard with the given markdown summary. If the dashboard
+// doesn't exist (e.g. it was deleted by hand), or predates the panel, it is
+// pushed again first.
+// Returns an error if the dashboard couldn't be retrieved or updated.
+func (c *Client) UpdateSelfDashboardSummary(ctx context.Context, panelID SelfDashboardPanel, summary string) (err error) {
+	db, err := c.GetDashboard(ctx, "uid/"+SelfDashboardUID)
+	if err != nil {
+		if err = c.PushSelfDashboard(ctx); err != nil {
+			return
+		}
+		if db, err = c.GetDashboard(ctx, "uid/"+SelfDashboardUID); err != nil {
+			return
+		}
+	}
+
+	dashRaw := string(db.RawJSON)
+	panelIndex := selfDashboardPanelIndex(dashRaw, panelID)
+	if panelIndex < 0 {
+		if err = c.PushSelfDashboard(ctx); err != nil {
+			return
+		}
+		if db, err = c.GetDashboard(ctx, "uid/"+SelfDashboardUID); err != nil {
+			return
+		}
+		dashRaw = string(db.RawJSON)
+		if panelIndex = selfDashboardPanelIndex(dashRaw, panelID); panelIndex < 0 {
+			return fmt.Errorf("no summary panel %d in dashboard %s", panelID, SelfDashboardUID)
+		}
+	}
+
+	dashRaw, err = sjson.Set(dashRaw, "panels."+strconv.Itoa(panelIndex)+".options.content", summary)
+	if err != nil {
+		return
+	}
+
+	return c.CreateOrUpdateDashboard(ctx, []byte(dashRaw), "")
+}
+
+// selfDashboardPanelIndex returns the index of the panel with the given ID in
+// the given status dashboard, or -1 if it doesn't have this panel.
+func selfDashboardPanelIndex(dashRaw string, panelID SelfDashboardPanel) int {
+	for i, panel := range gjson.Get(dashRaw, "panels").Array() {
+		if panel.Get("id").Int() == int64(panelID) {
+			return i
+		}
+	}
+	return -1
+}
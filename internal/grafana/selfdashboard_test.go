@@ -0,0 +1,218 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+
+	"github.com/tidwall/gjson"
+)
+
+// selfDashboardPanel returns the panel with the given ID of the given status
+// dashboard.
+func selfDashboardPanel(t *testing.T, dashboard []byte, panelID SelfDashboardPanel) gjson.Result {
+	t.Helper()
+	for _, panel := range gjson.GetBytes(dashboard, "panels").Array() {
+		if panel.Get("id").Int() == int64(panelID) {
+			return panel
+		}
+	}
+	t.Fatalf("no panel %d in the status dashboard", panelID)
+	return gjson.Result{}
+}
+
+func TestPushSelfDashboard(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+	client.SelfDashboardDatasource = "prometheus-uid"
+
+	if err := client.PushSelfDashboard(context.Background()); err != nil {
+		t.Fatalf("PushSelfDashboard: %v", err)
+	}
+
+	dashboard := fake.dashboard(SelfDashboardUID)
+	if dashboard == nil {
+		t.Fatalf("the status dashboard wasn't pushed")
+	}
+
+	stats := 0
+	for _, panel := range gjson.GetBytes(dashboard, "panels").Array() {
+		if panel.Get("type").String() != "stat" {
+			continue
+		}
+		stats++
+		if uid := panel.Get("datasource.uid").String(); uid != "prometheus-uid" {
+			t.Errorf("panel %q queries datasource %q, want prometheus-uid", panel.Get("title"), uid)
+		}
+		for _, target := range panel.Get("targets").Array() {
+			if uid := target.Get("datasource.uid").String(); uid != "prometheus-uid" {
+				t.Errorf("target of panel %q queries datasource %q, want prometheus-uid", panel.Get("title"), uid)
+			}
+		}
+	}
+	if stats == 0 {
+		t.Errorf("the status dashboard has no stat panel")
+	}
+}
+
+func TestSelfDashboardDefaultDatasource(t *testing.T) {
+	dashboard, err := selfDashboard("")
+	if err != nil {
+		t.Fatalf("selfDashboard: %v", err)
+	}
+	for _, panel := range gjson.GetBytes(dashboard, "panels").Array() {
+		if panel.Get("datasource.uid").Exists() {
+			t.Errorf("panel %q has a datasource UID, want the default datasource", panel.Get("title"))
+		}
+	}
+}
+
+// The stat panels must query metrics the manager actually exposes.
+func TestSelfDashboardQueriesRegisteredMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewPuller(registry).ObservePull(1, 1, 1, true)
+	metrics.NewGrafanaRequests(registry).ObserveRequest("dashboards", "500", time.Second)
+	var exposed bytes.Buffer
+	if err := registry.Write(&exposed); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	metricName := regexp.MustCompile(`grafana_dashboards_manager_[a-z_]+`)
+	for _, panel := range gjson.GetBytes(selfDashboardJSON, "panels").Array() {
+		for _, target := range panel.Get("targets").Array() {
+			for _, name := range metricName.FindAllString(target.Get("expr").String(), -1) {
+				if !bytes.Contains(exposed.Bytes(), []byte("# TYPE "+name+" ")) {
+					t.Errorf("panel %q queries %s, which isn't registered", panel.Get("title"), name)
+				}
+			}
+		}
+	}
+}
+
+func TestUpdateSelfDashboardSummary(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := client.PushSelfDashboard(ctx); err != nil {
+		t.Fatalf("PushSelfDashboard: %v", err)
+	}
+	if err := client.UpdateSelfDashboardSummary(ctx, SelfDashboardPushPanel, "pushed 3 dashboards"); err != nil {
+		t.Fatalf("UpdateSelfDashboardSummary: %v", err)
+	}
+
+	dashboard := fake.dashboard(SelfDashboardUID)
+	if content := selfDashboardPanel(t, dashboard, SelfDashboardPushPanel).Get("options.content").String(); content != "pushed 3 dashboards" {
+		t.Errorf("push panel content = %q, want the summary", content)
+	}
+	if content := selfDashboardPanel(t, dashboard, SelfDashboardPullPanel).Get("options.content").String(); content != "No pull recorded yet." {
+		t.Errorf("pull panel content = %q, want it unchanged", content)
+	}
+	if n := fake.count("POST /api/dashboards/db"); n != 2 {
+		t.Errorf("got %d pushes, want 2", n)
+	}
+}
+
+// A status dashboard deleted by hand is pushed again before it's updated.
+func TestUpdateSelfDashboardSummaryMissing(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+
+	if err := client.UpdateSelfDashboardSummary(context.Background(), SelfDashboardPullPanel, "pulled"); err != nil {
+		t.Fatalf("UpdateSelfDashboardSummary: %v", err)
+	}
+
+	dashboard := fake.dashboard(SelfDashboardUID)
+	if dashboard == nil {
+		t.Fatalf("the status dashboard wasn't pushed again")
+	}
+	if content := selfDashboardPanel(t, dashboard, SelfDashboardPullPanel).Get("options.content").String(); content != "pulled" {
+		t.Errorf("pull panel content = %q, want the summary", content)
+	}
+}
+
+func TestUpdateSelfDashboardPush(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+
+	run := results.NewRunResult()
+	run.Add(
+		results.NewItem(results.KindDashboard, results.ActionPush, "a", "a.json").Finish(nil),
+		results.NewItem(results.KindDashboard, results.ActionDelete, "b", "b.json").Finish(nil),
+	)
+	client.UpdateSelfDashboardPush(context.Background(), "0123abcd", run, nil)
+
+	content := selfDashboardPanel(t, fake.dashboard(SelfDashboardUID), SelfDashboardPushPanel).Get("options.content").String()
+	for _, want := range []string{"`0123abcd`", "| Pushed | 1 |", "| Deleted | 1 |", "| Failed | 0 |"} {
+		if !bytes.Contains([]byte(content), []byte(want)) {
+			t.Errorf("push summary %q doesn't contain %q", content, want)
+		}
+	}
+
+	// A dry run doesn't touch the instance.
+	client.DryRun = true
+	before := fake.count("POST /api/dashboards/db")
+	client.UpdateSelfDashboardPush(context.Background(), "0123abcd", run, nil)
+	if after := fake.count("POST /api/dashboards/db"); after != before {
+		t.Errorf("a dry run pushed the status dashboard")
+	}
+}
+
+func TestFilterIgnoredSelfDashboard(t *testing.T) {
+	contents := map[string][]byte{
+		"status.json": selfDashboardJSON,
+		"other.json":  []byte(`{"uid":"other","title":"Other"}`),
+	}
+	if err := FilterIgnored(&contents, &config.Config{}); err != nil {
+		t.Fatalf("FilterIgnored: %v", err)
+	}
+	if _, ok := contents["status.json"]; ok {
+		t.Errorf("the status dashboard would be pushed from the repository")
+	}
+	if _, ok := contents["other.json"]; !ok {
+		t.Errorf("another dashboard was filtered out")
+	}
+}
+
+func TestDeleteDashboardsSkipsSelfDashboard(t *testing.T) {
+	fake := newFakeDashboards()
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := client.PushSelfDashboard(ctx); err != nil {
+		t.Fatalf("PushSelfDashboard: %v", err)
+	}
+	if err := client.CreateOrUpdateDashboard(ctx, []byte(`{"uid":"other","title":"Other"}`), ""); err != nil {
+		t.Fatalf("CreateOrUpdateDashboard: %v", err)
+	}
+
+	// The status dashboard's file may be known by UID or only by its slug.
+	defs := DefsFile{DashboardMetaBySlug: map[string]DbSearchResponse{
+		"dashboards-manager-status": {UID: SelfDashboardUID},
+	}}
+	contents := map[string][]byte{
+		"status.json": selfDashboardJSON,
+		"other.json":  []byte(`{"uid":"other","title":"Other"}`),
+	}
+	filenames := []string{"status.json", "dashboards-manager-status.json", "other.json"}
+	run := DeleteDashboards(ctx, filenames, contents, defs, client)
+
+	if n := fake.count("DELETE /api/dashboards/uid/" + SelfDashboardUID); n != 0 {
+		t.Errorf("the status dashboard was deleted %d times", n)
+	}
+	if fake.dashboard(SelfDashboardUID) == nil {
+		t.Errorf("the status dashboard is gone")
+	}
+	if n := fake.count("DELETE /api/dashboards/uid/other"); n != 1 {
+		t.Errorf("the other dashboard was deleted %d times, want once", n)
+	}
+	if items := run.Items(); len(items) != 1 {
+		t.Errorf("got %d results, want 1: %+v", len(items), items)
+	}
+}
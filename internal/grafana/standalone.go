@@ -0,0 +1,215 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotADashboard is returned by PrepareDashboard when the content it is
+// given doesn't describe a dashboard.
+var ErrNotADashboard = errors.New("The content isn't the JSON description of a dashboard")
+
+// uidAlphabet is the set of characters generated UIDs are made of.
+const uidAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// dashboardInput represents an input of a dashboard exported for sharing,
+// such as the datasources it uses.
+type dashboardInput struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+// PrepareDashboard turns the JSON description of a dashboard coming from
+// outside of the repository into one that can be pushed: the description is
+// unwrapped if it's the dashboard envelope returned by the Grafana API, the ID
+// is removed, a UID is generated if there's none, and the datasource inputs of
+// dashboards exported for sharing (e.g. "${DS_PROMETHEUS}") are replaced with
+// the UID of a datasource of the same type, preferably the default one.
+// Returns the prepared description and the dashboard's UID.
+// Returns an error if the content couldn't be parsed, or if a datasource input
+// couldn't be resolved.
+func (c *Client) PrepareDashboard(ctx context.Context, content []byte) (prepared []byte, uid string, err error) {
+	var dashboard map[string]interface{}
+	if err = json.Unmarshal(content, &dashboard); err != nil {
+		return
+	}
+
+	// Unwrap the {"dashboard": ..., "meta": ...} envelope.
+	if inner, ok := dashboard["dashboard"].(map[string]interface{}); ok && dashboard["title"] == nil {
+		dashboard = inner
+	}
+	if _, ok := dashboard["title"].(string); !ok {
+		err = ErrNotADashboard
+		return
+	}
+
+	delete(dashboard, "id")
+
+	if uid, _ = dashboard["uid"].(string); uid == "" {
+		if uid, err = generateUID(); err != nil {
+			return
+		}
+		dashboard["uid"] = uid
+	}
+
+	// Only the datasource inputs can be resolved without asking the user.
+	var inputs []dashboardInput
+	if rawInputs, ok := dashboard["__inputs"]; ok {
+		var inputsJSON []byte
+		if inputsJSON, err = json.Marshal(rawInputs); err != nil {
+			return
+		}
+		if err = json.Unmarshal(inputsJSON, &inputs); err != nil {
+			return
+		}
+		delete(dashboard, "__inputs")
+	}
+
+	if prepared, err = json.Marshal(dashboard); err != nil {
+		return
+	}
+
+	var datasources []datasourceResponse
+	for _, input := range inputs {
+		if input.Type != "datasource" {
+			continue
+		}
+
+		if datasources == nil {
+			if datasources, err = c.getDatasources(ctx); err != nil {
+				return
+			}
+		}
+
+		ds, found := pickDatasource(datasources, input.PluginID)
+		if !found {
+			err = fmt.Errorf("No datasource of type %s found for the input %s", input.PluginID, input.Name)
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"input":      input.Name,
+			"datasource": ds.Name,
+		}).Info("Resolved datasource input")
+
+		prepared = bytes.ReplaceAll(prepared, []byte("${"+input.Name+"}"), []byte(ds.UID))
+	}
+
+	return
+}
+
+// ResolveFolder returns the UID of the folder identified by the given UID or
+// title, creating a folder with the given title if there's none (see
+// ResolveFolderByTitle). An empty
+// folder means the General folder, which UID is empty.
+// Returns an error if there was an issue requesting or creating the folder.
+func (c *Client) ResolveFolder(ctx context.Context, folder string) (uid string, err error) {
+	if folder == "" {
+		return
+	}
+
+	// Look the folder up by UID first.
+	body, err := c.request(ctx, "GET", "folders/"+url.PathEscape(folder), nil)
+	if err == nil {
+		var resp folderResponse
+		err = json.Unmarshal(body, &resp)
+		return resp.UID, err
+	}
+	if !isNotFound(err) {
+		return
+	}
+
+	// Then by title.
+	return c.ResolveFolderByTitle(ctx, folder)
+}
+
+// ResolveFolderByTitle returns the UID of the folder with the given title,
+// creating it with a generated UID if there's none. On a dry run, the folder
+// isn't created but the generated UID is returned.
+// Returns an error if several folders have this title, or if there was an
+// issue requesting or creating the folder.
+func (c *Client) ResolveFolderByTitle(ctx context.Context, title string) (uid string, err error) {
+	body, err := c.request(ctx, "GET", "search?type=dash-folder&query="+url.QueryEscape(title), nil)
+	if err != nil {
+		return
+	}
+	var results []DbSearchResponse
+	if err = json.Unmarshal(body, &results); err != nil {
+		return
+	}
+
+	matches := make([]string, 0)
+	for _, result := range results {
+		if result.Title == title {
+			matches = append(matches, result.UID)
+		}
+	}
+	switch {
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		sort.Strings(matches)
+		err = fmt.Errorf("Several folders are titled %q (UIDs %s), use __folderUID instead", title, strings.Join(matches, ", "))
+		return
+	}
+
+	// Else create it.
+	if uid, err = generateUID(); err != nil {
+		return
+	}
+
+	if c.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"title": title,
+			"uid":   uid,
+		}).Info("Dry run: folder not found, it would be created")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"title": title,
+		"uid":   uid,
+	}).Info("Folder not found, creating it")
+
+	reqBody, err := json.Marshal(folderCreateOrUpdateRequest{Title: title, Uid: uid})
+	if err != nil {
+		return
+	}
+	if body, err = c.request(ctx, "POST", "folders", reqBody); err != nil {
+		return
+	}
+
+	var created folderResponse
+	if err = json.Unmarshal(body, &created); err == nil && created.UID != "" {
+		uid = created.UID
+	}
+	return
+}
+
+// DashboardURL returns the URL of the dashboard with the given UID on the
+// Grafana instance.
+func (c *Client) DashboardURL(uid string) string {
+	return c.BaseURL + "/d/" + url.PathEscape(uid)
+}
+
+// generateUID returns a random dashboard UID.
+func generateUID() (uid string, err error) {
+	b := make([]byte, 14)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+
+	for i := range b {
+		b[i] = uidAlphabet[int(b[i])%len(uidAlphabet)]
+	}
+	return string(b), nil
+}
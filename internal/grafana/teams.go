@@ -0,0 +1,59 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// teamsPageSize is the number of teams requested per page.
+const teamsPageSize = 100
+
+// teamsSearchResponse represents the response sent by the Grafana API to a
+// teams search.
+type teamsSearchResponse struct {
+	TotalCount int `json:"totalCount"`
+	Teams      []struct {
+		ID    int64  `json:"id"`
+		UID   string `json:"uid"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"teams"`
+}
+
+// GetTeams requests the Grafana API for the teams of the organisation, one
+// page after the other until all the teams counted by the API have been
+// retrieved.
+// Returns the teams by name, and an error if there was an issue requesting the
+// teams or parsing the response body.
+func (c *Client) GetTeams(ctx context.Context) (teams format.TeamsFile, err error) {
+	teams = make(format.TeamsFile)
+
+	for page, count := 1, 0; ; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("perpage", strconv.Itoa(teamsPageSize))
+
+		var body []byte
+		if body, err = c.request(ctx, "GET", "teams/search?"+query.Encode(), nil); err != nil {
+			return
+		}
+		resp := new(teamsSearchResponse)
+		if err = json.Unmarshal(body, resp); err != nil {
+			return
+		}
+
+		for _, team := range resp.Teams {
+			teams[team.Name] = format.Team{ID: team.ID, UID: team.UID, Email: team.Email}
+		}
+
+		// Stop on an empty page too, in case the total count is wrong.
+		count += len(resp.Teams)
+		if len(resp.Teams) == 0 || count >= resp.TotalCount {
+			return
+		}
+	}
+}
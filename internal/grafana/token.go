@@ -0,0 +1,103 @@
+package grafana
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TokenSource returns the API token the requests are authenticated with. It's
+// called again when Grafana rejects the token, so a token rotated in the
+// meantime is picked up.
+type TokenSource func() (string, error)
+
+// StaticToken returns a token source always returning the given token.
+func StaticToken(token string) TokenSource {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+// FileToken returns a token source reading the token from the file at the
+// given path, without the surrounding whitespace, each time it's called.
+func FileToken(path string) TokenSource {
+	return func() (string, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("The API key file %s is empty", path)
+		}
+		return token, nil
+	}
+}
+
+// tokenCache holds the token last returned by a token source, so the source is
+// only called again when Grafana rejects the token. It's shared by the clients
+// of all the organisations, and safe for concurrent use.
+type tokenCache struct {
+	source TokenSource
+
+	mu     sync.Mutex
+	token  string
+	loaded bool
+}
+
+// newTokenCache returns a cache for the given token source, or nil if there's
+// no source, in which case basic auth is used.
+func newTokenCache(source TokenSource) *tokenCache {
+	if source == nil {
+		return nil
+	}
+	return &tokenCache{source: source}
+}
+
+// get returns the current token, calling the source if it hasn't been called
+// yet.
+// Returns an error if the source couldn't give a token.
+func (t *tokenCache) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.loaded {
+		token, err := t.source()
+		if err != nil {
+			return "", err
+		}
+		t.token, t.loaded = token, true
+	}
+	return t.token, nil
+}
+
+// refresh calls the source again after the given token was rejected.
+// Returns true if the source gave another token, in which case the request
+// is worth retrying.
+func (t *tokenCache) refresh(rejected string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Another request may have refreshed the token already.
+	if t.loaded && t.token != rejected {
+		return true
+	}
+
+	token, err := t.source()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to reload the API key after Grafana rejected it")
+		return false
+	}
+	if token == rejected {
+		return false
+	}
+
+	logrus.Info("Grafana rejected the API key, retrying with the reloaded one")
+	t.token, t.loaded = token, true
+	return true
+}
@@ -0,0 +1,136 @@
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Version is the version of a Grafana instance, e.g. 10.4.2. Pre-release and
+// build suffixes are ignored.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersion parses a Grafana version, such as "10.4.2", "v9.5.0" or
+// "11.0.0-pre".
+// Returns an error if the version doesn't start with a major and a minor
+// version number.
+func ParseVersion(s string) (v Version, err error) {
+	core := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(core, "-+ "); i >= 0 {
+		core = core[:i]
+	}
+
+	parts := strings.SplitN(core, ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("Invalid Grafana version %q", s)
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		if numbers[i], err = strconv.Atoi(part); err != nil {
+			return v, fmt.Errorf("Invalid Grafana version %q: %w", s, err)
+		}
+	}
+	return Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// AtLeast returns true if the version is the given major and minor version,
+// or a later one.
+func (v Version) AtLeast(major int, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// String implements fmt.Stringer.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// versionCache holds the version of the Grafana instance, detected once from
+// its health endpoint. It's shared by the clients of all the organisations,
+// and safe for concurrent use.
+type versionCache struct {
+	mu       sync.Mutex
+	version  Version
+	known    bool
+	detected bool
+}
+
+// store records the given version, as given by Grafana's health endpoint.
+func (v *versionCache) store(s string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.parse(s)
+}
+
+// parse records the given version, logging a warning if it can't be parsed.
+// The lock must be held.
+func (v *versionCache) parse(s string) {
+	v.detected = true
+	version, err := ParseVersion(s)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to parse Grafana's version, assuming it's an old one")
+		return
+	}
+	v.version, v.known = version, true
+}
+
+// Version returns the version of the Grafana instance, requesting Grafana's
+// health endpoint on the first call. The version is unknown if the endpoint
+// couldn't be requested, in which case it's requested again on the next call.
+// Returns false if the version is unknown.
+func (c *Client) Version(ctx context.Context) (version Version, known bool) {
+	c.version.mu.Lock()
+	defer c.version.mu.Unlock()
+
+	if !c.version.detected {
+		health, err := c.Health(ctx)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Failed to detect Grafana's version")
+			return
+		}
+		c.version.parse(health.Version)
+	}
+	return c.version.version, c.version.known
+}
+
+// supportsFolderUIDs returns true if the Grafana instance identifies the
+// folders of dashboards and libraries by UID, i.e. if it's Grafana 9 or
+// later. Older versions, and the ones which couldn't be detected, need the
+// folder's ID.
+func (c *Client) supportsFolderUIDs(ctx context.Context) bool {
+	version, known := c.Version(ctx)
+	return known && version.AtLeast(9, 0)
+}
+
+// legacyFolderID returns the ID of the folder with the given UID, for the
+// Grafana versions which don't support folder UIDs. Returns 0 for the General
+// folder, for a folder which doesn't exist, or if Grafana supports folder UIDs.
+// Returns an error if the folders couldn't be requested.
+func (c *Client) legacyFolderID(ctx context.Context, folderUID string) (id int, err error) {
+	if folderUID == "" || c.supportsFolderUIDs(ctx) {
+		return
+	}
+
+	folders, err := c.GetFolderList(ctx)
+	if err != nil {
+		return
+	}
+	for _, folder := range folders {
+		if folder.Uid == folderUID {
+			logrus.Infof("Found folder ID %v for UID %v (%v)", folder.Id, folder.Uid, folder.Title)
+			return folder.Id, nil
+		}
+	}
+	return
+}
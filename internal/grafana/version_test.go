@@ -0,0 +1,130 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Version
+	}{
+		{"10.4.2", Version{10, 4, 2}},
+		{"v9.5.0", Version{9, 5, 0}},
+		{"11.0.0-pre", Version{11, 0, 0}},
+		{"8.5", Version{8, 5, 0}},
+		{"10.2.3+security-01", Version{10, 2, 3}},
+	} {
+		got, err := ParseVersion(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "10", "main", "10.x.1"} {
+		if _, err := ParseVersion(in); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+// fakeVersioned fakes a Grafana instance of the given version, which an empty
+// version makes unhealthy, holding the folder "ops" of ID 42. It records the
+// bodies of the creation requests by route.
+type fakeVersioned struct {
+	version string
+
+	lock   sync.Mutex
+	bodies map[string]json.RawMessage
+}
+
+func (f *fakeVersioned) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/health":
+		if f.version == "" {
+			http.Error(w, `{"message":"unavailable"}`, http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"database": "ok", "version": f.version})
+
+	case r.URL.Path == "/api/folders":
+		w.Write([]byte(`[{"id":42,"uid":"ops","title":"Ops"}]`))
+
+	case r.Method == "POST":
+		body, _ := io.ReadAll(r.Body)
+		f.lock.Lock()
+		f.bodies[r.URL.Path] = body
+		f.lock.Unlock()
+		w.Write([]byte(`{"status":"success","version":1}`))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// folderFields returns the folderUid and folderId fields of the given request
+// body, and whether it has a folderId.
+func folderFields(t *testing.T, body json.RawMessage) (uid string, id int, hasID bool) {
+	t.Helper()
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatalf("Unmarshal %s: %v", body, err)
+	}
+	json.Unmarshal(fields["folderUid"], &uid)
+	raw, hasID := fields["folderId"]
+	json.Unmarshal(raw, &id)
+	return
+}
+
+// Grafana 9 and later get the folder's UID, older versions its ID too.
+func TestRequestBodiesByVersion(t *testing.T) {
+	dashboard := []byte(`{"uid":"db","title":"Dashboard","folderUid":"ops"}`)
+	library := []byte(`{"uid":"lib","name":"Panel","kind":1,"model":{"title":"Panel"}}`)
+
+	for _, tc := range []struct {
+		version string
+		wantID  bool
+	}{
+		{"8.5.27", true},
+		{"9.0.0", false},
+		{"10.4.2", false},
+		// An undetected version is assumed to be an old one.
+		{"", true},
+	} {
+		fake := &fakeVersioned{version: tc.version, bodies: make(map[string]json.RawMessage)}
+		client := newTestClient(t, fake)
+		ctx := context.Background()
+
+		if err := client.CreateOrUpdateDashboard(ctx, dashboard, "ops"); err != nil {
+			t.Fatalf("%s: CreateOrUpdateDashboard: %v", tc.version, err)
+		}
+		if err := client.CreateOrUpdateLibrary(ctx, library, "ops", 1); err != nil {
+			t.Fatalf("%s: CreateOrUpdateLibrary: %v", tc.version, err)
+		}
+
+		for _, route := range []string{"/api/dashboards/db", "/api/library-elements"} {
+			body, ok := fake.bodies[route]
+			if !ok {
+				t.Errorf("%s: nothing posted to %s", tc.version, route)
+				continue
+			}
+			uid, id, hasID := folderFields(t, body)
+			if uid != "ops" {
+				t.Errorf("%s: %s got folderUid %q, want ops", tc.version, route, uid)
+			}
+			if hasID != tc.wantID || (tc.wantID && id != 42) {
+				t.Errorf("%s: %s got %s, want a folderId: %v", tc.version, route, body, tc.wantID)
+			}
+		}
+	}
+}
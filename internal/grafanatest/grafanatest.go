@@ -0,0 +1,156 @@
+// Package grafanatest provides a fake Grafana instance and a client of it, for
+// the tests of the packages pushing dashboards to Grafana.
+package grafanatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+)
+
+// Fake fakes the parts of the Grafana API the pushes use, keeping the
+// dashboards pushed to it, and counting the pushes and deletions of each
+// dashboard. Like Grafana, it rejects the dashboards without a title. While
+// it's down, every request fails with a 503 status.
+type Fake struct {
+	lock       sync.Mutex
+	down       bool
+	dashboards map[string]json.RawMessage
+	pushes     map[string]int
+	deletions  map[string]int
+}
+
+// NewFake returns a fake instance holding no dashboard.
+func NewFake() *Fake {
+	return &Fake{
+		dashboards: make(map[string]json.RawMessage),
+		pushes:     make(map[string]int),
+		deletions:  make(map[string]int),
+	}
+}
+
+// SetDown makes the fake instance fail every request, or not.
+func (f *Fake) SetDown(down bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.down = down
+}
+
+// Counts returns copies of the numbers of pushes and deletions by UID.
+func (f *Fake) Counts() (pushes map[string]int, deletions map[string]int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pushes, deletions = make(map[string]int), make(map[string]int)
+	for uid, n := range f.pushes {
+		pushes[uid] = n
+	}
+	for uid, n := range f.deletions {
+		deletions[uid] = n
+	}
+	return
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.down {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/health":
+		w.Write([]byte(`{"database":"ok","version":"10.0.0"}`))
+
+	case r.URL.Path == "/api/search":
+		hits := make([]map[string]interface{}, 0)
+		if r.URL.Query().Get("page") == "1" && r.URL.Query().Get("type") != "dash-folder" {
+			uids := make([]string, 0, len(f.dashboards))
+			for uid := range f.dashboards {
+				uids = append(uids, uid)
+			}
+			sort.Strings(uids)
+			for _, uid := range uids {
+				var meta struct {
+					Title string `json:"title"`
+				}
+				json.Unmarshal(f.dashboards[uid], &meta)
+				hits = append(hits, map[string]interface{}{"uid": uid, "title": meta.Title, "type": "dash-db"})
+			}
+		}
+		json.NewEncoder(w).Encode(hits)
+
+	case strings.HasPrefix(r.URL.Path, "/api/library-elements"):
+		w.Write([]byte(`{"result":{"totalCount":0,"elements":[],"page":1,"perPage":100}}`))
+
+	case r.URL.Path == "/api/folders":
+		w.Write([]byte(`[]`))
+
+	case r.Method == "POST" && r.URL.Path == "/api/dashboards/db":
+		var req struct {
+			Dashboard json.RawMessage `json:"dashboard"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var meta struct {
+			UID   string `json:"uid"`
+			Title string `json:"title"`
+		}
+		json.Unmarshal(req.Dashboard, &meta)
+		if meta.Title == "" {
+			http.Error(w, `{"message":"Dashboard title cannot be empty"}`, http.StatusBadRequest)
+			return
+		}
+		f.dashboards[meta.UID] = req.Dashboard
+		f.pushes[meta.UID]++
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "uid": meta.UID, "version": f.pushes[meta.UID]})
+
+	case strings.HasPrefix(r.URL.Path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(r.URL.Path, "/api/dashboards/uid/")
+		dashboard, ok := f.dashboards[uid]
+		if !ok {
+			http.Error(w, `{"message":"Dashboard not found"}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.dashboards, uid)
+			f.deletions[uid]++
+			w.Write([]byte(`{"title":"deleted"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"dashboard": dashboard,
+			"meta":      map[string]interface{}{"version": f.pushes[uid]},
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// NewClient returns a client of a server handling the requests with the given
+// handler, e.g. a Fake, stopped at the end of the test. It doesn't retry the
+// failed requests.
+func NewClient(t *testing.T, handler http.Handler) *grafana.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := grafana.NewClient(server.URL, grafana.StaticToken("test"), "", "", 0, false)
+	client.DashboardsAPI = grafana.DashboardsAPILegacy
+	client.RetryAttempts = 1
+	return client
+}
+
+// DashboardJSON returns the content of the file of a dashboard with the given
+// UID and title.
+func DashboardJSON(uid string, title string) string {
+	return `{"uid":"` + uid + `","title":"` + title + `","panels":[]}`
+}
@@ -0,0 +1,191 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Paths the liveness and readiness probes, and the effective configuration,
+// are exposed at.
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+	ConfigPath    = "/config"
+)
+
+// Timings of the readiness probe's Grafana health checks.
+const (
+	// GrafanaMaxAge is how long a successful Grafana health check keeps the
+	// process ready. The readiness probe checks Grafana again once it's
+	// older.
+	GrafanaMaxAge = time.Minute
+	// grafanaCheckTimeout caps the duration of the checks run by the
+	// readiness probe, so it answers before the probe gives up.
+	grafanaCheckTimeout = 5 * time.Second
+)
+
+// State records whether the pusher is ready to push changes: its clones were
+// synchronised with the remote, and Grafana was found healthy recently. It's
+// updated as the synchronisations and the Grafana health checks succeed or
+// fail.
+type State struct {
+	lock sync.Mutex
+	// synced is true once the clones were synchronised, syncErr the error
+	// the latest synchronisation failed with, if any.
+	synced  bool
+	syncErr error
+	// grafanaErr is the error the latest Grafana health check failed with,
+	// if any, and grafanaCheckedAt the time of this check, zero if Grafana
+	// wasn't checked yet.
+	grafanaErr       error
+	grafanaCheckedAt time.Time
+	// checkGrafana requests Grafana's health endpoint. If set, the readiness
+	// probe uses it to check Grafana when the latest check is too old.
+	checkGrafana func(ctx context.Context) error
+	// config renders the effective configuration, with its secrets
+	// redacted. If set, it's exposed at ConfigPath.
+	config func() ([]byte, error)
+}
+
+// Default is the state of the process.
+var Default = new(State)
+
+// SetGrafanaCheck sets the function the readiness probe checks Grafana's health
+// with when the latest check is older than GrafanaMaxAge.
+func (s *State) SetGrafanaCheck(check func(ctx context.Context) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checkGrafana = check
+}
+
+// SetConfig sets the function rendering the effective configuration exposed
+// at ConfigPath, which must redact its secrets.
+func (s *State) SetConfig(render func() ([]byte, error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.config = render
+}
+
+// RecordSync records the result of a synchronisation of the clones with the
+// remote, successful if the given error is nil.
+func (s *State) RecordSync(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced = s.synced || err == nil
+	s.syncErr = err
+}
+
+// RecordGrafana records the result of a Grafana health check, successful if
+// the given error is nil.
+func (s *State) RecordGrafana(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.grafanaErr = err
+	s.grafanaCheckedAt = time.Now()
+}
+
+// Ready returns whether the pusher is ready: the clones were synchronised, the
+// latest synchronisation succeeded, and the latest Grafana health check
+// succeeded less than GrafanaMaxAge ago. Grafana is checked again first if the
+// latest check is older, and a function was set to check it.
+// Returns the reason the pusher isn't ready, if it isn't.
+func (s *State) Ready(ctx context.Context) (ready bool, reason string) {
+	s.lock.Lock()
+	check, checkedAt := s.checkGrafana, s.grafanaCheckedAt
+	s.lock.Unlock()
+
+	// The lock isn't held while Grafana is requested, so the other probes
+	// and the recordings aren't blocked meanwhile.
+	if check != nil && time.Since(checkedAt) > GrafanaMaxAge {
+		checkCtx, cancel := context.WithTimeout(ctx, grafanaCheckTimeout)
+		s.RecordGrafana(check(checkCtx))
+		cancel()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case !s.synced:
+		return false, "the repository wasn't synchronised yet"
+	case s.syncErr != nil:
+		return false, "the latest synchronisation of the repository failed: " + s.syncErr.Error()
+	case s.grafanaCheckedAt.IsZero():
+		return false, "Grafana's health wasn't checked yet"
+	case s.grafanaErr != nil:
+		return false, "Grafana isn't healthy: " + s.grafanaErr.Error()
+	case time.Since(s.grafanaCheckedAt) > GrafanaMaxAge:
+		return false, "Grafana's health wasn't checked recently"
+	}
+	return true, ""
+}
+
+// Handle registers the liveness and readiness probes, and the effective
+// configuration, on the given mux. The liveness probe always succeeds, since
+// the process answers it, while the readiness probe fails with a 503 status,
+// giving the reason, unless the pusher is ready. The configuration is only
+// exposed once set with SetConfig.
+func (s *State) Handle(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		if ready, reason := s.Ready(r.Context()); !ready {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(ConfigPath, func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		render := s.config
+		s.lock.Unlock()
+
+		if render == nil {
+			http.NotFound(w, r)
+			return
+		}
+		out, err := render()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Failed to render the effective configuration")
+			http.Error(w, "failed to render the configuration", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		w.Write(out)
+	})
+}
+
+// Serve exposes the liveness and readiness probes, and the effective
+// configuration, on a listener of their own on the given address, until the
+// given context is cancelled.
+// Returns an error if the listener couldn't be started.
+func (s *State) Serve(ctx context.Context, addr string) (err error) {
+	mux := http.NewServeMux()
+	s.Handle(mux)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"addr":      addr,
+		"liveness":  LivenessPath,
+		"readiness": ReadinessPath,
+		"config":    ConfigPath,
+	}).Info("Exposing the health probes")
+
+	if err = server.ListenAndServe(); err == http.ErrServerClosed {
+		return nil
+	}
+	return
+}
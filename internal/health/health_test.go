@@ -0,0 +1,60 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// get requests the given path on a mux the given state's handlers are
+// registered on.
+func get(s *State, path string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	s.Handle(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestConfig(t *testing.T) {
+	s := new(State)
+	if rec := get(s, ConfigPath); rec.Code != http.StatusNotFound {
+		t.Errorf("got %d before the configuration was set, want 404", rec.Code)
+	}
+
+	s.SetConfig(func() ([]byte, error) { return []byte("grafana:\n  api_key: <redacted>\n"), nil })
+	rec := get(s, ConfigPath)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if body := rec.Body.String(); body != "grafana:\n  api_key: <redacted>\n" {
+		t.Errorf("body = %q, want the rendered configuration", body)
+	}
+
+	s.SetConfig(func() ([]byte, error) { return nil, errors.New("marshalling failed") })
+	if rec = get(s, ConfigPath); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d when the configuration couldn't be rendered, want 500", rec.Code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	s := new(State)
+	if rec := get(s, LivenessPath); rec.Code != http.StatusOK {
+		t.Errorf("liveness probe got %d, want 200", rec.Code)
+	}
+	if rec := get(s, ReadinessPath); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness probe got %d before any synchronisation, want 503", rec.Code)
+	}
+
+	s.RecordSync(nil)
+	s.RecordGrafana(nil)
+	if rec := get(s, ReadinessPath); rec.Code != http.StatusOK {
+		t.Errorf("readiness probe got %d once ready, want 200", rec.Code)
+	}
+
+	s.RecordGrafana(errors.New("database locked"))
+	if rec := get(s, ReadinessPath); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness probe got %d with Grafana unhealthy, want 503", rec.Code)
+	}
+}
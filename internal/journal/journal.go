@@ -0,0 +1,329 @@
+package journal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+)
+
+const (
+	// DefaultMaxEntries is the maximum number of entries kept in a journal
+	// before the oldest pending ones are compacted.
+	DefaultMaxEntries = 100
+	// RetryBaseBackoff is the delay before the first retry of a pending
+	// range, doubled for each subsequent one.
+	RetryBaseBackoff = 30 * time.Second
+	// RetryMaxBackoff caps the delay between two retries of a pending range.
+	RetryMaxBackoff = 10 * time.Minute
+)
+
+// Entry is a range of commits accepted by the pusher, which changes must be
+// pushed to Grafana.
+type Entry struct {
+	ID int64 `json:"id"`
+	// Ref is the reference of the branch the commits were pushed to.
+	Ref string `json:"ref"`
+	// Before is the hash of the commit preceding the range, After the hash of
+	// the latest commit of the range.
+	Before     string    `json:"before"`
+	After      string    `json:"after"`
+	AcceptedAt time.Time `json:"acceptedAt"`
+	Attempts   int       `json:"attempts"`
+	// LastAttemptAt is the time of the latest attempt, zero if there was
+	// none.
+	LastAttemptAt time.Time `json:"lastAttemptAt,omitempty"`
+	Done          bool      `json:"done"`
+}
+
+// Range merges the pending entries of a branch into a single range of commits,
+// from the commit preceding the oldest entry to the latest commit of the most
+// recent one, so the changes are pushed at once and each file is only pushed
+// with its latest content.
+type Range struct {
+	Ref    string
+	Before string
+	After  string
+	// Entries are the merged entries, from the oldest to the most recent.
+	Entries []Entry
+}
+
+// Ranges merges the given pending entries into a range per branch, in the
+// order the branches first appear.
+func Ranges(pending []Entry) (ranges []Range) {
+	ranges = make([]Range, 0)
+	byRef := make(map[string]int)
+	for _, entry := range pending {
+		i, ok := byRef[entry.Ref]
+		if !ok {
+			byRef[entry.Ref] = len(ranges)
+			ranges = append(ranges, Range{Ref: entry.Ref, Before: entry.Before})
+			i = len(ranges) - 1
+		}
+		ranges[i].After = entry.After
+		ranges[i].Entries = append(ranges[i].Entries, entry)
+	}
+	return
+}
+
+// IDs returns the IDs of the range's entries.
+func (r Range) IDs() (ids []int64) {
+	ids = make([]int64, 0, len(r.Entries))
+	for _, entry := range r.Entries {
+		ids = append(ids, entry.ID)
+	}
+	return
+}
+
+// Commits returns the latest commits of the range's entries, i.e. the commits
+// the merged changes originally came from.
+func (r Range) Commits() (hashes []string) {
+	hashes = make([]string, 0, len(r.Entries))
+	for _, entry := range r.Entries {
+		hashes = append(hashes, entry.After)
+	}
+	return
+}
+
+// Attempts returns the number of attempts made to push the range, i.e. the
+// largest number of attempts of its entries.
+func (r Range) Attempts() (attempts int) {
+	for _, entry := range r.Entries {
+		if entry.Attempts > attempts {
+			attempts = entry.Attempts
+		}
+	}
+	return
+}
+
+// Due returns true if the range can be retried at the given time: if it was
+// never attempted, or if the delay since its latest attempt, doubling from
+// RetryBaseBackoff with each attempt up to RetryMaxBackoff, has passed.
+func (r Range) Due(now time.Time) bool {
+	var last time.Time
+	for _, entry := range r.Entries {
+		if entry.LastAttemptAt.After(last) {
+			last = entry.LastAttemptAt
+		}
+	}
+	if last.IsZero() {
+		return true
+	}
+
+	backoff := RetryBaseBackoff
+	for i := 1; i < r.Attempts() && backoff < RetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > RetryMaxBackoff {
+		backoff = RetryMaxBackoff
+	}
+	return !now.Before(last.Add(backoff))
+}
+
+// Journal is a durable list of the ranges of commits the pusher accepted,
+// stored as a JSON file. An entry is appended before the changes are pushed to
+// Grafana, and marked as done only once the push succeeded, so unfinished
+// pushes can be retried, even after a restart.
+// A Journal is safe for concurrent use within a process.
+type Journal struct {
+	path       string
+	maxEntries int
+	mu         sync.Mutex
+}
+
+// fileContent is the structure of the journal file.
+type fileContent struct {
+	NextID  int64   `json:"nextId"`
+	Entries []Entry `json:"entries"`
+}
+
+// Path returns the path of the journal file for the clone described by the
+// given Git settings. The file lives in the clone's .git directory, so it's
+// never committed.
+func Path(cfg *config.GitSettings) string {
+	return filepath.Join(cfg.ClonePath, ".git", "dashboards-manager", "journal.json")
+}
+
+// journals holds the journals opened by the process, so all of the goroutines
+// writing to a journal file share the same lock.
+var (
+	journals     = make(map[string]*Journal)
+	journalsLock sync.Mutex
+)
+
+// Open returns the journal stored in the file at the given path. The file is
+// created on the first write. Opening the same path twice returns the same
+// journal.
+func Open(path string) *Journal {
+	journalsLock.Lock()
+	defer journalsLock.Unlock()
+
+	if j, ok := journals[path]; ok {
+		return j
+	}
+
+	j := &Journal{path: path, maxEntries: DefaultMaxEntries}
+	journals[path] = j
+	return j
+}
+
+// Append adds a pending entry for the given range of commits to the journal.
+// Returns the ID of the new entry.
+// Returns an error if the journal couldn't be read or written.
+func (j *Journal) Append(ref string, before string, after string) (id int64, err error) {
+	err = j.update(func(content *fileContent) {
+		content.NextID++
+		id = content.NextID
+		content.Entries = append(content.Entries, Entry{
+			ID:         id,
+			Ref:        ref,
+			Before:     before,
+			After:      after,
+			AcceptedAt: time.Now().UTC(),
+		})
+	})
+	return
+}
+
+// MarkDone marks the entries with the given IDs as done. Done entries are
+// removed from the journal on the next write.
+// Returns an error if the journal couldn't be read or written.
+func (j *Journal) MarkDone(ids ...int64) error {
+	return j.update(func(content *fileContent) {
+		for i := range content.Entries {
+			if hasID(ids, content.Entries[i].ID) {
+				content.Entries[i].Done = true
+			}
+		}
+	})
+}
+
+// RecordAttempt increments the number of attempts of the entries with the
+// given IDs, and records the time of this attempt.
+// Returns an error if the journal couldn't be read or written.
+func (j *Journal) RecordAttempt(ids ...int64) error {
+	now := time.Now().UTC()
+	return j.update(func(content *fileContent) {
+		for i := range content.Entries {
+			if hasID(ids, content.Entries[i].ID) {
+				content.Entries[i].Attempts++
+				content.Entries[i].LastAttemptAt = now
+			}
+		}
+	})
+}
+
+// hasID returns true if the given IDs include the given one.
+func hasID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the entries which haven't been marked as done yet, from the
+// oldest to the most recent.
+// Returns an error if the journal couldn't be read.
+func (j *Journal) Pending() (pending []Entry, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	content, err := j.read()
+	if err != nil {
+		return
+	}
+
+	pending = make([]Entry, 0)
+	for _, entry := range content.Entries {
+		if !entry.Done {
+			pending = append(pending, entry)
+		}
+	}
+	return
+}
+
+// update reads the journal, applies the given modification, compacts the
+// entries and writes the journal back, while holding the lock.
+func (j *Journal) update(modify func(content *fileContent)) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	content, err := j.read()
+	if err != nil {
+		return
+	}
+
+	modify(content)
+	content.Entries = compact(content.Entries, j.maxEntries)
+
+	return j.write(content)
+}
+
+// compact removes the done entries, then, as long as there are more entries
+// than the given maximum, merges the oldest pending entry into the next
+// pending one for the same branch, which range then starts where the oldest
+// one started. The oldest entry is dropped if it isn't superseded by any
+// other entry.
+func compact(entries []Entry, maxEntries int) []Entry {
+	compacted := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Done {
+			compacted = append(compacted, entry)
+		}
+	}
+
+	for len(compacted) > maxEntries {
+		oldest := compacted[0]
+		compacted = compacted[1:]
+		for i := range compacted {
+			if compacted[i].Ref == oldest.Ref {
+				compacted[i].Before = oldest.Before
+				if oldest.AcceptedAt.Before(compacted[i].AcceptedAt) {
+					compacted[i].AcceptedAt = oldest.AcceptedAt
+				}
+				break
+			}
+		}
+	}
+
+	return compacted
+}
+
+// read loads the journal file. A missing file is an empty journal.
+func (j *Journal) read() (content *fileContent, err error) {
+	content = &fileContent{Entries: make([]Entry, 0)}
+
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return content, nil
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, content)
+	return
+}
+
+// write replaces the journal file atomically, so a crash can't corrupt it.
+func (j *Journal) write(content *fileContent) (err error) {
+	data, err := json.MarshalIndent(content, "", "\t")
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return
+	}
+
+	tmp := j.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,129 @@
+package journal
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendConcurrent(t *testing.T) {
+	j := Open(filepath.Join(t.TempDir(), "journal.json"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := j.Append("HEAD", strconv.Itoa(i), strconv.Itoa(i+1)); err != nil {
+				t.Errorf("Append: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 20 {
+		t.Fatalf("%d entries pending, want 20", len(pending))
+	}
+	ids := make(map[int64]bool)
+	for _, entry := range pending {
+		if ids[entry.ID] {
+			t.Errorf("ID %d given twice", entry.ID)
+		}
+		ids[entry.ID] = true
+	}
+}
+
+func TestOpenSharesJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	if Open(path) != Open(path) {
+		t.Errorf("opening the same path twice gave two journals")
+	}
+}
+
+func TestMarkDone(t *testing.T) {
+	j := Open(filepath.Join(t.TempDir(), "journal.json"))
+
+	first, err := j.Append("HEAD", "a", "b")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err = j.Append("HEAD", "b", "c"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err = j.MarkDone(first); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Before != "b" {
+		t.Errorf("pending = %+v, want only the second entry", pending)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	now := time.Now()
+	entries := []Entry{
+		{ID: 1, Ref: "refs/heads/a", Before: "a0", After: "a1", AcceptedAt: now},
+		{ID: 2, Ref: "refs/heads/b", Before: "b0", After: "b1", AcceptedAt: now.Add(time.Second)},
+		{ID: 3, Ref: "refs/heads/a", Before: "a1", After: "a2", AcceptedAt: now.Add(2 * time.Second)},
+		{ID: 4, Ref: "refs/heads/a", Before: "a2", After: "a3", AcceptedAt: now.Add(3 * time.Second), Done: true},
+	}
+
+	compacted := compact(entries, 2)
+	if len(compacted) != 2 {
+		t.Fatalf("compacted to %d entries, want 2: %+v", len(compacted), compacted)
+	}
+	// The oldest entry is merged into the next one of its branch.
+	if compacted[1].ID != 3 || compacted[1].Before != "a0" || !compacted[1].AcceptedAt.Equal(now) {
+		t.Errorf("entry 3 = %+v, want it to start where entry 1 started", compacted[1])
+	}
+
+	// An entry superseded by none is dropped.
+	compacted = compact(compacted, 1)
+	if len(compacted) != 1 || compacted[0].ID != 3 {
+		t.Errorf("compacted = %+v, want only entry 3", compacted)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	ranges := Ranges([]Entry{
+		{ID: 1, Ref: "refs/heads/a", Before: "a0", After: "a1"},
+		{ID: 2, Ref: "refs/heads/b", Before: "b0", After: "b1"},
+		{ID: 3, Ref: "refs/heads/a", Before: "a1", After: "a2"},
+	})
+	if len(ranges) != 2 {
+		t.Fatalf("got %d ranges, want 2", len(ranges))
+	}
+	if r := ranges[0]; r.Ref != "refs/heads/a" || r.Before != "a0" || r.After != "a2" || len(r.IDs()) != 2 {
+		t.Errorf("first range = %+v, want a0..a2 merging entries 1 and 3", r)
+	}
+}
+
+func TestDue(t *testing.T) {
+	now := time.Now()
+	if !(Range{Entries: []Entry{{}}}).Due(now) {
+		t.Errorf("a range never attempted isn't due")
+	}
+
+	r := Range{Entries: []Entry{{Attempts: 1, LastAttemptAt: now}}}
+	if r.Due(now.Add(RetryBaseBackoff - time.Second)) {
+		t.Errorf("a range is due before the backoff passed")
+	}
+	if !r.Due(now.Add(RetryBaseBackoff)) {
+		t.Errorf("a range isn't due once the backoff passed")
+	}
+
+	r = Range{Entries: []Entry{{Attempts: 100, LastAttemptAt: now}}}
+	if !r.Due(now.Add(RetryMaxBackoff)) {
+		t.Errorf("the backoff isn't capped")
+	}
+}
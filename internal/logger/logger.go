@@ -16,8 +16,11 @@ func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return f.Formatter.Format(entry)
 }
 
-// LogConfig sets the format of the default logger.
+// LogConfig sets the format of the default logger, and registers the hook
+// adding stack traces to logged errors.
 func LogConfig() {
+	logrus.AddHook(&StacktraceHook{})
+
 	logrus.SetFormatter(&utcFormatter{
 		&logrus.TextFormatter{
 			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxStackDepth is the maximum number of frames printed in a stack trace.
+const maxStackDepth = 32
+
+// maxUnwrapDepth is the maximum number of wrapped errors looked at when
+// searching for a stack trace, in case of a cyclic chain.
+const maxUnwrapDepth = 64
+
+// stackTracer is implemented by the errors created by github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() pkgerrors.StackTrace
+}
+
+// causer is implemented by the errors wrapped by github.com/pkg/errors.
+type causer interface {
+	Cause() error
+}
+
+// StacktraceHook is a logrus hook adding the stack trace of the error logged
+// under the "error" key, if there's one, to the entry's fields.
+type StacktraceHook struct {
+}
+
+// Levels implements logrus.Hook.Levels(). Stack traces are only useful on
+// errors, so the hook doesn't fire on lower levels.
+func (h *StacktraceHook) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+	}
+}
+
+// Fire implements logrus.Hook.Fire(). It never returns an error nor panics, so
+// a logging edge case can't interrupt a sync.
+func (h *StacktraceHook) Fire(e *logrus.Entry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = nil
+		}
+	}()
+
+	if e == nil || e.Data == nil {
+		return nil
+	}
+
+	v, found := e.Data[logrus.ErrorKey]
+	if !found || v == nil {
+		return nil
+	}
+
+	loggedErr, isErr := v.(error)
+	if !isErr {
+		return nil
+	}
+
+	if st := findStackTracer(loggedErr); st != nil {
+		stack := st.StackTrace()
+		if len(stack) > maxStackDepth {
+			stack = stack[:maxStackDepth]
+		}
+		e.Data["stacktrace"] = fmt.Sprintf("%+v", stack)
+	}
+
+	return nil
+}
+
+// findStackTracer walks the chain of wrapped errors, following both standard
+// library wrapping (errors.Unwrap) and github.com/pkg/errors causes, and
+// returns the first error carrying a stack trace.
+// Returns nil if no error in the chain carries one.
+func findStackTracer(err error) stackTracer {
+	for depth := 0; err != nil && depth < maxUnwrapDepth; depth++ {
+		if st, isSt := err.(stackTracer); isSt {
+			return st
+		}
+
+		next := errors.Unwrap(err)
+		if next == nil {
+			if c, isCauser := err.(causer); isCauser {
+				next = c.Cause()
+			}
+		}
+		err = next
+	}
+
+	return nil
+}
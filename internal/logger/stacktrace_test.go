@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fire runs the hook on an entry holding the given value under the error key,
+// and returns the stack trace it added, if any.
+func fire(t *testing.T, value interface{}) (stack string, added bool) {
+	t.Helper()
+
+	e := logrus.NewEntry(logrus.New()).WithField(logrus.ErrorKey, value)
+	if err := new(StacktraceHook).Fire(e); err != nil {
+		t.Fatalf("Fire: %v", err)
+	}
+	v, added := e.Data["stacktrace"]
+	if added {
+		stack = v.(string)
+	}
+	return
+}
+
+func TestStacktraceHookPkgErrors(t *testing.T) {
+	stack, added := fire(t, pkgerrors.Wrap(pkgerrors.New("root"), "wrapped"))
+	if !added {
+		t.Fatalf("no stack trace added for a github.com/pkg/errors error")
+	}
+	if !strings.Contains(stack, "TestStacktraceHookPkgErrors") {
+		t.Errorf("the stack trace doesn't mention the test:\n%s", stack)
+	}
+}
+
+func TestStacktraceHookStdlibChain(t *testing.T) {
+	err := fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", pkgerrors.New("root")))
+	if _, added := fire(t, err); !added {
+		t.Errorf("no stack trace added for a fmt.Errorf chain wrapping a github.com/pkg/errors error")
+	}
+
+	// pkg/errors wrapping a standard error wrapping a pkg/errors error.
+	err = pkgerrors.WithMessage(fmt.Errorf("middle: %w", pkgerrors.New("root")), "outer")
+	if _, added := fire(t, err); !added {
+		t.Errorf("no stack trace added for a mixed chain")
+	}
+}
+
+func TestStacktraceHookWithoutStack(t *testing.T) {
+	for name, value := range map[string]interface{}{
+		"standard error": fmt.Errorf("outer: %w", errors.New("root")),
+		"string":         "not an error",
+		"int":            42,
+		"nil":            nil,
+		"nil error":      error(nil),
+	} {
+		if stack, added := fire(t, value); added {
+			t.Errorf("%s: stack trace added:\n%s", name, stack)
+		}
+	}
+}
+
+// cyclicError unwraps to itself.
+type cyclicError struct{}
+
+func (e *cyclicError) Error() string { return "cyclic" }
+func (e *cyclicError) Unwrap() error { return e }
+
+func TestStacktraceHookCyclicChain(t *testing.T) {
+	if _, added := fire(t, &cyclicError{}); added {
+		t.Errorf("stack trace added for a cyclic chain without one")
+	}
+}
+
+// deepError returns an error created at the given depth of recursion.
+func deepError(depth int) error {
+	if depth == 0 {
+		return pkgerrors.New("deep")
+	}
+	return deepError(depth - 1)
+}
+
+func TestStacktraceHookDepth(t *testing.T) {
+	stack, added := fire(t, deepError(2*maxStackDepth))
+	if !added {
+		t.Fatalf("no stack trace added")
+	}
+	if frames := strings.Count(stack, "deepError"); frames > maxStackDepth {
+		t.Errorf("printed %d frames, want at most %d", frames, maxStackDepth)
+	}
+}
+
+func TestStacktraceHookNilEntry(t *testing.T) {
+	hook := new(StacktraceHook)
+	if err := hook.Fire(nil); err != nil {
+		t.Errorf("Fire(nil): %v", err)
+	}
+	if err := hook.Fire(&logrus.Entry{}); err != nil {
+		t.Errorf("Fire without data: %v", err)
+	}
+}
+
+func TestStacktraceHookLevels(t *testing.T) {
+	for _, level := range new(StacktraceHook).Levels() {
+		if level > logrus.ErrorLevel {
+			t.Errorf("the hook fires on %s", level)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// GrafanaRequests records the requests sent to the Grafana API: their number
+// and duration by group of endpoints and class of status code. It implements
+// grafana.RequestMetrics.
+type GrafanaRequests struct {
+	total    *CounterVec
+	errors   *CounterVec
+	duration *HistogramVec
+}
+
+// NewGrafanaRequests registers the metrics of the requests sent to the Grafana
+// API with the given registry.
+func NewGrafanaRequests(r *Registry) *GrafanaRequests {
+	return &GrafanaRequests{
+		total: r.NewCounterVec(
+			"grafana_dashboards_manager_grafana_requests_total",
+			"Number of requests sent to the Grafana API, by group of endpoints and class of status code (\"error\" if no response was received).",
+			"group", "status",
+		),
+		errors: r.NewCounterVec(
+			"grafana_dashboards_manager_grafana_api_errors_total",
+			"Number of requests sent to the Grafana API which failed, with a 4xx or 5xx status code or without a response, by group of endpoints.",
+			"group",
+		),
+		duration: r.NewHistogramVec(
+			"grafana_dashboards_manager_grafana_request_duration_seconds",
+			"Duration of the requests sent to the Grafana API, by group of endpoints.",
+			DefaultDurationBuckets,
+			"group",
+		),
+	}
+}
+
+// ObserveRequest implements grafana.RequestMetrics.
+func (g *GrafanaRequests) ObserveRequest(group string, status string, duration time.Duration) {
+	g.total.Inc(group, status)
+	if status == "error" || strings.HasPrefix(status, "4") || strings.HasPrefix(status, "5") {
+		g.errors.Inc(group)
+	}
+	g.duration.Observe(duration.Seconds(), group)
+}
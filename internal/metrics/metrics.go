@@ -0,0 +1,298 @@
+// Package metrics implements the few Prometheus metric types the manager
+// exposes, and their text exposition format, so it doesn't need the Prometheus
+// client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry the puller and the pusher register their metrics
+// with, and expose.
+var Default = NewRegistry()
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the histograms of durations of HTTP requests.
+var DefaultDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// collector is a metric family, written in the text exposition format.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds metric families, to expose them. It's safe for concurrent
+// use.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds the given metric family to the registry.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes the metric families of the registry to the given writer in the
+// Prometheus text exposition format. The families without any series yet are
+// left out.
+// Returns an error if writing failed.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler returns an HTTP handler serving the metric families of the
+// registry, for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// family holds what the metric families have in common: their name, help,
+// labels, and series by label values.
+type family struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+// newFamily returns a metric family with the given name, help and labels.
+func newFamily(name string, help string, labels []string) family {
+	return family{name: name, help: help, labels: labels, series: make(map[string][]string)}
+}
+
+// key returns the key of the series with the given label values, recording
+// them. The lock must be held.
+// Panics if the number of values doesn't match the number of labels, which is
+// a programming error.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := f.series[key]; !ok {
+		f.series[key] = append([]string(nil), values...)
+	}
+	return key
+}
+
+// sortedKeys returns the keys of the series, sorted. The lock must be held.
+func (f *family) sortedKeys() []string {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeHeader writes the help and type of the family.
+func (f *family) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, kind)
+}
+
+// writeSample writes a sample of the series with the given label values, with
+// an extra label if the given name isn't empty.
+func (f *family) writeSample(w io.Writer, suffix string, values []string, extraName string, extraValue string, value float64) {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, f.labels[i]+`="`+escapeLabelValue(v)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s%s%s %s\n", f.name, suffix, labels, formatValue(value))
+}
+
+// CounterVec is a family of counters, partitioned by label values.
+type CounterVec struct {
+	family
+	values map[string]float64
+}
+
+// NewCounterVec registers and returns a family of counters with the given
+// name, help and labels.
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: newFamily(name, help, labels), values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Add adds the given value, which mustn't be negative, to the counter with
+// the given label values.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += value
+}
+
+// Inc increments the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// write implements collector.
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.series) == 0 {
+		return
+	}
+	c.writeHeader(w, "counter")
+	for _, key := range c.sortedKeys() {
+		c.writeSample(w, "", c.series[key], "", "", c.values[key])
+	}
+}
+
+// GaugeVec is a family of gauges, partitioned by label values.
+type GaugeVec struct {
+	family
+	values map[string]float64
+}
+
+// NewGaugeVec registers and returns a family of gauges with the given name,
+// help and labels.
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: newFamily(name, help, labels), values: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge with the given label values to the given value.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+// write implements collector.
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.series) == 0 {
+		return
+	}
+	g.writeHeader(w, "gauge")
+	for _, key := range g.sortedKeys() {
+		g.writeSample(w, "", g.series[key], "", "", g.values[key])
+	}
+}
+
+// HistogramVec is a family of histograms, partitioned by label values.
+type HistogramVec struct {
+	family
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+// histogram holds the observations of a single series.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers and returns a family of histograms with the given
+// name, help, buckets' upper bounds and labels.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		family:     newFamily(name, help, labels),
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records the given value in the histogram with the given label
+// values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// write implements collector.
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.series) == 0 {
+		return
+	}
+	h.writeHeader(w, "histogram")
+	for _, key := range h.sortedKeys() {
+		values, hist := h.series[key], h.histograms[key]
+		for i, bound := range h.buckets {
+			h.writeSample(w, "_bucket", values, "le", formatValue(bound), float64(hist.counts[i]))
+		}
+		h.writeSample(w, "_bucket", values, "le", "+Inf", float64(hist.count))
+		h.writeSample(w, "_sum", values, "", "", hist.sum)
+		h.writeSample(w, "_count", values, "", "", float64(hist.count))
+	}
+}
+
+// escapeLabelValue escapes the given label value for the text exposition
+// format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatValue formats the given sample value for the text exposition format.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Puller records the outcome of the pulls: when the last one succeeded, and
+// the number of dashboards and libraries they examined and changed, and of
+// pushes to the Git remote which failed.
+type Puller struct {
+	lastSuccess       *GaugeVec
+	examined          *CounterVec
+	dashboardsChanged *CounterVec
+	librariesChanged  *CounterVec
+	pushFailures      *CounterVec
+}
+
+// NewPuller registers the metrics of the pulls with the given registry.
+func NewPuller(r *Registry) *Puller {
+	return &Puller{
+		lastSuccess: r.NewGaugeVec(
+			"grafana_dashboards_manager_last_successful_pull_timestamp_seconds",
+			"Time of the end of the last successful pull, as a Unix timestamp.",
+		),
+		examined: r.NewCounterVec(
+			"grafana_dashboards_manager_pull_dashboards_examined_total",
+			"Number of dashboards retrieved from Grafana and compared with the repository by the pulls.",
+		),
+		dashboardsChanged: r.NewCounterVec(
+			"grafana_dashboards_manager_pull_dashboards_changed_total",
+			"Number of dashboards written to the repository because Grafana had a newer version.",
+		),
+		librariesChanged: r.NewCounterVec(
+			"grafana_dashboards_manager_pull_libraries_changed_total",
+			"Number of library panels written to the repository because Grafana had a newer version.",
+		),
+		pushFailures: r.NewCounterVec(
+			"grafana_dashboards_manager_git_push_failures_total",
+			"Number of pushes of the pulled changes to the Git remote which failed, including the merge requests which couldn't be opened.",
+		),
+	}
+}
+
+// ObservePull records a pull, which examined and changed the given numbers of
+// dashboards and libraries, and if it succeeded, the time it ended at.
+func (p *Puller) ObservePull(examined int, dashboardsChanged int, librariesChanged int, succeeded bool) {
+	p.examined.Add(float64(examined))
+	p.dashboardsChanged.Add(float64(dashboardsChanged))
+	p.librariesChanged.Add(float64(librariesChanged))
+	if succeeded {
+		p.lastSuccess.Set(float64(time.Now().Unix()))
+	}
+}
+
+// PushFailed records a push to the Git remote which failed.
+func (p *Puller) PushFailed() {
+	p.pushFailures.Inc()
+}
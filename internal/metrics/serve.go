@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Path is the path the metrics are exposed at for Prometheus.
+const Path = "/metrics"
+
+// Serve exposes the metric families of the registry at Path on a listener of
+// its own on the given address, until the given context is cancelled.
+// Returns an error if the listener couldn't be started.
+func (r *Registry) Serve(ctx context.Context, addr string) (err error) {
+	mux := http.NewServeMux()
+	mux.Handle(Path, r.Handler())
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"addr": addr,
+		"path": Path,
+	}).Info("Exposing the metrics")
+
+	if err = server.ListenAndServe(); err == http.ErrServerClosed {
+		return nil
+	}
+	return
+}
+
+// Push sends the metric families of the registry to the Prometheus Pushgateway
+// at the given base URL, in the group of the given job. The metrics pushed
+// replace the ones with the same names in the group, the others are kept, so
+// e.g. the time of the last successful run stays there after a failed one.
+// Returns an error if the request failed or the Pushgateway refused it.
+func (r *Registry) Push(baseURL string, job string) (err error) {
+	body := new(bytes.Buffer)
+	if err = r.Write(body); err != nil {
+		return
+	}
+
+	target := strings.TrimSuffix(baseURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest("POST", target, body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("The Pushgateway responded with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return
+}
@@ -0,0 +1,353 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// Action describes what would happen to a dashboard on the Grafana instance.
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// actionLabels are the labels of the actions in rendered plans.
+var actionLabels = map[Action]string{
+	ActionCreate: "Create",
+	ActionUpdate: "Update",
+	ActionDelete: "Delete",
+}
+
+// Change describes what would happen to a dashboard on the Grafana instance
+// if the files from the repository were pushed.
+type Change struct {
+	Action   Action
+	Filename string
+	UID      string
+	Title    string
+	// Details lists the semantic changes to the dashboard, e.g. panels added,
+	// removed or modified.
+	Details []string
+}
+
+// Plan is the list of changes that would happen on the Grafana instance if
+// the files from the repository were pushed.
+type Plan struct {
+	Changes []Change
+}
+
+// instanceKeys are the keys of a dashboard's JSON description which values
+// are specific to a Grafana instance or to the manager, and are therefore not
+// compared.
+var instanceKeys = []string{"id", "version", format.FolderUIDKey}
+
+// ForDashboards computes the plan for the given dashboard files: the added or
+// modified files are compared with the dashboards from the given definitions
+// retrieved from the Grafana API, and the removed files are planned for
+// deletion if deleteRemoved is true. Files which content can't be parsed are
+// ignored.
+func ForDashboards(
+	modified []string, removed []string, contents map[string][]byte,
+	grafanaDefs grafana.DefsFile, deleteRemoved bool,
+) (p *Plan) {
+	p = &Plan{Changes: make([]Change, 0)}
+
+	current := make(map[string]*grafana.Dashboard)
+	currentFolder := make(map[string]string)
+	for slug, dashboard := range grafanaDefs.DashboardBySlug {
+		current[dashboard.UID] = dashboard
+		currentFolder[dashboard.UID] = grafanaDefs.DashboardMetaBySlug[slug].FolderUID
+	}
+
+	for _, filename := range utils.SortedCopy(modified) {
+		if format.IsPermissionsFile(filename) {
+			continue
+		}
+		proposed, err := decode(contents[filename])
+		if err != nil {
+			continue
+		}
+		uid, _ := proposed["uid"].(string)
+		title, _ := proposed["title"].(string)
+
+		dashboard, exists := current[uid]
+		if !exists {
+			p.Changes = append(p.Changes, Change{
+				Action: ActionCreate, Filename: filename, UID: uid, Title: title,
+			})
+			continue
+		}
+
+		existing, err := decode(dashboard.RawJSON)
+		if err != nil {
+			continue
+		}
+
+		details := DashboardDetails(existing, proposed)
+		if folderUID, _ := proposed[format.FolderUIDKey].(string); folderUID != currentFolder[uid] {
+			details = append(details, fmt.Sprintf("Moved from folder %q to folder %q", currentFolder[uid], folderUID))
+		}
+		if len(details) > 0 {
+			p.Changes = append(p.Changes, Change{
+				Action: ActionUpdate, Filename: filename, UID: uid, Title: title, Details: details,
+			})
+		}
+	}
+
+	if deleteRemoved {
+		for _, filename := range utils.SortedCopy(removed) {
+			uid, title, err := grafana.UIDNameFromRawJSON(contents[filename])
+			if err != nil {
+				continue
+			}
+			if _, exists := current[uid]; exists {
+				p.Changes = append(p.Changes, Change{
+					Action: ActionDelete, Filename: filename, UID: uid, Title: title,
+				})
+			}
+		}
+	}
+
+	return
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(action Action) (count int) {
+	for _, change := range p.Changes {
+		if change.Action == action {
+			count++
+		}
+	}
+	return
+}
+
+// DashboardDetails compares two decoded JSON descriptions of a dashboard and
+// returns human-readable bullets describing the changes from the existing
+// description to the proposed one. Keys specific to a Grafana instance are
+// ignored.
+func DashboardDetails(existing map[string]interface{}, proposed map[string]interface{}) (details []string) {
+	details = make([]string, 0)
+
+	existingTitle, _ := existing["title"].(string)
+	proposedTitle, _ := proposed["title"].(string)
+	if existingTitle != proposedTitle {
+		details = append(details, fmt.Sprintf("Title changed from %q to %q", existingTitle, proposedTitle))
+	}
+
+	added, removed := diffStrings(stringList(existing["tags"]), stringList(proposed["tags"]))
+	for _, tag := range added {
+		details = append(details, fmt.Sprintf("Tag %q added", tag))
+	}
+	for _, tag := range removed {
+		details = append(details, fmt.Sprintf("Tag %q removed", tag))
+	}
+
+	details = append(details, diffNamed("Panel", panelsByKey(existing), panelsByKey(proposed))...)
+
+	details = append(details, diffNamed(
+		"Variable", variablesByName(existing), variablesByName(proposed),
+	)...)
+
+	if !reflect.DeepEqual(settings(existing), settings(proposed)) {
+		details = append(details, "Dashboard settings changed")
+	}
+
+	return
+}
+
+// Markdown renders the plan as a markdown summary, suitable for a merge
+// request comment.
+func (p *Plan) Markdown() string {
+	var b strings.Builder
+
+	b.WriteString("### Grafana changes if merged\n\n")
+	if len(p.Changes) == 0 {
+		b.WriteString("No dashboard would change.\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(
+		&b, "%d created, %d updated, %d deleted.\n\n",
+		p.Count(ActionCreate), p.Count(ActionUpdate), p.Count(ActionDelete),
+	)
+
+	for _, change := range p.Changes {
+		fmt.Fprintf(&b, "- **%s** %s (`%s`)\n", actionLabels[change.Action], change.Title, change.UID)
+		for _, detail := range change.Details {
+			fmt.Fprintf(&b, "  - %s\n", detail)
+		}
+	}
+
+	return b.String()
+}
+
+// decode parses a dashboard's JSON description.
+func decode(rawJSON []byte) (decoded map[string]interface{}, err error) {
+	err = json.Unmarshal(rawJSON, &decoded)
+	return
+}
+
+// settings returns the part of a dashboard's JSON description which isn't
+// described in details, i.e. everything but the title, tags, panels,
+// variables and instance-specific keys.
+func settings(dashboard map[string]interface{}) map[string]interface{} {
+	rest := make(map[string]interface{})
+	for key, value := range dashboard {
+		rest[key] = value
+	}
+
+	for _, key := range append(instanceKeys, "title", "tags", "panels", "rows", "templating") {
+		delete(rest, key)
+	}
+
+	return rest
+}
+
+// stringList converts a decoded JSON array of strings into a slice.
+func stringList(v interface{}) (list []string) {
+	list = make([]string, 0)
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// diffStrings returns the strings only found in the proposed list, and the
+// ones only found in the existing list, sorted.
+func diffStrings(existing []string, proposed []string) (added []string, removed []string) {
+	inExisting := make(map[string]bool)
+	for _, s := range existing {
+		inExisting[s] = true
+	}
+	inProposed := make(map[string]bool)
+	for _, s := range proposed {
+		inProposed[s] = true
+		if !inExisting[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range existing {
+		if !inProposed[s] {
+			removed = append(removed, s)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// namedItem is a panel or a variable, identified by a key and displayed using
+// a name.
+type namedItem struct {
+	name  string
+	value interface{}
+}
+
+// diffNamed compares two sets of panels or variables, and returns bullets
+// describing the ones which were added, removed or modified.
+func diffNamed(kind string, existing map[string]namedItem, proposed map[string]namedItem) (details []string) {
+	for _, key := range utils.SortedKeys(proposed) {
+		item := proposed[key]
+		previous, found := existing[key]
+		if !found {
+			details = append(details, fmt.Sprintf("%s %q added", kind, item.name))
+		} else if !reflect.DeepEqual(previous.value, item.value) {
+			details = append(details, fmt.Sprintf("%s %q modified", kind, item.name))
+		}
+	}
+
+	for _, key := range utils.SortedKeys(existing) {
+		if _, found := proposed[key]; !found {
+			details = append(details, fmt.Sprintf("%s %q removed", kind, existing[key].name))
+		}
+	}
+
+	return
+}
+
+// panelsByKey returns the panels of a dashboard, including the ones nested in
+// collapsed rows, identified by their ID, or by their title if they don't have
+// one.
+func panelsByKey(dashboard map[string]interface{}) map[string]namedItem {
+	panels := make(map[string]namedItem)
+
+	var add func(list interface{})
+	add = func(list interface{}) {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			panel, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			title, _ := panel["title"].(string)
+			key := "title:" + title
+			if id, ok := panel["id"].(float64); ok {
+				key = "id:" + strconv.FormatFloat(id, 'f', -1, 64)
+			}
+			if title == "" {
+				title = key
+			}
+
+			// Nested panels are reported on their own.
+			nested, hasNested := panel["panels"]
+			if hasNested {
+				copied := make(map[string]interface{})
+				for k, v := range panel {
+					copied[k] = v
+				}
+				delete(copied, "panels")
+				panel = copied
+			}
+
+			panels[key] = namedItem{name: title, value: panel}
+			if hasNested {
+				add(nested)
+			}
+		}
+	}
+	add(dashboard["panels"])
+
+	return panels
+}
+
+// variablesByName returns the template variables of a dashboard, identified
+// by their name.
+func variablesByName(dashboard map[string]interface{}) map[string]namedItem {
+	variables := make(map[string]namedItem)
+
+	templating, _ := dashboard["templating"].(map[string]interface{})
+	list, _ := templating["list"].([]interface{})
+	for _, item := range list {
+		variable, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := variable["name"].(string)
+		// The current value changes whenever someone uses the dashboard.
+		copied := make(map[string]interface{})
+		for k, v := range variable {
+			if k != "current" && k != "options" {
+				copied[k] = v
+			}
+		}
+		variables[name] = namedItem{name: "$" + name, value: copied}
+	}
+
+	return variables
+}
@@ -0,0 +1,132 @@
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// unifiedContext is the number of unchanged lines around the changes of a
+// unified diff.
+const unifiedContext = 3
+
+// diffLine is a line of a unified diff: ' ' if it's in both contents, '-' if
+// it's only in the old one, '+' if it's only in the new one.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// UnifiedDiff returns the differences between the given old and new contents,
+// line by line, as a unified diff, which header names them with the given
+// names. A missing final newline isn't a difference. Returns an empty string
+// if the contents are the same.
+func UnifiedDiff(oldName string, newName string, oldContent string, newContent string) string {
+	oldContent, newContent = withFinalNewline(oldContent), withFinalNewline(newContent)
+	if oldContent == newContent {
+		return ""
+	}
+
+	lines := diffLines(oldContent, newContent)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(lines); {
+		// Skip to the next change, keeping the context before it.
+		next := i
+		for next < len(lines) && lines[next].op == ' ' {
+			next++
+		}
+		if next == len(lines) {
+			break
+		}
+		start := next - unifiedContext
+		if start < i {
+			start = i
+		}
+		// The lines skipped are in both contents.
+		oldLine += start - i
+		newLine += start - i
+
+		// The hunk goes on as long as the changes are close enough for
+		// their contexts to overlap.
+		last := next
+		for j := next; j < len(lines) && j-last <= 2*unifiedContext; j++ {
+			if lines[j].op != ' ' {
+				last = j
+			}
+		}
+		end := last + unifiedContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		oldCount, newCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line.op != '+' {
+				oldCount++
+			}
+			if line.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, line := range lines[start:end] {
+			b.WriteByte(line.op)
+			b.WriteString(line.text)
+			b.WriteByte('\n')
+		}
+
+		oldLine += oldCount
+		newLine += newCount
+		i = end
+	}
+	return b.String()
+}
+
+// diffLines returns the lines of the given contents, in order, marked as in
+// both or only in one of them.
+func diffLines(oldContent string, newContent string) (lines []diffLine) {
+	dmp := diffmatchpatch.New()
+	oldChars, newChars, lineArray := dmp.DiffLinesToChars(oldContent, newContent)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(oldChars, newChars, false), lineArray)
+
+	for _, d := range diffs {
+		op := byte(' ')
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		}
+		for _, text := range strings.SplitAfter(d.Text, "\n") {
+			if text != "" {
+				lines = append(lines, diffLine{op: op, text: strings.TrimSuffix(text, "\n")})
+			}
+		}
+	}
+	return
+}
+
+// withFinalNewline returns the given content ending with a newline, so its last
+// line compares like the other ones.
+func withFinalNewline(content string) string {
+	if content == "" || strings.HasSuffix(content, "\n") {
+		return content
+	}
+	return content + "\n"
+}
+
+// hunkRange formats the range of lines of a hunk starting at the given line,
+// with the given number of lines. An empty range gives the line before it.
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -1,180 +1,720 @@
 package poller
 
 import (
+	"context"
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/deploy"
 	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/health"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
 	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+	"github.com/bruce34/grafana-dashboards-manager/internal/quiet"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"math/rand"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+const (
+	// healthBaseBackoff is the delay before checking Grafana's health again
+	// after it was found unhealthy, doubled after each check.
+	healthBaseBackoff = 5 * time.Second
+	// healthMaxBackoff caps the delay between two health checks.
+	healthMaxBackoff = 5 * time.Minute
+	// pollMaxBackoff caps the delay before polling again after consecutive
+	// failed polls, unless the configured interval is longer.
+	pollMaxBackoff = 30 * time.Minute
+	// pollJitter is the fraction of the delay between two polls it's
+	// randomly shortened or lengthened by, so several instances don't poll
+	// the remote and Grafana at the same time.
+	pollJitter = 0.1
+)
+
+// pollRand draws the jitter of the delays between two polls. It's seeded so
+// instances started at the same time don't draw the same delays, and only
+// used by the poller's goroutine.
+var pollRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// clonePoller holds the state the poller keeps between two iterations for one
+// clone of the Git repository.
+type clonePoller struct {
+	// cfg is the configuration, with the Git settings of the clone.
+	cfg  *config.Config
+	repo *git.Repository
+	// previousCommit is the latest commit at the previous iteration, which
+	// hash is compared with the one from the most recent commit after we pull
+	// from the remote, so we know if there was any new commit.
+	previousCommit *object.Commit
+	// previousFilesContents is the content of the files at the previous
+	// iteration, needed to manage removed files which contents won't be
+	// accessible anymore.
+	previousFilesContents map[string][]byte
+	// deployState records the last deployed commit when only the changes
+	// marked for deployment are pushed. It is nil otherwise.
+	deployState *deploy.State
+	// quietHours is the schedule of the quiet hours during which the new
+	// commits are deferred, nil if there aren't any.
+	quietHours *quiet.Schedule
+}
+
 // Setup loads (and synchronise if needed) the Git repository mentioned in the
 // configuration file, then creates the poller that will pull from the Git
-// repository on a regular basis and push all the changes to Grafana.
+// repository on a regular basis and push all the changes to Grafana. If
+// folders are mapped to branches, the clone of each of these branches is
+// polled as well. The poller stops between two iterations once the given
+// context is cancelled, while the changes are pushed with the given work
+// context, so the iteration in progress can finish.
 // Returns an error if the poller encountered one.
-func Setup(cfg *config.Config, client *grafana.Client, delRemoved bool, singleShot bool) error {
-	// Load the Git repository.
-	r, needsSync, err := git.NewRepository(cfg.Git)
+func Setup(
+	ctx context.Context, workCtx context.Context, cfg *config.Config, client *grafana.Client,
+	delRemoved bool, singleShot bool,
+) error {
+	clones, err := loadClones(cfg)
 	if err != nil {
 		return err
 	}
-
-	// Synchronise the repository if needed.
-	if needsSync {
-		if err = r.Sync(false); err != nil {
-			return err
-		}
-	}
+	health.Default.RecordSync(nil)
 
 	errs := make(chan error, 1)
 
 	// In the future we may want to poll from several Git repositories, so we
 	// run the poller in a go routine.
 	go func() {
-		if err = poller(cfg, r, client, delRemoved, singleShot); err != nil || singleShot {
+		if err := poller(ctx, workCtx, cfg, clones, client, delRemoved, singleShot); err != nil || singleShot {
 			errs <- err
 			return
 		}
 	}()
 
-	err = <-errs
-	return err
+	return <-errs
+}
+
+// loadClones loads, and synchronises if needed, the clone of each branch of the
+// Git repository the configuration gives.
+// Returns an error if a clone couldn't be loaded or synchronised, or if the
+// quiet hours are invalid.
+func loadClones(cfg *config.Config) (clones []*clonePoller, err error) {
+	quietHours, err := quiet.New(cfg.Pusher.QuietHours)
+	if err != nil {
+		return
+	}
+
+	clones = make([]*clonePoller, 0)
+	for _, branchCfg := range cfg.BranchConfigs() {
+		// Load the Git repository.
+		r, needsSync, err := git.NewRepository(branchCfg.Git)
+		if err != nil {
+			return nil, err
+		}
+
+		// Synchronise the repository if needed.
+		if needsSync {
+			if err = r.Sync(false); err != nil {
+				return nil, err
+			}
+		}
+
+		clones = append(clones, &clonePoller{cfg: branchCfg, repo: r, quietHours: quietHours})
+	}
+	return
 }
 
-// poller gets the current status of the Git repository that has previously been
-// loaded, and then starts an infinite loop that will pull from the Git
-// remote, then, if there was any new commit, retrieve the contents of the
-// modified and added files to push them to Grafana. If set by the user via
-// a command-line flag, it will also check for removed files and delete the
-// corresponding dashboards from Grafana. It then sleeps for the time specified
-// in the configuration file, before starting its next iteration.
-// Returns an error if there was an issue checking the Git repository status,
-// synchronising it, reading the files' contents, filtering out ignored files,
-// or discussing with the Grafana API.
+// poller gets the current status of the clones of the Git repository that
+// have previously been loaded, and then starts an infinite loop that will
+// poll each of them (see clonePoller.poll), then sleep for the time specified
+// in the configuration file, before starting its next iteration. The loop stops
+// between two polls once the given context is cancelled, the polls being done
+// with the given work context.
+// Returns an error if there was an issue checking a Git repository status or
+// polling a clone.
 func poller(
-	cfg *config.Config, repo *git.Repository, client *grafana.Client,
+	ctx context.Context, workCtx context.Context, cfg *config.Config, clones []*clonePoller, client *grafana.Client,
 	delRemoved bool, singleShot bool,
 ) (err error) {
-	var latestCommit *object.Commit
-	// Get current state of the repo.
+	// Get current state of the repos.
 	// This is mainly to give an initial value to variables that will see their
 	// content changed with every iteration of the loop.
-	latestCommit, err = repo.GetLatestCommit()
+	for _, clone := range clones {
+		latestCommit, err := clone.repo.GetLatestCommit()
+		if err != nil {
+			return err
+		}
+		if err = clone.start(cfg, latestCommit); err != nil {
+			return err
+		}
+	}
+
+	interval := time.Duration(cfg.Pusher.Config.Interval) * time.Second
+	failures := 0
+	for loop := true; loop; loop = !singleShot {
+		// Don't push to a Grafana which couldn't take the changes.
+		if !waitHealthy(ctx, client) {
+			logrus.Info("Poller stopped")
+			return nil
+		}
+
+		// Clones are polled one after the other, since pulling Grafana after
+		// pushing to it synchronises all of them.
+		var pollErr error
+		for _, clone := range clones {
+			if ctx.Err() != nil {
+				logrus.Info("Poller stopped")
+				return nil
+			}
+			if pollErr = clone.poll(workCtx, cfg, client, delRemoved); pollErr != nil {
+				break
+			}
+		}
+		if singleShot {
+			return pollErr
+		}
+
+		// Back off after failures, e.g. while the remote is unreachable,
+		// rather than failing again at each interval.
+		if pollErr != nil {
+			failures++
+		} else if failures > 0 {
+			logrus.WithFields(logrus.Fields{
+				"failures": failures,
+			}).Info("Polled successfully again, back to the configured interval")
+			failures = 0
+		}
+		delay := nextPollDelay(interval, failures)
+		if pollErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     pollErr,
+				"failures":  failures,
+				"next_poll": delay,
+			}).Error("Failed to poll the Git repository, backing off")
+		}
+
+		// Sleep before the next iteration.
+		select {
+		case <-ctx.Done():
+			logrus.Info("Poller stopped")
+			return nil
+		case <-time.After(delay):
+		}
+	}
+	return
+}
+
+// nextPollDelay returns the delay before the next poll, given the configured
+// interval and the number of consecutive failed polls: the interval, doubled
+// after each failure up to pollMaxBackoff, unless the interval is longer,
+// then randomly shortened or lengthened by up to pollJitter of itself.
+func nextPollDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < pollMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > pollMaxBackoff && interval < pollMaxBackoff {
+		delay = pollMaxBackoff
+	}
+	return delay + time.Duration((pollRand.Float64()*2-1)*pollJitter*float64(delay))
+}
+
+// start sets the state of the clone as of the given commit, which changes are
+// considered as already pushed.
+// Returns an error if the files couldn't be read at this commit, or if the
+// deployment state couldn't be loaded.
+func (p *clonePoller) start(cfg *config.Config, commit *object.Commit) (err error) {
+	p.previousCommit = commit
+	p.previousFilesContents, err = p.repo.GetFilesContentsAtCommit(commit)
 	if err != nil {
 		return
 	}
 
-	var filesContents map[string][]byte
-	filesContents, err = repo.GetFilesContentsAtCommit(latestCommit)
+	if cfg.Pusher.Deploy != nil {
+		p.deployState, err = deploy.LoadOrInitState(
+			deploy.StatePath(p.cfg), cfg.Pusher.Deploy.Target, commit.Hash.String(),
+		)
+	}
+	return
+}
+
+// waitHealthy waits until Grafana is healthy, requesting its health endpoint
+// again with an exponential backoff between attempts.
+// Returns false if the given context was cancelled while waiting.
+func waitHealthy(ctx context.Context, client *grafana.Client) bool {
+	wait := healthBaseBackoff
+	for {
+		_, err := client.CheckHealth(ctx)
+		health.Default.RecordGrafana(err)
+		if err == nil {
+			return true
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"wait":  wait,
+		}).Warn("Grafana isn't healthy, waiting before polling")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+
+		if wait *= 2; wait > healthMaxBackoff {
+			wait = healthMaxBackoff
+		}
+	}
+}
+
+// poll pulls the clone from the Git remote, then, if there was any new
+// commit, retrieves the contents of the modified and added files to push them
+// to Grafana. If set by the user via a command-line flag, it will also check
+// for removed files and delete the corresponding dashboards from Grafana. It
+// then calls the puller with the global configuration, so the new versions
+// are committed to every clone.
+// Each range of new commits is recorded in the clone's journal before being
+// pushed, so a range which couldn't be pushed (e.g. because Grafana was down)
+// is pushed again at the next iterations, even after a restart. During quiet
+// hours, the ranges are only recorded, and pushed at the first iteration
+// after the quiet hours, unless a commit is marked as urgent.
+// Returns an error if there was an issue synchronising the repository or
+// reading the files' contents.
+func (p *clonePoller) poll(ctx context.Context, globalCfg *config.Config, client *grafana.Client, delRemoved bool) (err error) {
+	cfg := p.cfg
+
+	// Synchronise the repository (i.e. pull from remote).
+	err = p.repo.Sync(true)
+	health.Default.RecordSync(err)
 	if err != nil {
 		return
 	}
 
-	// We'll need to know the previous commit in order to compare its hash with
-	// the one from the most recent commit after we pull from the remote, se we
-	// know if there was any new commit.
-	previousCommit := latestCommit
-	// We need to store the content of the files from the previous iteration of
-	// the loop in order to manage removed files which contents won't be
-	// accessible anymore.
-	previousFilesContents := filesContents
+	// Retrieve the latest commit in order to compare its hash with the
+	// previous one.
+	latestCommit, err := p.repo.GetLatestCommit()
+	if err != nil {
+		return
+	}
 
-	for loop := true; loop; loop = !singleShot {
-		// Synchronise the repository (i.e. pull from remote).
-		if err = repo.Sync(true); err != nil {
-			return
-		}
+	// Nothing is pushed during quiet hours, unless the new commits are
+	// urgent, in which case the deferred ones are pushed too so the changes
+	// are applied in order.
+	quietUntil, quietNow := p.quietHours.Until(time.Now())
+	urgent := quietNow && p.isUrgent(latestCommit)
+
+	// Retry the previous ranges which failed or were deferred, if any, first
+	// so the changes are applied in order.
+	// They're retried with a backoff, unless new commits must be pushed
+	// after them.
+	var replayErr error
+	if !quietNow || urgent {
+		newCommits := p.previousCommit.Hash != latestCommit.Hash
+		replayErr = p.replayJournal(ctx, globalCfg, client, delRemoved, newCommits)
+	}
 
-		// Retrieve the latest commit in order to compare its hash with the
-		// previous one.
-		latestCommit, err = repo.GetLatestCommit()
+	filesContents := p.previousFilesContents
+
+	// If there is at least one new commit, handle the changes it introduces.
+	if p.previousCommit.Hash.String() != latestCommit.Hash.String() {
+		logrus.WithFields(logrus.Fields{
+			"previous_hash": p.previousCommit.Hash.String(),
+			"new_hash":      latestCommit.Hash.String(),
+			"clone_path":    cfg.Git.ClonePath,
+		}).Info("New commit(s) detected")
+
+		// Get the updated files contents.
+		filesContents, err = p.repo.GetFilesContentsAtCommit(latestCommit)
 		if err != nil {
 			return
 		}
 
-		// If there is at least one new commit, handle the changes it introduces.
-		if previousCommit.Hash.String() != latestCommit.Hash.String() {
+		// Record the range before pushing it.
+		j := journal.Open(journal.Path(cfg.Git))
+		entryID, journalErr := j.Append(p.ref(), p.previousCommit.Hash.String(), latestCommit.Hash.String())
+		if journalErr != nil {
 			logrus.WithFields(logrus.Fields{
-				"previous_hash": previousCommit.Hash.String(),
-				"new_hash":      latestCommit.Hash.String(),
-			}).Info("New commit(s) detected")
-
-			// Get the updated files contents.
-			filesContents, err = repo.GetFilesContentsAtCommit(latestCommit)
-			if err != nil {
-				return
-			}
+				"error": journalErr,
+			}).Error("Failed to record the new commits in the journal")
+		}
 
-			// Get the name of the files that have been added/modified and
-			// removed between the two iterations.
-			modified, removed, err := repo.GetModifiedAndRemovedFiles(previousCommit, latestCommit)
-			if err != nil {
-				return err
+		if quietNow && !urgent {
+			logrus.WithFields(logrus.Fields{
+				"new_hash":   latestCommit.Hash.String(),
+				"clone_path": cfg.Git.ClonePath,
+				"until":      quietUntil,
+			}).Info("Quiet hours, deferring the new commits until they end")
+		} else if replayErr != nil && entryID > 0 {
+			// Pushing the new commits before the pending ones would let
+			// the pending ones overwrite their changes once pushed, so
+			// they're left in the journal, to be pushed along with them.
+			logrus.WithFields(logrus.Fields{
+				"new_hash":   latestCommit.Hash.String(),
+				"clone_path": cfg.Git.ClonePath,
+			}).Warn("Previous commits still couldn't be pushed, the new commits will be pushed with them")
+		} else if err = p.pushRange(
+			ctx, globalCfg, client, delRemoved, p.previousCommit, latestCommit, p.previousFilesContents, filesContents,
+		); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      err,
+				"clone_path": cfg.Git.ClonePath,
+			}).Error("Failed to push the new commits, will retry later")
+			err = nil
+		} else if entryID > 0 {
+			if journalErr = j.MarkDone(entryID); journalErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": journalErr,
+				}).Error("Failed to mark the new commits as done in the journal")
 			}
+		}
+	}
 
-			// Get a map containing the latest known content of each added,
-			// modified and removed file.
-			mergedContents := mergeContents(modified, removed, filesContents, previousFilesContents)
+	// Update the commit and files contents to prepare for the next iteration.
+	p.previousCommit = latestCommit
+	p.previousFilesContents = filesContents
 
-			// Separate out dashboards and folders
-			dashboardsModified, foldersModified, librariesModified := SeparateDashboardsFoldersLibraries(modified)
-			dashboardsRemoved, _, librariesRemoved := SeparateDashboardsFoldersLibraries(removed)
+	return nil
+}
 
-			_ = librariesModified
-			_ = librariesRemoved
+// isUrgent returns true if a commit made since the previous iteration, up to
+// the given latest commit, is marked as urgent.
+func (p *clonePoller) isUrgent(latestCommit *object.Commit) bool {
+	if p.previousCommit.Hash == latestCommit.Hash {
+		return false
+	}
 
-			// Load versions
-			logrus.Info("Getting local dashboard versions")
-			syncPath := puller.SyncPath(cfg)
-			fileVersionFile, _, err := puller.GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
-			if err != nil {
-				logrus.Error("Failed to get dashboard versions from local file system")
-				return err
-			}
-			// ensure all folders are created
-			client.CreateFolders(foldersModified, mergedContents)
-			// cowardly not deleting folders as they may delete all dashboards underneath them
-			var grafanaVersionFile grafana.DefsFile
-			_, grafanaVersionFile, err = puller.GetDefinitionsFromGrafanaAPI(client, cfg)
-
-			// If the user requested it, delete all dashboards that were removed
-			// from the repository. Delete before adding new ones in case of rename.
-			if delRemoved {
-				grafana.DeleteDashboards(dashboardsRemoved, mergedContents, client)
-				grafana.DeleteLibraries(librariesRemoved, mergedContents, client)
-			}
+	commits, err := p.repo.GetCommitsBetween(p.previousCommit, latestCommit)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to read the new commits, considering them as not urgent")
+		return false
+	}
 
-			// Push the contents of the files that were added or modified to the
-			// Grafana API.
-			grafana.PushLibraryFiles(librariesModified, mergedContents, fileVersionFile, grafanaVersionFile, client)
-			grafana.Push(cfg, fileVersionFile, grafanaVersionFile, dashboardsModified, mergedContents, client)
-
-			// Grafana will auto-update the version number after we pushed the new
-			// dashboards, so we use the puller mechanic to pull the updated numbers and
-			// commit them in the git repo.
-			if !cfg.Git.DontPush {
-				if err = puller.PullGrafanaAndCommit(client, cfg); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"error":      err,
-						"repo":       cfg.Git.User + "@" + cfg.Git.URL,
-						"clone_path": cfg.Git.ClonePath,
-					}).Error("Call to puller returned an error")
-				}
-			} else {
-				logrus.Info("Skipping git push - asked not to")
-			}
+	for _, commit := range commits {
+		if quiet.IsUrgent(commit.Message) {
+			return true
 		}
+	}
+	return false
+}
+
+// ref returns the reference of the branch tracked by the clone, as recorded
+// in the journal.
+func (p *clonePoller) ref() string {
+	if p.cfg.Git.Branch == "" {
+		return "HEAD"
+	}
+	return "refs/heads/" + p.cfg.Git.Branch
+}
 
-		// Update the commit and files contents to prepare for the next iteration.
-		previousCommit = latestCommit
-		previousFilesContents = filesContents
+// replayJournal pushes again the ranges of commits recorded in the clone's
+// journal which couldn't be pushed to Grafana, and marks them as done once
+// pushed. The pending ranges are merged into a single one, so each file is
+// only pushed with its latest content. Unless forced, e.g. because new commits
+// must be pushed after them, they're only retried once the backoff since the
+// previous attempt has passed.
+// Returns an error if a range still couldn't be pushed, in which case the
+// changes made after it mustn't be pushed before it.
+func (p *clonePoller) replayJournal(
+	ctx context.Context, globalCfg *config.Config, client *grafana.Client, delRemoved bool, force bool,
+) (err error) {
+	j := journal.Open(journal.Path(p.cfg.Git))
+	pending, journalErr := j.Pending()
+	if journalErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": journalErr,
+		}).Error("Failed to read the journal")
+		return
+	}
 
-		if !singleShot {
-			// Sleep before the next iteration.
-			time.Sleep(time.Duration(cfg.Pusher.Config.Interval) * time.Second)
+	for _, r := range journal.Ranges(pending) {
+		if !force && !r.Due(time.Now()) {
+			continue
+		}
+		logFields := logrus.Fields{
+			"before":   r.Before,
+			"after":    r.After,
+			"commits":  r.Commits(),
+			"accepted": r.Entries[0].AcceptedAt,
+			"attempts": r.Attempts(),
+		}
+		logrus.WithFields(logFields).Info("Retrying commits which weren't pushed to Grafana")
+
+		if journalErr = j.RecordAttempt(r.IDs()...); journalErr != nil {
+			logrus.WithFields(logFields).WithField("error", journalErr).Error("Failed to update the journal")
+		}
+
+		if err = p.replayRange(ctx, globalCfg, client, delRemoved, r); err != nil {
+			logrus.WithFields(logFields).WithField("error", err).Warn("Commits still couldn't be pushed, will retry later")
+			return
+		}
+
+		if journalErr = j.MarkDone(r.IDs()...); journalErr != nil {
+			logrus.WithFields(logFields).WithField("error", journalErr).Error("Failed to update the journal")
+		}
+		logrus.WithFields(logFields).Info("Pushed the commits which weren't pushed to Grafana")
+	}
+	return
+}
+
+// replayRange pushes the range of commits merging journal entries. If the
+// latest commit of the range isn't known anymore, e.g. because it was
+// force-pushed away, the changes are pushed up to the current head instead. If
+// the commit preceding the range isn't known, all of the files are pushed.
+// Returns an error if the commits couldn't be loaded or pushed.
+func (p *clonePoller) replayRange(
+	ctx context.Context, globalCfg *config.Config, client *grafana.Client, delRemoved bool, r journal.Range,
+) (err error) {
+	to, err := p.repo.GetCommit(r.After)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"after":      r.After,
+			"clone_path": p.cfg.Git.ClonePath,
+		}).Warn("Latest commit of the range not found, pushing up to the current head instead")
+
+		if to, err = p.repo.GetLatestCommit(); err != nil {
+			return
+		}
+	}
+	toContents, err := p.repo.GetFilesContentsAtCommit(to)
+	if err != nil {
+		return
+	}
+
+	fromContents := make(map[string][]byte)
+	from, fromErr := p.repo.GetCommit(r.Before)
+	if fromErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      fromErr,
+			"before":     r.Before,
+			"clone_path": p.cfg.Git.ClonePath,
+		}).Warn("Commit preceding the range not found, pushing all files")
+
+		from = nil
+	} else if fromContents, err = p.repo.GetFilesContentsAtCommit(from); err != nil {
+		return
+	}
+
+	return p.pushRange(ctx, globalCfg, client, delRemoved, from, to, fromContents, toContents)
+}
+
+// pushRange pushes to Grafana the changes made between the two given
+// commits, which files contents are given, then calls the puller. If the
+// commit preceding the range is nil, every file is pushed.
+// Returns an error if the changes couldn't be computed, if Grafana couldn't
+// be reached or if a file couldn't be pushed.
+func (p *clonePoller) pushRange(
+	ctx context.Context, globalCfg *config.Config, client *grafana.Client, delRemoved bool,
+	from *object.Commit, to *object.Commit, fromContents map[string][]byte, toContents map[string][]byte,
+) (err error) {
+	cfg := p.cfg
+	// Write the summary of the push and the pull which follows, if asked to.
+	defer func() { results.Current.Flush(err) }()
+
+	// A rewritten history, e.g. force-pushed, can't be walked back to the
+	// previous commit, which isn't in it anymore, so every file is pushed, as
+	// when the previous commit isn't known.
+	rewritten := from == nil
+	if !rewritten {
+		if rewritten, err = historyRewritten(from, to); err != nil {
+			return err
+		}
+		if rewritten {
+			logrus.WithFields(logrus.Fields{
+				"previous_hash": from.Hash.String(),
+				"new_hash":      to.Hash.String(),
+				"clone_path":    cfg.Git.ClonePath,
+			}).Warn("History rewrite detected, the previous commit isn't in the branch's history anymore: pushing the full current state")
+		}
+	}
+
+	var modified, removed []string
+	var mergedContents map[string][]byte
+	var deployChanges *deploy.Changes
+	if rewritten {
+		modified, removed = allFiles(toContents, fromContents)
+		mergedContents = mergeContents(modified, removed, toContents, fromContents)
+		if cfg.Pusher.Deploy != nil {
+			// Everything is deployed, so the next catch-up starts from
+			// there.
+			deployChanges = &deploy.Changes{DeployedAll: to.Hash.String()}
+		}
+	} else if cfg.Pusher.Deploy != nil {
+		// Only push the changes marked for deployment.
+		deployChanges, err = deploy.PlanRange(p.repo, cfg.Pusher.Deploy, p.deployState, from, to)
+		if err != nil {
+			return err
+		}
+		modified, removed, mergedContents = deployChanges.Modified, deployChanges.Removed, deployChanges.Contents
+	} else {
+		// Get the name of the files that have been added/modified and
+		// removed between the two commits.
+		modified, removed, err = p.repo.GetModifiedAndRemovedFiles(from, to)
+		if err != nil {
+			return err
+		}
+
+		// Get a map containing the latest known content of each added,
+		// modified and removed file.
+		mergedContents = mergeContents(modified, removed, toContents, fromContents)
+	}
+
+	// Push the changes of each organisation's files with a client working in
+	// this organisation. The dashboards retrieved to compare the files with
+	// are kept for the pull which follows.
+	snapshot := puller.NewSnapshot()
+	run := results.NewRunResult()
+	var pushErr error
+	for _, orgCfg := range cfg.OrgConfigs() {
+		orgClient := client.ForOrg(orgCfg.Grafana.OrgID)
+		orgRun, orgPushErr, err := pushOrgChanges(
+			ctx, orgCfg, orgClient, snapshot, delRemoved,
+			orgCfg.OrgFiles(modified), orgCfg.OrgFiles(removed), mergedContents,
+		)
+		if err != nil {
+			return err
+		}
+		if cfg.Pusher.Annotate {
+			orgClient.AnnotatePush(ctx, to.Hash.String(), orgRun)
+		}
+		run.Merge(orgRun)
+		if pushErr == nil {
+			pushErr = orgPushErr
+		}
+	}
+	results.Current.Record(run)
+	logrus.WithFields(logrus.Fields{
+		"results": run.Summary(),
+	}).Info("Pushed the changes to Grafana")
+	if cfg.Grafana.SelfDashboard {
+		client.UpdateSelfDashboardPush(ctx, to.Hash.String(), run, pushErr)
+	}
+
+	// A dry run changes nothing, neither on Grafana nor in the repository.
+	if client.DryRun {
+		logrus.Info("Dry run: not recording the deployment nor pulling the new versions")
+		return pushErr
+	}
+
+	// Record the catch-up so the next one starts from there.
+	if pushErr == nil && deployChanges != nil && len(deployChanges.DeployedAll) > 0 {
+		if err = p.deployState.MarkDeployed(deployChanges.DeployedAll, deploy.StatePath(cfg)); err != nil {
+			return err
+		}
+	}
+
+	// Grafana will auto-update the version number after we pushed the new
+	// dashboards, so we use the puller mechanic to pull the updated numbers and
+	// commit them in the git repo.
+	if !cfg.Git.DontPush {
+		if err = puller.PullGrafanaAndCommit(ctx, client, globalCfg, snapshot); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      err,
+				"repo":       cfg.Git.User + "@" + cfg.Git.URL,
+				"clone_path": cfg.Git.ClonePath,
+			}).Error("Call to puller returned an error")
+		}
+	} else {
+		logrus.Info("Skipping git push - asked not to")
+	}
+
+	return pushErr
+}
+
+// pushOrgChanges pushes to Grafana the given modified and removed files of
+// the organisation the given configuration is for, retrieving the dashboards
+// from Grafana into the given snapshot, which forgets the ones changed.
+// Returns the result of each push, the first error encountered pushing the
+// libraries or the dashboards, if any, and an error if the definitions from
+// the repository or Grafana couldn't be loaded.
+func pushOrgChanges(
+	ctx context.Context, cfg *config.Config, client *grafana.Client, snapshot *puller.Snapshot, delRemoved bool,
+	modified []string, removed []string, mergedContents map[string][]byte,
+) (run *results.RunResult, pushErr error, err error) {
+	// Separate out dashboards and folders
+	dashboardsModified, foldersModified, librariesModified := SeparateDashboardsFoldersLibraries(modified)
+	dashboardsRemoved, foldersRemoved, librariesRemoved := SeparateDashboardsFoldersLibraries(removed)
+
+	// Load versions
+	logrus.Info("Getting local dashboard versions")
+	syncPath := puller.SyncPath(cfg)
+	fileVersionFile, _, err := puller.GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
+	if err != nil {
+		logrus.Error("Failed to get dashboard versions from local file system")
+		return
+	}
+	// Push the folders, datasources, libraries and dashboards in the order
+	// they depend on each other. The datasources are never deleted, since
+	// they may be used by dashboards outside of the repository, and the
+	// folders are only deleted at the end, and only if they're empty, as
+	// deleting a folder deletes all dashboards underneath it.
+	run, pushErr, err = grafana.PushAll(ctx, cfg, client, grafana.PushFiles{
+		Folders:           foldersModified,
+		Datasources:       SeparateDatasources(modified),
+		Libraries:         librariesModified,
+		Dashboards:        dashboardsModified,
+		RemovedDashboards: dashboardsRemoved,
+		RemovedLibraries:  librariesRemoved,
+		Delete:            delRemoved,
+		Contents:          mergedContents,
+	}, fileVersionFile, func(ctx context.Context) (grafana.DefsFile, error) {
+		return snapshot.Definitions(ctx, client, cfg)
+	})
+	if err != nil {
+		return
+	}
+	// Alert rules reference the folders they belong to, which have been
+	// created above, and the contact points they notify.
+	alertRun := results.NewRunResult()
+	if cfg.Grafana.SyncNotifications {
+		contactPointsModified, muteTimingsModified, policiesModified := SeparateNotifications(modified)
+		alertRun.Merge(grafana.PushNotificationFiles(ctx, contactPointsModified, muteTimingsModified, policiesModified, mergedContents, client))
+		// Mute timings can only be deleted once the notification policies
+		// don't refer to them anymore.
+		if delRemoved {
+			_, muteTimingsRemoved, _ := SeparateNotifications(removed)
+			alertRun.Merge(grafana.DeleteMuteTimings(ctx, muteTimingsRemoved, mergedContents, client))
+		}
+	}
+	if cfg.Grafana.SyncAlertRules {
+		alertRun.Merge(grafana.PushAlertRuleFiles(ctx, SeparateAlertRules(modified), mergedContents, client))
+	}
+	run.Merge(alertRun)
+	// The dashboards moved out of the removed folders have been pushed by now.
+	if delRemoved && client.DeleteRemovedFolders {
+		run.Merge(grafana.DeleteFolders(ctx, foldersRemoved, dashboardsRemoved, mergedContents, fileVersionFile, client))
+	}
+	// The pull which follows has to retrieve again what changed.
+	snapshot.Invalidate(client, run)
+
+	if pushErr == nil {
+		pushErr = alertRun.Err()
+	}
+	return
+}
+
+// historyRewritten returns true if the given previous commit isn't an ancestor
+// of the given latest one, e.g. because the history was force-pushed, so the
+// changes between them can't be computed from the commits made since.
+// Returns an error if the history couldn't be walked.
+func historyRewritten(previous *object.Commit, latest *object.Commit) (bool, error) {
+	if previous.Hash == latest.Hash {
+		return false, nil
+	}
+	isAncestor, err := previous.IsAncestor(latest)
+	return !isAncestor, err
+}
+
+// allFiles returns the files in the given latest contents, as modified, and the
+// ones only in the given previous contents, as removed, both sorted.
+func allFiles(filesContents map[string][]byte, previousFilesContents map[string][]byte) (modified []string, removed []string) {
+	modified = utils.SortedKeys(filesContents)
+	removed = make([]string, 0)
+	for _, filename := range utils.SortedKeys(previousFilesContents) {
+		if _, ok := filesContents[filename]; !ok {
+			removed = append(removed, filename)
 		}
 	}
 	return
@@ -208,16 +748,74 @@ func mergeContents(
 	return
 }
 
+// SeparateDatasources returns the given files which describe datasources,
+// sorted so they're pushed in the same order from one run to another.
+func SeparateDatasources(modified []string) (datasourcesModified []string) {
+	datasourcesModified = make([]string, 0)
+	for _, o := range utils.SortedCopy(modified) {
+		if strings.HasPrefix(o, "datasources") {
+			datasourcesModified = append(datasourcesModified, o)
+		}
+	}
+	return
+}
+
+// SeparateAlertRules returns the given files which describe alert rules,
+// sorted so they're pushed in the same order from one run to another.
+func SeparateAlertRules(modified []string) (alertRulesModified []string) {
+	alertRulesModified = make([]string, 0)
+	for _, o := range utils.SortedCopy(modified) {
+		if strings.HasPrefix(o, "alerts") {
+			alertRulesModified = append(alertRulesModified, o)
+		}
+	}
+	return
+}
+
+// SeparateNotifications returns the given files which describe contact points,
+// the ones which describe mute timings, and the ones which describe the
+// notification policy tree, sorted so they're pushed in the same order from
+// one run to another.
+func SeparateNotifications(modified []string) (contactPointsModified []string, muteTimingsModified []string, policiesModified []string) {
+	contactPointsModified = make([]string, 0)
+	muteTimingsModified = make([]string, 0)
+	policiesModified = make([]string, 0)
+	for _, o := range utils.SortedCopy(modified) {
+		if strings.HasPrefix(o, "alerting/contact-points/") {
+			contactPointsModified = append(contactPointsModified, o)
+		} else if strings.HasPrefix(o, "alerting/mute-timings/") {
+			muteTimingsModified = append(muteTimingsModified, o)
+		} else if strings.HasPrefix(o, "alerting/") && filepath.Base(o) == "policies.json" {
+			policiesModified = append(policiesModified, o)
+		}
+	}
+	return
+}
+
 func SeparateDashboardsFoldersLibraries(modified []string) (dashboardsModified []string, foldersModified []string, librariesModified []string) {
 	foldersModified = make([]string, 0)
 	dashboardsModified = make([]string, 0)
-	for _, o := range modified {
+	// Sort the files so they're pushed in the same order from one run to
+	// another.
+	for _, o := range utils.SortedCopy(modified) {
 		if strings.HasPrefix(o, "dashboards") {
 			dashboardsModified = append(dashboardsModified, o)
 		} else if strings.HasPrefix(o, "folders") {
 			foldersModified = append(foldersModified, o)
 		} else if strings.HasPrefix(o, "libraries") {
 			librariesModified = append(librariesModified, o)
+		} else if format.IsTeamsFile(o) {
+			// The teams are only read when pushing permissions.
+			continue
+		} else if strings.HasPrefix(o, "provisioning") {
+			// The dashboards written for Grafana's file provisioning
+			// are never pushed.
+			continue
+		} else if strings.HasPrefix(o, "datasources") || strings.HasPrefix(o, "alerts") || strings.HasPrefix(o, "alerting") {
+			// Datasources, alert rules and notification settings are
+			// separated by SeparateDatasources, SeparateAlertRules and
+			// SeparateNotifications.
+			continue
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"filename": o,
@@ -0,0 +1,338 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafanatest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
+)
+
+func TestSeparateDashboardsFoldersLibrariesStable(t *testing.T) {
+	modified := []string{
+		"libraries/b.json",
+		"dashboards/z.json",
+		"folders/y.json",
+		"dashboards/a.json",
+		"libraries/a.json",
+		"folders/b.json",
+		"dashboards/m.json",
+	}
+	// The same files, in another order.
+	reversed := make([]string, len(modified))
+	for i, filename := range modified {
+		reversed[len(modified)-1-i] = filename
+	}
+
+	dashboards, folders, libraries := SeparateDashboardsFoldersLibraries(modified)
+	if want := []string{"dashboards/a.json", "dashboards/m.json", "dashboards/z.json"}; !reflect.DeepEqual(dashboards, want) {
+		t.Errorf("dashboards = %v, want %v", dashboards, want)
+	}
+	if want := []string{"folders/b.json", "folders/y.json"}; !reflect.DeepEqual(folders, want) {
+		t.Errorf("folders = %v, want %v", folders, want)
+	}
+	if want := []string{"libraries/a.json", "libraries/b.json"}; !reflect.DeepEqual(libraries, want) {
+		t.Errorf("libraries = %v, want %v", libraries, want)
+	}
+
+	d2, f2, l2 := SeparateDashboardsFoldersLibraries(reversed)
+	if !reflect.DeepEqual(d2, dashboards) || !reflect.DeepEqual(f2, folders) || !reflect.DeepEqual(l2, libraries) {
+		t.Errorf("the order of the files changed the order they're pushed in")
+	}
+	if modified[0] != "libraries/b.json" {
+		t.Errorf("the given files were reordered")
+	}
+}
+
+// newTestConfig returns the configuration of a pusher polling the given remote
+// into a new clone, without pulling Grafana after the pushes.
+func newTestConfig(t *testing.T, remote *gittest.Remote) *config.Config {
+	t.Helper()
+
+	gitCfg := remote.Settings()
+	gitCfg.DontPush = true
+	return &config.Config{Git: gitCfg, Pusher: &config.PusherSettings{Mode: "git-pull"}}
+}
+
+// newTestClone loads the clone of the remote the given configuration gives,
+// cloning it, and starts polling it from its latest commit, as the poller does
+// when it starts.
+func newTestClone(t *testing.T, cfg *config.Config) *clonePoller {
+	t.Helper()
+
+	clones, err := loadClones(cfg)
+	if err != nil {
+		t.Fatalf("loadClones: %v", err)
+	}
+	latest, err := clones[0].repo.GetLatestCommit()
+	if err != nil {
+		t.Fatalf("GetLatestCommit: %v", err)
+	}
+	if err = clones[0].start(cfg, latest); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	return clones[0]
+}
+
+// A range which couldn't be pushed because Grafana was down is pushed, once,
+// by the next poller started after a restart.
+func TestPollReplaysJournalAfterRestart(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	ctx := context.Background()
+
+	clone := newTestClone(t, cfg)
+	remote.Commit("Add a dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops")}, nil, false)
+	fake.SetDown(true)
+	if err := clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	j := journal.Open(journal.Path(cfg.Git))
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("%d ranges pending after a failed push, want 1", len(pending))
+	}
+
+	// Restart: the new poller starts from the latest commit, which it
+	// doesn't push, but replays the journal.
+	fake.SetDown(false)
+	clone = newTestClone(t, cfg)
+	if err = clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if err = clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	if pushes, _ := fake.Counts(); pushes["ops"] != 1 {
+		t.Errorf("the dashboard was pushed %d times, want once", pushes["ops"])
+	}
+	if pending, err = j.Pending(); err != nil {
+		t.Fatalf("Pending: %v", err)
+	} else if len(pending) != 0 {
+		t.Errorf("%d ranges still pending: %+v", len(pending), pending)
+	}
+}
+
+func TestAllFiles(t *testing.T) {
+	latest := map[string][]byte{"dashboards/a.json": nil, "dashboards/c.json": nil}
+	previous := map[string][]byte{"dashboards/b.json": nil, "dashboards/a.json": nil, "README.md": nil}
+
+	modified, removed := allFiles(latest, previous)
+	if strings.Join(modified, " ") != "dashboards/a.json dashboards/c.json" {
+		t.Errorf("modified = %v, want every latest file", modified)
+	}
+	if strings.Join(removed, " ") != "README.md dashboards/b.json" {
+		t.Errorf("removed = %v, want the files only in the previous contents", removed)
+	}
+}
+
+// After a force-push, every file of the new head is pushed, and the ones
+// which only existed before are deleted.
+func TestPollForcePushed(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	initial := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	ctx := context.Background()
+
+	clone := newTestClone(t, cfg)
+	remote.Commit("Add dashboards", map[string]string{
+		"dashboards/ops.json":   grafanatest.DashboardJSON("ops", "Ops"),
+		"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra"),
+	}, nil, false)
+	if err := clone.poll(ctx, cfg, client, true); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	previous := clone.previousCommit
+
+	remote.ResetTo(initial)
+	rewritten := remote.Commit("Add dashboards again", map[string]string{
+		"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops"),
+		"dashboards/db.json":  grafanatest.DashboardJSON("db", "Databases"),
+	}, nil, true)
+
+	if err := clone.poll(ctx, cfg, client, true); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	head, err := clone.repo.GetLatestCommit()
+	if err != nil {
+		t.Fatalf("GetLatestCommit: %v", err)
+	}
+	// The versions are committed on top of the remote's head once pushed.
+	reset, err := clone.repo.GetCommit(rewritten.String())
+	if err != nil {
+		t.Fatalf("the clone doesn't have the rewritten head: %v", err)
+	}
+	if onTop, _ := reset.IsAncestor(head); head.Hash != rewritten && !onTop {
+		t.Fatalf("the clone is at %s, not reset to the rewritten head %s", head.Hash, rewritten)
+	}
+	if rw, err := historyRewritten(previous, head); err != nil || !rw {
+		t.Errorf("historyRewritten = %v, %v, want true", rw, err)
+	}
+
+	pushes, deletions := fake.Counts()
+	// The unchanged dashboard is pushed again, like every file of the head.
+	if pushes["ops"] != 2 || pushes["db"] != 1 {
+		t.Errorf("pushes = %v, want ops twice and db once", pushes)
+	}
+	if deletions["infra"] != 1 {
+		t.Errorf("deletions = %v, want infra once", deletions)
+	}
+}
+
+// Each of the commits made between the polls has its changes pushed exactly
+// once.
+func TestPollPushesEachCommitOnce(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	ctx := context.Background()
+
+	clone := newTestClone(t, cfg)
+	commits := []struct {
+		files map[string]string
+		want  map[string]int
+	}{
+		{
+			map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops")},
+			map[string]int{"ops": 1},
+		},
+		{
+			map[string]string{"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra")},
+			map[string]int{"ops": 1, "infra": 1},
+		},
+		{
+			map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Operations"), "dashboards/db.json": grafanatest.DashboardJSON("db", "Databases")},
+			map[string]int{"ops": 2, "infra": 1, "db": 1},
+		},
+	}
+	for i, commit := range commits {
+		remote.Commit(fmt.Sprintf("Commit %d", i+1), commit.files, nil, false)
+		// Polling again without new commits doesn't push anything.
+		for poll := 0; poll < 2; poll++ {
+			if err := clone.poll(ctx, cfg, client, false); err != nil {
+				t.Fatalf("commit %d: poll: %v", i+1, err)
+			}
+		}
+
+		pushes, _ := fake.Counts()
+		if !reflect.DeepEqual(pushes, commit.want) {
+			t.Errorf("after commit %d: pushes = %v, want %v", i+1, pushes, commit.want)
+		}
+	}
+}
+
+// New commits aren't pushed before the pending ones which still fail, which
+// would then overwrite their changes once pushed, but along with them, so
+// only the latest content of each file is pushed.
+func TestPollPendingBeforeNewCommits(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	ctx := context.Background()
+
+	clone := newTestClone(t, cfg)
+	remote.Commit("Add a dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "")}, nil, false)
+	if err := clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	// The pending commit still fails, so the new one is left pending too.
+	remote.Commit("Fix the dashboard", map[string]string{
+		"dashboards/ops.json":   grafanatest.DashboardJSON("ops", "Ops"),
+		"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra"),
+	}, nil, false)
+	if err := clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if pushes, _ := fake.Counts(); len(pushes) != 0 {
+		t.Errorf("pushes = %v, want none before the pending commits", pushes)
+	}
+	j := journal.Open(journal.Path(cfg.Git))
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d ranges pending, want both", len(pending))
+	}
+
+	// The next commits push the pending ones first, merged, with the fixed
+	// dashboard.
+	remote.Commit("Add another dashboard", map[string]string{"dashboards/db.json": grafanatest.DashboardJSON("db", "Databases")}, nil, false)
+	if err = clone.poll(ctx, cfg, client, false); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if pushes, _ := fake.Counts(); !reflect.DeepEqual(pushes, map[string]int{"ops": 1, "infra": 1, "db": 1}) {
+		t.Errorf("pushes = %v, want every dashboard once", pushes)
+	}
+	if pending, err = j.Pending(); err != nil {
+		t.Fatalf("Pending: %v", err)
+	} else if len(pending) != 0 {
+		t.Errorf("%d ranges still pending: %+v", len(pending), pending)
+	}
+}
+
+// A pending range which commits aren't known anymore, e.g. after a force-push
+// and a garbage collection, is still pushed instead of being retried forever:
+// with every file if the commit preceding it is unknown, up to the current
+// head if its latest commit is.
+func TestReplayUnknownCommits(t *testing.T) {
+	const unknown = "0123456789abcdef0123456789abcdef01234567"
+
+	for _, missing := range []string{"before", "after"} {
+		remote := gittest.NewRemote(t)
+		initial := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+		head := remote.Commit("Add dashboards", map[string]string{
+			"dashboards/ops.json":   grafanatest.DashboardJSON("ops", "Ops"),
+			"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra"),
+		}, nil, false)
+		cfg := newTestConfig(t, remote)
+		fake := grafanatest.NewFake()
+		client := grafanatest.NewClient(t, fake)
+		ctx := context.Background()
+
+		before, after := initial.String(), head.String()
+		if missing == "before" {
+			before = unknown
+		} else {
+			after = unknown
+		}
+
+		clone := newTestClone(t, cfg)
+		j := journal.Open(journal.Path(cfg.Git))
+		if _, err := j.Append(clone.ref(), before, after); err != nil {
+			t.Fatalf("%s: Append: %v", missing, err)
+		}
+		if err := clone.poll(ctx, cfg, client, false); err != nil {
+			t.Fatalf("%s: poll: %v", missing, err)
+		}
+
+		if pushes, _ := fake.Counts(); !reflect.DeepEqual(pushes, map[string]int{"ops": 1, "infra": 1}) {
+			t.Errorf("%s unknown: pushes = %v, want every dashboard once", missing, pushes)
+		}
+		if pending, err := j.Pending(); err != nil {
+			t.Fatalf("%s: Pending: %v", missing, err)
+		} else if len(pending) != 0 {
+			t.Errorf("%s unknown: %d ranges still pending: %+v", missing, len(pending), pending)
+		}
+	}
+}
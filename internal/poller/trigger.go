@@ -0,0 +1,185 @@
+package poller
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/health"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lastSeen records the latest commit of a clone the trigger handled, so the
+// next run, even after a restart, pushes the changes made since.
+type lastSeen struct {
+	Commit string    `json:"commit"`
+	SeenAt time.Time `json:"seenAt"`
+}
+
+// Trigger runs single iterations of the poller on demand, e.g. when a generic
+// webhook is called, instead of on a regular basis.
+type Trigger struct {
+	cfg        *config.Config
+	client     *grafana.Client
+	delRemoved bool
+	clones     []*clonePoller
+
+	// lock protects running and pending: a run requested while another one
+	// is in progress is done once it ends, so the runs are serialised and
+	// no request is lost.
+	lock    sync.Mutex
+	running bool
+	pending bool
+}
+
+// NewTrigger loads (and synchronise if needed) the clones of the Git
+// repository mentioned in the configuration file, and returns a trigger
+// polling them. Each clone starts from the latest commit handled by a
+// previous run, as recorded on disk, or else from its latest commit.
+// Returns an error if a clone couldn't be loaded or its state read.
+func NewTrigger(cfg *config.Config, client *grafana.Client, delRemoved bool) (t *Trigger, err error) {
+	clones, err := loadClones(cfg)
+	if err != nil {
+		return
+	}
+
+	for _, clone := range clones {
+		commit, err := clone.repo.GetLatestCommit()
+		if err != nil {
+			return nil, err
+		}
+
+		seen, err := loadLastSeen(lastSeenPath(clone.cfg.Git))
+		if err != nil {
+			return nil, err
+		}
+		if seen != nil {
+			if commit, err = clone.repo.GetCommit(seen.Commit); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":      err,
+					"commit":     seen.Commit,
+					"clone_path": clone.cfg.Git.ClonePath,
+				}).Warn("The last commit handled isn't in the clone anymore, starting from the latest one")
+				if commit, err = clone.repo.GetLatestCommit(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if err = clone.start(cfg, commit); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Trigger{cfg: cfg, client: client, delRemoved: delRemoved, clones: clones}, nil
+}
+
+// Run runs one iteration of the poller: each clone is synchronised with the
+// remote and the changes made since the last commit handled are pushed to
+// Grafana. If a run is already in progress, another one is done once it ends
+// instead, and Run returns right away.
+// Returns false if a run was already in progress, and an error if the last
+// iteration run failed.
+func (t *Trigger) Run(ctx context.Context) (started bool, err error) {
+	t.lock.Lock()
+	if t.running {
+		t.pending = true
+		t.lock.Unlock()
+		return false, nil
+	}
+	t.running = true
+	t.lock.Unlock()
+
+	for {
+		err = t.iterate(ctx)
+
+		t.lock.Lock()
+		if !t.pending || ctx.Err() != nil {
+			t.running, t.pending = false, false
+			t.lock.Unlock()
+			return true, err
+		}
+		t.pending = false
+		t.lock.Unlock()
+	}
+}
+
+// iterate polls each clone once, and records the latest commit it handled.
+// Returns an error if Grafana isn't healthy, or if a clone couldn't be polled.
+func (t *Trigger) iterate(ctx context.Context) (err error) {
+	// Don't push to a Grafana which couldn't take the changes.
+	_, err = t.client.CheckHealth(ctx)
+	health.Default.RecordGrafana(err)
+	if err != nil {
+		return
+	}
+
+	for _, clone := range t.clones {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = clone.poll(ctx, t.cfg, t.client, t.delRemoved); err != nil {
+			return
+		}
+
+		seen := lastSeen{Commit: clone.previousCommit.Hash.String(), SeenAt: time.Now()}
+		if saveErr := seen.save(lastSeenPath(clone.cfg.Git)); saveErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      saveErr,
+				"clone_path": clone.cfg.Git.ClonePath,
+			}).Error("Failed to record the last commit handled")
+		}
+	}
+	return
+}
+
+// lastSeenPath returns the path of the file recording the last commit of the
+// clone with the given settings the trigger handled. The file lives in the
+// .git directory of the clone, so it's never committed.
+func lastSeenPath(cfg *config.GitSettings) string {
+	return filepath.Join(cfg.ClonePath, ".git", "dashboards-manager", "last-seen.json")
+}
+
+// loadLastSeen reads the file at the given path.
+// Returns nil and no error if the file doesn't exist.
+// Returns an error if the file couldn't be read or parsed.
+func loadLastSeen(path string) (seen *lastSeen, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	seen = new(lastSeen)
+	err = json.Unmarshal(data, seen)
+	return
+}
+
+// save writes the last commit handled to the file at the given path, creating
+// its directory if needed. The file is replaced atomically so a crash can't
+// corrupt it.
+// Returns an error if the file couldn't be written.
+func (s lastSeen) save(path string) (err error) {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
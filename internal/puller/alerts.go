@@ -0,0 +1,70 @@
+package puller
+
+import (
+	"fmt"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pullAlertRules plans writing the alert rules which have been updated on the
+// Grafana instance since the versions file was written, and removing the
+// files of the rules which don't exist anymore or have moved to a folder
+// mapped to another branch.
+// Returns an error if a rule's description couldn't be written.
+func pullAlertRules(
+	cfg *config.Config, allDefs grafana.DefsFile, APIDefs grafana.DefsFile, fileDefs grafana.DefsFile,
+	changes *changeSet, result *pullResult,
+) (err error) {
+	for _, uid := range utils.SortedKeys(APIDefs.AlertRuleByUID) {
+		rule := APIDefs.AlertRuleByUID[uid]
+		fileVersion, ok := fileDefs.AlertRuleVersionByUID[uid]
+		if ok && rule.Version <= fileVersion {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"title":        rule.Title,
+			"file_version": fileVersion,
+			"new_version":  rule.Version,
+			"uid":          uid,
+		}).Info("Grafana has a newer alert rule version than previously, updating")
+
+		item := results.NewItem(results.KindAlertRule, results.ActionPull, uid, rule.Title)
+		item.Details = fmt.Sprintf("%d => %d", fileVersion, rule.Version)
+		err = addAlertRuleChangesToRepo(rule, changes)
+		result.run.Add(item.Finish(err))
+		if err != nil {
+			return
+		}
+	}
+
+	// remove any alert rules that have gone
+	for _, uid := range utils.SortedKeys(fileDefs.AlertRuleVersionByUID) {
+		if _, ok := APIDefs.AlertRuleByUID[uid]; ok {
+			continue
+		}
+
+		if moved, ok := allDefs.AlertRuleByUID[uid]; ok {
+			logrus.WithFields(logrus.Fields{
+				"uid":         uid,
+				"title":       moved.Title,
+				"from_branch": branchName(cfg),
+				"to_branch":   displayBranch(branchForFolder(cfg, allDefs, moved.FolderUID)),
+			}).Info("Alert rule moved to a folder mapped to another branch, removing it from this branch")
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"uid": uid,
+			}).Info("Removing alert rule from filesystem")
+		}
+		removeAlertRuleFromFilesystem(uid, changes)
+		result.removed++
+		result.run.Add(results.NewItem(results.KindAlertRule, results.ActionRemove, uid, uid).Finish(nil))
+	}
+
+	return
+}
@@ -0,0 +1,191 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dashboardCache holds the dashboards retrieved by the previous pulls, by UID,
+// so a pull only retrieves again the dashboards which were updated since.
+// It's kept in the .git directory of the clone, so it's never committed.
+// A nil dashboardCache doesn't keep anything, so every dashboard is
+// retrieved. It's safe for concurrent use.
+type dashboardCache struct {
+	path string
+
+	mu         sync.Mutex
+	Dashboards map[string]cachedDashboard `json:"dashboards"`
+}
+
+// cachedDashboard is a dashboard retrieved by a previous pull.
+type cachedDashboard struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	FolderUID string `json:"folderUid,omitempty"`
+	// Updated is the time of the dashboard's latest update given by the
+	// search which listed it, if any.
+	Updated string `json:"updated,omitempty"`
+	// RawJSON is kept as a string, so it's given back exactly as it was
+	// retrieved.
+	RawJSON string `json:"json"`
+}
+
+// dashboardCachePath returns the path of the dashboards cache for the given
+// configuration, or an empty string if the configuration has no git settings,
+// in which case there's no cache.
+func dashboardCachePath(cfg *config.Config) string {
+	if cfg.Git == nil {
+		return ""
+	}
+	name := "dashboards-cache.json"
+	if len(cfg.OrgDir) > 0 {
+		name = "dashboards-cache-" + cfg.OrgDir + ".json"
+	}
+	return filepath.Join(cfg.Git.ClonePath, ".git", "dashboards-manager", name)
+}
+
+// loadDashboardCache reads the dashboards cache for the given configuration.
+// The cache is empty if the file doesn't exist or couldn't be read, which is
+// logged, since it only makes the pull slower. Returns nil if there's no
+// cache for the configuration.
+func loadDashboardCache(cfg *config.Config) *dashboardCache {
+	path := dashboardCachePath(cfg)
+	if len(path) == 0 {
+		return nil
+	}
+
+	cache := &dashboardCache{path: path}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, cache)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"file":  path,
+		}).Warn("Failed to read the dashboards cache, every dashboard will be retrieved")
+	}
+	if err != nil || cache.Dashboards == nil {
+		cache.Dashboards = make(map[string]cachedDashboard)
+	}
+	return cache
+}
+
+// dashboard returns the cached dashboard with the given UID if it wasn't
+// updated since it was cached, i.e. if the given time of its latest update,
+// from the search which listed it, is still the cached one. Without a time of
+// update to compare, its latest version is requested from Grafana instead.
+// Nothing is requested if the dashboard isn't cached.
+func (c *dashboardCache) dashboard(
+	ctx context.Context, client *grafana.Client, uid string, updated string,
+) (dashboard *grafana.Dashboard, ok bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	cached, found := c.Dashboards[uid]
+	c.mu.Unlock()
+	if !found {
+		return
+	}
+
+	if len(updated) > 0 && len(cached.Updated) > 0 {
+		if updated != cached.Updated {
+			return
+		}
+	} else {
+		version, err := client.GetDashboardLatestVersion(ctx, uid)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"uid":   uid,
+			}).Warn("Failed to retrieve the version of the dashboard, retrieving it")
+			return
+		}
+		if version != cached.Version {
+			return
+		}
+	}
+
+	return &grafana.Dashboard{
+		RawJSON:   []byte(cached.RawJSON),
+		Name:      cached.Name,
+		UID:       uid,
+		Version:   cached.Version,
+		FolderUID: cached.FolderUID,
+	}, true
+}
+
+// store replaces the content of the cache with the given dashboards, by slug,
+// along with the time of their latest update from the given search results,
+// by slug, so the dashboards which were deleted are forgotten. The dashboards
+// using library panels aren't kept, since their JSON description includes the
+// library panels' models, which can change without the dashboard being
+// updated.
+func (c *dashboardCache) store(dashboards map[string]*grafana.Dashboard, metaBySlug map[string]grafana.DbSearchResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Dashboards = make(map[string]cachedDashboard, len(dashboards))
+	for slug, dashboard := range dashboards {
+		if bytes.Contains(dashboard.RawJSON, []byte(`"libraryPanel"`)) {
+			continue
+		}
+		c.Dashboards[dashboard.UID] = cachedDashboard{
+			Name:      dashboard.Name,
+			Version:   dashboard.Version,
+			FolderUID: dashboard.FolderUID,
+			Updated:   metaBySlug[slug].Updated,
+			RawJSON:   string(dashboard.RawJSON),
+		}
+	}
+}
+
+// save writes the cache to its file, creating its directory if needed. The
+// file is replaced atomically so a crash can't corrupt it. Failing to write
+// it is only logged, since it only makes the next pull slower. Nothing is
+// written before the repository is cloned, e.g. on the first pull, since
+// creating the .git directory would make the clone path look like a broken
+// clone.
+func (c *dashboardCache) save() {
+	if c == nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Dir(filepath.Dir(c.path))); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file": c.path,
+		}).Debug("The repository isn't cloned yet, not writing the dashboards cache")
+		return
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	}
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, c.path)
+		}
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"file":  c.path,
+		}).Warn("Failed to write the dashboards cache")
+	}
+}
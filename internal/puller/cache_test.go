@@ -0,0 +1,71 @@
+package puller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+)
+
+// Saving the cache before the first clone leaves the clone path alone, so the
+// repository is then cloned rather than taken for a broken clone.
+func TestDashboardCacheSaveBeforeClone(t *testing.T) {
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	cfg := &config.Config{Git: &config.GitSettings{ClonePath: clonePath}}
+
+	cache := loadDashboardCache(cfg)
+	cache.Dashboards = map[string]cachedDashboard{"ops": {Name: "ops", Version: 1, RawJSON: `{}`}}
+	cache.save()
+	if _, err := os.Stat(clonePath); !os.IsNotExist(err) {
+		t.Fatalf("the clone path was created before the clone: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(clonePath, ".git"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cache.save()
+	if loaded := loadDashboardCache(cfg); loaded.Dashboards["ops"].Version != 1 {
+		t.Errorf("the cache wasn't saved once the repository was cloned")
+	}
+}
+
+// A pull only requests the dashboards updated since the previous one, as told
+// by the search, without requesting the version of the other ones.
+func TestDashboardCacheUpdated(t *testing.T) {
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	if err := os.MkdirAll(filepath.Join(clonePath, ".git"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cfg := &config.Config{Git: &config.GitSettings{ClonePath: clonePath}}
+	fake := newFakeGrafana(
+		map[string]interface{}{"uid": "ops", "title": "Ops"},
+		map[string]interface{}{"uid": "infra", "title": "Infra"},
+	)
+	client := newTestClient(t, fake)
+
+	pull := func() {
+		t.Helper()
+
+		var defs grafana.DefsFile
+		if _, err := GetDashboardDefinitionsFromLocalGrafana(context.Background(), client, cfg, &defs, NewSnapshot()); err != nil {
+			t.Fatalf("GetDashboardDefinitionsFromLocalGrafana: %v", err)
+		}
+		if len(defs.DashboardBySlug) != 2 {
+			t.Fatalf("pulled %d dashboards, want both", len(defs.DashboardBySlug))
+		}
+	}
+	pull()
+	pull()
+	fake.setRaw("ops", `{"uid":"ops","title":"Ops","panels":[]}`)
+	pull()
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	want := map[string]int{"ops": 2, "infra": 1}
+	if len(fake.requested) != len(want) || fake.requested["ops"] != want["ops"] || fake.requested["infra"] != want["infra"] {
+		t.Errorf("requested %v, want %v", fake.requested, want)
+	}
+}
@@ -0,0 +1,187 @@
+package puller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/github"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gitlab"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// changeRequest is a merge request, or a pull request on GitHub, opened by the
+// puller.
+type changeRequest struct {
+	branch string
+	url    string
+}
+
+// proposeChanges pushes the commits made in the clone on top of the given
+// commit to a branch of their own instead of the tracked branch, and opens a
+// merge request from it into the target branch, unless the puller already
+// has one open, in which case its branch is replaced with the commits. The
+// tracked branch is then reset to the given commit, so the clone keeps
+// following the remote, and the changes are committed again by the next pulls
+// until the merge request is merged.
+// Returns an error if the commits couldn't be pushed, the merge request
+// couldn't be looked up or opened, or the clone couldn't be reset.
+func proposeChanges(cfg *config.Config, repo *git.Repository, base *object.Commit) (err error) {
+	head, err := repo.HeadCommit()
+	if err != nil {
+		return
+	}
+	if head.Hash == base.Hash {
+		logrus.WithFields(logrus.Fields{
+			"branch": branchName(cfg),
+		}).Info("No changes to open a merge request with")
+		return nil
+	}
+
+	defer func() {
+		if resetErr := repo.ResetTo(base.Hash); resetErr != nil && err == nil {
+			err = resetErr
+		}
+	}()
+
+	settings := cfg.Git.ChangeRequest
+	target := settings.TargetBranch
+	if target == "" {
+		target = strings.TrimPrefix(repo.BranchRef(), "refs/heads/")
+	}
+	prefix := settings.BranchPrefix
+	if prefix == "" {
+		prefix = config.DefaultChangeRequestBranchPrefix
+	}
+
+	logFields := logrus.Fields{
+		"provider":      settings.ChangeRequestProvider(),
+		"target_branch": target,
+	}
+
+	existing, found, err := findChangeRequest(cfg, target, prefix)
+	if err != nil {
+		return
+	}
+
+	if found {
+		logFields["source_branch"] = existing.branch
+		logFields["url"] = existing.url
+
+		// Don't replace the branch if it already has the same content.
+		var current *object.Commit
+		if current, err = repo.FetchBranch(existing.branch); err != nil {
+			return
+		}
+		if current.TreeHash == head.TreeHash {
+			logrus.WithFields(logFields).Info("The open merge request already has the changes")
+			return nil
+		}
+
+		if err = repo.PushCommitToBranch(head.Hash, existing.branch); err != nil {
+			return
+		}
+		logrus.WithFields(logFields).Info("Updated the open merge request with the changes")
+		return nil
+	}
+
+	branch := prefix
+	if cfg.Git.FolderBranch != "" {
+		branch += cfg.Git.FolderBranch + "/"
+	}
+	branch += time.Now().UTC().Format("20060102-150405")
+	logFields["source_branch"] = branch
+
+	if err = repo.PushCommitToBranch(head.Hash, branch); err != nil {
+		return
+	}
+
+	title := settings.Title
+	if title == "" {
+		title = config.DefaultChangeRequestTitle
+	}
+	opened, err := openChangeRequest(cfg, branch, target, title, head.Message)
+	if err != nil {
+		return
+	}
+
+	logFields["url"] = opened.url
+	logrus.WithFields(logFields).Info("Opened a merge request with the changes")
+	return nil
+}
+
+// changeRequestToken returns the access token used to request the API of the
+// merge requests' provider, defaulting to the Git token.
+func changeRequestToken(cfg *config.Config) string {
+	if cfg.Git.ChangeRequest.Token != "" {
+		return cfg.Git.ChangeRequest.Token
+	}
+	return cfg.Git.Token
+}
+
+// findChangeRequest looks for an open merge request into the given target
+// branch from a branch with the given prefix, i.e. opened by the puller.
+// Returns an error if the merge requests couldn't be retrieved.
+func findChangeRequest(cfg *config.Config, target string, prefix string) (cr changeRequest, found bool, err error) {
+	settings := cfg.Git.ChangeRequest
+
+	switch settings.ChangeRequestProvider() {
+	case config.ProviderGitHub:
+		apiURL := settings.APIURL
+		if apiURL == "" {
+			apiURL = config.DefaultGitHubAPIURL
+		}
+		var prs []github.PullRequest
+		prs, err = github.NewClient(apiURL, changeRequestToken(cfg)).OpenPullRequests(settings.Repository, target)
+		if err != nil {
+			return
+		}
+		for _, pr := range prs {
+			if strings.HasPrefix(pr.Head.Ref, prefix) {
+				return changeRequest{branch: pr.Head.Ref, url: pr.HTMLURL}, true, nil
+			}
+		}
+	default:
+		var mrs []gitlab.MergeRequest
+		mrs, err = gitlab.NewClient(settings.APIURL, changeRequestToken(cfg)).OpenMergeRequests(settings.ProjectID, target)
+		if err != nil {
+			return
+		}
+		for _, mr := range mrs {
+			if strings.HasPrefix(mr.SourceBranch, prefix) {
+				return changeRequest{branch: mr.SourceBranch, url: mr.WebURL}, true, nil
+			}
+		}
+	}
+
+	return
+}
+
+// openChangeRequest opens a merge request from the given source branch into
+// the given target branch.
+// Returns an error if the merge request couldn't be opened.
+func openChangeRequest(cfg *config.Config, source string, target string, title string, description string) (cr changeRequest, err error) {
+	settings := cfg.Git.ChangeRequest
+
+	switch settings.ChangeRequestProvider() {
+	case config.ProviderGitHub:
+		apiURL := settings.APIURL
+		if apiURL == "" {
+			apiURL = config.DefaultGitHubAPIURL
+		}
+		var pr github.PullRequest
+		pr, err = github.NewClient(apiURL, changeRequestToken(cfg)).CreatePullRequest(
+			settings.Repository, source, target, title, description,
+		)
+		return changeRequest{branch: source, url: pr.HTMLURL}, err
+	default:
+		var mr gitlab.MergeRequest
+		mr, err = gitlab.NewClient(settings.APIURL, changeRequestToken(cfg)).CreateMergeRequest(
+			settings.ProjectID, source, target, title, description,
+		)
+		return changeRequest{branch: source, url: mr.WebURL}, err
+	}
+}
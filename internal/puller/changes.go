@@ -0,0 +1,275 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/gosimple/slug"
+	gogit "gopkg.in/src-d/go-git.v4"
+)
+
+// Actions a pull can take on a file.
+const (
+	FileAdd    = "add"
+	FileModify = "modify"
+	FileDelete = "delete"
+)
+
+// FileChange describes a change a pull makes to a file of the clone.
+type FileChange struct {
+	// Path is the path of the file, relative to the clone.
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// SizeDelta is the difference between the file's new and old sizes, in
+	// bytes.
+	SizeDelta int `json:"sizeDelta"`
+
+	// content is the new content of the file, for additions and
+	// modifications.
+	content []byte
+}
+
+// BranchPlan describes the changes a pull would make to the clone of a
+// branch.
+type BranchPlan struct {
+	Branch  string       `json:"branch"`
+	Changes []FileChange `json:"changes"`
+	// CommitMessage is the message of the commit which would be created, if
+	// the changes were committed.
+	CommitMessage string `json:"commitMessage,omitempty"`
+	// Versions are the changes of version of the dashboards and libraries
+	// which would be written, sorted by kind then name.
+	Versions []VersionChange `json:"versions,omitempty"`
+}
+
+// VersionChange describes the change of version of a dashboard or a library
+// between the repository and Grafana. Old is zero for new ones.
+type VersionChange struct {
+	// Kind is "dashboard" or "library".
+	Kind string `json:"kind"`
+	// Name is the slug of a dashboard, or the UID of a library.
+	Name string `json:"name"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+}
+
+// changeSet decides which files a pull has to change in a clone, and applies
+// the changes, unless it's a dry run in which case they're only recorded.
+type changeSet struct {
+	syncPath string
+	// orgDir is the subdirectory of the organisation's files, if any.
+	orgDir string
+	// worktree is nil on "simple sync" mode.
+	worktree *gogit.Worktree
+	dryRun   bool
+	changes  []FileChange
+	// datasourceAliases maps the UIDs of the datasources to the
+	// placeholders written instead in the dashboards and libraries.
+	datasourceAliases map[string]string
+	// byFolder is true if the dashboards' files are stored in
+	// subdirectories named after the titles of their folders, found in
+	// defs.
+	byFolder bool
+	// style is how the JSON files are indented and ended.
+	style format.Style
+	defs  grafana.DefsFile
+	// folderFiles and folderDirs map the UIDs of the folders in defs to the
+	// names of their files and, with the by-folder layout, of their
+	// directories. They're computed when first needed.
+	folderFiles map[string]string
+	folderDirs  map[string]string
+	// dashboardDirs maps the slugs of the dashboards to the directories,
+	// relative to the clone, their files were found in before the pull.
+	dashboardDirs map[string]string
+}
+
+// filePath returns the path, relative to the clone, of the file with the
+// given name in the given directory (e.g. "dashboards") for the organisation
+// pulled.
+func (cs *changeSet) filePath(dir string, name string) string {
+	return filepath.Join(dir, cs.orgDir, name)
+}
+
+// dashboardDir returns the directory, relative to the clone, the layout puts
+// the files of the dashboards in the folder with the given UID in: the
+// dashboards directory, or with the by-folder layout its subdirectory named
+// after the folder's title, followed by its UID if another folder's title gives
+// the same name, "general" for the dashboards which aren't in any folder.
+func (cs *changeSet) dashboardDir(folderUID string) string {
+	dir := cs.filePath("dashboards", "")
+	if !cs.byFolder {
+		return dir
+	}
+
+	return filepath.Join(dir, cs.folderDirName(folderUID))
+}
+
+// folderDirName returns the name of the directory of the dashboards in the
+// folder with the given UID, with the by-folder layout: the slug of the
+// folder's title, followed by its UID if another folder's title gives the same
+// slug, or "general" for the dashboards which aren't in any folder.
+func (cs *changeSet) folderDirName(folderUID string) string {
+	if folderUID == "" {
+		return slug.Make(config.GeneralFolder)
+	}
+	if cs.folderDirs == nil {
+		cs.folderDirs = folderDirNames(cs.defs.FoldersMetaByUID)
+	}
+	// Fall back to the folder's UID if its title is unknown.
+	if name, ok := cs.folderDirs[folderUID]; ok {
+		return name
+	}
+	return slug.Make(folderUID)
+}
+
+// currentDashboardDir returns the directory, relative to the clone, the files
+// of the dashboard with the given slug were found in before the pull, or the
+// one of the flat layout if they weren't found.
+func (cs *changeSet) currentDashboardDir(slug string) string {
+	if dir, ok := cs.dashboardDirs[slug]; ok {
+		return dir
+	}
+	return cs.filePath("dashboards", "")
+}
+
+// loadDashboardDirs looks for the files of the dashboards in the dashboards
+// directory and its subdirectories, so the files which aren't where the
+// layout puts them, e.g. after the layout changed or a dashboard moved to
+// another folder, can be moved. A file found in several directories is only
+// recorded in the first one, in lexical order.
+// Returns an error if a directory couldn't be read.
+func (cs *changeSet) loadDashboardDirs() error {
+	cs.dashboardDirs = make(map[string]string)
+	root := filepath.Join(cs.syncPath, cs.filePath("dashboards", ""))
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") || format.IsPermissionsFile(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(cs.syncPath, path)
+		if err != nil {
+			return err
+		}
+		dashboardSlug := strings.TrimSuffix(name, ".json")
+		if _, ok := cs.dashboardDirs[dashboardSlug]; !ok {
+			cs.dashboardDirs[dashboardSlug] = filepath.Dir(rel)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// write plans writing the given JSON content, indented in the change set's
+// style, to the file at the given path, relative to the clone. Nothing is
+// planned if the file already has this content, however it's indented.
+// Returns an error if the content couldn't be indented, or if the change
+// couldn't be applied.
+func (cs *changeSet) write(path string, content []byte) (err error) {
+	indented, err := indent(content, cs.style)
+	if err != nil {
+		return
+	}
+	if existing, readErr := os.ReadFile(filepath.Join(cs.syncPath, path)); readErr == nil && sameJSON(existing, indented, cs.style) {
+		return nil
+	}
+	return cs.writeRaw(path, indented)
+}
+
+// sameJSON returns true if the given existing content of a file is the same
+// JSON document as the given indented one, however it's indented, e.g. after
+// the style changed or the file was edited by hand, so the file isn't
+// rewritten only to change its whitespace.
+func sameJSON(existing []byte, indented []byte, style format.Style) bool {
+	canonical, err := style.Canonical(existing)
+	return err == nil && bytes.Equal(canonical, indented)
+}
+
+// writeRaw plans writing the given content as it is to the file at the given
+// path, relative to the clone. See write.
+// Returns an error if the change couldn't be applied.
+func (cs *changeSet) writeRaw(path string, content []byte) (err error) {
+	change := FileChange{Path: path, Action: FileAdd, SizeDelta: len(content), content: content}
+	existing, readErr := os.ReadFile(filepath.Join(cs.syncPath, path))
+	if readErr == nil {
+		if bytes.Equal(existing, content) {
+			return nil
+		}
+		change.Action = FileModify
+		change.SizeDelta -= len(existing)
+	}
+
+	return cs.add(change)
+}
+
+// writeJSON plans writing the JSON representation of the given value to the
+// file at the given path. See write.
+func (cs *changeSet) writeJSON(path string, v interface{}) (err error) {
+	rawJSON, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return cs.write(path, rawJSON)
+}
+
+// remove plans removing the file at the given path, relative to the clone.
+// Nothing is planned if the file doesn't exist.
+// Returns an error if the change couldn't be applied.
+func (cs *changeSet) remove(path string) error {
+	info, err := os.Stat(filepath.Join(cs.syncPath, path))
+	if err != nil {
+		return nil
+	}
+
+	return cs.add(FileChange{Path: path, Action: FileDelete, SizeDelta: -int(info.Size())})
+}
+
+// add records the given change, and applies it unless it's a dry run.
+func (cs *changeSet) add(change FileChange) error {
+	cs.changes = append(cs.changes, change)
+	if cs.dryRun {
+		return nil
+	}
+	return cs.apply(change)
+}
+
+// apply writes or removes the file described by the given change, and adds
+// the change to the Git index.
+// Returns an error if there was an issue with either of the steps.
+func (cs *changeSet) apply(change FileChange) (err error) {
+	filename := filepath.Join(cs.syncPath, change.Path)
+
+	if change.Action == FileDelete {
+		// If worktree is nil, it means that it hasn't been initialised,
+		// which means the sync mode is "simple sync" and not Git.
+		if cs.worktree == nil {
+			return os.Remove(filename)
+		}
+		_, err = cs.worktree.Remove(change.Path)
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	// The content is already indented by write, if it's JSON.
+	if err = replaceFile(filename, change.content); err != nil {
+		return
+	}
+
+	if cs.worktree != nil {
+		_, err = cs.worktree.Add(change.Path)
+	}
+	return
+}
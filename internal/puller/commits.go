@@ -0,0 +1,284 @@
+package puller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/sirupsen/logrus"
+	gogit "gopkg.in/src-d/go-git.v4"
+)
+
+// commitGroup is a group of changed files committed together, along with the
+// part of the versions file describing them.
+type commitGroup struct {
+	message string
+	paths   []string
+	// applyVersions updates the versions file's content with the versions
+	// of what the group's files describe.
+	applyVersions func(versions *grafana.DefsFile)
+}
+
+// commitSeparately commits the changes planned by the pull in several
+// commits rather than a single one: the folders first, then the libraries,
+// then each dashboard, and finally the other files. Each commit updates the
+// versions file with the versions of what it changes, starting from the file's
+// versions, so the last one leaves it with the versions retrieved.
+// Returns an error if the files couldn't be staged, the versions file written,
+// or a commit created.
+func commitSeparately(
+	repo *git.Repository, worktree *gogit.Worktree, cfg *config.Config, changes *changeSet,
+	fileDefs grafana.DefsFile, APIDefs grafana.DefsFile, dv map[string]diffVersion, lv map[string]diffVersion,
+) (err error) {
+	// The changes are staged as they're applied, only stage the ones of each
+	// commit instead.
+	if err = repo.UnstageAll(); err != nil {
+		return
+	}
+
+	versions := copyVersions(fileDefs)
+	for _, group := range groupChanges(changes.changes, fileDefs, APIDefs, dv, lv) {
+		for _, path := range group.paths {
+			if err = stagePath(worktree, changes.syncPath, path); err != nil {
+				return
+			}
+		}
+		group.applyVersions(&versions)
+		if err = writeVersions(versions, dv, cfg.Git.ClonePath, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions(), jsonStyle(cfg.Git)); err != nil {
+			return
+		}
+		if err = addVersionsToIndex(worktree, cfg.Git.VersionsFilePrefix); err != nil {
+			return
+		}
+
+		var status gogit.Status
+		if status, err = worktree.Status(); err != nil {
+			return
+		}
+		if !hasStagedChanges(status) {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"branch": branchName(cfg),
+			"files":  len(group.paths),
+		}).Info("Committing " + strings.SplitN(group.message, "\n", 2)[0])
+		if err = commitAsManager(worktree, cfg, group.message); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// groupChanges groups the given changes of files into the commits made by
+// commitSeparately, in the order they're made. The last group is always there,
+// so the versions file ends up with the versions retrieved even if it's the
+// only file which changed.
+func groupChanges(
+	fileChanges []FileChange, fileDefs grafana.DefsFile, APIDefs grafana.DefsFile,
+	dv map[string]diffVersion, lv map[string]diffVersion,
+) (groups []commitGroup) {
+	hostname, _ := os.Hostname()
+
+	// Find out the dashboard each file of the dashboards directory is for,
+	// by UID, so a dashboard which file was renamed is committed at once.
+	uidBySlug := make(map[string]string)
+	for slug, meta := range fileDefs.DashboardMetaBySlug {
+		uidBySlug[slug] = meta.UID
+	}
+	slugByUID := make(map[string]string)
+	for slug, meta := range APIDefs.DashboardMetaBySlug {
+		uidBySlug[slug] = meta.UID
+		slugByUID[meta.UID] = slug
+	}
+
+	var folderPaths, libraryPaths, otherPaths []string
+	dashboardPaths := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, change := range fileChanges {
+		if seen[change.Path] {
+			continue
+		}
+		seen[change.Path] = true
+
+		parts := strings.Split(filepath.ToSlash(change.Path), "/")
+		switch {
+		case parts[0] == "folders":
+			folderPaths = append(folderPaths, change.Path)
+		case parts[0] == "libraries":
+			libraryPaths = append(libraryPaths, change.Path)
+		case parts[0] == "dashboards":
+			name := filepath.Base(change.Path)
+			if format.IsPermissionsFile(name) {
+				name = format.PermissionsTarget(name)
+			}
+			slug := strings.TrimSuffix(name, ".json")
+			key := slug
+			if uid, ok := uidBySlug[slug]; ok {
+				key = uid
+			}
+			dashboardPaths[key] = append(dashboardPaths[key], change.Path)
+		default:
+			otherPaths = append(otherPaths, change.Path)
+		}
+	}
+
+	if len(folderPaths) > 0 {
+		groups = append(groups, commitGroup{
+			message: "Updated folders on " + hostname + "\n",
+			paths:   folderPaths,
+			applyVersions: func(versions *grafana.DefsFile) {
+				versions.FoldersMetaByUID = APIDefs.FoldersMetaByUID
+			},
+		})
+	}
+
+	if len(libraryPaths) > 0 {
+		message := "Updated libraries on " + hostname + "\n"
+		for _, uid := range utils.SortedKeys(lv) {
+			message += fmt.Sprintf("%s: %d => %d\n", uid, lv[uid].old, lv[uid].new)
+		}
+		groups = append(groups, commitGroup{
+			message: message,
+			paths:   libraryPaths,
+			applyVersions: func(versions *grafana.DefsFile) {
+				versions.LibraryMetaByUID = APIDefs.LibraryMetaByUID
+				versions.LibraryVersionByUID = APIDefs.LibraryVersionByUID
+			},
+		})
+	}
+
+	// Sort the dashboards by their slugs, the removed ones by the ones of
+	// their files.
+	fileSlugByUID := make(map[string]string)
+	for slug, meta := range fileDefs.DashboardMetaBySlug {
+		fileSlugByUID[meta.UID] = slug
+	}
+	names := make(map[string]string)
+	keys := make([]string, 0, len(dashboardPaths))
+	for key := range dashboardPaths {
+		keys = append(keys, key)
+		names[key] = key
+		if slug, ok := slugByUID[key]; ok {
+			names[key] = slug
+		} else if slug, ok := fileSlugByUID[key]; ok {
+			names[key] = slug
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return names[keys[i]] < names[keys[j]] })
+
+	for _, key := range keys {
+		key := key
+		slug := names[key]
+		message := "Removed " + slug + " on " + hostname + "\n"
+		if _, ok := slugByUID[key]; ok {
+			message = "Updated " + slug + " on " + hostname + "\n"
+			if diff, ok := dv[slug]; ok {
+				message = fmt.Sprintf("Updated %s on %s: %d => %d\n", slug, hostname, diff.old, diff.new)
+			}
+		}
+		groups = append(groups, commitGroup{
+			message: message,
+			paths:   dashboardPaths[key],
+			applyVersions: func(versions *grafana.DefsFile) {
+				applyDashboardVersion(versions, APIDefs, key)
+			},
+		})
+	}
+
+	message := "Updated the remaining files on " + hostname + "\n"
+	if len(otherPaths) == 0 {
+		message = "Updated the versions on " + hostname + "\n"
+	}
+	groups = append(groups, commitGroup{
+		message: message,
+		paths:   otherPaths,
+		applyVersions: func(versions *grafana.DefsFile) {
+			*versions = APIDefs
+		},
+	})
+	return
+}
+
+// applyDashboardVersion updates the given content of the versions file with
+// the version of the dashboard with the given UID retrieved, removing it if it
+// wasn't retrieved.
+func applyDashboardVersion(versions *grafana.DefsFile, APIDefs grafana.DefsFile, uid string) {
+	for slug, meta := range versions.DashboardMetaBySlug {
+		if meta.UID == uid {
+			delete(versions.DashboardMetaBySlug, slug)
+		}
+	}
+	delete(versions.DashboardVersionByUID, uid)
+	delete(versions.OverComplexityLimits, uid)
+
+	for slug, meta := range APIDefs.DashboardMetaBySlug {
+		if meta.UID != uid {
+			continue
+		}
+		versions.DashboardMetaBySlug[slug] = meta
+		if version, ok := APIDefs.DashboardVersionByUID[uid]; ok {
+			versions.DashboardVersionByUID[uid] = version
+		}
+		if exceeded, ok := APIDefs.OverComplexityLimits[uid]; ok {
+			versions.OverComplexityLimits[uid] = exceeded
+		}
+	}
+}
+
+// copyVersions returns a copy of the part of the given definitions written to
+// the versions file, which maps can be changed without changing the given
+// ones.
+func copyVersions(defs grafana.DefsFile) (versions grafana.DefsFile) {
+	versions = grafana.DefsFile{
+		DashboardMetaBySlug:    make(map[string]grafana.DbSearchResponse),
+		LibraryMetaByUID:       defs.LibraryMetaByUID,
+		FoldersMetaByUID:       defs.FoldersMetaByUID,
+		DashboardVersionByUID:  make(map[string]int),
+		LibraryVersionByUID:    defs.LibraryVersionByUID,
+		DatasourceVersionByUID: defs.DatasourceVersionByUID,
+		AlertRuleVersionByUID:  defs.AlertRuleVersionByUID,
+		OverComplexityLimits:   make(map[string][]string),
+	}
+	for slug, meta := range defs.DashboardMetaBySlug {
+		versions.DashboardMetaBySlug[slug] = meta
+	}
+	for uid, version := range defs.DashboardVersionByUID {
+		versions.DashboardVersionByUID[uid] = version
+	}
+	for uid, exceeded := range defs.OverComplexityLimits {
+		versions.OverComplexityLimits[uid] = exceeded
+	}
+	return
+}
+
+// stagePath adds the file at the given path, relative to the clone, to the git
+// index, or removes it from the index if it doesn't exist anymore.
+// Returns an error if the index couldn't be updated.
+func stagePath(worktree *gogit.Worktree, syncPath string, path string) (err error) {
+	if _, statErr := os.Stat(filepath.Join(syncPath, path)); os.IsNotExist(statErr) {
+		_, err = worktree.Remove(path)
+		return
+	}
+	_, err = worktree.Add(path)
+	return
+}
+
+// hasStagedChanges returns true if some changes were added to the git index.
+func hasStagedChanges(status gogit.Status) bool {
+	for _, fileStatus := range status {
+		if fileStatus.Staging != gogit.Unmodified && fileStatus.Staging != gogit.Untracked {
+			return true
+		}
+	}
+	return false
+}
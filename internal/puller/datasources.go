@@ -0,0 +1,64 @@
+package puller
+
+import (
+	"fmt"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pullDatasources plans writing the datasources which have a newer version on
+// the Grafana instance than in the versions file, and removing the files of
+// the datasources which don't exist anymore. Datasources don't belong to
+// folders, so they're only pulled into the clone of the default branch.
+// Returns an error if a datasource's description couldn't be written.
+func pullDatasources(
+	cfg *config.Config, APIDefs grafana.DefsFile, fileDefs grafana.DefsFile, changes *changeSet, result *pullResult,
+) (err error) {
+	if cfg.Git != nil && cfg.Git.FolderBranch != "" {
+		return
+	}
+
+	for _, uid := range utils.SortedKeys(APIDefs.DatasourceByUID) {
+		ds := APIDefs.DatasourceByUID[uid]
+		fileVersion, ok := fileDefs.DatasourceVersionByUID[uid]
+		if ok && ds.Version <= fileVersion {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"name":         ds.Name,
+			"file_version": fileVersion,
+			"new_version":  ds.Version,
+			"uid":          uid,
+		}).Info("Grafana has a newer datasource version than previously, updating")
+
+		item := results.NewItem(results.KindDatasource, results.ActionPull, uid, ds.Name)
+		item.Details = fmt.Sprintf("%d => %d", fileVersion, ds.Version)
+		err = addDatasourceChangesToRepo(ds, changes)
+		result.run.Add(item.Finish(err))
+		if err != nil {
+			return
+		}
+	}
+
+	// remove any datasources that have gone
+	for _, uid := range utils.SortedKeys(fileDefs.DatasourceVersionByUID) {
+		if _, ok := APIDefs.DatasourceByUID[uid]; ok {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"uid": uid,
+		}).Info("Removing datasource from filesystem")
+		removeDatasourceFromFilesystem(uid, changes)
+		result.removed++
+		result.run.Add(results.NewItem(results.KindDatasource, results.ActionRemove, uid, uid).Finish(nil))
+	}
+
+	return
+}
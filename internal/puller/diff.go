@@ -0,0 +1,177 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// diffDirs are the directories of the files compared by Diff.
+var diffDirs = []string{"dashboards", "folders", "libraries"}
+
+// diffIgnoredKeys are the keys of the files which aren't compared by Diff,
+// since they change on Grafana without the object changing.
+var diffIgnoredKeys = append([]string{"meta"}, format.InstanceKeys...)
+
+// ObjectDiff is a dashboard, folder or library, or the permissions of one,
+// which file differs between the repository and Grafana.
+type ObjectDiff struct {
+	// Path is the path of the file, relative to the clone.
+	Path string
+	// Repository and Grafana are the normalised contents of the file in the
+	// repository and of the one a pull would write, nil if the object only
+	// exists on the other side.
+	Repository []byte
+	Grafana    []byte
+}
+
+// Diff compares the dashboards, folders and libraries of the repository, as
+// they are in the clones, with the files a pull would write for the ones on
+// Grafana, both normalised the same way, without the keys which change on
+// Grafana without the objects changing. Neither the repository nor the
+// versions files are changed.
+// Returns the objects which differ, sorted by path, and an error if Grafana
+// couldn't be requested or a file couldn't be read.
+func Diff(ctx context.Context, client *grafana.Client, cfg *config.Config) (diffs []ObjectDiff, err error) {
+	grafanaFiles, err := grafanaDiffFiles(ctx, client, cfg)
+	if err != nil {
+		return
+	}
+	repoFiles, err := repositoryDiffFiles(cfg)
+	if err != nil {
+		return
+	}
+
+	paths := make(map[string]bool)
+	for path := range grafanaFiles {
+		paths[path] = true
+	}
+	for path := range repoFiles {
+		paths[path] = true
+	}
+
+	diffs = make([]ObjectDiff, 0)
+	for _, path := range utils.SortedKeys(paths) {
+		repoContent, grafanaContent := repoFiles[path], grafanaFiles[path]
+		if repoContent != nil && grafanaContent != nil && bytes.Equal(repoContent, grafanaContent) {
+			continue
+		}
+		diffs = append(diffs, ObjectDiff{Path: path, Repository: repoContent, Grafana: grafanaContent})
+	}
+	return
+}
+
+// grafanaDiffFiles returns the normalised contents of the files a pull would
+// write to an empty repository for the dashboards, folders and libraries of
+// each organisation, by path.
+// Returns an error if Grafana couldn't be requested or a file couldn't be
+// generated.
+func grafanaDiffFiles(ctx context.Context, client *grafana.Client, cfg *config.Config) (files map[string][]byte, err error) {
+	// The changes are planned against an empty directory, so every file is
+	// an addition holding its content.
+	emptyDir, err := os.MkdirTemp("", "grafana-diff-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(emptyDir)
+
+	files = make(map[string][]byte)
+	for _, orgCfg := range cfg.OrgConfigs() {
+		var changes []FileChange
+		if changes, err = exportOrg(ctx, client.ForOrg(orgCfg.Grafana.OrgID), orgCfg, emptyDir); err != nil {
+			return
+		}
+		for _, change := range changes {
+			if isDiffFile(change.Path) {
+				files[change.Path] = normaliseDiffFile(change.content)
+			}
+		}
+	}
+	return
+}
+
+// repositoryDiffFiles returns the normalised contents of the dashboards',
+// folders' and libraries' files of each organisation in the clones of the
+// configured branches, by path.
+// Returns an error if a file couldn't be read.
+func repositoryDiffFiles(cfg *config.Config) (files map[string][]byte, err error) {
+	files = make(map[string][]byte)
+	for _, branchCfg := range cfg.BranchConfigs() {
+		for _, orgCfg := range branchCfg.OrgConfigs() {
+			syncPath := SyncPath(orgCfg)
+			for _, dir := range diffDirs {
+				root := filepath.Join(syncPath, dir, orgCfg.OrgDir)
+				err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+					if err != nil {
+						return err
+					}
+					if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+						return nil
+					}
+					rel, err := filepath.Rel(syncPath, path)
+					if err != nil {
+						return err
+					}
+					content, err := os.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					files[rel] = normaliseDiffFile(content)
+					return nil
+				})
+				if os.IsNotExist(err) {
+					err = nil
+				} else if err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// isDiffFile returns true if the file at the given path, relative to the clone,
+// is compared by Diff.
+func isDiffFile(path string) bool {
+	dir := strings.SplitN(filepath.ToSlash(path), "/", 2)[0]
+	for _, diffDir := range diffDirs {
+		if dir == diffDir {
+			return strings.HasSuffix(path, ".json")
+		}
+	}
+	return false
+}
+
+// normaliseDiffFile returns the given content of a file in its canonical form,
+// without the keys which aren't compared. A content which isn't a JSON object
+// is returned as it is.
+func normaliseDiffFile(content []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if decoder.Decode(&object) != nil {
+		return content
+	}
+	for _, key := range diffIgnoredKeys {
+		delete(object, key)
+	}
+
+	rawJSON, err := json.Marshal(object)
+	if err != nil {
+		return content
+	}
+	canonical, err := format.Canonical(rawJSON)
+	if err != nil {
+		return content
+	}
+	return canonical
+}
@@ -0,0 +1,177 @@
+package puller
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// exportTimeFormat is the format of the time in the names of the exports.
+const exportTimeFormat = "20060102T150405Z"
+
+// Export retrieves the dashboards, libraries and folders from Grafana, with
+// their permissions and the teams if they're synchronised, and writes the files a pull would
+// write to an empty repository, along with the versions file, to a
+// timestamped tarball in the given directory. The files are laid out like in
+// the repository, so the archive can be extracted into a clone and pushed back
+// with the pusher's -push-all flag. All the folders are exported together,
+// even if they're mapped to different branches. Neither the repository nor
+// the versions file are read or changed.
+// Returns the path of the tarball, and an error if Grafana couldn't be
+// requested or the tarball couldn't be written.
+func Export(ctx context.Context, client *grafana.Client, cfg *config.Config, dir string) (path string, err error) {
+	// The changes are planned against an empty directory, so every file is
+	// an addition holding its content.
+	emptyDir, err := os.MkdirTemp("", "grafana-export-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(emptyDir)
+
+	var changes []FileChange
+	for _, orgCfg := range cfg.OrgConfigs() {
+		var orgChanges []FileChange
+		orgChanges, err = exportOrg(ctx, client.ForOrg(orgCfg.Grafana.OrgID), orgCfg, emptyDir)
+		if err != nil {
+			return
+		}
+		changes = append(changes, orgChanges...)
+	}
+
+	now := time.Now().UTC()
+	path = filepath.Join(dir, "grafana-snapshot-"+now.Format(exportTimeFormat)+".tar.gz")
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+	if err = writeTarball(path, changes, now); err != nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":  path,
+		"files": len(changes),
+	}).Info("Exported the dashboards from Grafana")
+	return
+}
+
+// exportOrg returns the files to export for the organisation the given
+// configuration is for, planned against the given empty directory.
+// Returns an error if Grafana couldn't be requested or a file couldn't be
+// generated.
+func exportOrg(ctx context.Context, client *grafana.Client, cfg *config.Config, emptyDir string) (changes []FileChange, err error) {
+	_, defs, err := GetDefinitionsFromGrafanaAPI(ctx, client, cfg)
+	if err != nil {
+		return
+	}
+
+	cs := &changeSet{
+		syncPath:          emptyDir,
+		orgDir:            cfg.OrgDir,
+		dryRun:            true,
+		datasourceAliases: cfg.Grafana.DatasourceAliases,
+		byFolder:          cfg.Git.ByFolder(),
+		style:             jsonStyle(cfg.Git),
+		defs:              defs,
+	}
+	for _, slug := range utils.SortedKeys(defs.DashboardBySlug) {
+		dashboard := defs.DashboardBySlug[slug]
+		if err = addDashboardChangesToRepo(slug, dashboard, cs, defs.DashboardMetaBySlug[slug].FolderUID); err != nil {
+			return
+		}
+		if perms, ok := defs.DashboardPermissionsByUID[dashboard.UID]; ok {
+			if err = addDashboardPermissionsChangesToRepo(slug, defs.DashboardMetaBySlug[slug].FolderUID, perms, cs); err != nil {
+				return
+			}
+		}
+	}
+	for _, uid := range utils.SortedKeys(defs.LibraryByUID) {
+		if err = addLibraryChangesToRepo(defs.LibraryByUID[uid], cs, defs.LibraryMetaByUID[uid].Meta.FolderUid); err != nil {
+			return
+		}
+	}
+	for _, uid := range utils.SortedKeys(defs.FoldersMetaByUID) {
+		folder := defs.FoldersMetaByUID[uid]
+		if err = addFolderChangesToRepo(folder, cs); err != nil {
+			return
+		}
+		if perms, ok := defs.FolderPermissionsByUID[uid]; ok {
+			if err = addFolderPermissionsChangesToRepo(folder, perms, cs); err != nil {
+				return
+			}
+		}
+	}
+
+	if defs.Teams != nil {
+		if err = addTeamsChangesToRepo(defs.Teams, cs); err != nil {
+			return
+		}
+	}
+	if cfg.Git != nil && cfg.Git.Provisioning != nil {
+		if err = addProvisioningChangesToRepo(cfg, defs, cs); err != nil {
+			return
+		}
+	}
+
+	var prefix string
+	if cfg.Git != nil {
+		prefix = cfg.Git.VersionsFilePrefix
+	}
+	if err = cs.writeVersions(defs, prefix, cfg.Git.PerDashboardVersions()); err != nil {
+		return
+	}
+	return cs.changes, nil
+}
+
+// writeTarball writes the given files, all of them additions, to a gzipped
+// tarball at the given path, dated with the given time. The tarball is
+// written to a temporary file first, so an interrupted export doesn't leave
+// a truncated archive behind.
+// Returns an error if the tarball couldn't be written.
+func writeTarball(path string, files []FileChange, modTime time.Time) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".grafana-snapshot-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    filepath.ToSlash(file.Path),
+			Mode:    0644,
+			Size:    int64(len(file.content)),
+			ModTime: modTime,
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return
+		}
+		if _, err = tw.Write(file.content); err != nil {
+			return
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,136 @@
+package puller
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/gosimple/slug"
+	"github.com/sirupsen/logrus"
+)
+
+// uniqueFolderNames returns the names, by folder UID, computed for the given
+// folders by the given function. Folders which names collide, case-
+// insensitively since the repository may be cloned on a case-insensitive file
+// system, e.g. two folders with the same title in different parent folders,
+// have their UID appended to their names, so one file doesn't overwrite the
+// other's. The given kind of name is logged along with the collisions.
+func uniqueFolderNames(
+	folders map[string]grafana.DbSearchResponse, kind string, nameOf func(folder grafana.DbSearchResponse) string,
+) (names map[string]string) {
+	names = make(map[string]string)
+	uidsByName := make(map[string][]string)
+	for _, id := range utils.SortedKeys(folders) {
+		folder := folders[id]
+		name := nameOf(folder)
+		names[folder.UID] = name
+		key := strings.ToLower(name)
+		uidsByName[key] = append(uidsByName[key], folder.UID)
+	}
+
+	for _, key := range utils.SortedKeys(uidsByName) {
+		uids := uidsByName[key]
+		if len(uids) < 2 {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			kind:   names[uids[0]],
+			"uids": strings.Join(uids, ","),
+		}).Warn("Several folders have the same " + kind + ", appending their UIDs to it")
+		for _, uid := range uids {
+			names[uid] += "-" + uid
+		}
+	}
+	return
+}
+
+// folderDirNames returns the names of the directories of the dashboards in
+// the given folders, by UID, with the by-folder layout. See folderDirName.
+func folderDirNames(folders map[string]grafana.DbSearchResponse) map[string]string {
+	// Fall back to the folder's UID if its title only contains characters a
+	// slug leaves out.
+	return uniqueFolderNames(folders, "directory", func(folder grafana.DbSearchResponse) string {
+		if name := slug.Make(folder.Title); name != "" {
+			return name
+		}
+		return slug.Make(folder.UID)
+	})
+}
+
+// folderFileName returns the name, without its extension, of the file
+// describing the folder with the given UID: its title, followed by its UID if
+// another folder has the same title.
+func (cs *changeSet) folderFileName(folder grafana.DbSearchResponse) string {
+	if cs.folderFiles == nil {
+		cs.folderFiles = uniqueFolderNames(cs.defs.FoldersMetaByUID, "title", func(folder grafana.DbSearchResponse) string {
+			return folder.Title
+		})
+	}
+	if name, ok := cs.folderFiles[folder.UID]; ok {
+		return name
+	}
+	return folder.Title
+}
+
+// removeRenamedFolderFiles plans removing the files describing the given
+// folders, and their permissions, which aren't named as they're now written,
+// e.g. after the folder was renamed or another folder got the same title. The
+// folders are identified by the UIDs in the files' contents, the files of the
+// other folders are left as they are.
+// Returns an error if the folders directory couldn't be read or a removal
+// couldn't be applied.
+func removeRenamedFolderFiles(folders map[string]grafana.DbSearchResponse, changes *changeSet) (err error) {
+	current := make(map[string]string)
+	written := make(map[string]bool)
+	for _, folder := range folders {
+		current[folder.UID] = changes.folderFileName(folder) + ".json"
+		written[current[folder.UID]] = true
+	}
+
+	dir := changes.filePath("folders", "")
+	entries, err := os.ReadDir(filepath.Join(changes.syncPath, dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		// The files written by the pull are left as they are, their
+		// content may not be on disk yet on a dry run.
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") || format.IsPermissionsFile(name) || written[name] {
+			continue
+		}
+		data, readErr := os.ReadFile(filepath.Join(changes.syncPath, dir, name))
+		if readErr != nil {
+			continue
+		}
+		var folder format.FolderFile
+		if json.Unmarshal(data, &folder) != nil {
+			continue
+		}
+		if _, ok := current[folder.UID]; !ok {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"filename": name,
+			"uid":      folder.UID,
+			"new_name": current[folder.UID],
+		}).Info("Removing the file of a folder now written under another name")
+		if err = changes.remove(filepath.Join(dir, name)); err != nil {
+			return
+		}
+		base := strings.TrimSuffix(name, ".json")
+		if err = changes.remove(filepath.Join(dir, base+format.PermissionsFileSuffix)); err != nil {
+			return
+		}
+	}
+	return
+}
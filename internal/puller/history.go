@@ -0,0 +1,183 @@
+package puller
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// historyVersion is an intermediate version of a dashboard to commit.
+type historyVersion struct {
+	slug      string
+	uid       string
+	folderUID string
+	info      grafana.DashboardVersionInfo
+}
+
+// importVersionHistory commits the versions Grafana has of the given
+// dashboards between the ones of their files and the ones retrieved, one
+// commit per version, in the order they were created, authored by the
+// Grafana users who created them when Grafana gives them. Only the latest
+// versions, up to the maximum from the settings, are committed for each
+// dashboard. The versions retrieved are left to be committed by the pull.
+// Dashboards which don't have a file yet have no history to import. Each
+// version is written to the dashboard's current file, which the pull moves
+// afterwards if needed.
+// A dashboard which history couldn't be retrieved is skipped, the error is
+// only logged.
+// Returns an error if a version couldn't be written or committed.
+func importVersionHistory(
+	ctx context.Context, client *grafana.Client, cfg *config.Config, worktree *gogit.Worktree,
+	changes *changeSet, fileDefs grafana.DefsFile, APIDefs grafana.DefsFile, fileSlugByUID map[string]string,
+) (err error) {
+	maxVersions := config.DefaultMaxHistoryVersions
+	if cfg.Git.VersionHistory.MaxVersions > 0 {
+		maxVersions = cfg.Git.VersionHistory.MaxVersions
+	}
+
+	history := make([]historyVersion, 0)
+	for _, slug := range utils.SortedKeys(APIDefs.DashboardBySlug) {
+		dashboard := APIDefs.DashboardBySlug[slug]
+		fileVersion, ok := fileDefs.DashboardVersionByUID[dashboard.UID]
+		if !ok || dashboard.Version <= fileVersion+1 {
+			continue
+		}
+
+		// The latest version is listed too.
+		var versions []grafana.DashboardVersionInfo
+		if versions, err = client.GetDashboardVersions(ctx, dashboard.UID, maxVersions+1); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"slug":  slug,
+				"uid":   dashboard.UID,
+			}).Warn("Failed to retrieve the dashboard's versions, only committing its latest one")
+			err = nil
+			continue
+		}
+
+		count := 0
+		for _, info := range versions {
+			if info.Version <= fileVersion || info.Version >= dashboard.Version || count == maxVersions {
+				continue
+			}
+			count++
+			history = append(history, historyVersion{
+				slug:      slug,
+				uid:       dashboard.UID,
+				folderUID: APIDefs.DashboardMetaBySlug[slug].FolderUID,
+				info:      info,
+			})
+		}
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		if !history[i].info.Created.Equal(history[j].info.Created) {
+			return history[i].info.Created.Before(history[j].info.Created)
+		}
+		if history[i].slug != history[j].slug {
+			return history[i].slug < history[j].slug
+		}
+		return history[i].info.Version < history[j].info.Version
+	})
+
+	for _, version := range history {
+		if err = commitHistoryVersion(ctx, client, cfg, worktree, changes, version, fileSlugByUID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// commitHistoryVersion writes the given version of a dashboard to the
+// dashboard's current file, then commits it.
+// A version which couldn't be retrieved is skipped, the error is only logged.
+// Returns an error if the version couldn't be written or committed.
+func commitHistoryVersion(
+	ctx context.Context, client *grafana.Client, cfg *config.Config, worktree *gogit.Worktree,
+	changes *changeSet, version historyVersion, fileSlugByUID map[string]string,
+) (err error) {
+	dashboard, err := client.GetDashboardAtVersion(ctx, version.uid, version.info)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"slug":    version.slug,
+			"version": version.info.Version,
+		}).Warn("Failed to retrieve a version of the dashboard, skipping it")
+		return nil
+	}
+
+	fileSlug, ok := fileSlugByUID[version.uid]
+	if !ok {
+		fileSlug = version.slug
+	}
+	dir, ok := changes.dashboardDirs[fileSlug]
+	if !ok {
+		dir = changes.dashboardDir(version.folderUID)
+	}
+	file, err := dashboardFile(dashboard, version.folderUID, changes.datasourceAliases)
+	if err != nil {
+		return
+	}
+	written := len(changes.changes)
+	if err = changes.writeJSON(filepath.Join(dir, fileSlug+".json"), file); err != nil {
+		return
+	}
+	// The file already has this version's content.
+	if len(changes.changes) == written {
+		return nil
+	}
+
+	author := cfg.Git.CommitsAuthor.Name
+	if version.info.CreatedBy != "" {
+		author = version.info.CreatedBy
+	}
+	message := fmt.Sprintf("Imported version %d of %s from Grafana\n", version.info.Version, version.slug)
+	if version.info.Message != "" {
+		message += "\n" + version.info.Message + "\n"
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"slug":    version.slug,
+		"version": version.info.Version,
+		"author":  author,
+	}).Info("Committing an intermediate version of the dashboard")
+	signKey, err := git.SigningKey(cfg.Git)
+	if err != nil {
+		return
+	}
+	when := version.info.Created
+	if when.IsZero() {
+		when = time.Now()
+	}
+	hash, err := worktree.Commit(message, &gogit.CommitOptions{
+		Author: &object.Signature{
+			Name:  author,
+			Email: cfg.Git.CommitsAuthor.Email,
+			When:  when,
+		},
+		Committer: &object.Signature{
+			Name:  cfg.Git.CommitsAuthor.Name,
+			Email: cfg.Git.CommitsAuthor.Email,
+			When:  time.Now(),
+		},
+		SignKey: signKey,
+	})
+	if err == nil {
+		results.Current.RecordCommit(hash.String())
+	}
+	// The change is committed already, it isn't one of the pull's.
+	changes.changes = changes.changes[:written]
+	return
+}
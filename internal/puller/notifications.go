@@ -0,0 +1,122 @@
+package puller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Directories and file of the alerting notification settings, relative to the
+// clone.
+const (
+	alertingDir      = "alerting"
+	contactPointsDir = "alerting/contact-points"
+	muteTimingsDir   = "alerting/mute-timings"
+	policiesFile     = "policies.json"
+)
+
+// pullNotifications plans writing the contact points, the mute timings and
+// the notification policy tree which differ from their files, and removing the
+// files of the contact points and mute timings which don't exist anymore. Grafana doesn't version them, so
+// the files are compared with the descriptions from the API instead. They
+// don't belong to folders, so they're only pulled into the clone of the
+// default branch.
+// Returns an error if a description couldn't be written.
+func pullNotifications(cfg *config.Config, APIDefs grafana.DefsFile, changes *changeSet, result *pullResult) (err error) {
+	if cfg.Git != nil && cfg.Git.FolderBranch != "" {
+		return
+	}
+
+	for _, uid := range utils.SortedKeys(APIDefs.ContactPointByUID) {
+		cp := APIDefs.ContactPointByUID[uid]
+		planned := len(changes.changes)
+		if err = changes.write(changes.filePath(contactPointsDir, uid+".json"), cp.RawJSON); err != nil {
+			result.run.Add(results.NewItem(results.KindContactPoint, results.ActionPull, uid, cp.Name).Finish(err))
+			return
+		}
+		if len(changes.changes) > planned {
+			logrus.WithFields(logrus.Fields{
+				"uid":  uid,
+				"name": cp.Name,
+				"type": cp.Type,
+			}).Info("Grafana has a different contact point than the repository, updating")
+			result.run.Add(results.NewItem(results.KindContactPoint, results.ActionPull, uid, cp.Name).Finish(nil))
+		}
+	}
+
+	// remove any contact points that have gone
+	removeUnknownNotificationFiles(contactPointsDir, results.KindContactPoint, func(uid string) bool {
+		_, ok := APIDefs.ContactPointByUID[uid]
+		return ok
+	}, changes, result)
+
+	for _, name := range utils.SortedKeys(APIDefs.MuteTimingByName) {
+		mt := APIDefs.MuteTimingByName[name]
+		planned := len(changes.changes)
+		if err = changes.write(changes.filePath(muteTimingsDir, muteTimingFilename(name)), mt.RawJSON); err != nil {
+			result.run.Add(results.NewItem(results.KindMuteTiming, results.ActionPull, name, name).Finish(err))
+			return
+		}
+		if len(changes.changes) > planned {
+			logrus.WithFields(logrus.Fields{
+				"name": name,
+			}).Info("Grafana has a different mute timing than the repository, updating")
+			result.run.Add(results.NewItem(results.KindMuteTiming, results.ActionPull, name, name).Finish(nil))
+		}
+	}
+
+	// remove any mute timings that have gone
+	muteTimingFiles := make(map[string]bool, len(APIDefs.MuteTimingByName))
+	for name := range APIDefs.MuteTimingByName {
+		muteTimingFiles[muteTimingFilename(name)] = true
+	}
+	removeUnknownNotificationFiles(muteTimingsDir, results.KindMuteTiming, func(id string) bool {
+		return muteTimingFiles[id+".json"]
+	}, changes, result)
+
+	if APIDefs.NotificationPolicies == nil {
+		return
+	}
+	planned := len(changes.changes)
+	err = changes.write(changes.filePath(alertingDir, policiesFile), APIDefs.NotificationPolicies)
+	if err != nil || len(changes.changes) > planned {
+		logrus.Info("Grafana has a different notification policy tree than the repository, updating")
+		result.run.Add(results.NewItem(results.KindNotificationPolicy, results.ActionPull, "", policiesFile).Finish(err))
+	}
+	return
+}
+
+// muteTimingFilename returns the name of the file describing the mute timing
+// with the given name. Mute timings are identified by their name, which may
+// contain slashes.
+func muteTimingFilename(name string) string {
+	return strings.ReplaceAll(name, "/", "_") + ".json"
+}
+
+// removeUnknownNotificationFiles plans removing the JSON files in the given
+// directory which the given function doesn't know, given their name without
+// the extension.
+func removeUnknownNotificationFiles(dir string, kind results.Kind, known func(id string) bool, changes *changeSet, result *pullResult) {
+	files, _ := os.ReadDir(filepath.Join(changes.syncPath, changes.filePath(dir, "")))
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || id == file.Name() || known(id) {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"kind": kind,
+			"id":   id,
+		}).Info("Removing alerting description from filesystem")
+		changes.remove(changes.filePath(dir, file.Name()))
+		result.removed++
+		result.run.Add(results.NewItem(kind, results.ActionRemove, id, id).Finish(nil))
+	}
+}
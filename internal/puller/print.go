@@ -0,0 +1,47 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+)
+
+// PrintDashboard retrieves the dashboard with the given UID from the Grafana
+// API, and writes to the given writer the content of the file a pull would
+// write for it. If raw is true, the dashboard's JSON description as returned by
+// the API is written first, so both can be compared. The file is printed in
+// the JSON style of the given Git settings. Neither the repository
+// nor the versions file are read or changed.
+// Returns an error if the dashboard couldn't be retrieved or normalised, or the
+// output couldn't be written.
+func PrintDashboard(
+	ctx context.Context, client *grafana.Client, git *config.GitSettings, uid string, raw bool, out io.Writer,
+) (err error) {
+	dashboard, err := client.GetRawDashboard(ctx, "uid/"+uid)
+	if err != nil {
+		return
+	}
+
+	// The raw dashboard is only indented, so its keys are in the order
+	// Grafana gave them.
+	if raw {
+		rawContent := new(bytes.Buffer)
+		if err = json.Indent(rawContent, dashboard.RawJSON, "", "\t"); err != nil {
+			return
+		}
+		if _, err = out.Write(append(rawContent.Bytes(), '\n')); err != nil {
+			return
+		}
+	}
+
+	content, err := DashboardFileContent(dashboard, dashboard.FolderUID, client.DatasourceAliases, git)
+	if err != nil {
+		return
+	}
+	_, err = out.Write(content)
+	return
+}
@@ -0,0 +1,166 @@
+package puller
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Paths of the files read by Grafana's file provisioning, in the provisioning
+// directory of the organisation.
+const (
+	provisioningDir           = "provisioning"
+	provisioningProvidersFile = "dashboards.yaml"
+	provisioningDashboardsDir = "dashboards"
+)
+
+// provisioningProviders is the definition of the dashboards' providers read by
+// Grafana's file provisioning.
+type provisioningProviders struct {
+	APIVersion int                    `yaml:"apiVersion"`
+	Providers  []provisioningProvider `yaml:"providers"`
+}
+
+// provisioningProvider provisions the dashboards of a directory into a
+// folder.
+type provisioningProvider struct {
+	Name            string `yaml:"name"`
+	OrgID           int64  `yaml:"orgId,omitempty"`
+	Folder          string `yaml:"folder"`
+	FolderUID       string `yaml:"folderUid,omitempty"`
+	Type            string `yaml:"type"`
+	DisableDeletion bool   `yaml:"disableDeletion"`
+	AllowUIUpdates  bool   `yaml:"allowUiUpdates"`
+	Options         struct {
+		Path string `yaml:"path"`
+	} `yaml:"options"`
+}
+
+// provisioningDashboard returns the given dashboard's JSON model as the
+// provisioning reads it: without the keys specific to an instance, nor the
+// ones giving the dashboard's folder, which is given by its provider instead.
+// The datasources aren't replaced with their aliases, which Grafana wouldn't
+// resolve.
+// Returns an error if the model couldn't be parsed.
+func provisioningDashboard(dashboard *grafana.Dashboard) (content []byte, err error) {
+	var model map[string]interface{}
+	if err = json.Unmarshal(grafana.NormalizeDashboardJSON(dashboard.RawJSON), &model); err != nil {
+		return
+	}
+	for _, key := range format.InstanceKeys {
+		delete(model, key)
+	}
+	delete(model, format.FolderUIDKey)
+	delete(model, format.FolderKey)
+	return json.Marshal(model)
+}
+
+// addProvisioningChangesToRepo plans writing the given dashboards in the
+// provisioning directory, in a subdirectory per folder named like the
+// by-folder layout names them, and the definition of a provider per folder
+// reading this subdirectory. The other files of the provisioning directory are
+// removed.
+// Returns an error if a dashboard's model couldn't be parsed, the providers'
+// definition generated, or the provisioning directory read, or if a change
+// couldn't be applied.
+func addProvisioningChangesToRepo(cfg *config.Config, defs grafana.DefsFile, changes *changeSet) (err error) {
+	settings := cfg.Git.Provisioning
+	written := make(map[string]bool)
+
+	providers := provisioningProviders{APIVersion: 1, Providers: make([]provisioningProvider, 0)}
+	providerDirs := make(map[string]bool)
+	for _, slug := range utils.SortedKeys(defs.DashboardBySlug) {
+		folderUID := defs.DashboardMetaBySlug[slug].FolderUID
+		dir := changes.folderDirName(folderUID)
+
+		var content []byte
+		if content, err = provisioningDashboard(defs.DashboardBySlug[slug]); err != nil {
+			return
+		}
+		filename := changes.filePath(provisioningDir, filepath.Join(provisioningDashboardsDir, dir, slug+".json"))
+		if err = changes.write(filename, content); err != nil {
+			return
+		}
+		written[filename] = true
+
+		if providerDirs[dir] {
+			continue
+		}
+		providerDirs[dir] = true
+
+		// The dashboards which aren't in any folder are provisioned in
+		// the General folder.
+		provider := provisioningProvider{
+			Name:            dir,
+			OrgID:           cfg.Grafana.OrgID,
+			Type:            "file",
+			DisableDeletion: settings.DisableDeletion,
+			AllowUIUpdates:  settings.AllowUIUpdates,
+		}
+		if folder, found := defs.FolderByUID(folderUID); found {
+			provider.Folder = folder.Title
+			provider.FolderUID = folder.UID
+		}
+		provider.Options.Path = path.Join(settings.Path, provisioningDashboardsDir, dir)
+		providers.Providers = append(providers.Providers, provider)
+	}
+
+	content, err := yaml.Marshal(providers)
+	if err != nil {
+		return
+	}
+	filename := changes.filePath(provisioningDir, provisioningProvidersFile)
+	if err = changes.writeRaw(filename, content); err != nil {
+		return
+	}
+	written[filename] = true
+
+	return removeStaleProvisioningFiles(changes, written)
+}
+
+// removeStaleProvisioningFiles plans removing the files of the provisioning
+// directory which aren't among the given written ones, e.g. the ones of the
+// dashboards removed from Grafana.
+// Returns an error if the directory couldn't be read or a removal couldn't be
+// applied.
+func removeStaleProvisioningFiles(changes *changeSet, written map[string]bool) error {
+	root := filepath.Join(changes.syncPath, changes.filePath(provisioningDir, ""))
+	stale := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(changes.syncPath, path)
+		if err != nil {
+			return err
+		}
+		if !written[rel] {
+			stale = append(stale, rel)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, filename := range stale {
+		if err = changes.remove(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
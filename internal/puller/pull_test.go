@@ -0,0 +1,199 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+)
+
+// newPullConfig returns the configuration of a puller committing to a new
+// clone of the given remote, and pushing to it.
+func newPullConfig(remote *gittest.Remote) *config.Config {
+	return &config.Config{Git: remote.Settings()}
+}
+
+// dashboardFiles returns the names of the dashboards' files in the clone the
+// given configuration describes.
+func dashboardFiles(t *testing.T, cfg *config.Config) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(cfg.Git.ClonePath, "dashboards", "*.json"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	return files
+}
+
+// A Grafana instance listing no dashboards doesn't empty the repository.
+func TestPullRefusesEmptyInstance(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newPullConfig(remote)
+	fake := newFakeGrafana(map[string]interface{}{"uid": "ops", "title": "Ops", "version": 1})
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := PullGrafanaAndCommit(ctx, client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+	files := dashboardFiles(t, cfg)
+	if len(files) != 1 {
+		t.Fatalf("pulled %v, want the dashboard's file", files)
+	}
+	pulled := remote.Head()
+
+	fake.setDashboards()
+	if err := PullGrafanaAndCommit(ctx, client, cfg, nil); err != ErrNoDashboards {
+		t.Errorf("PullGrafanaAndCommit = %v, want ErrNoDashboards", err)
+	}
+	if kept := dashboardFiles(t, cfg); len(kept) != 1 {
+		t.Errorf("the dashboard's file was removed, left %v", kept)
+	}
+	if head := remote.Head(); head != pulled {
+		t.Errorf("a commit was pushed after the empty pull")
+	}
+}
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+// Pulling the same dashboard twice writes the same bytes, whichever order
+// Grafana gives its keys in.
+func TestPullWritesCanonicalJSON(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newPullConfig(remote)
+	fake := newFakeGrafana(map[string]interface{}{"uid": "ops", "title": "Ops"})
+	fake.setRaw("ops", `{"uid":"ops","title":"Ops","schemaVersion":39,"tags":["b","a"],"panels":[{"type":"graph","id":2,"gridPos":{"y":0,"x":0,"w":12,"h":8},"fieldConfig":{"defaults":{"max":1.0,"unit":"ms"}}},{"type":"text","id":1,"options":{"content":"<b>A & B</b>"}}]}`)
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := PullGrafanaAndCommit(ctx, client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+	files := dashboardFiles(t, cfg)
+	if len(files) != 1 {
+		t.Fatalf("pulled %v, want the dashboard's file", files)
+	}
+	path := filepath.Join(cfg.Git.ClonePath, "dashboards", files[0])
+	first, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	golden := filepath.Join("testdata", "dashboard.golden.json")
+	if *update {
+		if err = os.WriteFile(golden, first, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(first, want) {
+		t.Errorf("the dashboard's file differs from %s:\n%s", golden, first)
+	}
+
+	// A new version with the same content, in another order.
+	fake.setRaw("ops", `{"panels":[{"fieldConfig":{"defaults":{"unit":"ms","max":1.0}},"gridPos":{"h":8,"w":12,"x":0,"y":0},"id":2,"type":"graph"},{"options":{"content":"<b>A & B</b>"},"id":1,"type":"text"}],"tags":["b","a"],"schemaVersion":39,"title":"Ops","uid":"ops"}`)
+	if err = PullGrafanaAndCommit(ctx, client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+	if n := fake.requested["ops"]; n != 2 {
+		t.Fatalf("the dashboard was requested %d times, want twice", n)
+	}
+	second, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("pulling the same dashboard again changed its file:\n%s\n%s", first, second)
+	}
+}
+
+// The commits of a pull are signed with the signing key, if any.
+func TestPullSignsCommits(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newPullConfig(remote)
+	var public string
+	cfg.Git.SigningKeyPath, public = gittest.SigningKey(t)
+	client := newTestClient(t, newFakeGrafana(map[string]interface{}{"uid": "ops", "title": "Ops"}))
+
+	if err := PullGrafanaAndCommit(context.Background(), client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+
+	commit := remote.CommitObject(remote.Head())
+	if commit.Author.Email != gittest.ManagerAuthor.Email {
+		t.Fatalf("the latest commit is by %s, want the manager's", commit.Author.Email)
+	}
+	if commit.PGPSignature == "" {
+		t.Fatalf("the commit isn't signed")
+	}
+	if _, err := commit.Verify(public); err != nil {
+		t.Errorf("the commit's signature doesn't verify: %v", err)
+	}
+}
+
+// A renamed dashboard has its file moved, in the same commit as the versions
+// file.
+func TestPullRenamedDashboard(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	cfg := newPullConfig(remote)
+	fake := newFakeGrafana(map[string]interface{}{"uid": "ops", "title": "Ops"})
+	client := newTestClient(t, fake)
+	ctx := context.Background()
+
+	if err := PullGrafanaAndCommit(ctx, client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+	before := dashboardFiles(t, cfg)
+	if len(before) != 1 {
+		t.Fatalf("pulled %v, want the dashboard's file", before)
+	}
+	pulled := remote.Head()
+
+	fake.setDashboards(map[string]interface{}{"uid": "ops", "title": "Operations"})
+	if err := PullGrafanaAndCommit(ctx, client, cfg, nil); err != nil {
+		t.Fatalf("PullGrafanaAndCommit: %v", err)
+	}
+	after := dashboardFiles(t, cfg)
+	if len(after) != 1 || after[0] == before[0] {
+		t.Fatalf("the dashboard's files are %v after the rename, want one other than %s", after, before[0])
+	}
+
+	commit := remote.CommitObject(remote.Head())
+	if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != pulled {
+		t.Fatalf("the rename took more than one commit")
+	}
+	stats, err := commit.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	changed := make(map[string]bool)
+	versions := false
+	for _, stat := range stats {
+		changed[stat.Name] = true
+		versions = versions || strings.HasPrefix(filepath.Base(stat.Name), "versions")
+	}
+	for _, name := range []string{"dashboards/" + before[0], "dashboards/" + after[0]} {
+		if !changed[name] {
+			t.Errorf("the commit doesn't change %s, only %v", name, changed)
+		}
+	}
+	if !versions {
+		t.Errorf("the commit doesn't change the versions file, only %v", changed)
+	}
+}
@@ -1,23 +1,36 @@
 package puller
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/tidwall/sjson"
-	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
 	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
 
 	"github.com/icza/dyno"
 	"github.com/sirupsen/logrus"
 	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
+// pullMetrics records the outcome of the pulls, exposed with the other metrics
+// of the manager.
+var pullMetrics = metrics.NewPuller(metrics.Default)
+
 // diffVersion represents a dashboard version diff.
 type diffVersion struct {
 	old int
@@ -33,61 +46,211 @@ func SyncPath(cfg *config.Config) (syncPath string) {
 	return
 }
 
-func GetDashboardDefinitionsFromLocalGrafana(client *grafana.Client, cfg *config.Config, defs *grafana.DefsFile) (dashURIs []string, err error) {
+// GetDashboardDefinitionsFromLocalGrafana gets all the dashboards from the
+// Grafana API, except the ones owned by plugins or ignored, taking them from
+// the given snapshot if it holds them. The dashboards are requested by several
+// workers at once (see config.GrafanaSettings.PullConcurrency). A dashboard
+// which couldn't be retrieved is left out, so its file is left as it is, and
+// the UIDs of these dashboards are reported once all have been requested.
+// Returns an error if the dashboards couldn't be listed or the given context
+// was cancelled.
+func GetDashboardDefinitionsFromLocalGrafana(ctx context.Context, client *grafana.Client, cfg *config.Config, defs *grafana.DefsFile, snapshot *Snapshot) (dashURIs []string, err error) {
 	// Get URIs for all known dashboards
 	logrus.Info("Getting dashboard URIs")
-	dashboardMetaBySlug, foldersMetaByUID, _, err := client.GetDashboardsURIs()
+	dashboardMetaBySlug, foldersMetaByUID, _, err := client.GetDashboardsURIs(ctx)
 	if err != nil {
 		return
 	}
 
+	// The status dashboard belongs to the manager, not to the repository.
+	for slug, db := range dashboardMetaBySlug {
+		if grafana.IsSelfDashboard(db.UID) {
+			delete(dashboardMetaBySlug, slug)
+		}
+	}
+
 	defs.DashboardMetaBySlug = dashboardMetaBySlug
 	defs.DashboardBySlug = make(map[string]*grafana.Dashboard, 0)
 	defs.FoldersMetaByUID = foldersMetaByUID
 	defs.DashboardVersionByUID = make(map[string]int, 0)
 
+	// Record where each folder sits in the folders tree, so folders can be
+	// matched by their ancestors. Nested folders are optional, so this
+	// shouldn't prevent the dashboards from being retrieved.
+	if err = client.LoadFolderAncestry(ctx, defs); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to retrieve the ancestry of the folders")
+		err = nil
+	}
+
+	// Find out which dashboards are owned by plugins, so they can be left
+	// alone. Older Grafana versions or restricted API keys may not allow it,
+	// which shouldn't prevent the other dashboards from being retrieved.
+	if err = client.LoadPluginOwners(ctx, defs, cfg.Grafana.IncludePlugins); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to retrieve the dashboards owned by plugins")
+		err = nil
+	}
+
 	// Iterate over the dashboards URIs
-	for slug, db := range dashboardMetaBySlug {
+	scope := cfg.Grafana.FolderScope()
+	toFetch := make([]string, 0, len(dashboardMetaBySlug))
+	for _, slug := range utils.SortedKeys(dashboardMetaBySlug) {
+		db := dashboardMetaBySlug[slug]
 		uri := "uid/" + db.UID
-		logrus.WithFields(logrus.Fields{
-			"uri": uri,
-		}).Debug("Retrieving dashboard")
 
-		// Retrieve the dashboard JSON
-		var dashboard *grafana.Dashboard
-		dashboard, err = client.GetDashboard(uri)
-		if err != nil {
-			return
+		if pluginID, unmanaged := defs.UnmanagedPluginOwner(db.UID); unmanaged {
+			logrus.WithFields(logrus.Fields{
+				"uri":    uri,
+				"name":   db.Title,
+				"plugin": pluginID,
+			}).Info("Dashboard is owned by a plugin, skipping")
+
+			continue
+		}
+
+		// Ignored dashboards aren't retrieved. Their metadata is kept, so
+		// their files aren't removed from the repository.
+		if rule, ignored := cfg.Grafana.IgnoredBy(db.Title, slug, db.Tags); ignored {
+			logrus.WithFields(logrus.Fields{
+				"uri":  uri,
+				"uid":  db.UID,
+				"name": db.Title,
+				"rule": rule.String(),
+			}).Info("Dashboard matches an ignore rule, skipping")
+
+			continue
+		}
+
+		// Neither are the dashboards outside of the managed folders, which
+		// belong to someone else.
+		if !scope.Allows(defs.FolderKeys(db.FolderUID)) {
+			logrus.WithFields(logrus.Fields{
+				"uri":    uri,
+				"name":   db.Title,
+				"folder": defs.FolderPath(db.FolderUID),
+			}).Info("Dashboard is outside of the managed folders, skipping")
+
+			continue
 		}
 
-		if len(cfg.Grafana.IgnorePrefix) > 0 {
-			if strings.HasPrefix(dashboard.Name, cfg.Grafana.IgnorePrefix) {
+		toFetch = append(toFetch, slug)
+	}
+
+	// Dashboards retrieved by previous pulls are reused if they weren't
+	// updated since, unless a full pull is forced. The cache is written
+	// either way, so the next pull can use it.
+	cache := loadDashboardCache(cfg)
+	useCache := cache != nil && !cfg.ForceFullPull
+
+	var (
+		mu     sync.Mutex
+		failed []string
+	)
+	fetch := func(slug string) {
+		uid, updated := dashboardMetaBySlug[slug].UID, dashboardMetaBySlug[slug].Updated
+		// Retrieve the dashboard JSON, unless it was retrieved earlier in
+		// the run, or by a previous pull, and hasn't changed since.
+		dashboard, ok := snapshot.dashboard(client, uid)
+		if !ok && useCache {
+			if dashboard, ok = cache.dashboard(ctx, client, uid, updated); ok {
 				logrus.WithFields(logrus.Fields{
-					"uri":    uri,
-					"name":   dashboard.Name,
-					"prefix": cfg.Grafana.IgnorePrefix,
-				}).Info("Dashboard name starts with specified prefix, skipping")
+					"uri":     "uid/" + uid,
+					"version": dashboard.Version,
+				}).Debug("Dashboard unchanged since the last pull, reusing it")
+				snapshot.storeDashboard(client, dashboard)
+			}
+		}
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"uri": "uid/" + uid,
+			}).Debug("Retrieving dashboard")
 
-				continue
+			var fetchErr error
+			dashboard, fetchErr = client.GetDashboard(ctx, "uid/"+uid)
+			if fetchErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": fetchErr,
+					"uid":   uid,
+				}).Error("Failed to retrieve the dashboard")
+				mu.Lock()
+				failed = append(failed, uid)
+				mu.Unlock()
+				return
 			}
+			snapshot.storeDashboard(client, dashboard)
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
 		defs.DashboardBySlug[slug] = dashboard
 		defs.DashboardVersionByUID[dashboard.UID] = dashboard.Version
 	}
+
+	workers := cfg.Grafana.PullConcurrency
+	if workers <= 0 {
+		workers = config.DefaultPullConcurrency
+	}
+	slugs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for slug := range slugs {
+				fetch(slug)
+			}
+		}()
+	}
+	for _, slug := range toFetch {
+		slugs <- slug
+	}
+	close(slugs)
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	cache.store(defs.DashboardBySlug, dashboardMetaBySlug)
+	cache.save()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		logrus.WithFields(logrus.Fields{
+			"count": len(failed),
+			"uids":  strings.Join(failed, ","),
+		}).Warn("Some dashboards couldn't be retrieved, their files are left as they are")
+	}
 	return
 }
-func GetLibraryDefinitionsFromLocalGrafana(client *grafana.Client, cfg *config.Config, defs *grafana.DefsFile) (err error) {
+func GetLibraryDefinitionsFromLocalGrafana(ctx context.Context, client *grafana.Client, cfg *config.Config, defs *grafana.DefsFile) (err error) {
 	var libs []grafana.LibraryElementResponse
 	var raw []json.RawMessage
 	defs.LibraryMetaByUID = make(map[string]grafana.LibraryElementResponse, 0)
 	defs.LibraryByUID = make(map[string]*grafana.Library, 0)
 	defs.LibraryVersionByUID = make(map[string]int, 0)
 
-	libs, raw, err = client.GetLibraryList()
+	libs, raw, err = client.GetLibraryList(ctx)
 	if err != nil {
 		return
 	}
 	for i, lib := range libs {
+		libSlug := grafana.GetSluglikeName(lib.Uid, lib.Name)
+		defs.LibraryMetaByUID[lib.Uid] = lib
+
+		// Ignored libraries aren't retrieved. Their metadata is kept, so
+		// their files aren't removed from the repository.
+		if rule, ignored := cfg.Grafana.IgnoredBy(lib.Name, libSlug, nil); ignored {
+			logrus.WithFields(logrus.Fields{
+				"uid":  lib.Uid,
+				"name": lib.Name,
+				"rule": rule.String(),
+			}).Info("Library matches an ignore rule, skipping")
+
+			continue
+		}
+
 		rawJson, _ := sjson.Delete(string(raw[i]), "model.libraryPanel.version")
 		rawJson, _ = sjson.Delete(rawJson, "model.libraryPanel.created")
 		rawJson, _ = sjson.Delete(rawJson, "model.libraryPanel.createdBy")
@@ -100,34 +263,332 @@ func GetLibraryDefinitionsFromLocalGrafana(client *grafana.Client, cfg *config.C
 		defs.LibraryByUID[lib.Uid] = &grafana.Library{
 			RawJSON: []byte(rawJson),
 			Name:    lib.Name,
-			Slug:    grafana.GetSluglikeName(lib.Uid, lib.Name),
+			Slug:    libSlug,
 			Version: lib.Version,
 		}
 		defs.LibraryVersionByUID[lib.Uid] = lib.Version
-		defs.LibraryMetaByUID[lib.Uid] = lib
 	}
 	return
 }
 
-// GetDefinitionsFromGrafanaAPI gets all the dashboards and libraries from the Grafana API
-func GetDefinitionsFromGrafanaAPI(client *grafana.Client, cfg *config.Config) (dashURIs []string, defs grafana.DefsFile, err error) {
+// GetDatasourceDefinitionsFromLocalGrafana gets all the datasources from the
+// Grafana API, except the provisioned ones which can't be changed through the
+// API anyway.
+func GetDatasourceDefinitionsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile) (err error) {
+	defs.DatasourceByUID = make(map[string]*grafana.Datasource)
+	defs.DatasourceVersionByUID = make(map[string]int)
+
+	datasources, err := client.GetDatasources(ctx)
+	if err != nil {
+		return
+	}
+	for _, ds := range datasources {
+		if ds.ReadOnly {
+			logrus.WithFields(logrus.Fields{
+				"uid":  ds.UID,
+				"name": ds.Name,
+			}).Debug("Datasource is provisioned, skipping")
+			continue
+		}
+		defs.DatasourceByUID[ds.UID] = ds
+		defs.DatasourceVersionByUID[ds.UID] = ds.Version
+	}
+	return
+}
+
+// GetAlertRuleDefinitionsFromLocalGrafana gets all the alert rules from the
+// Grafana provisioning API.
+func GetAlertRuleDefinitionsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile) (err error) {
+	defs.AlertRuleByUID = make(map[string]*grafana.AlertRule)
+	defs.AlertRuleVersionByUID = make(map[string]int64)
+
+	rules, err := client.GetAlertRules(ctx)
+	if err != nil {
+		return
+	}
+	for _, rule := range rules {
+		defs.AlertRuleByUID[rule.UID] = rule
+		defs.AlertRuleVersionByUID[rule.UID] = rule.Version
+	}
+	return
+}
+
+// GetFolderPermissionsFromLocalGrafana gets the permissions of the folders
+// already retrieved from the Grafana API. The folders which permissions can't
+// be retrieved, e.g. because the user isn't an administrator of them, are left
+// out with a warning.
+func GetFolderPermissionsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile) {
+	defs.FolderPermissionsByUID = make(map[string]*format.FolderPermissions)
+
+	for _, uid := range utils.SortedKeys(defs.FoldersMetaByUID) {
+		perms, err := client.GetFolderPermissions(ctx, uid)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"uid":   uid,
+				"title": defs.FoldersMetaByUID[uid].Title,
+			}).Warn("Failed to retrieve the folder permissions, not synchronising them")
+			continue
+		}
+		defs.FolderPermissionsByUID[uid] = perms
+	}
+}
+
+// GetDashboardPermissionsFromLocalGrafana gets the permissions of the
+// dashboards already retrieved from the Grafana API, taking them from the given
+// snapshot if it holds them. The dashboards which permissions can't be
+// retrieved are left out with a warning.
+func GetDashboardPermissionsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile, snapshot *Snapshot) {
+	defs.DashboardPermissionsByUID = make(map[string]*format.DashboardPermissions)
+
+	for _, slug := range utils.SortedKeys(defs.DashboardBySlug) {
+		dashboard := defs.DashboardBySlug[slug]
+		if perms, ok := snapshot.dashboardPermissions(client, dashboard.UID); ok {
+			defs.DashboardPermissionsByUID[dashboard.UID] = perms
+			continue
+		}
+		perms, err := client.GetDashboardPermissions(ctx, dashboard.UID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"slug":  slug,
+			}).Warn("Failed to retrieve the dashboard permissions, not synchronising them")
+			continue
+		}
+		defs.DashboardPermissionsByUID[dashboard.UID] = perms
+		snapshot.storeDashboardPermissions(client, perms)
+	}
+}
+
+// GetTeamsFromLocalGrafana gets the teams from the Grafana API, so they can be
+// written next to the permissions referencing them. The teams are left out
+// with a warning if they can't be retrieved, e.g. because the user isn't an
+// administrator of the organisation.
+func GetTeamsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile) {
+	teams, err := client.GetTeams(ctx)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to retrieve the teams, not writing them")
+		return
+	}
+	defs.Teams = teams
+}
+
+// GetNotificationDefinitionsFromLocalGrafana gets the contact points, the mute
+// timings and the notification policy tree from the Grafana provisioning API.
+func GetNotificationDefinitionsFromLocalGrafana(ctx context.Context, client *grafana.Client, defs *grafana.DefsFile) (err error) {
+	defs.ContactPointByUID = make(map[string]*grafana.ContactPoint)
+	defs.MuteTimingByName = make(map[string]*grafana.MuteTiming)
+
+	contactPoints, err := client.GetContactPoints(ctx)
+	if err != nil {
+		return
+	}
+	for _, cp := range contactPoints {
+		defs.ContactPointByUID[cp.UID] = cp
+	}
+
+	muteTimings, err := client.GetMuteTimings(ctx)
+	if err != nil {
+		return
+	}
+	for _, mt := range muteTimings {
+		defs.MuteTimingByName[mt.Name] = mt
+	}
+
+	defs.NotificationPolicies, err = client.GetNotificationPolicies(ctx)
+	return
+}
+
+// GetDefinitionsFromGrafanaAPI gets all the dashboards and libraries, and the
+// datasources, alert rules and notification settings if they're synchronised,
+// from the Grafana API
+func GetDefinitionsFromGrafanaAPI(ctx context.Context, client *grafana.Client, cfg *config.Config) (dashURIs []string, defs grafana.DefsFile, err error) {
+	return getDefinitions(ctx, client, cfg, nil)
+}
 
+// getDefinitions implements GetDefinitionsFromGrafanaAPI and
+// Snapshot.Definitions.
+func getDefinitions(ctx context.Context, client *grafana.Client, cfg *config.Config, snapshot *Snapshot) (dashURIs []string, defs grafana.DefsFile, err error) {
 	defs = grafana.DefsFile{}
-	dashURIs, err = GetDashboardDefinitionsFromLocalGrafana(client, cfg, &defs)
+	dashURIs, err = GetDashboardDefinitionsFromLocalGrafana(ctx, client, cfg, &defs, snapshot)
 	if err != nil {
 		return
 	}
-	err = GetLibraryDefinitionsFromLocalGrafana(client, cfg, &defs)
+	if err = GetLibraryDefinitionsFromLocalGrafana(ctx, client, cfg, &defs); err != nil {
+		return
+	}
+	if cfg.Grafana.SyncDatasources {
+		if err = GetDatasourceDefinitionsFromLocalGrafana(ctx, client, &defs); err != nil {
+			return
+		}
+	}
+	if cfg.Grafana.SyncAlertRules {
+		if err = GetAlertRuleDefinitionsFromLocalGrafana(ctx, client, &defs); err != nil {
+			return
+		}
+	}
+	if cfg.Grafana.SyncNotifications {
+		if err = GetNotificationDefinitionsFromLocalGrafana(ctx, client, &defs); err != nil {
+			return
+		}
+	}
+	if cfg.Grafana.SyncFolderPermissions {
+		GetFolderPermissionsFromLocalGrafana(ctx, client, &defs)
+	}
+	if cfg.Grafana.SyncDashboardPermissions {
+		GetDashboardPermissionsFromLocalGrafana(ctx, client, &defs, snapshot)
+	}
+	if cfg.Grafana.SyncFolderPermissions || cfg.Grafana.SyncDashboardPermissions {
+		GetTeamsFromLocalGrafana(ctx, client, &defs)
+	}
 	return
 }
 
+// ErrNoDashboards is returned when the Grafana instance has no dashboards while
+// the repository has some, which is more likely caused by an instance being
+// restored or by missing permissions than by all dashboards being deleted. The
+// files are kept, and have to be removed from the repository by hand if the
+// dashboards were actually deleted.
+var ErrNoDashboards = errors.New("Grafana returned no dashboards, not removing the ones from the repository")
+
+// pullResult records the changes a pull made to the repository.
+type pullResult struct {
+	dv      map[string]diffVersion
+	lv      map[string]diffVersion
+	removed int
+	// examined is the number of dashboards retrieved from Grafana.
+	examined int
+	// run records the result for each pulled or removed item.
+	run *results.RunResult
+	// complexity maps the slugs of the dashboards over the complexity limits
+	// to the limits they exceed, if they're reported.
+	complexity map[string][]string
+	// dryRun is true if the pull mustn't change anything, in which case the
+	// changes it would make are recorded in plans.
+	dryRun bool
+	plans  []BranchPlan
+}
+
 // PullGrafanaAndCommit pulls all the dashboards from Grafana except the ones
 // which name starts with "test", then commits each of them to Git except for
 // those that have a newer or equal version number already versioned in the
-// repo.
-func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error) {
+// repo. If folders are mapped to branches, the dashboards, libraries and
+// folder definitions of these folders are committed to the clone of their
+// branch instead.
+// The dashboards the given snapshot holds aren't retrieved again, which lets
+// the pull following a push reuse what the push retrieved. It can be nil.
+// Nothing is pulled if Grafana isn't healthy, so a Grafana in the middle of an
+// upgrade doesn't get a half-empty state committed.
+func PullGrafanaAndCommit(ctx context.Context, client *grafana.Client, cfg *config.Config, snapshot *Snapshot) (err error) {
+	if _, err = client.CheckHealth(ctx); err != nil {
+		return
+	}
+	_, err = pull(ctx, client, cfg, false, snapshot)
+	return
+}
+
+// DryRun retrieves and compares the dashboards like PullGrafanaAndCommit,
+// without changing the clones nor the Grafana instance.
+// Returns the changes the pull would make to the clone of each branch, and
+// an error if the pull couldn't be run.
+func DryRun(ctx context.Context, client *grafana.Client, cfg *config.Config) (plans []BranchPlan, err error) {
+	result, err := pull(ctx, client, cfg, true, nil)
+	return result.plans, err
+}
+
+// pull implements PullGrafanaAndCommit and, if dryRun is true, DryRun.
+func pull(ctx context.Context, client *grafana.Client, cfg *config.Config, dryRun bool, snapshot *Snapshot) (result *pullResult, err error) {
+	result = &pullResult{
+		dv:         make(map[string]diffVersion),
+		lv:         make(map[string]diffVersion),
+		run:        results.NewRunResult(),
+		complexity: make(map[string][]string),
+		dryRun:     dryRun,
+	}
+	if !dryRun {
+		defer func() {
+			pullMetrics.ObservePull(result.examined, len(result.dv), len(result.lv), err == nil)
+			results.Current.Record(result.run)
+		}()
+	}
+	defer func() {
+		fields := logrus.Fields{
+			"results": result.run.Summary(),
+		}
+		if len(result.complexity) > 0 {
+			fields["complexity"] = result.complexity
+		}
+		logrus.WithFields(fields).Info("Pulled the changes from Grafana")
+	}()
+
+	if cfg.Grafana.SelfDashboard && !dryRun {
+		defer func() {
+			summary := selfDashboardSummary(result, err)
+			if updateErr := client.UpdateSelfDashboardSummary(ctx, grafana.SelfDashboardPullPanel, summary); updateErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": updateErr,
+				}).Warn("Failed to update the status dashboard")
+			}
+		}()
+	}
+
+	// Each organisation is pulled into its own subdirectories.
+	for _, orgCfg := range cfg.OrgConfigs() {
+		if err = pullOrg(ctx, client.ForOrg(orgCfg.Grafana.OrgID), orgCfg, snapshot, result); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// pullOrg pulls the dashboards and libraries of the organisation the given
+// configuration is for into the clone of each branch, reusing the dashboards
+// the given snapshot holds.
+// Returns an error if Grafana couldn't be requested or a clone couldn't be
+// updated.
+func pullOrg(ctx context.Context, client *grafana.Client, cfg *config.Config, snapshot *Snapshot, result *pullResult) (err error) {
+	logrus.WithFields(logrus.Fields{
+		"org": cfg.OrgDir,
+	}).Info("PullGrafanaAndCommit: Getting dashboard versions from Grafana API")
+	var APIDefs grafana.DefsFile
+	_, APIDefs, err = getDefinitions(ctx, client, cfg, snapshot)
+	if err != nil {
+		return
+	}
+	result.examined += len(APIDefs.DashboardBySlug)
+
+	for _, branchCfg := range cfg.BranchConfigs() {
+		branchDefs := APIDefs
+		if cfg.Git != nil && len(cfg.Git.FolderBranchMap) > 0 {
+			branchDefs = filterDefsForBranch(cfg, APIDefs, branchCfg.Git.FolderBranch)
+		}
+
+		if err = pullIntoRepo(ctx, client, branchCfg, APIDefs, branchDefs, result); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// pullIntoRepo writes the given definitions retrieved from the Grafana API
+// into the clone described by the configuration, removes the files of the
+// dashboards and libraries that aren't part of the definitions anymore, then
+// commits and pushes the changes. allDefs contains all the definitions
+// retrieved from the Grafana API, and is only used to tell apart dashboards
+// that moved to another branch from the ones that were deleted. The given
+// client is only needed to import the history of the dashboards' versions. On
+// a dry run, the clone is neither synchronised nor changed, and the changes are
+// recorded in the result instead.
+func pullIntoRepo(ctx context.Context, client *grafana.Client, cfg *config.Config, allDefs grafana.DefsFile, APIDefs grafana.DefsFile, result *pullResult) (err error) {
 	var repo *git.Repository
 	var w *gogit.Worktree
+	// The commit the changes are made on top of, when they're proposed in a
+	// merge request rather than pushed.
+	var base *object.Commit
 
 	syncPath := SyncPath(cfg)
 	// Only do Git stuff if there's a configuration for that. On "simple sync"
@@ -140,8 +601,15 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 			return err
 		}
 
-		if err = repo.Sync(false); err != nil {
-			return err
+		if !result.dryRun {
+			if err = repo.Sync(false); err != nil {
+				return err
+			}
+			if cfg.Git.ChangeRequest != nil {
+				if base, err = repo.HeadCommit(); err != nil {
+					return err
+				}
+			}
 		}
 
 		w, err = repo.Repo.Worktree()
@@ -150,29 +618,100 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 		}
 	}
 
-	logrus.Info("PullGrafanaAndCommit: Getting dashboard versions from Grafana API")
-	var APIDefs grafana.DefsFile
-	_, APIDefs, err = GetDefinitionsFromGrafanaAPI(client, cfg)
-	if err != nil {
+	changes := &changeSet{
+		syncPath:          syncPath,
+		orgDir:            cfg.OrgDir,
+		worktree:          w,
+		dryRun:            result.dryRun,
+		datasourceAliases: cfg.Grafana.DatasourceAliases,
+		byFolder:          cfg.Git.ByFolder(),
+		style:             jsonStyle(cfg.Git),
+		defs:              allDefs,
+	}
+	if err = changes.loadDashboardDirs(); err != nil {
 		return err
 	}
-
 	dv := make(map[string]diffVersion)
+	lv := make(map[string]diffVersion)
 	// Load versions
-	logrus.Info("PullGrafanaAndCommit: Getting dashboard versions from disc/repo")
+	logrus.WithFields(logrus.Fields{
+		"branch": branchName(cfg),
+	}).Info("PullGrafanaAndCommit: Getting dashboard versions from disc/repo")
 	fileDefs, oldSlugs, err := GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
 	if err != nil {
 		return err
 	}
 
+	// Don't remove every file because of a Grafana instance answering with
+	// no dashboards.
+	if len(allDefs.DashboardMetaBySlug) == 0 && len(fileDefs.DashboardMetaBySlug) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"branch":     branchName(cfg),
+			"dashboards": len(fileDefs.DashboardMetaBySlug),
+		}).Error("Grafana returned no dashboards while the repository has some")
+		return ErrNoDashboards
+	}
+
+	// The files of the dashboards are found by UID, so a dashboard which
+	// file name changed, e.g. because its title or the filename template
+	// did, has its file renamed rather than duplicated.
+	fileSlugByUID := make(map[string]string)
+	for slug, meta := range fileDefs.DashboardMetaBySlug {
+		fileSlugByUID[meta.UID] = slug
+	}
+	apiSlugByUID := make(map[string]string)
+	for slug, meta := range APIDefs.DashboardMetaBySlug {
+		apiSlugByUID[meta.UID] = slug
+	}
+
+	// Commit the versions between the ones of the files and the ones
+	// retrieved first, if asked to.
+	if cfg.Git != nil && cfg.Git.VersionHistory != nil && !cfg.Git.DontCommit && !result.dryRun {
+		if err = importVersionHistory(ctx, client, cfg, w, changes, fileDefs, APIDefs, fileSlugByUID); err != nil {
+			return err
+		}
+	}
+
 	// Iterate over the dashboards URIs from the grafana instance
-	for slug, dashboard := range APIDefs.DashboardBySlug {
+	APIDefs.OverComplexityLimits = make(map[string][]string)
+	for _, slug := range utils.SortedKeys(APIDefs.DashboardBySlug) {
+		dashboard := APIDefs.DashboardBySlug[slug]
+		if exceeded := checkComplexity(cfg, slug, dashboard); len(exceeded) > 0 {
+			APIDefs.OverComplexityLimits[dashboard.UID] = exceeded
+			if cfg.Grafana.ComplexityLimits.Report {
+				result.complexity[slug] = exceeded
+			}
+		}
 		// Check if there's a version for this dashboard in the data loaded from
 		// the "versions.json" file. If there's a version and it's older (lower
 		// version number) than the version we just retrieved from the Grafana
 		// API, or if there's no known version (ok will be false), write the
 		// changes in the repo and add the modified file to the git index.
+		folderUID := APIDefs.DashboardMetaBySlug[slug].FolderUID
 		fileVersion, ok := fileDefs.DashboardVersionByUID[dashboard.UID]
+
+		// Move the files which aren't where the layout puts them, e.g.
+		// because the dashboard moved to another folder, or which aren't
+		// named like they should anymore.
+		fileSlug, known := fileSlugByUID[dashboard.UID]
+		if !known {
+			fileSlug = slug
+		}
+		currentDir, moved := changes.dashboardDirs[fileSlug]
+		moved = moved && (fileSlug != slug || currentDir != changes.dashboardDir(folderUID))
+		if moved {
+			logrus.WithFields(logrus.Fields{
+				"slug":      slug,
+				"from":      filepath.Join(currentDir, fileSlug+".json"),
+				"to":        filepath.Join(changes.dashboardDir(folderUID), slug+".json"),
+				"uid":       dashboard.UID,
+				"file_slug": fileSlug,
+			}).Info("Moving the dashboard's files")
+			if err = removeDashboardFromFilesystem(fileSlug, changes); err != nil {
+				return err
+			}
+		}
+
 		if !ok || dashboard.Version > fileVersion {
 			logrus.WithFields(logrus.Fields{
 				"slug":         slug,
@@ -182,9 +721,12 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 				"uid":          dashboard.UID,
 			}).Info("Grafana has a newer dashboard version than previously, updating")
 
-			if err = addDashboardChangesToRepo(
-				dashboard, syncPath, w, APIDefs.DashboardMetaBySlug[slug].FolderUID,
-			); err != nil {
+			item := results.NewItem(results.KindDashboard, results.ActionPull, dashboard.UID, slug)
+			item.Details = fmt.Sprintf("%d => %d", fileVersion, dashboard.Version)
+			item.OldVersion, item.NewVersion = fileVersion, dashboard.Version
+			err = addDashboardChangesToRepo(slug, dashboard, changes, folderUID)
+			result.run.Add(item.Finish(err))
+			if err != nil {
 				return err
 			}
 
@@ -196,22 +738,51 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 				old: fileVersion,
 				new: APIDefs.DashboardBySlug[slug].Version,
 			}
+		} else if moved {
+			if err = addDashboardChangesToRepo(slug, dashboard, changes, folderUID); err != nil {
+				return err
+			}
+		}
+
+		// Permissions don't change the dashboard's version, so they're
+		// compared with their file instead.
+		if perms, ok := APIDefs.DashboardPermissionsByUID[dashboard.UID]; ok {
+			if err = addDashboardPermissionsChangesToRepo(slug, folderUID, perms, changes); err != nil {
+				return err
+			}
 		}
 	}
 
 	// remove any dashboards that have gone
-	for slug, dashboard := range fileDefs.DashboardMetaBySlug {
+	for _, slug := range utils.SortedKeys(fileDefs.DashboardMetaBySlug) {
+		dashboard := fileDefs.DashboardMetaBySlug[slug]
 		logrus.WithFields(logrus.Fields{
 			"slug": slug,
 			"name": dashboard.Title,
 			"got":  APIDefs.DashboardMetaBySlug[slug],
 		}).Debug("dashboard on filesystem")
 		if _, ok := APIDefs.DashboardMetaBySlug[slug]; !ok {
-			logrus.WithFields(logrus.Fields{
-				"slug": slug,
-				"name": dashboard.Title,
-			}).Info("Removing dashboard from filesystem")
-			removeDashboardFromFilesystem(slug, w)
+			// Renamed dashboards were moved above, or are left as they
+			// are if they're ignored.
+			if _, renamed := apiSlugByUID[dashboard.UID]; renamed {
+				continue
+			}
+			if moved, ok := allDefs.DashboardMetaBySlug[slug]; ok {
+				logrus.WithFields(logrus.Fields{
+					"slug":        slug,
+					"name":        dashboard.Title,
+					"from_branch": branchName(cfg),
+					"to_branch":   displayBranch(branchForFolder(cfg, allDefs, moved.FolderUID)),
+				}).Info("Dashboard moved to a folder mapped to another branch, removing it from this branch")
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"slug": slug,
+					"name": dashboard.Title,
+				}).Info("Removing dashboard from filesystem")
+			}
+			removeDashboardFromFilesystem(slug, changes)
+			result.removed++
+			result.run.Add(results.NewItem(results.KindDashboard, results.ActionRemove, dashboard.UID, slug).Finish(nil))
 		}
 	}
 	for _, slug := range oldSlugs {
@@ -223,13 +794,13 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 			logrus.WithFields(logrus.Fields{
 				"slug": slug,
 			}).Info("Removing old dashboard from filesystem")
-			removeDashboardFromFilesystem(slug, w)
+			removeDashboardFromFilesystem(slug, changes)
 		}
 	}
 
-	lv := make(map[string]diffVersion)
 	// Iterate over the library-elements
-	for uid, library := range APIDefs.LibraryByUID {
+	for _, uid := range utils.SortedKeys(APIDefs.LibraryByUID) {
+		library := APIDefs.LibraryByUID[uid]
 		// Check if there's a version for this library in the data loaded from
 		// the "versions.json" file. If there's a version, and it's older (lower
 		// version number) than the version we just retrieved from the Grafana
@@ -243,8 +814,13 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 				"new_version":  library.Version,
 				"uid":          uid,
 			}).Info("Grafana has a newer library-element version than previously, updating")
-			if err = addLibraryChangesToRepo(
-				library, syncPath, w, APIDefs.LibraryMetaByUID[uid].Meta.FolderUid); err != nil {
+			item := results.NewItem(results.KindLibrary, results.ActionPull, uid, library.Slug)
+			item.Details = fmt.Sprintf("%d => %d", fileVersion, library.Version)
+			item.OldVersion, item.NewVersion = fileVersion, library.Version
+			err = addLibraryChangesToRepo(
+				library, changes, APIDefs.LibraryMetaByUID[uid].Meta.FolderUid)
+			result.run.Add(item.Finish(err))
+			if err != nil {
 				return err
 			}
 
@@ -260,28 +836,88 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 	}
 
 	// remove any libraries that have gone
-	for uid, lib := range fileDefs.LibraryByUID {
+	for _, uid := range utils.SortedKeys(fileDefs.LibraryByUID) {
+		lib := fileDefs.LibraryByUID[uid]
 		logrus.WithFields(logrus.Fields{
 			"uid":  uid,
 			"name": lib.Name,
 			"got":  APIDefs.LibraryByUID[uid],
 		}).Debug("dashboard on filesystem")
 		if _, ok := APIDefs.LibraryByUID[uid]; !ok {
-			logrus.WithFields(logrus.Fields{
-				"uid":  uid,
-				"name": lib.Name,
-			}).Info("Removing dashboard from filesystem")
-			removeLibraryFromFilesystem(lib.Slug, w)
+			// Ignored libraries are left as they are.
+			if _, ignored := APIDefs.LibraryMetaByUID[uid]; ignored {
+				continue
+			}
+			if moved, ok := allDefs.LibraryMetaByUID[uid]; ok {
+				logrus.WithFields(logrus.Fields{
+					"uid":         uid,
+					"name":        lib.Name,
+					"from_branch": branchName(cfg),
+					"to_branch":   displayBranch(branchForFolder(cfg, allDefs, moved.Meta.FolderUid)),
+				}).Info("Library moved to a folder mapped to another branch, removing it from this branch")
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"uid":  uid,
+					"name": lib.Name,
+				}).Info("Removing dashboard from filesystem")
+			}
+			removeLibraryFromFilesystem(lib.Slug, changes)
+			result.removed++
+			result.run.Add(results.NewItem(results.KindLibrary, results.ActionRemove, uid, lib.Slug).Finish(nil))
+		}
+	}
+
+	if cfg.Grafana.SyncDatasources {
+		if err = pullDatasources(cfg, APIDefs, fileDefs, changes, result); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Grafana.SyncAlertRules {
+		if err = pullAlertRules(cfg, allDefs, APIDefs, fileDefs, changes, result); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Grafana.SyncNotifications {
+		if err = pullNotifications(cfg, APIDefs, changes, result); err != nil {
+			return err
 		}
 	}
 
 	// Iterate over the folders
-	for _, folderResponse := range APIDefs.FoldersMetaByUID {
-		if err = addFolderChangesToRepo(folderResponse, syncPath, w); err != nil {
+	for _, id := range utils.SortedKeys(APIDefs.FoldersMetaByUID) {
+		folderResponse := APIDefs.FoldersMetaByUID[id]
+		if err = addFolderChangesToRepo(folderResponse, changes); err != nil {
+			return err
+		}
+		if perms, ok := APIDefs.FolderPermissionsByUID[id]; ok {
+			if err = addFolderPermissionsChangesToRepo(folderResponse, perms, changes); err != nil {
+				return err
+			}
+		}
+	}
+	if err = removeRenamedFolderFiles(APIDefs.FoldersMetaByUID, changes); err != nil {
+		return err
+	}
+	if cfg.Git != nil && cfg.Git.Provisioning != nil {
+		if err = addProvisioningChangesToRepo(cfg, APIDefs, changes); err != nil {
+			return err
+		}
+	}
+	if APIDefs.Teams != nil {
+		if err = addTeamsChangesToRepo(APIDefs.Teams, changes); err != nil {
 			return err
 		}
 	}
 
+	for slug, diff := range dv {
+		result.dv[slug] = diff
+	}
+	for uid, diff := range lv {
+		result.lv[uid] = diff
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"APIDefs": APIDefs,
 	}).Debug("GrafanaVersionsFile")
@@ -290,13 +926,30 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 		"fileDefs": fileDefs,
 	}).Debug("FileVersionsFile")
 
+	// On a dry run, only record what would be written and committed.
+	if result.dryRun {
+		if err = changes.writeVersions(APIDefs, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions()); err != nil {
+			return err
+		}
+		plan := BranchPlan{
+			Branch:   branchName(cfg),
+			Changes:  changes.changes,
+			Versions: versionChanges(dv, lv),
+		}
+		if len(plan.Changes) > 0 && cfg.Git != nil && !cfg.Git.DontCommit {
+			plan.CommitMessage = getCommitMessage(dv)
+		}
+		result.plans = append(result.plans, plan)
+		return nil
+	}
+
 	// Only do Git stuff if there's a configuration for that. On "simple sync"
 	// mode, we don't need to do any versioning.
 	if cfg.Git != nil {
 		// inefficiently, we write the versions here just in case the versions are different but no dashboards are.
 		// then the file will be rewritten inside commitNewVersions
 
-		if err = writeVersions(APIDefs, dv, cfg.Git.ClonePath, cfg.Git.VersionsFilePrefix); err != nil {
+		if err = writeVersions(APIDefs, dv, cfg.Git.ClonePath, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions(), jsonStyle(cfg.Git)); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"err": err,
 			}).Info("Marshall error for versions file")
@@ -312,9 +965,16 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 		// them.
 		if !cfg.Git.DontCommit {
 			if !status.IsClean() {
-				logrus.Info("Committing changes")
+				logrus.WithFields(logrus.Fields{
+					"branch": branchName(cfg),
+				}).Info("Committing changes")
 
-				if err = commitNewVersions(APIDefs, dv, w, cfg); err != nil {
+				if cfg.Git.CommitPerDashboard {
+					err = commitSeparately(repo, w, cfg, changes, fileDefs, APIDefs, dv, lv)
+				} else {
+					err = commitNewVersions(APIDefs, dv, w, cfg)
+				}
+				if err != nil {
 					return err
 				}
 			}
@@ -322,10 +982,20 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 			logrus.Info("Skipping git commit - asked not to")
 		}
 
-		if !cfg.Git.DontPush && !cfg.Git.DontCommit {
+		if !cfg.Git.DontPush && !cfg.Git.DontCommit && base != nil {
+			// Open a merge request with the changes instead of pushing them
+			// to a protected branch.
+			if err = proposeChanges(cfg, repo, base); err != nil {
+				pullMetrics.PushFailed()
+				logrus.WithFields(logrus.Fields{
+					"err": err}).Info("Failed to open a merge request")
+				return err
+			}
+		} else if !cfg.Git.DontPush && !cfg.Git.DontCommit {
 			// Push the changes (we don't do it in the if clause above in case there
 			// are pending commits in the local repo that haven't been pushed yet).
 			if err = repo.Push(); err != nil {
+				pullMetrics.PushFailed()
 				logrus.WithFields(logrus.Fields{
 					"err": err}).Info("Failed to push")
 				return err
@@ -336,7 +1006,7 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 	} else {
 		// If we're on simple sync mode, write versions and don't do anything
 		// else.
-		if err = writeVersions(APIDefs, dv, syncPath, cfg.Git.VersionsFilePrefix); err != nil {
+		if err = writeVersions(APIDefs, dv, syncPath, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions(), jsonStyle(cfg.Git)); err != nil {
 			return err
 		}
 	}
@@ -344,165 +1014,400 @@ func PullGrafanaAndCommit(client *grafana.Client, cfg *config.Config) (err error
 	return nil
 }
 
-func addFolderChangesToRepo(
-	folderResponse grafana.DbSearchResponse, clonePath string, worktree *gogit.Worktree,
-) (err error) {
-	folder := grafana.Folder{
-		Title:     folderResponse.Title,
-		UID:       folderResponse.UID,
-		FolderUID: folderResponse.FolderUID,
-		URI:       folderResponse.URI,
-		Starred:   folderResponse.Starred,
-		Tags:      folderResponse.Tags,
+// branchForFolder returns the branch the content of the folder with the given
+// UID is committed to, looking the folder then its ancestors, nearest first, up
+// in the folder to branch mapping by UID then by title, so a mapped folder
+// takes its whole subtree along. Returns an empty string for the default
+// branch.
+func branchForFolder(cfg *config.Config, defs grafana.DefsFile, folderUID string) string {
+	if cfg.Git == nil || folderUID == "" {
+		return ""
 	}
 
-	slugExt := folder.Title + ".json"
-	dirPath := filepath.Join(clonePath, "folders")
-	os.MkdirAll(dirPath, os.ModePerm)
-	rawJSON, err := json.Marshal(folder)
-	if err != nil {
+	if branch, ok := cfg.Git.FolderBranchMap[folderUID]; ok {
+		return branch
+	}
+
+	for _, ref := range defs.FolderLineage(folderUID) {
+		if branch, ok := cfg.Git.FolderBranchMap[ref.UID]; ok {
+			return branch
+		}
+		if branch, ok := cfg.Git.FolderBranchMap[ref.Title]; ok {
+			return branch
+		}
+	}
+
+	return ""
+}
+
+// filterDefsForBranch returns a copy of the given definitions only containing
+// the dashboards, libraries and folders committed to the given branch (an
+// empty string meaning the default branch).
+func filterDefsForBranch(cfg *config.Config, defs grafana.DefsFile, branch string) (filtered grafana.DefsFile) {
+	filtered = grafana.DefsFile{
+		DashboardMetaBySlug:   make(map[string]grafana.DbSearchResponse),
+		DashboardBySlug:       make(map[string]*grafana.Dashboard),
+		LibraryMetaByUID:      make(map[string]grafana.LibraryElementResponse),
+		LibraryByUID:          make(map[string]*grafana.Library),
+		FoldersMetaByUID:      make(map[string]grafana.DbSearchResponse),
+		DashboardVersionByUID: make(map[string]int),
+		LibraryVersionByUID:   make(map[string]int),
+
+		// Only the permissions of the folders and dashboards below are
+		// written.
+		FolderPermissionsByUID:    defs.FolderPermissionsByUID,
+		DashboardPermissionsByUID: defs.DashboardPermissionsByUID,
+		Teams:                     defs.Teams,
+
+		UnmanagedPluginDashboards: defs.UnmanagedPluginDashboards,
+	}
+
+	for slug, meta := range defs.DashboardMetaBySlug {
+		if branchForFolder(cfg, defs, meta.FolderUID) != branch {
+			continue
+		}
+		filtered.DashboardMetaBySlug[slug] = meta
+		if dashboard, ok := defs.DashboardBySlug[slug]; ok {
+			filtered.DashboardBySlug[slug] = dashboard
+			filtered.DashboardVersionByUID[dashboard.UID] = dashboard.Version
+		}
+	}
+
+	for uid, meta := range defs.LibraryMetaByUID {
+		if branchForFolder(cfg, defs, meta.Meta.FolderUid) != branch {
+			continue
+		}
+		filtered.LibraryMetaByUID[uid] = meta
+		if library, ok := defs.LibraryByUID[uid]; ok {
+			filtered.LibraryByUID[uid] = library
+			filtered.LibraryVersionByUID[uid] = library.Version
+		}
+	}
+
+	// Datasources and notification settings don't belong to folders, so
+	// they stay on the default branch.
+	if branch == "" {
+		filtered.DatasourceByUID = defs.DatasourceByUID
+		filtered.DatasourceVersionByUID = defs.DatasourceVersionByUID
+		filtered.ContactPointByUID = defs.ContactPointByUID
+		filtered.MuteTimingByName = defs.MuteTimingByName
+		filtered.NotificationPolicies = defs.NotificationPolicies
+	}
+
+	if defs.AlertRuleByUID != nil {
+		filtered.AlertRuleByUID = make(map[string]*grafana.AlertRule)
+		filtered.AlertRuleVersionByUID = make(map[string]int64)
+		for uid, rule := range defs.AlertRuleByUID {
+			if branchForFolder(cfg, defs, rule.FolderUID) != branch {
+				continue
+			}
+			filtered.AlertRuleByUID[uid] = rule
+			filtered.AlertRuleVersionByUID[uid] = rule.Version
+		}
+	}
+
+	for id, folder := range defs.FoldersMetaByUID {
+		if branchForFolder(cfg, defs, folder.UID) == branch {
+			filtered.FoldersMetaByUID[id] = folder
+		}
+	}
+
+	return
+}
+
+// branchName returns the name of the branch tracked by the clone described by
+// the configuration, for logging purposes.
+func branchName(cfg *config.Config) string {
+	if cfg.Git == nil {
+		return displayBranch("")
+	}
+	return displayBranch(cfg.Git.Branch)
+}
+
+// displayBranch returns the given branch name, or "default" for the default
+// branch.
+func displayBranch(branch string) string {
+	if branch == "" {
+		return "default"
+	}
+	return branch
+}
+
+// checkComplexity checks the given dashboard against the complexity limits
+// from the configuration, if any, and logs a warning if it's over some of
+// them. Returns the description of the limits it exceeds.
+func checkComplexity(cfg *config.Config, slug string, dashboard *grafana.Dashboard) (exceeded []string) {
+	if cfg.Grafana.ComplexityLimits == nil {
 		return
 	}
 
-	if err = rewriteFile(filepath.Join(dirPath, slugExt), rawJSON); err != nil {
+	cx, err := grafana.MeasureComplexity(dashboard.RawJSON)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"slug":  slug,
+		}).Warn("Failed to measure the dashboard's complexity")
 		return
 	}
 
-	// If worktree is nil, it means that it hasn't been initialised, which means
-	// the sync mode is "simple sync" and not Git.
-	if worktree != nil {
-		if _, err = worktree.Add(filepath.Join("folders", slugExt)); err != nil {
-			return err
+	exceeded = cx.Exceeded(cfg.Grafana.ComplexityLimits)
+	if len(exceeded) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"slug":     slug,
+			"uid":      dashboard.UID,
+			"exceeded": exceeded,
+		}).Warn("Dashboard is over the complexity limits")
+	}
+	return
+}
+
+// selfDashboardSummary renders the markdown summary of a pull displayed in the
+// status dashboard's pull panel.
+func selfDashboardSummary(result *pullResult, err error) string {
+	hostname, _ := os.Hostname()
+
+	summary := fmt.Sprintf("**Last pull:** %s on %s\n\n", time.Now().UTC().Format(time.RFC3339), hostname)
+	summary += "| | Count |\n|---|---|\n"
+	summary += fmt.Sprintf("| Dashboards updated | %d |\n", len(result.dv))
+	summary += fmt.Sprintf("| Libraries updated | %d |\n", len(result.lv))
+	summary += fmt.Sprintf("| Files removed | %d |\n", result.removed)
+
+	if len(result.complexity) > 0 {
+		summary += "\n**Over the complexity limits:**\n\n"
+		for _, slug := range utils.SortedKeys(result.complexity) {
+			summary += fmt.Sprintf("* %s: %s\n", slug, strings.Join(result.complexity[slug], ", "))
 		}
 	}
 
-	return
+	if err != nil {
+		summary += fmt.Sprintf("\n**Error:** `%v`\n", err)
+	}
+
+	return summary
+}
+
+// addFolderChangesToRepo plans writing a folder's description in a file named
+// after the folder's title, followed by its UID if another folder has the same
+// title.
+// Returns an error if the description couldn't be written.
+func addFolderChangesToRepo(folderResponse grafana.DbSearchResponse, changes *changeSet) (err error) {
+	folder := format.FolderFile{
+		Title:     folderResponse.Title,
+		UID:       folderResponse.UID,
+		FolderUID: folderResponse.FolderUID,
+		URI:       folderResponse.URI,
+		Starred:   folderResponse.Starred,
+		Tags:      folderResponse.Tags,
+	}
+
+	return changes.writeJSON(changes.filePath("folders", changes.folderFileName(folderResponse)+".json"), folder)
+}
+
+// addFolderPermissionsChangesToRepo plans writing a folder's permissions in a
+// file next to the folder's description.
+// Returns an error if there was an issue writing the file.
+func addFolderPermissionsChangesToRepo(
+	folderResponse grafana.DbSearchResponse, perms *format.FolderPermissions, changes *changeSet,
+) (err error) {
+	return changes.writeJSON(changes.filePath("folders", changes.folderFileName(folderResponse)+format.PermissionsFileSuffix), perms)
 }
 
-// addDashboardChangesToRepo writes a dashboard content in a file, then adds the
-// file to the git index, so it can be committed afterwards.
+// addTeamsChangesToRepo plans writing the description of the teams at the
+// root of the organisation's files.
+// Returns an error if there was an issue writing the file.
+func addTeamsChangesToRepo(teams format.TeamsFile, changes *changeSet) (err error) {
+	return changes.writeJSON(changes.filePath("", format.TeamsFileName), teams)
+}
+
+// addDashboardChangesToRepo plans writing a dashboard content in a file named
+// after the given slug, in the directory the layout puts the dashboards of the
+// given folder in, which is then added to the git index, so it can be
+// committed afterwards.
 // Returns an error if there was an issue with either of the steps.
 func addDashboardChangesToRepo(
-	dashboard *grafana.Dashboard, clonePath string, worktree *gogit.Worktree, folderUID string) error {
-	slug := grafana.GetSluglikeName(dashboard.UID, dashboard.Name)
-	slugExt := slug + ".json"
-	// we take out the versions here, as versions are generated by grafana and
-	// therefore can't be sanely sync'd across multiple grafana instances
-	var jsRaw interface{}
-	if err := json.Unmarshal([]byte(dashboard.RawJSON), &jsRaw); err != nil {
-		return err
-	}
-	// the following keys are unique only to an individual grafana instance
-	dyno.Delete(jsRaw, "version")
-	dyno.Delete(jsRaw, "id")
-	dyno.Set(jsRaw, folderUID, "__folderUID")
-	rawJSON, err := json.Marshal(jsRaw)
+	slug string, dashboard *grafana.Dashboard, changes *changeSet, folderUID string) error {
+	file, err := dashboardFile(dashboard, folderUID, changes.datasourceAliases)
 	if err != nil {
 		return err
 	}
 
-	dirPath := filepath.Join(clonePath, "dashboards")
-	os.MkdirAll(dirPath, os.ModePerm)
+	return changes.writeJSON(filepath.Join(changes.dashboardDir(folderUID), slug+".json"), file)
+}
 
-	if err := rewriteFile(filepath.Join(dirPath, slugExt), rawJSON); err != nil {
-		return err
+// dashboardFile applies to a dashboard retrieved from the Grafana API, in the
+// folder with the given UID, the normalisation a pull applies before writing
+// it, including replacing the given datasource aliases, and returns the
+// resulting file. The versions and IDs are left out, as they're generated by
+// grafana and therefore can't be sanely sync'd across multiple grafana
+// instances.
+// Returns an error if the dashboard's JSON description couldn't be parsed.
+func dashboardFile(dashboard *grafana.Dashboard, folderUID string, aliases map[string]string) (*format.DashboardFile, error) {
+	content, err := grafana.AliasDatasources(grafana.NormalizeDashboardJSON(dashboard.RawJSON), aliases)
+	if err != nil {
+		return nil, err
 	}
+	return format.NewDashboardFile(content, folderUID)
+}
 
-	// If worktree is nil, it means that it hasn't been initialised, which means
-	// the sync mode is "simple sync" and not Git.
-	if worktree != nil {
-		if _, err := worktree.Add(filepath.Join("dashboards", slugExt)); err != nil {
-			return err
-		}
+// DashboardFileContent returns the content of the file a pull writes for the
+// given dashboard, as retrieved from the Grafana API, in the folder with the
+// given UID, with the given datasource aliases and the JSON style of the given
+// Git settings. It doesn't need nor change the repository.
+// Returns an error if the dashboard's JSON description couldn't be parsed.
+func DashboardFileContent(
+	dashboard *grafana.Dashboard, folderUID string, aliases map[string]string, git *config.GitSettings,
+) (content []byte, err error) {
+	file, err := dashboardFile(dashboard, folderUID, aliases)
+	if err != nil {
+		return
 	}
 
-	return nil
+	rawJSON, err := json.Marshal(file)
+	if err != nil {
+		return
+	}
+	return indent(rawJSON, jsonStyle(git))
 }
 
-func removeDashboardFromFilesystem(slug string, worktree *gogit.Worktree) (err error) {
-	_, err = worktree.Remove(filepath.Join("dashboards", slug+".json"))
-	return
+// addDashboardPermissionsChangesToRepo plans writing a dashboard's permissions
+// in a file next to the dashboard's.
+// Returns an error if there was an issue writing the file.
+func addDashboardPermissionsChangesToRepo(slug string, folderUID string, perms *format.DashboardPermissions, changes *changeSet) (err error) {
+	return changes.writeJSON(filepath.Join(changes.dashboardDir(folderUID), slug+format.PermissionsFileSuffix), perms)
+}
+
+// removeDashboardFromFilesystem plans removing a dashboard's file, from the
+// directory it was found in, along with the file of its permissions if
+// there's one.
+func removeDashboardFromFilesystem(slug string, changes *changeSet) (err error) {
+	dir := changes.currentDashboardDir(slug)
+	if err = changes.remove(filepath.Join(dir, slug+format.PermissionsFileSuffix)); err != nil {
+		return
+	}
+	return changes.remove(filepath.Join(dir, slug+".json"))
 }
 
-// addLibraryChangesToRepo writes a library element content in a file, then adds the
-// file to the git index, so it can be committed afterwards.
+// addLibraryChangesToRepo plans writing a library element content in a file,
+// which is then added to the git index, so it can be committed afterwards.
 // Returns an error if there was an issue with either of the steps.
 func addLibraryChangesToRepo(
-	library *grafana.Library, clonePath string, worktree *gogit.Worktree, folderUID string) error {
-	slugExt := library.Slug + ".json"
+	library *grafana.Library, changes *changeSet, folderUID string) error {
 	// we take out the versions here, as versions are generated by grafana and
-	// therefore can't be sanely sync'd across multiple grafana instances
-	var jsRaw interface{}
-	if err := json.Unmarshal([]byte(library.RawJSON), &jsRaw); err != nil {
+	// therefore can't be sanely sync'd across multiple grafana instances.
+	// grafana 8.5 doesn't accept folderUID, needs folderID, folderIDs are only
+	// unique per grafana instance, so the folder's UID is kept instead.
+	content, err := grafana.AliasDatasources(library.RawJSON, changes.datasourceAliases)
+	if err != nil {
 		return err
 	}
-	// the following keys are unique only to an individual grafana instance
-	dyno.Delete(jsRaw, "version")
-	dyno.Delete(jsRaw, "id")
-	// grafana 8.5 doesn't accept folderUID, needs folderID, folderIDs are only unique per grafana instance
-	dyno.Set(jsRaw, folderUID, "__folderUID")
-	rawJSON, err := json.Marshal(jsRaw)
+	file, err := format.NewLibraryFile(content, folderUID)
 	if err != nil {
 		return err
 	}
 
-	dirPath := filepath.Join(clonePath, "libraries")
-	os.MkdirAll(dirPath, os.ModePerm)
+	return changes.writeJSON(changes.filePath("libraries", library.Slug+".json"), file)
+}
+
+func removeLibraryFromFilesystem(slug string, changes *changeSet) (err error) {
+	return changes.remove(changes.filePath("libraries", slug+".json"))
+}
 
-	if err := rewriteFile(filepath.Join(dirPath, slugExt), rawJSON); err != nil {
+// addDatasourceChangesToRepo plans writing a datasource's description in a
+// file named after its UID, with the names of its secret fields but not
+// their values.
+// Returns an error if the description couldn't be written.
+func addDatasourceChangesToRepo(ds *grafana.Datasource, changes *changeSet) error {
+	var jsRaw interface{}
+	if err := json.Unmarshal(ds.RawJSON, &jsRaw); err != nil {
 		return err
 	}
+	if len(ds.SecureFields) > 0 {
+		dyno.Set(jsRaw, ds.SecureFields, grafana.DatasourceSecureFieldsKey)
+	}
 
-	// If worktree is nil, it means that it hasn't been initialised, which means
-	// the sync mode is "simple sync" and not Git.
-	if worktree != nil {
-		if _, err := worktree.Add(filepath.Join("libraries", slugExt)); err != nil {
-			return err
-		}
+	return changes.writeJSON(changes.filePath("datasources", ds.UID+".json"), jsRaw)
+}
+
+func removeDatasourceFromFilesystem(uid string, changes *changeSet) (err error) {
+	return changes.remove(changes.filePath("datasources", uid+".json"))
+}
+
+// addAlertRuleChangesToRepo plans writing an alert rule's description in a
+// file named after its UID.
+// Returns an error if the description couldn't be written.
+func addAlertRuleChangesToRepo(rule *grafana.AlertRule, changes *changeSet) error {
+	var jsRaw interface{}
+	if err := json.Unmarshal(rule.RawJSON, &jsRaw); err != nil {
+		return err
 	}
 
-	return nil
+	return changes.writeJSON(changes.filePath("alerts", rule.UID+".json"), jsRaw)
 }
 
-func removeLibraryFromFilesystem(slug string, worktree *gogit.Worktree) (err error) {
-	_, err = worktree.Remove(filepath.Join("libraries", slug+".json"))
-	return
+func removeAlertRuleFromFilesystem(uid string, changes *changeSet) (err error) {
+	return changes.remove(changes.filePath("alerts", uid+".json"))
 }
 
-// rewriteFile removes a given file and re-creates it with a new content. The
-// content is provided as JSON, and is then indented before being written down.
-// We need the whole "remove then recreate" thing because, if the file already
-// exists, ioutil.WriteFile will append the content to it. However, we want to
-// replace the oldest version with another (so git can diff it), so we re-create
-// the file with the changed content.
-// Returns an error if there was an issue when removing or writing the file, or
-// indenting the JSON content.
-func rewriteFile(filename string, content []byte) error {
-	if err := os.Remove(filename); err != nil {
-		pe, ok := err.(*os.PathError)
-		if !ok || pe.Err.Error() != "no such file or directory" {
-			return err
-		}
+// rewriteFile replaces a given file with a new content, or creates it. The
+// content is provided as JSON, and is then indented in the given style before
+// being written down with replaceFile.
+// Returns an error if there was an issue when indenting the JSON content, or
+// writing the file.
+func rewriteFile(filename string, content []byte, style format.Style) (err error) {
+	indentedContent, err := indent(content, style)
+	if err != nil {
+		return
 	}
+	return replaceFile(filename, indentedContent)
+}
 
-	indentedContent, err := indent(content)
+// replaceFile replaces a given file with a new content, or creates it. The
+// content is written to a temporary file in the same directory first, then
+// renamed over the file, so a crash or a full disk while writing never leaves
+// the file missing or truncated, which the next run would take for a removed
+// dashboard.
+// Returns an error if there was an issue when writing or renaming the file.
+// The temporary file is removed in this case.
+func replaceFile(filename string, content []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
 	if err != nil {
-		return err
+		return
 	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
 
-	return os.WriteFile(filename, indentedContent, 0644)
+	if _, err = tmp.Write(content); err != nil {
+		return
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
-// indent indents a given JSON content with tabs.
+// indent writes a given JSON content in its canonical form, indented as the
+// given style sets and with sorted keys (see format.Canonical).
 // We need to indent the content as the Grafana API returns a one-lined JSON
-// string, which isn't great to work with.
+// string, which isn't great to work with, and to sort the keys so the files
+// only change when their content does.
 // Returns an error if there was an issue with the process.
-func indent(srcJSON []byte) (indentedJSON []byte, err error) {
-	buf := bytes.NewBuffer(nil)
-	if err = json.Indent(buf, srcJSON, "", "\t"); err != nil {
-		return
-	}
+func indent(srcJSON []byte, style format.Style) (indentedJSON []byte, err error) {
+	return style.Canonical(srcJSON)
+}
 
-	indentedJSON, err = io.ReadAll(buf)
-	return
+// jsonStyle returns the style the JSON files are written in with the given
+// Git settings: indented with tabs, without a final newline, unless set
+// otherwise.
+func jsonStyle(g *config.GitSettings) format.Style {
+	if g == nil {
+		return format.Style{}
+	}
+	return format.Style{Indent: g.JSONIndent, FinalNewline: g.FinalNewline}
 }
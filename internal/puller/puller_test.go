@@ -0,0 +1,255 @@
+package puller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+)
+
+// fakeGrafana fakes the search and dashboards API of a Grafana instance
+// holding the given dashboards, and records the dashboards requested. The
+// search gives the time of the latest update of the dashboards, which changes
+// with their version.
+type fakeGrafana struct {
+	lock       sync.Mutex
+	dashboards []map[string]interface{}
+	versions   map[string]int
+	requested  map[string]int
+	// raw is the JSON returned for the dashboards with the given UIDs, as
+	// is, instead of their encoding, which sorts their keys.
+	raw map[string]string
+}
+
+func newFakeGrafana(dashboards ...map[string]interface{}) *fakeGrafana {
+	f := &fakeGrafana{versions: make(map[string]int), requested: make(map[string]int), raw: make(map[string]string)}
+	for _, dashboard := range dashboards {
+		f.dashboards = append(f.dashboards, dashboard)
+		f.versions[dashboard["uid"].(string)] = 1
+	}
+	return f
+}
+
+// setRaw sets the JSON returned for the dashboard with the given UID, as is,
+// and bumps its version.
+func (f *fakeGrafana) setRaw(uid string, raw string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.raw[uid] = raw
+	f.versions[uid]++
+}
+
+// setDashboards replaces the dashboards of the fake instance, bumping the
+// version of the ones which already existed.
+func (f *fakeGrafana) setDashboards(dashboards ...map[string]interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.dashboards = dashboards
+	for _, dashboard := range dashboards {
+		f.versions[dashboard["uid"].(string)]++
+	}
+}
+
+func (f *fakeGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/health":
+		w.Write([]byte(`{"database":"ok","version":"10.0.0"}`))
+
+	case strings.HasPrefix(r.URL.Path, "/api/library-elements"):
+		w.Write([]byte(`{"result":{"totalCount":0,"elements":[],"page":1,"perPage":100}}`))
+
+	case r.URL.Path == "/api/search":
+		hits := make([]map[string]interface{}, 0)
+		if r.URL.Query().Get("page") == "1" {
+			for _, dashboard := range f.dashboards {
+				updated := time.Date(2024, 1, 1, 0, 0, f.versions[dashboard["uid"].(string)], 0, time.UTC)
+				hits = append(hits, map[string]interface{}{
+					"uid":     dashboard["uid"],
+					"title":   dashboard["title"],
+					"type":    "dash-db",
+					"updated": updated.Format(time.RFC3339),
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(hits)
+
+	case strings.HasPrefix(r.URL.Path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(r.URL.Path, "/api/dashboards/uid/")
+		f.requested[uid]++
+		for _, dashboard := range f.dashboards {
+			if dashboard["uid"] == uid {
+				var encoded interface{} = dashboard
+				if raw, ok := f.raw[uid]; ok {
+					encoded = json.RawMessage(raw)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"dashboard": encoded,
+					"meta":      map[string]interface{}{"version": f.versions[uid]},
+				})
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestClient returns a client of the Grafana instance the given handler
+// fakes, stopped at the end of the test.
+func newTestClient(t *testing.T, handler http.Handler) *grafana.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := grafana.NewClient(server.URL, grafana.StaticToken("test"), "", "", 0, false)
+	client.DashboardsAPI = grafana.DashboardsAPILegacy
+	client.RetryAttempts = 1
+	return client
+}
+
+func TestGetDashboardDefinitionsSkipsSelfDashboard(t *testing.T) {
+	fake := newFakeGrafana(
+		map[string]interface{}{"uid": grafana.SelfDashboardUID, "title": "Dashboards Manager Status"},
+		map[string]interface{}{"uid": "ops", "title": "Ops"},
+	)
+	client := newTestClient(t, fake)
+
+	var defs grafana.DefsFile
+	_, err := GetDashboardDefinitionsFromLocalGrafana(context.Background(), client, &config.Config{}, &defs, NewSnapshot())
+	if err != nil {
+		t.Fatalf("GetDashboardDefinitionsFromLocalGrafana: %v", err)
+	}
+
+	for slug, meta := range defs.DashboardMetaBySlug {
+		if grafana.IsSelfDashboard(meta.UID) {
+			t.Errorf("the status dashboard is listed as %s", slug)
+		}
+	}
+	for slug, dashboard := range defs.DashboardBySlug {
+		if grafana.IsSelfDashboard(dashboard.UID) {
+			t.Errorf("the status dashboard was pulled as %s", slug)
+		}
+	}
+	if len(defs.DashboardBySlug) != 1 {
+		t.Errorf("pulled %d dashboards, want only the other one", len(defs.DashboardBySlug))
+	}
+	if n := fake.requested[grafana.SelfDashboardUID]; n != 0 {
+		t.Errorf("the status dashboard was requested %d times", n)
+	}
+}
+
+// dirEntries returns the names of the entries of the given directory.
+func dirEntries(t *testing.T, dir string) (names []string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return
+}
+
+func TestRewriteFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ops.json")
+
+	// Create a new file.
+	if err := rewriteFile(filename, []byte(`{"uid":"ops","title":"Ops"}`), format.Style{}); err != nil {
+		t.Fatalf("rewriteFile: %v", err)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if want := "{\n\t\"title\": \"Ops\",\n\t\"uid\": \"ops\"\n}"; string(content) != want {
+		t.Errorf("created %q, want %q", content, want)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("created with mode %v, want 0644", info.Mode().Perm())
+	}
+
+	// Overwrite it with a shorter content.
+	if err = rewriteFile(filename, []byte(`{"uid":"ops"}`), format.Style{FinalNewline: true}); err != nil {
+		t.Fatalf("rewriteFile: %v", err)
+	}
+	if content, err = os.ReadFile(filename); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if want := "{\n\t\"uid\": \"ops\"\n}\n"; string(content) != want {
+		t.Errorf("overwrote with %q, want %q", content, want)
+	}
+
+	// Invalid JSON leaves the file as it was.
+	if err = rewriteFile(filename, []byte(`{"uid":`), format.Style{}); err == nil {
+		t.Errorf("no error with invalid JSON")
+	}
+	if again, _ := os.ReadFile(filename); string(again) != string(content) {
+		t.Errorf("invalid JSON changed the file to %q", again)
+	}
+
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("left %v in the directory, want only the file", names)
+	}
+}
+
+// A file which can't be written is left as it was, without temporary files.
+func TestRewriteFileReadOnlyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ops.json")
+	if err := os.WriteFile(filename, []byte("{}"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	// The directory is still writable by root.
+	if probe, err := os.CreateTemp(dir, "probe"); err == nil {
+		probe.Close()
+		os.Remove(probe.Name())
+		t.Skip("the directory is writable despite its mode, e.g. as root")
+	}
+
+	if err := rewriteFile(filename, []byte(`{"uid":"ops"}`), format.Style{}); !os.IsPermission(err) {
+		t.Errorf("got %v, want a permission error", err)
+	}
+	if content, _ := os.ReadFile(filename); string(content) != "{}" {
+		t.Errorf("the file was changed to %q", content)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("left %v in the directory, want only the file", names)
+	}
+}
+
+// The same failure whoever runs the test: the directory doesn't exist.
+func TestRewriteFileMissingDirectory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing", "ops.json")
+	if err := rewriteFile(filename, []byte(`{"uid":"ops"}`), format.Style{}); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}
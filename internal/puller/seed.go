@@ -0,0 +1,195 @@
+package puller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSeedNeedsGit is returned by Seed when the configuration has no Git
+// settings, since the versions files only exist in repositories.
+var ErrSeedNeedsGit = errors.New("Seeding a versions file requires the git settings")
+
+// versionsFileSuffix is the suffix shared by the names of all versions files.
+const versionsFileSuffix = "versions-metadata.json"
+
+// Seed creates the versions file of the current host from the versions file
+// of another host, identified by its prefix (e.g. "otherhost-", or the full
+// name of its versions file), so the first pull on a new Grafana instance,
+// once the repository's files have been pushed to it, doesn't see every
+// dashboard as changed.
+// Versions and folder IDs are specific to each instance, so they're retrieved
+// from the current host's Grafana instance: the seeded file describes the
+// dashboards and libraries of the source file which exist on the instance,
+// with the instance's versions. Dashboards and libraries only existing on one
+// side are reported, and the ones only existing on the instance are left for
+// the next pull to commit.
+// An existing versions file is only overwritten if force is true.
+// Returns an error if a versions file couldn't be read or written, or if the
+// Grafana API couldn't be requested.
+func Seed(ctx context.Context, client *grafana.Client, cfg *config.Config, sourcePrefix string, force bool) (err error) {
+	if cfg.Git == nil {
+		return ErrSeedNeedsGit
+	}
+	sourcePrefix = strings.TrimSuffix(filepath.Base(sourcePrefix), versionsFileSuffix)
+
+	// Each organisation has its own versions files, seeded from the source
+	// host's file for the same organisation.
+	for _, orgCfg := range cfg.OrgConfigs() {
+		orgClient := client.ForOrg(orgCfg.Grafana.OrgID)
+		if err = seedOrg(ctx, orgClient, orgCfg, orgCfg.OrgVersionsFilePrefix(sourcePrefix), force); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// seedOrg seeds the versions file of the clone of each branch for the
+// organisation the given configuration is for. See Seed.
+func seedOrg(ctx context.Context, client *grafana.Client, cfg *config.Config, sourcePrefix string, force bool) (err error) {
+	_, APIDefs, err := GetDefinitionsFromGrafanaAPI(ctx, client, cfg)
+	if err != nil {
+		return
+	}
+
+	for _, branchCfg := range cfg.BranchConfigs() {
+		branchDefs := APIDefs
+		if len(cfg.Git.FolderBranchMap) > 0 {
+			branchDefs = filterDefsForBranch(cfg, APIDefs, branchCfg.Git.FolderBranch)
+		}
+
+		if err = seedRepo(branchCfg, branchDefs, sourcePrefix, force); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// seedRepo seeds the versions file of the clone described by the configuration
+// from the given definitions retrieved from the Grafana API. See Seed.
+func seedRepo(cfg *config.Config, APIDefs grafana.DefsFile, sourcePrefix string, force bool) (err error) {
+	repo, _, err := git.NewRepository(cfg.Git)
+	if err != nil {
+		return
+	}
+	if err = repo.Sync(false); err != nil {
+		return
+	}
+
+	syncPath := SyncPath(cfg)
+	sourceFile := filepath.Join(syncPath, getVersionsFile(sourcePrefix))
+	targetFile := filepath.Join(syncPath, getVersionsFile(cfg.Git.VersionsFilePrefix))
+	if sourceFile == targetFile {
+		return fmt.Errorf("The source versions file %s is the current host's", sourceFile)
+	}
+	if !hasVersions(syncPath, sourcePrefix) {
+		return fmt.Errorf("The source versions file %s doesn't exist", sourceFile)
+	}
+	if hasVersions(syncPath, cfg.Git.VersionsFilePrefix) && !force {
+		return fmt.Errorf("The versions file %s already exists", targetFile)
+	}
+
+	sourceDefs, _, err := GetDefinitionsFromDisc(syncPath, sourcePrefix)
+	if err != nil {
+		return
+	}
+
+	seeded := seedDefs(sourceDefs, APIDefs)
+
+	logrus.WithFields(logrus.Fields{
+		"branch":     branchName(cfg),
+		"source":     sourceFile,
+		"target":     targetFile,
+		"dashboards": len(seeded.DashboardMetaBySlug),
+		"libraries":  len(seeded.LibraryMetaByUID),
+	}).Info("Seeding the versions file")
+
+	return writeVersions(seeded, nil, syncPath, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions(), jsonStyle(cfg.Git))
+}
+
+// seedDefs returns the definitions of the dashboards and libraries from the
+// source definitions which exist in the definitions retrieved from the Grafana
+// API, with the data from the latter, and all the folders from the latter.
+// Mismatches between both sides are logged.
+func seedDefs(sourceDefs grafana.DefsFile, APIDefs grafana.DefsFile) (seeded grafana.DefsFile) {
+	seeded = grafana.DefsFile{
+		DashboardMetaBySlug:   make(map[string]grafana.DbSearchResponse),
+		LibraryMetaByUID:      make(map[string]grafana.LibraryElementResponse),
+		FoldersMetaByUID:      APIDefs.FoldersMetaByUID,
+		DashboardVersionByUID: make(map[string]int),
+		LibraryVersionByUID:   make(map[string]int),
+	}
+
+	sourceUIDs := make(map[string]bool)
+	for _, slug := range utils.SortedKeys(sourceDefs.DashboardMetaBySlug) {
+		sourceUIDs[sourceDefs.DashboardMetaBySlug[slug].UID] = true
+	}
+
+	targetUIDs := make(map[string]bool)
+	for _, slug := range utils.SortedKeys(APIDefs.DashboardMetaBySlug) {
+		meta := APIDefs.DashboardMetaBySlug[slug]
+		dashboard, retrieved := APIDefs.DashboardBySlug[slug]
+		if !retrieved {
+			// Ignored or owned by a plugin.
+			continue
+		}
+		targetUIDs[meta.UID] = true
+
+		if !sourceUIDs[meta.UID] {
+			logrus.WithFields(logrus.Fields{
+				"uid":  meta.UID,
+				"name": meta.Title,
+			}).Warn("Dashboard only exists on the Grafana instance, it will be committed by the next pull")
+			continue
+		}
+
+		seeded.DashboardMetaBySlug[slug] = meta
+		seeded.DashboardVersionByUID[meta.UID] = dashboard.Version
+	}
+
+	for _, slug := range utils.SortedKeys(sourceDefs.DashboardMetaBySlug) {
+		meta := sourceDefs.DashboardMetaBySlug[slug]
+		if !targetUIDs[meta.UID] {
+			logrus.WithFields(logrus.Fields{
+				"uid":  meta.UID,
+				"name": meta.Title,
+			}).Warn("Dashboard from the source versions file doesn't exist on the Grafana instance")
+		}
+	}
+
+	for _, uid := range utils.SortedKeys(APIDefs.LibraryMetaByUID) {
+		meta := APIDefs.LibraryMetaByUID[uid]
+		if _, ok := sourceDefs.LibraryMetaByUID[uid]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"uid":  uid,
+				"name": meta.Name,
+			}).Warn("Library only exists on the Grafana instance, it will be committed by the next pull")
+			continue
+		}
+
+		seeded.LibraryMetaByUID[uid] = meta
+		seeded.LibraryVersionByUID[uid] = APIDefs.LibraryVersionByUID[uid]
+	}
+
+	for _, uid := range utils.SortedKeys(sourceDefs.LibraryMetaByUID) {
+		if _, ok := APIDefs.LibraryMetaByUID[uid]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"uid":  uid,
+				"name": sourceDefs.LibraryMetaByUID[uid].Name,
+			}).Warn("Library from the source versions file doesn't exist on the Grafana instance")
+		}
+	}
+
+	return
+}
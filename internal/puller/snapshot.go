@@ -0,0 +1,183 @@
+package puller
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// Snapshot shares the state of a Grafana instance between the push and the
+// pull of a single run, so the pull doesn't retrieve again every dashboard the
+// push already retrieved to compare the files with. The dashboards and their
+// permissions are reused, except the ones the push changed, which have to be
+// invalidated. The lists of dashboards, folders, libraries and other
+// resources are requested again, since each is a single request and the push
+// may have changed them.
+// A nil Snapshot doesn't keep anything, so every dashboard is retrieved. It's
+// safe for concurrent use.
+type Snapshot struct {
+	mu   sync.Mutex
+	orgs map[int64]*orgSnapshot
+}
+
+// orgSnapshot holds the dashboards and permissions of an organisation, by
+// dashboard UID.
+type orgSnapshot struct {
+	dashboards  map[string]*grafana.Dashboard
+	permissions map[string]*format.DashboardPermissions
+}
+
+// NewSnapshot returns an empty snapshot, to be used for a single run.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{orgs: make(map[int64]*orgSnapshot)}
+}
+
+// Definitions gets the definitions from the Grafana API like
+// GetDefinitionsFromGrafanaAPI, reusing the dashboards and permissions the
+// snapshot already holds and keeping the ones it retrieves.
+func (s *Snapshot) Definitions(ctx context.Context, client *grafana.Client, cfg *config.Config) (defs grafana.DefsFile, err error) {
+	_, defs, err = getDefinitions(ctx, client, cfg, s)
+	return
+}
+
+// Invalidate forgets the dashboards the given results pushed or deleted in the
+// organisation the given client works in, and the dashboards using the
+// library panels they pushed or deleted, so the next pull retrieves them
+// again. Skipped items didn't change anything, and are kept.
+func (s *Snapshot) Invalidate(client *grafana.Client, run *results.RunResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	org, ok := s.orgs[client.OrgID]
+	if !ok {
+		return
+	}
+
+	libraries := make(map[string]bool)
+	for _, item := range run.Items() {
+		if item.Outcome == results.OutcomeSkipped {
+			continue
+		}
+		switch item.Kind {
+		case results.KindDashboard:
+			org.forget(item.UID)
+		case results.KindLibrary:
+			libraries[item.UID] = true
+		}
+	}
+	if len(libraries) == 0 {
+		return
+	}
+	for uid, dashboard := range org.dashboards {
+		if usesLibrary(dashboard.RawJSON, libraries) {
+			org.forget(uid)
+		}
+	}
+}
+
+// dashboard returns the dashboard with the given UID in the organisation the
+// given client works in, if the snapshot holds it.
+func (s *Snapshot) dashboard(client *grafana.Client, uid string) (dashboard *grafana.Dashboard, ok bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dashboard, ok = s.org(client).dashboards[uid]
+	return
+}
+
+// storeDashboard keeps the given dashboard of the organisation the given
+// client works in.
+func (s *Snapshot) storeDashboard(client *grafana.Client, dashboard *grafana.Dashboard) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.org(client).dashboards[dashboard.UID] = dashboard
+}
+
+// dashboardPermissions returns the permissions of the dashboard with the given
+// UID in the organisation the given client works in, if the snapshot holds
+// them.
+func (s *Snapshot) dashboardPermissions(client *grafana.Client, uid string) (perms *format.DashboardPermissions, ok bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	perms, ok = s.org(client).permissions[uid]
+	return
+}
+
+// storeDashboardPermissions keeps the given permissions of a dashboard of the
+// organisation the given client works in.
+func (s *Snapshot) storeDashboardPermissions(client *grafana.Client, perms *format.DashboardPermissions) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.org(client).permissions[perms.DashboardUID] = perms
+}
+
+// org returns the part of the snapshot for the organisation the given client
+// works in, creating it if needed. The lock must be held.
+func (s *Snapshot) org(client *grafana.Client) *orgSnapshot {
+	org, ok := s.orgs[client.OrgID]
+	if !ok {
+		org = &orgSnapshot{
+			dashboards:  make(map[string]*grafana.Dashboard),
+			permissions: make(map[string]*format.DashboardPermissions),
+		}
+		s.orgs[client.OrgID] = org
+	}
+	return org
+}
+
+// forget removes the dashboard with the given UID and its permissions.
+func (o *orgSnapshot) forget(uid string) {
+	if _, ok := o.dashboards[uid]; ok {
+		logrus.WithFields(logrus.Fields{
+			"uid": uid,
+		}).Debug("Dashboard changed by the push, it will be retrieved again")
+	}
+	delete(o.dashboards, uid)
+	delete(o.permissions, uid)
+}
+
+// usesLibrary returns true if the dashboard with the given JSON description
+// has a panel from one of the given library panels, including in collapsed
+// rows. The dashboard's description includes the library panels' models,
+// which changed if they were pushed.
+func usesLibrary(raw []byte, libraries map[string]bool) bool {
+	for _, path := range []string{"panels.#.libraryPanel.uid", "panels.#.panels.#.libraryPanel.uid"} {
+		found := false
+		gjson.GetBytes(raw, path).ForEach(func(_, uid gjson.Result) bool {
+			if uid.IsArray() {
+				uid.ForEach(func(_, nested gjson.Result) bool {
+					found = found || libraries[nested.String()]
+					return !found
+				})
+			} else {
+				found = libraries[uid.String()]
+			}
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
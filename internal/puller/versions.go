@@ -7,7 +7,11 @@ import (
 	"time"
 
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
 
 	gogit "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -42,6 +46,17 @@ func GetDefinitionsFromDisc(clonePath string, versionsFile string) (versions gra
 	m.LibraryByUID = make(map[string]*grafana.Library, 0)
 	m.DashboardVersionByUID = make(map[string]int, 0)
 	m.LibraryVersionByUID = make(map[string]int, 0)
+	m.DatasourceVersionByUID = make(map[string]int, 0)
+	m.AlertRuleVersionByUID = make(map[string]int64, 0)
+	m.OverComplexityLimits = make(map[string][]string, 0)
+
+	// The versions written with the per-dashboard layout are read first, so
+	// the single file is only read until they're migrated.
+	if hasPerDashboardVersions(clonePath, versionsFile) {
+		versions = m.DefsFile
+		err = readPerDashboardVersions(clonePath, versionsFile, &versions)
+		return versions, []string{}, err
+	}
 
 	filename := clonePath + "/" + getVersionsFile(versionsFile)
 
@@ -60,9 +75,7 @@ func GetDefinitionsFromDisc(clonePath string, versionsFile string) (versions gra
 	}
 	// must require a migration
 	if len(m.DashboardVersionBySlug) > 0 {
-		for slug, _ := range m.DashboardMetaByTitle { // byTitle was the same as slug, d.Title
-			oldSlugs = append(oldSlugs, slug)
-		}
+		oldSlugs = utils.SortedKeys(m.DashboardMetaByTitle) // byTitle was the same as slug, d.Title
 	}
 	// copy over what we require
 	versionsJSON, _ := json.Marshal(m)
@@ -79,19 +92,9 @@ func GetDefinitionsFromDisc(clonePath string, versionsFile string) (versions gra
 // Returns an error if there was an issue when conerting to JSON, indenting or
 // writing on disk.
 func writeVersions(versions grafana.DefsFile, dv map[string]diffVersion, clonePath string, versionsFile string,
+	perDashboard bool, style format.Style,
 ) (err error) {
-	rawJSON, err := json.Marshal(versions)
-	if err != nil {
-		return
-	}
-
-	indentedJSON, err := indent(rawJSON)
-	if err != nil {
-		return
-	}
-
-	filename := clonePath + "/" + getVersionsFile(versionsFile)
-	return rewriteFile(filename, indentedJSON)
+	return writeVersionsFiles(clonePath, versionsFile, versionsFiles(versions, versionsFile, perDashboard), style)
 }
 
 // commitNewVersions creates a git commit from updated dashboard files (that
@@ -102,24 +105,52 @@ func writeVersions(versions grafana.DefsFile, dv map[string]diffVersion, clonePa
 func commitNewVersions(versions grafana.DefsFile, dv map[string]diffVersion, worktree *gogit.Worktree,
 	cfg *config.Config,
 ) (err error) {
-	if err = writeVersions(versions, dv, cfg.Git.ClonePath, cfg.Git.VersionsFilePrefix); err != nil {
+	if err = writeVersions(versions, dv, cfg.Git.ClonePath, cfg.Git.VersionsFilePrefix, cfg.Git.PerDashboardVersions(), jsonStyle(cfg.Git)); err != nil {
 		return err
 	}
 
-	if _, err = worktree.Add(getVersionsFile(cfg.Git.VersionsFilePrefix)); err != nil {
+	if err = addVersionsToIndex(worktree, cfg.Git.VersionsFilePrefix); err != nil {
 		return err
 	}
-	_, err = worktree.Commit(getCommitMessage(dv), &gogit.CommitOptions{
+	return commitAsManager(worktree, cfg, getCommitMessage(dv))
+}
+
+// commitAsManager commits the changes added to the git index with the given
+// message, authored by the manager, and signed if a signing key is set.
+// Returns an error if the signing key couldn't be loaded or the commit
+// created.
+func commitAsManager(worktree *gogit.Worktree, cfg *config.Config, message string) (err error) {
+	signKey, err := git.SigningKey(cfg.Git)
+	if err != nil {
+		return err
+	}
+	hash, err := worktree.Commit(message, &gogit.CommitOptions{
 		Author: &object.Signature{
 			Name:  cfg.Git.CommitsAuthor.Name,
 			Email: cfg.Git.CommitsAuthor.Email,
 			When:  time.Now(),
 		},
+		SignKey: signKey,
 	})
+	if err == nil {
+		results.Current.RecordCommit(hash.String())
+	}
 
 	return
 }
 
+// versionChanges lists the given changes of version of the dashboards, by
+// slug, and of the libraries, by UID, sorted by kind then name.
+func versionChanges(dv map[string]diffVersion, lv map[string]diffVersion) (changes []VersionChange) {
+	for _, slug := range utils.SortedKeys(dv) {
+		changes = append(changes, VersionChange{Kind: "dashboard", Name: slug, Old: dv[slug].old, New: dv[slug].new})
+	}
+	for _, uid := range utils.SortedKeys(lv) {
+		changes = append(changes, VersionChange{Kind: "library", Name: uid, Old: lv[uid].old, New: lv[uid].new})
+	}
+	return
+}
+
 // getCommitMessage creates a commit message that summarises the version updates
 // included in the commit.
 func getCommitMessage(dv map[string]diffVersion) string {
@@ -127,7 +158,8 @@ func getCommitMessage(dv map[string]diffVersion) string {
 
 	message := "Updated dashboards on " + hostname + "\n"
 
-	for slug, diff := range dv {
+	for _, slug := range utils.SortedKeys(dv) {
+		diff := dv[slug]
 		message += fmt.Sprintf(
 			"%s: %d => %d\n", slug, diff.old, diff.new,
 		)
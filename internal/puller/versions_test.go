@@ -0,0 +1,67 @@
+package puller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// versionsFixture returns changes of version of many dashboards and libraries,
+// so an order leaking from the maps would show.
+func versionsFixture() (dv map[string]diffVersion, lv map[string]diffVersion) {
+	dv = make(map[string]diffVersion)
+	lv = make(map[string]diffVersion)
+	for i := 0; i < 50; i++ {
+		dv[fmt.Sprintf("dashboard-%02d", i)] = diffVersion{old: i, new: i + 1}
+		lv[fmt.Sprintf("library-%02d", i)] = diffVersion{old: i, new: i + 2}
+	}
+	return
+}
+
+func TestGetCommitMessageStable(t *testing.T) {
+	dv, _ := versionsFixture()
+
+	first := getCommitMessage(dv)
+	for i := 0; i < 20; i++ {
+		if message := getCommitMessage(dv); message != first {
+			t.Fatalf("run %d gave a different message:\n%s\nwant:\n%s", i, message, first)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(first), "\n")[1:]
+	if len(lines) != len(dv) {
+		t.Fatalf("got %d lines of changes, want %d", len(lines), len(dv))
+	}
+	if !sort.StringsAreSorted(lines) {
+		t.Errorf("the changes aren't sorted by slug:\n%s", first)
+	}
+	if lines[0] != "dashboard-00: 0 => 1" {
+		t.Errorf("first change = %q", lines[0])
+	}
+}
+
+func TestVersionChangesStable(t *testing.T) {
+	dv, lv := versionsFixture()
+
+	first := versionChanges(dv, lv)
+	if len(first) != len(dv)+len(lv) {
+		t.Fatalf("got %d changes, want %d", len(first), len(dv)+len(lv))
+	}
+	for i := 0; i < 20; i++ {
+		if changes := versionChanges(dv, lv); !reflect.DeepEqual(changes, first) {
+			t.Fatalf("run %d gave different changes", i)
+		}
+	}
+
+	// Dashboards first, then libraries, each sorted by name.
+	if !sort.SliceIsSorted(first, func(i, j int) bool {
+		if first[i].Kind != first[j].Kind {
+			return first[i].Kind == "dashboard"
+		}
+		return first[i].Name < first[j].Name
+	}) {
+		t.Errorf("changes aren't sorted by kind then name: %+v", first)
+	}
+}
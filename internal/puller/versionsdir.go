@@ -0,0 +1,256 @@
+package puller
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+	"github.com/bruce34/grafana-dashboards-manager/pkg/format"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+)
+
+// versionsDir is the directory, at the root of the repository, of the versions
+// with the per-dashboard layout.
+const versionsDir = "versions"
+
+// dashboardVersion is the content of the file describing the version of a
+// dashboard with the per-dashboard layout of the versions.
+type dashboardVersion struct {
+	Version   int    `json:"version"`
+	Slug      string `json:"slug"`
+	Title     string `json:"title,omitempty"`
+	FolderUID string `json:"folderUid,omitempty"`
+	// OverComplexityLimits describes the complexity limits the dashboard
+	// exceeds, if any.
+	OverComplexityLimits []string `json:"overComplexityLimits,omitempty"`
+}
+
+// versionsName returns the name the versions are stored under with the
+// per-dashboard layout: the host's name if the prefix is "hostname", else the
+// prefix without its trailing separators, or "default" if it's empty.
+func versionsName(prefix string) string {
+	if prefix == "hostname" {
+		hostname, _ := os.Hostname()
+		return hostname
+	}
+	if name := strings.TrimRight(prefix, "-_."); name != "" {
+		return name
+	}
+	return "default"
+}
+
+// getVersionsDir returns the path, relative to the clone, of the directory of
+// the dashboards' versions with the per-dashboard layout.
+func getVersionsDir(prefix string) string {
+	return filepath.Join(versionsDir, versionsName(prefix))
+}
+
+// getOtherVersionsFile returns the path, relative to the clone, of the file of
+// the versions other than the dashboards' with the per-dashboard layout.
+func getOtherVersionsFile(prefix string) string {
+	return getVersionsDir(prefix) + ".json"
+}
+
+// versionsFiles returns the contents of the files the given definitions are
+// written to, with the per-dashboard layout or in a single file, by path
+// relative to the clone.
+func versionsFiles(defs grafana.DefsFile, prefix string, perDashboard bool) map[string]interface{} {
+	if !perDashboard {
+		return map[string]interface{}{getVersionsFile(prefix): defs}
+	}
+
+	files := make(map[string]interface{})
+	for slug, meta := range defs.DashboardMetaBySlug {
+		files[filepath.Join(getVersionsDir(prefix), meta.UID+".json")] = dashboardVersion{
+			Version:              defs.DashboardVersionByUID[meta.UID],
+			Slug:                 slug,
+			Title:                meta.Title,
+			FolderUID:            meta.FolderUID,
+			OverComplexityLimits: defs.OverComplexityLimits[meta.UID],
+		}
+	}
+
+	others := defs
+	others.DashboardMetaBySlug = nil
+	others.DashboardVersionByUID = nil
+	others.OverComplexityLimits = nil
+	files[getOtherVersionsFile(prefix)] = others
+	return files
+}
+
+// staleVersionsFiles returns the paths, relative to the clone, of the existing
+// versions files which aren't part of the given ones, i.e. the ones of the
+// dashboards which don't exist anymore, and the ones of the other layout.
+func staleVersionsFiles(clonePath string, prefix string, files map[string]interface{}) (stale []string) {
+	candidates := []string{getVersionsFile(prefix), getOtherVersionsFile(prefix)}
+	entries, _ := os.ReadDir(filepath.Join(clonePath, getVersionsDir(prefix)))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			candidates = append(candidates, filepath.Join(getVersionsDir(prefix), entry.Name()))
+		}
+	}
+
+	for _, path := range candidates {
+		if _, ok := files[path]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(clonePath, path)); err == nil {
+			stale = append(stale, path)
+		}
+	}
+	return
+}
+
+// writeVersionsFiles writes the given contents of the versions files to the
+// clone in the given JSON style, skipping the files which already have them,
+// however they're indented, and removes the stale ones.
+// Returns an error if a file couldn't be written or removed.
+func writeVersionsFiles(clonePath string, prefix string, files map[string]interface{}, style format.Style) (err error) {
+	for path, content := range files {
+		var rawJSON, indentedJSON []byte
+		if rawJSON, err = json.Marshal(content); err != nil {
+			return
+		}
+		if indentedJSON, err = indent(rawJSON, style); err != nil {
+			return
+		}
+
+		filename := filepath.Join(clonePath, path)
+		if existing, readErr := os.ReadFile(filename); readErr == nil && sameJSON(existing, indentedJSON, style) {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			return
+		}
+		if err = replaceFile(filename, indentedJSON); err != nil {
+			return
+		}
+	}
+
+	for _, path := range staleVersionsFiles(clonePath, prefix, files) {
+		if err = os.Remove(filepath.Join(clonePath, path)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readPerDashboardVersions reads the versions with the per-dashboard layout
+// into the given definitions.
+// Returns an error if a file couldn't be read or parsed.
+func readPerDashboardVersions(clonePath string, prefix string, versions *grafana.DefsFile) (err error) {
+	data, err := os.ReadFile(filepath.Join(clonePath, getOtherVersionsFile(prefix)))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, versions); err != nil {
+		return
+	}
+	// The dashboards' maps are written empty to this file.
+	versions.DashboardMetaBySlug = make(map[string]grafana.DbSearchResponse)
+	versions.DashboardVersionByUID = make(map[string]int)
+	versions.OverComplexityLimits = make(map[string][]string)
+
+	dir := filepath.Join(clonePath, getVersionsDir(prefix))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if data, err = os.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return
+		}
+		var version dashboardVersion
+		if err = json.Unmarshal(data, &version); err != nil {
+			return
+		}
+
+		uid := strings.TrimSuffix(entry.Name(), ".json")
+		versions.DashboardMetaBySlug[version.Slug] = grafana.DbSearchResponse{
+			UID:       uid,
+			Title:     version.Title,
+			FolderUID: version.FolderUID,
+			Type:      "dash-db",
+		}
+		versions.DashboardVersionByUID[uid] = version.Version
+		if len(version.OverComplexityLimits) > 0 {
+			versions.OverComplexityLimits[uid] = version.OverComplexityLimits
+		}
+	}
+	return
+}
+
+// hasPerDashboardVersions returns true if the clone has versions with the
+// per-dashboard layout.
+func hasPerDashboardVersions(clonePath string, prefix string) bool {
+	_, err := os.Stat(filepath.Join(clonePath, getOtherVersionsFile(prefix)))
+	return err == nil
+}
+
+// hasVersions returns true if the clone has versions, in either layout.
+func hasVersions(clonePath string, prefix string) bool {
+	if hasPerDashboardVersions(clonePath, prefix) {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(clonePath, getVersionsFile(prefix)))
+	return err == nil
+}
+
+// addVersionsToIndex adds the changes of the versions files, in either layout,
+// to the git index, including their removals.
+// Returns an error if the status of the worktree couldn't be computed or the
+// index updated.
+func addVersionsToIndex(worktree *gogit.Worktree, prefix string) (err error) {
+	status, err := worktree.Status()
+	if err != nil {
+		return
+	}
+
+	dir := filepath.ToSlash(getVersionsDir(prefix)) + "/"
+	for path, fileStatus := range status {
+		if path != getVersionsFile(prefix) && path != filepath.ToSlash(getOtherVersionsFile(prefix)) && !strings.HasPrefix(path, dir) {
+			continue
+		}
+		switch fileStatus.Worktree {
+		case gogit.Unmodified:
+			continue
+		case gogit.Deleted:
+			_, err = worktree.Remove(path)
+		default:
+			_, err = worktree.Add(path)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeVersions plans writing the given definitions to the versions files,
+// with the per-dashboard layout or in a single file, and removing the stale
+// ones. See write.
+// Returns an error if a change couldn't be planned or applied.
+func (cs *changeSet) writeVersions(defs grafana.DefsFile, prefix string, perDashboard bool) (err error) {
+	files := versionsFiles(defs, prefix, perDashboard)
+	for _, path := range utils.SortedKeys(files) {
+		if err = cs.writeJSON(path, files[path]); err != nil {
+			return
+		}
+	}
+	for _, path := range staleVersionsFiles(cs.syncPath, prefix, files) {
+		if err = cs.remove(path); err != nil {
+			return
+		}
+	}
+	return
+}
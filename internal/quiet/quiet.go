@@ -0,0 +1,167 @@
+package quiet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/deploy"
+)
+
+// TrailerUrgent is the commit message trailer marking a commit as an
+// emergency fix, which changes are pushed even during quiet hours, e.g.
+// "Urgent: true".
+const TrailerUrgent = "Urgent"
+
+// maxWindowsChained is the maximum number of consecutive windows looked at to
+// find the end of quiet hours, in case windows cover the whole week.
+const maxWindowsChained = 64
+
+// weekdays maps the accepted names of the days of the week to their value.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// window is a quiet window, starting on the given days at the given number of
+// minutes after midnight and lasting the given number of minutes.
+type window struct {
+	days     map[time.Weekday]bool
+	start    int
+	duration int
+}
+
+// Schedule describes the quiet hours during which the pusher mustn't apply
+// changes to Grafana.
+type Schedule struct {
+	windows  []window
+	location *time.Location
+}
+
+// New parses the given quiet hours settings. Returns a nil schedule if there
+// aren't any settings, i.e. if changes can be applied at any time.
+// Returns an error if the time zone, a day or a time of day is invalid.
+func New(settings *config.QuietHoursSettings) (s *Schedule, err error) {
+	if settings == nil || len(settings.Windows) == 0 {
+		return nil, nil
+	}
+
+	s = &Schedule{location: time.Local}
+	if len(settings.Timezone) > 0 {
+		if s.location, err = time.LoadLocation(settings.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, w := range settings.Windows {
+		parsed := window{days: make(map[time.Weekday]bool)}
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]
+			if !ok {
+				return nil, fmt.Errorf("Invalid day in the quiet hours: %s", day)
+			}
+			parsed.days[weekday] = true
+		}
+
+		var end int
+		if parsed.start, err = parseTimeOfDay(w.Start); err != nil {
+			return nil, err
+		}
+		if end, err = parseTimeOfDay(w.End); err != nil {
+			return nil, err
+		}
+		// A window ending before it starts ends the next day.
+		parsed.duration = end - parsed.start
+		if parsed.duration <= 0 {
+			parsed.duration += 24 * 60
+		}
+
+		s.windows = append(s.windows, parsed)
+	}
+
+	return
+}
+
+// parseTimeOfDay parses a time of day in the "15:04" format, "24:00" being
+// the end of the day, and returns the number of minutes after midnight.
+// Returns an error if the time of day is invalid.
+func parseTimeOfDay(value string) (minutes int, err error) {
+	hours, mins, found := strings.Cut(strings.TrimSpace(value), ":")
+	h, hErr := strconv.Atoi(hours)
+	m, mErr := strconv.Atoi(mins)
+	if !found || hErr != nil || mErr != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Invalid time of day in the quiet hours: %s", value)
+	}
+	return h*60 + m, nil
+}
+
+// Until tells whether the given time is within quiet hours and, if so, when
+// they end, following windows which start before the previous one ends.
+func (s *Schedule) Until(now time.Time) (until time.Time, quiet bool) {
+	if s == nil {
+		return
+	}
+
+	until = now.In(s.location)
+	for i := 0; i < maxWindowsChained; i++ {
+		end, inWindow := s.windowEnd(until)
+		if !inWindow {
+			break
+		}
+		until, quiet = end, true
+	}
+	if !quiet {
+		until = time.Time{}
+	}
+	return
+}
+
+// windowEnd returns the latest end of the windows the given time is within,
+// and false if it isn't within any window. Windows starting the previous day
+// are looked at too, since they may end after midnight.
+// The start and end of the windows are times of day, so they're computed as
+// such, not as durations after midnight, which would be an hour off on the
+// days the clocks change.
+func (s *Schedule) windowEnd(t time.Time) (end time.Time, inWindow bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.location)
+	for _, w := range s.windows {
+		for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+			if len(w.days) > 0 && !w.days[day.Weekday()] {
+				continue
+			}
+
+			// A window ending after midnight ends the next day, which
+			// time.Date handles.
+			endMinutes := w.start + w.duration
+			start := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, s.location)
+			windowEnd := time.Date(day.Year(), day.Month(), day.Day(), endMinutes/60, endMinutes%60, 0, 0, s.location)
+			if !t.Before(start) && t.Before(windowEnd) && windowEnd.After(end) {
+				end, inWindow = windowEnd, true
+			}
+		}
+	}
+	return
+}
+
+// IsUrgent returns true if the given commit message has an "Urgent" trailer
+// which isn't "false" or "no".
+func IsUrgent(message string) bool {
+	for key, values := range deploy.ParseTrailers(message) {
+		if !strings.EqualFold(key, TrailerUrgent) {
+			continue
+		}
+		for _, value := range values {
+			if !strings.EqualFold(value, "false") && !strings.EqualFold(value, "no") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package quiet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+)
+
+// The windows start and end at their times of day on the days the clocks
+// change too.
+func TestUntilDST(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("LoadLocation: %v", err)
+	}
+	s, err := New(&config.QuietHoursSettings{
+		Timezone: "America/New_York",
+		Windows:  []config.QuietWindow{{Start: "09:00", End: "17:00"}, {Start: "22:00", End: "06:00"}},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	at := func(month time.Month, day int, hour int, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, location)
+	}
+	for _, tc := range []struct {
+		name      string
+		now       time.Time
+		wantQuiet bool
+		wantUntil time.Time
+	}{
+		// The clocks go forward at 02:00 on the 10th of March 2024.
+		{"spring, before the window", at(time.March, 10, 8, 59), false, time.Time{}},
+		{"spring, window start", at(time.March, 10, 9, 0), true, at(time.March, 10, 17, 0)},
+		{"spring, window end", at(time.March, 10, 17, 0), false, time.Time{}},
+		{"spring, overnight window", at(time.March, 10, 1, 30), true, at(time.March, 10, 6, 0)},
+		// The clocks go back at 02:00 on the 3rd of November 2024.
+		{"autumn, before the window", at(time.November, 3, 8, 30), false, time.Time{}},
+		{"autumn, window start", at(time.November, 3, 9, 0), true, at(time.November, 3, 17, 0)},
+		{"autumn, before the window end", at(time.November, 3, 16, 30), true, at(time.November, 3, 17, 0)},
+		{"autumn, overnight window", at(time.November, 3, 5, 30), true, at(time.November, 3, 6, 0)},
+	} {
+		until, quiet := s.Until(tc.now)
+		if quiet != tc.wantQuiet || !until.Equal(tc.wantUntil) {
+			t.Errorf("%s: got %v until %s, want %v until %s", tc.name, quiet, until, tc.wantQuiet, tc.wantUntil)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Package results describes the outcome of the operations the manager runs on
+// dashboards, libraries and folders, so summaries, reports and exit codes can
+// all be derived from the same data instead of from the logs.
+package results
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of item an operation ran on.
+type Kind string
+
+const (
+	KindDashboard  Kind = "dashboard"
+	KindLibrary    Kind = "library"
+	KindFolder     Kind = "folder"
+	KindDatasource Kind = "datasource"
+	KindAlertRule  Kind = "alert-rule"
+
+	KindContactPoint       Kind = "contact-point"
+	KindNotificationPolicy Kind = "notification-policy"
+	KindMuteTiming         Kind = "mute-timing"
+)
+
+// Action is the operation run on an item.
+type Action string
+
+const (
+	// ActionPush creates or updates an item on Grafana.
+	ActionPush Action = "push"
+	// ActionDelete deletes an item from Grafana.
+	ActionDelete Action = "delete"
+	// ActionPull writes an item retrieved from Grafana to the repository.
+	ActionPull Action = "pull"
+	// ActionRemove removes an item from the repository.
+	ActionRemove Action = "remove"
+)
+
+// Outcome is the outcome of an operation. Outcomes are ordered by severity,
+// so the worst of several outcomes is the greatest one.
+type Outcome int
+
+const (
+	OutcomeSuccess Outcome = iota
+	OutcomeSkipped
+	OutcomeWarning
+	OutcomeFailed
+)
+
+// Reason identifies why an item was skipped, for the skips which are counted
+// apart from the other ones in the summaries.
+type Reason string
+
+const (
+	// ReasonSchemaDowngrade skips a dashboard which would downgrade the
+	// schemaVersion of the dashboard on the Grafana instance.
+	ReasonSchemaDowngrade Reason = "schema-downgrade"
+	// ReasonDryRun skips an item which would have been pushed or deleted,
+	// since it's a dry run.
+	ReasonDryRun Reason = "dry-run"
+)
+
+// countedReasons are the reasons counted apart in the summaries, in order.
+var countedReasons = []Reason{ReasonSchemaDowngrade, ReasonDryRun}
+
+// outcomeNames are the names of the outcomes, as displayed and serialised.
+var outcomeNames = map[Outcome]string{
+	OutcomeSuccess: "success",
+	OutcomeSkipped: "skipped",
+	OutcomeWarning: "warning",
+	OutcomeFailed:  "failed",
+}
+
+// String implements fmt.Stringer.
+func (o Outcome) String() string {
+	if name, ok := outcomeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
+}
+
+// MarshalJSON implements json.Marshaler, serialising the outcome as its name.
+func (o Outcome) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *Outcome) UnmarshalJSON(b []byte) (err error) {
+	var name string
+	if err = json.Unmarshal(b, &name); err != nil {
+		return
+	}
+	for outcome, outcomeName := range outcomeNames {
+		if outcomeName == name {
+			*o = outcome
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown outcome %q", name)
+}
+
+// ItemResult is the result of an operation on a single item.
+type ItemResult struct {
+	Kind Kind   `json:"kind"`
+	UID  string `json:"uid,omitempty"`
+	// Slug identifies the item in the repository, i.e. its file name or
+	// slug.
+	Slug       string  `json:"slug,omitempty"`
+	Action     Action  `json:"action"`
+	Outcome    Outcome `json:"outcome"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs int64   `json:"durationMs"`
+	// Details gives more information about the outcome, e.g. the reason an
+	// item was skipped or the versions of a pulled dashboard.
+	Details string `json:"details,omitempty"`
+	// Reason identifies why the item was skipped, if it's counted apart.
+	Reason Reason `json:"reason,omitempty"`
+	// OldVersion and NewVersion are the versions of a pulled item in the
+	// repository and on Grafana, zero if unknown.
+	OldVersion int `json:"oldVersion,omitempty"`
+	NewVersion int `json:"newVersion,omitempty"`
+
+	err   error
+	start time.Time
+}
+
+// NewItem starts the result of an operation on an item, timing it from now.
+func NewItem(kind Kind, action Action, uid string, slug string) *ItemResult {
+	return &ItemResult{
+		Kind:   kind,
+		Action: action,
+		UID:    uid,
+		Slug:   slug,
+		start:  time.Now(),
+	}
+}
+
+// Finish records the end of the operation: its duration, and its error if
+// there's one, in which case the outcome is a failure.
+func (i *ItemResult) Finish(err error) *ItemResult {
+	if !i.start.IsZero() {
+		i.DurationMs = time.Since(i.start).Milliseconds()
+	}
+	if err != nil {
+		i.Outcome = OutcomeFailed
+		i.Error = err.Error()
+		i.err = err
+	}
+	return i
+}
+
+// Skip records that the operation wasn't run, for the given reason.
+func (i *ItemResult) Skip(reason string) *ItemResult {
+	i.Outcome = OutcomeSkipped
+	i.Details = reason
+	return i.Finish(nil)
+}
+
+// SkipFor records that the operation wasn't run for the given reason, which is
+// counted apart in the summaries, and described by the given details.
+func (i *ItemResult) SkipFor(reason Reason, details string) *ItemResult {
+	i.Reason = reason
+	return i.Skip(details)
+}
+
+// Warn records that the operation ran with a warning, described by the given
+// details.
+func (i *ItemResult) Warn(details string) *ItemResult {
+	i.Outcome = OutcomeWarning
+	i.Details = details
+	return i
+}
+
+// Err returns the error the operation failed with, if any.
+func (i *ItemResult) Err() error {
+	return i.err
+}
+
+// RunResult aggregates the results of the operations of a run. It's safe for
+// concurrent use.
+type RunResult struct {
+	mu    sync.Mutex
+	items []ItemResult
+}
+
+// NewRunResult returns an empty run result.
+func NewRunResult() *RunResult {
+	return &RunResult{}
+}
+
+// Add records the given item results. A nil run result ignores them, so
+// callers which don't need the results can pass nil around.
+func (r *RunResult) Add(items ...*ItemResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range items {
+		if item != nil {
+			r.items = append(r.items, *item)
+		}
+	}
+}
+
+// Merge records the results of another run.
+func (r *RunResult) Merge(others ...*RunResult) {
+	for _, other := range others {
+		if other == nil || other == r {
+			continue
+		}
+		for _, item := range other.Items() {
+			item := item
+			r.Add(&item)
+		}
+	}
+}
+
+// Items returns a copy of the recorded item results, in the order they were
+// recorded.
+func (r *RunResult) Items() []ItemResult {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ItemResult(nil), r.items...)
+}
+
+// Count returns the number of items with the given outcome.
+func (r *RunResult) Count(outcome Outcome) (count int) {
+	for _, item := range r.Items() {
+		if item.Outcome == outcome {
+			count++
+		}
+	}
+	return
+}
+
+// Counts returns the number of items with each outcome.
+func (r *RunResult) Counts() map[Outcome]int {
+	counts := make(map[Outcome]int)
+	for _, item := range r.Items() {
+		counts[item.Outcome]++
+	}
+	return counts
+}
+
+// CountReason returns the number of items skipped for the given reason.
+func (r *RunResult) CountReason(reason Reason) (count int) {
+	for _, item := range r.Items() {
+		if item.Outcome == OutcomeSkipped && item.Reason == reason {
+			count++
+		}
+	}
+	return
+}
+
+// Worst returns the most severe outcome of the items, or OutcomeSuccess if
+// there's none.
+func (r *RunResult) Worst() (worst Outcome) {
+	for _, item := range r.Items() {
+		if item.Outcome > worst {
+			worst = item.Outcome
+		}
+	}
+	return
+}
+
+// Failed returns the items which failed.
+func (r *RunResult) Failed() (failed []ItemResult) {
+	for _, item := range r.Items() {
+		if item.Outcome == OutcomeFailed {
+			failed = append(failed, item)
+		}
+	}
+	return
+}
+
+// Err returns the error of the last failed item, or nil if no item failed.
+func (r *RunResult) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	last := failed[len(failed)-1]
+	if last.err != nil {
+		return last.err
+	}
+	return fmt.Errorf("%s %s: %s", last.Kind, last.Slug, last.Error)
+}
+
+// Summary describes the number of items with each outcome, and the number of
+// items skipped for each reason counted apart, e.g.
+// "3 success, 2 skipped (1 schema-downgrade, 1 dry-run), 1 failed".
+func (r *RunResult) Summary() string {
+	counts := r.Counts()
+	parts := make([]string, 0)
+	for outcome := OutcomeSuccess; outcome <= OutcomeFailed; outcome++ {
+		if counts[outcome] == 0 {
+			continue
+		}
+		part := fmt.Sprintf("%d %s", counts[outcome], outcome)
+		if outcome == OutcomeSkipped {
+			reasons := make([]string, 0)
+			for _, reason := range countedReasons {
+				if count := r.CountReason(reason); count > 0 {
+					reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+				}
+			}
+			if len(reasons) > 0 {
+				part += " (" + strings.Join(reasons, ", ") + ")"
+			}
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "nothing to do"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,164 @@
+package results
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Summary is the machine-readable summary of a run of the puller or the
+// pusher, written to the file given with --summary-file.
+type Summary struct {
+	// Mode is what the process ran as, e.g. "pull" or "webhook".
+	Mode  string    `json:"mode"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Error is the error the run ended with, if any. Items may have failed
+	// without it.
+	Error  string        `json:"error,omitempty"`
+	Counts SummaryCounts `json:"counts"`
+	// Commits are the hashes of the commits the run created, in order.
+	Commits []string     `json:"commits"`
+	Items   []ItemResult `json:"items"`
+}
+
+// SummaryCounts counts the items of a run by what happened to them. Skipped
+// items and warnings are only counted by the outcome.
+type SummaryCounts struct {
+	// Pulled counts the items written to the repository.
+	Pulled int `json:"pulled"`
+	// Pushed counts the items created or updated on Grafana.
+	Pushed int `json:"pushed"`
+	// Deleted counts the items deleted from Grafana or removed from the
+	// repository.
+	Deleted int `json:"deleted"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// Session records the results of the operations of a run, and the commits it
+// creates, from wherever they run, so the summary of the run can be written at
+// its end. It's safe for concurrent use.
+type Session struct {
+	mu sync.Mutex
+	// Path is the file the summary is written to by Flush. Nothing is written
+	// if it's empty.
+	Path    string
+	Mode    string
+	start   time.Time
+	run     *RunResult
+	commits []string
+}
+
+// Current is the session of the process' current run.
+var Current = NewSession()
+
+// NewSession returns a session starting now.
+func NewSession() *Session {
+	return &Session{start: time.Now(), run: NewRunResult()}
+}
+
+// Record records the results of the given run.
+func (s *Session) Record(run *RunResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.run.Merge(run)
+}
+
+// RecordCommit records a commit created by the run.
+func (s *Session) RecordCommit(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits = append(s.commits, hash)
+}
+
+// Summary returns the summary of the run so far, which ended with the given
+// error, if any.
+func (s *Session) Summary(err error) (summary Summary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary = Summary{
+		Mode:    s.Mode,
+		Start:   s.start,
+		End:     time.Now(),
+		Commits: append(make([]string, 0), s.commits...),
+		Items:   append(make([]ItemResult, 0), s.run.Items()...),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	for _, item := range summary.Items {
+		switch {
+		case item.Outcome == OutcomeFailed:
+			summary.Counts.Failed++
+		case item.Outcome == OutcomeSkipped:
+			summary.Counts.Skipped++
+		case item.Action == ActionPull:
+			summary.Counts.Pulled++
+		case item.Action == ActionPush:
+			summary.Counts.Pushed++
+		case item.Action == ActionDelete || item.Action == ActionRemove:
+			summary.Counts.Deleted++
+		}
+	}
+	return
+}
+
+// Flush writes the summary of the run, which ended with the given error if
+// any, to the session's file, then starts a new run, e.g. for the next change
+// handled by the pusher. A failure to write the file is only logged.
+func (s *Session) Flush(err error) {
+	if s.Path == "" {
+		return
+	}
+
+	if writeErr := writeSummary(s.Path, s.Summary(err)); writeErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": writeErr,
+			"path":  s.Path,
+		}).Error("Failed to write the summary of the run")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+	s.run = NewRunResult()
+	s.commits = nil
+}
+
+// writeSummary writes the given summary as JSON to the file at the given
+// path, through a temporary file renamed over it, so a reader never sees a
+// partial summary.
+// Returns an error if the file couldn't be written.
+func writeSummary(path string, summary Summary) (err error) {
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(append(content, '\n')); err != nil {
+		return
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
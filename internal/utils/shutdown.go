@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultShutdownGrace is the default time the work in progress is given to
+// finish once asked to stop.
+const DefaultShutdownGrace = 30 * time.Second
+
+// GraceContext returns a context for the work in progress, e.g. a push to
+// Grafana, which is cancelled the given grace period after the given context
+// is, or once the returned function is called, so the work can finish rather
+// than being aborted halfway when asked to stop. It doesn't carry the given
+// context's values.
+func GraceContext(ctx context.Context, grace time.Duration) (graceCtx context.Context, cancel context.CancelFunc) {
+	graceCtx, cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-graceCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+
+		select {
+		case <-graceCtx.Done():
+		case <-time.After(grace):
+			cancel()
+		}
+	}()
+	return
+}
@@ -0,0 +1,25 @@
+package utils
+
+import "sort"
+
+// SortedKeys returns the keys of the given map in ascending order, so that
+// iterating over a map can happen in the same order from one run to another.
+// This matters wherever the order is observable, e.g. in API calls, log lines,
+// files written and commit messages.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SortedCopy returns a sorted copy of the given slice, leaving the original
+// slice untouched.
+func SortedCopy(s []string) []string {
+	sorted := make([]string, len(s))
+	copy(sorted, s)
+	sort.Strings(sorted)
+	return sorted
+}
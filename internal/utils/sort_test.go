@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSortedKeys(t *testing.T) {
+	m := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		m["key-"+strconv.Itoa(i)] = i
+	}
+
+	first := SortedKeys(m)
+	if !sort.StringsAreSorted(first) {
+		t.Fatalf("keys aren't sorted: %v", first)
+	}
+	if len(first) != len(m) {
+		t.Fatalf("got %d keys, want %d", len(first), len(m))
+	}
+	// Go randomises the iteration order of maps, so repeated calls would
+	// catch an order leaking through.
+	for i := 0; i < 20; i++ {
+		if keys := SortedKeys(m); !reflect.DeepEqual(keys, first) {
+			t.Fatalf("run %d gave %v, want %v", i, keys, first)
+		}
+	}
+}
+
+func TestSortedCopy(t *testing.T) {
+	s := []string{"c", "a", "b"}
+	if sorted := SortedCopy(s); !reflect.DeepEqual(sorted, []string{"a", "b", "c"}) {
+		t.Errorf("SortedCopy = %v", sorted)
+	}
+	if !reflect.DeepEqual(s, []string{"c", "a", "b"}) {
+		t.Errorf("the original slice was sorted: %v", s)
+	}
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/gitlab"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultCommitStatusName is the name of the commit statuses set when none is
+// configured.
+const defaultCommitStatusName = "grafana-dashboards-manager"
+
+// commitStatusEnabled returns true if the processing of push events must be
+// reported as GitLab commit statuses.
+func commitStatusEnabled() bool {
+	return cfg.Pusher.CommitStatus != nil && len(cfg.Pusher.CommitStatus.GitLabAPIURL) > 0
+}
+
+// reportCommitStatus sets the status of the given commit of the given project
+// (unless another one is configured): running if the push event isn't done
+// being processed, else successful or failed depending on the given error.
+func reportCommitStatus(projectID int, sha string, done bool, pushErr error) {
+	status := gitlab.CommitStatus{
+		State:       gitlab.CommitStatusRunning,
+		Description: "Pushing the changes to Grafana",
+	}
+	if done && pushErr != nil {
+		status.State = gitlab.CommitStatusFailed
+		status.Description = "Failed to push the changes to Grafana: " + pushErr.Error()
+	} else if done {
+		status.State = gitlab.CommitStatusSuccess
+		status.Description = "Pushed the changes to Grafana"
+	}
+
+	setCommitStatus(projectID, sha, status)
+}
+
+// reportDeferredStatus sets the status of the given commit of the given
+// project (unless another one is configured) to pending, until the given end
+// of the quiet hours.
+func reportDeferredStatus(projectID int, sha string, until time.Time) {
+	setCommitStatus(projectID, sha, gitlab.CommitStatus{
+		State:       gitlab.CommitStatusPending,
+		Description: "Quiet hours, the changes will be pushed to Grafana after " + until.Format(time.RFC3339),
+	})
+}
+
+// setCommitStatus sets the given status, with the configured name and target
+// URL, on the given commit of the given project (unless another one is
+// configured). Failures are only logged, since the status is purely
+// informative.
+func setCommitStatus(projectID int, sha string, status gitlab.CommitStatus) {
+	if !commitStatusEnabled() || len(sha) == 0 {
+		return
+	}
+	settings := cfg.Pusher.CommitStatus
+
+	if settings.ProjectID > 0 {
+		projectID = settings.ProjectID
+	}
+	if projectID <= 0 {
+		return
+	}
+	token := settings.Token
+	if len(token) == 0 {
+		token = cfg.Git.Token
+	}
+
+	status.Name = settings.Name
+	if len(status.Name) == 0 {
+		status.Name = defaultCommitStatusName
+	}
+	status.TargetURL = settings.TargetURL
+	if len(status.TargetURL) == 0 {
+		status.TargetURL = cfg.Grafana.BaseURL
+	}
+
+	client := gitlab.NewClient(settings.GitLabAPIURL, token)
+	if err := client.SetCommitStatus(projectID, sha, status); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"project": projectID,
+			"commit":  sha,
+			"state":   status.State,
+		}).Error("Failed to set the commit status on GitLab")
+	}
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/deploy"
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handleDeployPush handles a push event when only the changes marked for
+// deployment must be pushed to Grafana. The commits' trailers are read from
+// the repository rather than from the payload, so catch-up diffs can be
+// computed.
+// Returns an error if the changes couldn't be computed or pushed.
+func handleDeployPush(pl pushEvent, repo *git.Repository, branchCfg *config.Config) (err error) {
+	// Synchronise the repository (i.e. pull from remote)
+	if err = syncRepo(repo); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"repo":       cfg.Git.User + "@" + cfg.Git.URL,
+			"clone_path": branchCfg.Git.ClonePath,
+		}).Error("Failed to synchronise the Git repository with the remote")
+
+		return
+	}
+
+	from, err := repo.GetCommit(pl.Before)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"before": pl.Before,
+		}).Error("Failed to load the commit preceding the push")
+
+		return
+	}
+
+	to, err := repo.GetCommit(pl.After)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"after": pl.After,
+		}).Error("Failed to load the pushed commit")
+
+		return
+	}
+
+	state := deployStates[pl.Ref]
+	changes, err := deploy.PlanRange(repo, cfg.Pusher.Deploy, state, from, to)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to compute the changes to deploy")
+
+		return
+	}
+
+	if err = pushChanges(branchCfg, pl.After, nil, changes.Modified, changes.Removed, changes.Contents); err != nil {
+		return
+	}
+
+	// Record the catch-up so the next one starts from there.
+	if len(changes.DeployedAll) > 0 {
+		if err = state.MarkDeployed(changes.DeployedAll, deploy.StatePath(branchCfg)); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to save the deployment state")
+		}
+	}
+
+	return
+}
+
+// handleLabelledMerge deploys the changes introduced by the merge commit of a
+// merged merge request, if the merge request carries the label from the
+// configuration.
+func handleLabelledMerge(event mergeRequestEvent) {
+	if event.ObjectAttributes.Action != "merge" {
+		return
+	}
+
+	labels := make([]string, 0, len(event.Labels))
+	for _, label := range event.Labels {
+		labels = append(labels, label.Title)
+	}
+	if !deploy.HasLabel(labels, cfg.Pusher.Deploy.Label) {
+		logrus.WithFields(logrus.Fields{
+			"label": cfg.Pusher.Deploy.Label,
+		}).Info("Merged merge request isn't labelled for deployment, skipping")
+
+		return
+	}
+
+	ref := "refs/heads/" + event.ObjectAttributes.TargetBranch
+	repo, ok := repos[ref]
+	if !ok {
+		return
+	}
+	branchCfg := branchCfgs[ref]
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(event.ObjectAttributes.MergeCommitSHA) == 0 {
+		logrus.Warn("Merged merge request has no merge commit, skipping")
+		return
+	}
+
+	if err := syncRepo(repo); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"repo":       cfg.Git.User + "@" + cfg.Git.URL,
+			"clone_path": branchCfg.Git.ClonePath,
+		}).Error("Failed to synchronise the Git repository with the remote")
+
+		return
+	}
+
+	commit, err := repo.GetCommit(event.ObjectAttributes.MergeCommitSHA)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"commit": event.ObjectAttributes.MergeCommitSHA,
+		}).Error("Failed to load the merge commit")
+
+		return
+	}
+
+	changes, err := deploy.PlanCommit(repo, commit)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to compute the changes to deploy")
+
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"commit": event.ObjectAttributes.MergeCommitSHA,
+		"label":  cfg.Pusher.Deploy.Label,
+	}).Info("Deploying labelled merge request")
+
+	if err = pushChanges(branchCfg, event.ObjectAttributes.MergeCommitSHA, nil, changes.Modified, changes.Removed, changes.Contents); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"commit": event.ObjectAttributes.MergeCommitSHA,
+		}).Error("Failed to deploy the labelled merge request")
+	}
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxForgeEventSize is the maximum size of the body of a GitHub or Gitea event
+// read by the webhook.
+const maxForgeEventSize = 25 << 20
+
+// signedForge describes how a Git forge sending signed JSON events to the
+// webhook, such as GitHub or Gitea, sends them.
+type signedForge struct {
+	// name is the forge's name, for the logs.
+	name string
+	// eventHeader, deliveryHeader and signatureHeader are the headers
+	// giving the type of event, the ID of the delivery and the HMAC-SHA256
+	// signature of the body.
+	eventHeader     string
+	deliveryHeader  string
+	signatureHeader string
+	// signaturePrefix is the prefix of the hex-encoded signature in its
+	// header, if any.
+	signaturePrefix string
+}
+
+var (
+	githubForge = signedForge{
+		name:            "GitHub",
+		eventHeader:     "X-GitHub-Event",
+		deliveryHeader:  "X-GitHub-Delivery",
+		signatureHeader: "X-Hub-Signature-256",
+		signaturePrefix: "sha256=",
+	}
+	// Forgejo sends the same headers as Gitea, which it's a fork of.
+	giteaForge = signedForge{
+		name:            "Gitea",
+		eventHeader:     "X-Gitea-Event",
+		deliveryHeader:  "X-Gitea-Delivery",
+		signatureHeader: "X-Gitea-Signature",
+	}
+)
+
+// forgePushEvent is the part of a GitHub or Gitea push event the webhook uses,
+// which both forges send in the same format.
+type forgePushEvent struct {
+	Ref     string `json:"ref"`
+	Before  string `json:"before"`
+	After   string `json:"after"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Email string `json:"email"`
+		} `json:"author"`
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+// signedHandler returns a HTTP handler processing the push events sent by the
+// given forge, authenticated by their HMAC-SHA256 signature with the given
+// secret. The event is acknowledged before being processed, since the forges
+// don't wait for long. The pings sent when the webhook is created are
+// answered, the other events are ignored.
+func signedHandler(forge signedForge, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxForgeEventSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !validSignature(secret, forge.signaturePrefix, r.Header.Get(forge.signatureHeader), body) {
+			logrus.WithFields(logrus.Fields{
+				"forge":    forge.name,
+				"delivery": r.Header.Get(forge.deliveryHeader),
+			}).Warn("Got an event with an invalid signature, ignoring it")
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		switch r.Header.Get(forge.eventHeader) {
+		case "push":
+		case "ping":
+			w.WriteHeader(http.StatusOK)
+			return
+		default:
+			logrus.WithFields(logrus.Fields{
+				"forge": forge.name,
+				"event": r.Header.Get(forge.eventHeader),
+			}).Debug("Got an event which isn't a push, ignoring it")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var event forgePushEvent
+		if err = json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pl := pushEvent{Ref: event.Ref, Before: event.Before, After: event.After}
+		for _, commit := range event.Commits {
+			pl.Commits = append(pl.Commits, pushCommit{
+				ID:          commit.ID,
+				Message:     commit.Message,
+				AuthorEmail: commit.Author.Email,
+				Added:       commit.Added,
+				Modified:    commit.Modified,
+				Removed:     commit.Removed,
+			})
+		}
+
+		w.WriteHeader(http.StatusOK)
+		go processPush(pl)
+	})
+}
+
+// validSignature returns true if the given signature header, after the given
+// prefix, is the hex-encoded HMAC-SHA256 signature of the given body with the
+// given secret.
+func validSignature(secret string, prefix string, header string, body []byte) bool {
+	if header == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafanatest"
+)
+
+// sign returns the hex-encoded HMAC-SHA256 signature of the given body with
+// the given secret.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// giteaRequest returns a request delivering the given Gitea event, with the
+// given signature.
+func giteaRequest(event string, body []byte, signature string) *http.Request {
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Gitea-Event", event)
+	r.Header.Set("X-Gitea-Delivery", "5c9c4b0e-7d5a-4f53-a1a4-3f7f6f1f2f61")
+	if signature != "" {
+		r.Header.Set("X-Gitea-Signature", signature)
+	}
+	return r
+}
+
+func TestGiteaSignature(t *testing.T) {
+	const secret = "s3cr3t"
+	body := []byte(`{"zen":"Keep it simple."}`)
+	handler := signedHandler(giteaForge, secret)
+
+	for _, tc := range []struct {
+		name      string
+		body      []byte
+		signature string
+		want      int
+	}{
+		{"valid", body, sign(secret, body), http.StatusOK},
+		{"missing", body, "", http.StatusForbidden},
+		{"other secret", body, sign("other", body), http.StatusForbidden},
+		{"tampered body", []byte(`{"zen":"Keep it complex."}`), sign(secret, body), http.StatusForbidden},
+		{"not hex", body, "not-a-signature", http.StatusForbidden},
+		// Gitea doesn't prefix its signatures like GitHub.
+		{"GitHub prefix", body, "sha256=" + sign(secret, body), http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, giteaRequest("ping", tc.body, tc.signature))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+// A push event captured from Gitea, which hashes are replaced with the test
+// remote's, has the files of its commits pushed, except the ones of the
+// manager's commits.
+func TestGiteaPushEvent(t *testing.T) {
+	const secret = "s3cr3t"
+	remote := gittest.NewRemote(t)
+	before := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	conf := newTestConfig(t, remote)
+	conf.Pusher.Config.Provider = config.ProviderGitea
+	conf.Pusher.Config.Secret = secret
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+
+	startTestWebhook(t, conf, client)
+	commit := remote.Commit("Add the Ops dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops")}, nil, false)
+	after := remote.Commit("Update the versions", map[string]string{"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra")}, nil, false)
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "gitea_push.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	body := []byte(strings.NewReplacer(
+		"{{before}}", before.String(),
+		"{{commit}}", commit.String(),
+		"{{after}}", after.String(),
+	).Replace(string(fixture)))
+
+	rec := httptest.NewRecorder()
+	newHandler().ServeHTTP(rec, giteaRequest("push", body, sign(secret, body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+
+	// The event is processed once acknowledged.
+	deadline := time.Now().Add(10 * time.Second)
+	for pushes, _ := fake.Counts(); pushes["ops"] == 0; pushes, _ = fake.Counts() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the dashboard wasn't pushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	lock.Unlock()
+
+	pushes, _ := fake.Counts()
+	if pushes["ops"] != 1 {
+		t.Errorf("the dashboard added by the user was pushed %d times, want once", pushes["ops"])
+	}
+	if pushes["infra"] != 0 {
+		t.Errorf("the dashboard added by the manager was pushed %d times, want never", pushes["infra"])
+	}
+}
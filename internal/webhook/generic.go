@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/poller"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxGenericRequestSize is the maximum size of the body of a request to the
+// generic webhook read to check its signature.
+const maxGenericRequestSize = 1 << 20
+
+// genericSignatureHeader is the header holding the HMAC-SHA256 signature of
+// the body of a request to the generic webhook, in the same format as GitHub's.
+const genericSignatureHeader = "X-Signature-256"
+
+// genericHandler returns a HTTP handler running an iteration of the poller
+// with the given trigger each time it's called, whatever the request's body.
+// The requests are authenticated either by the given secret as a bearer token,
+// or by the HMAC-SHA256 signature of their body with it. The handler responds
+// once the run is over, unless a run is already in progress, in which case
+// another one is done after it and the handler responds right away with a 202
+// status.
+func genericHandler(trigger *poller.Trigger, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxGenericRequestSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !validBearerToken(secret, r.Header.Get("Authorization")) &&
+			!validSignature(secret, "sha256=", r.Header.Get(genericSignatureHeader), body) {
+			logrus.WithFields(logrus.Fields{
+				"remote_addr": r.RemoteAddr,
+			}).Warn("Got a trigger request without a valid token or signature, ignoring it")
+			http.Error(w, "invalid token or signature", http.StatusForbidden)
+			return
+		}
+
+		// The run goes on if the client gives up waiting, so the changes
+		// aren't left half pushed.
+		started, err := trigger.Run(runCtx)
+		switch {
+		case !started:
+			logrus.Info("Got a trigger request while a run is in progress, running again after it")
+			w.WriteHeader(http.StatusAccepted)
+		case err != nil:
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Triggered poll failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// validBearerToken returns true if the given Authorization header holds the
+// given secret as a bearer token.
+func validBearerToken(secret string, header string) bool {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
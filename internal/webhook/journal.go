@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryCheckInterval is the interval at which the webhook checks whether the
+// changes which couldn't be pushed are due for a retry.
+const retryCheckInterval = 30 * time.Second
+
+// retryPending pushes again, on a timer, the changes which couldn't be pushed
+// to Grafana, e.g. because it was down, with a backoff between attempts, so
+// they don't wait for the next push event. Nothing is retried during quiet
+// hours. Stops once the given context is cancelled.
+func retryPending(ctx context.Context) {
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, quietNow := quietHours.Until(time.Now()); quietNow {
+			continue
+		}
+		lock.Lock()
+		for ref := range repos {
+			replayJournal(ref, false)
+		}
+		lock.Unlock()
+	}
+}
+
+// replayJournal pushes again the changes from the push events on the branch
+// with the given reference which couldn't be pushed to Grafana, e.g. because
+// it was down, and marks them as done once pushed. The pending push events are
+// merged into a single range of commits, so each file is only pushed with its
+// latest content. Unless forced, e.g. because a new push event must be pushed
+// after them, they're only retried once the backoff since the previous attempt
+// has passed. The caller must hold the lock.
+// Returns an error if push events still couldn't be pushed, in which case the
+// push events which came after them mustn't be pushed before them.
+func replayJournal(ref string, force bool) (err error) {
+	repo, ok := repos[ref]
+	if !ok {
+		return
+	}
+	branchCfg := branchCfgs[ref]
+
+	j := journal.Open(journal.Path(branchCfg.Git))
+	pending, journalErr := j.Pending()
+	if journalErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": journalErr,
+		}).Error("Failed to read the journal")
+		return
+	}
+
+	for _, r := range journal.Ranges(pending) {
+		if r.Ref != ref || (!force && !r.Due(time.Now())) {
+			continue
+		}
+		logFields := logrus.Fields{
+			"ref":      r.Ref,
+			"before":   r.Before,
+			"after":    r.After,
+			"commits":  r.Commits(),
+			"accepted": r.Entries[0].AcceptedAt,
+			"attempts": r.Attempts(),
+		}
+		logrus.WithFields(logFields).Info("Retrying push events which weren't pushed to Grafana")
+
+		if journalErr = j.RecordAttempt(r.IDs()...); journalErr != nil {
+			logrus.WithFields(logFields).WithField("error", journalErr).Error("Failed to update the journal")
+		}
+
+		pl := pushEvent{Ref: r.Ref, Before: r.Before, After: r.After}
+		if cfg.Pusher.Deploy != nil {
+			err = handleDeployPush(pl, repo, branchCfg)
+		} else {
+			err = pushRange(repo, pl)
+		}
+		if err != nil {
+			logrus.WithFields(logFields).WithField("error", err).Warn("Push events still couldn't be pushed, will retry later")
+			return
+		}
+
+		if journalErr = j.MarkDone(r.IDs()...); journalErr != nil {
+			logrus.WithFields(logFields).WithField("error", journalErr).Error("Failed to update the journal")
+		}
+		logrus.WithFields(logFields).Info("Pushed the changes of the push events which weren't pushed to Grafana")
+		// The project isn't recorded, so only a configured one gets the
+		// status of the changes which were deferred or failed.
+		for _, hash := range r.Commits() {
+			reportCommitStatus(0, hash, true, nil)
+		}
+	}
+	return
+}
+
+// pushRange pushes to Grafana the changes between the commits described by the
+// push event, computed from the repository. If the commit preceding the range
+// isn't known (e.g. a new branch or a force-push), all of the files from the
+// latest commit are pushed. If the latest commit isn't known anymore, e.g.
+// because it was force-pushed away, the changes are pushed up to the current
+// head instead.
+// Returns an error if the changes couldn't be computed or pushed.
+func pushRange(repo *git.Repository, pl pushEvent) (err error) {
+	branchCfg := branchCfgs[pl.Ref]
+
+	if err = syncRepo(repo); err != nil {
+		return
+	}
+
+	to, err := repo.GetCommit(pl.After)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"after":      pl.After,
+			"clone_path": branchCfg.Git.ClonePath,
+		}).Warn("Latest commit of the push event not found, pushing up to the current head instead")
+
+		if to, err = repo.GetLatestCommit(); err != nil {
+			return
+		}
+	}
+
+	var modified, removed []string
+	contents := make(map[string][]byte)
+
+	from, fromErr := repo.GetCommit(pl.Before)
+	if fromErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"before":     pl.Before,
+			"clone_path": branchCfg.Git.ClonePath,
+		}).Warn("Commit preceding the push event not found, pushing all files")
+
+		var all map[string][]byte
+		if all, err = repo.GetFilesContentsAtCommit(to); err != nil {
+			return
+		}
+		for filename, content := range all {
+			modified = append(modified, filename)
+			contents[filename] = content
+		}
+	} else {
+		if modified, removed, err = repo.GetModifiedAndRemovedFiles(from, to); err != nil {
+			return
+		}
+		if err = readContents(contents, modified, to); err != nil {
+			return
+		}
+		if err = readContents(contents, removed, from); err != nil {
+			return
+		}
+	}
+
+	return pushChanges(branchCfg, to.Hash.String(), nil, modified, removed, contents)
+}
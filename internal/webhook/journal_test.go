@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafanatest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
+)
+
+// A push event accepted while Grafana is down is recorded in the journal, and
+// pushed, once, when the webhook restarts after Grafana recovered.
+func TestPushEventReplayedAfterRestart(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	before := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	conf := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+
+	startTestWebhook(t, conf, client)
+	after := remote.Commit("Add a dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops")}, nil, false)
+	fake.SetDown(true)
+	processPush(pushEvent{
+		Ref:    "refs/heads/master",
+		Before: before.String(),
+		After:  after.String(),
+		Commits: []pushCommit{{
+			ID:          after.String(),
+			AuthorEmail: "test@example.com",
+			Added:       []string{"dashboards/ops.json"},
+		}},
+	})
+
+	j := journal.Open(journal.Path(conf.Git))
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].After != after.String() {
+		t.Fatalf("pending = %+v, want the push event", pending)
+	}
+
+	// Restart once Grafana recovered.
+	fake.SetDown(false)
+	startTestWebhook(t, conf, client)
+
+	if pushes, _ := fake.Counts(); pushes["ops"] != 1 {
+		t.Errorf("the dashboard was pushed %d times, want once", pushes["ops"])
+	}
+	if pending, err = j.Pending(); err != nil {
+		t.Fatalf("Pending: %v", err)
+	} else if len(pending) != 0 {
+		t.Errorf("%d push events still pending: %+v", len(pending), pending)
+	}
+}
+
+// A push event isn't pushed before the pending ones which still fail, which
+// would then overwrite its changes once pushed, but along with them, so only
+// the latest content of each file is pushed.
+func TestPendingPushedBeforePushEvent(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	before := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	conf := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	startTestWebhook(t, conf, client)
+
+	// push commits the given files and processes the push event of the
+	// commit.
+	push := func(message string, files map[string]string) {
+		after := remote.Commit(message, files, nil, false)
+		pl := pushEvent{Ref: "refs/heads/master", Before: before.String(), After: after.String()}
+		commit := pushCommit{ID: after.String(), AuthorEmail: gittest.Author.Email}
+		for _, filename := range utils.SortedKeys(files) {
+			commit.Modified = append(commit.Modified, filename)
+		}
+		pl.Commits = []pushCommit{commit}
+		processPush(pl)
+		before = after
+	}
+
+	push("Add a dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "")})
+
+	// The pending push event still fails, so the new one is left pending too.
+	push("Fix the dashboard", map[string]string{
+		"dashboards/ops.json":   grafanatest.DashboardJSON("ops", "Ops"),
+		"dashboards/infra.json": grafanatest.DashboardJSON("infra", "Infra"),
+	})
+	if pushes, _ := fake.Counts(); len(pushes) != 0 {
+		t.Errorf("pushes = %v, want none before the pending push events", pushes)
+	}
+	j := journal.Open(journal.Path(conf.Git))
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d push events pending, want both", len(pending))
+	}
+
+	// The next push event pushes the pending ones first, merged, with the
+	// fixed dashboard.
+	push("Add another dashboard", map[string]string{"dashboards/db.json": grafanatest.DashboardJSON("db", "Databases")})
+	if pushes, _ := fake.Counts(); !reflect.DeepEqual(pushes, map[string]int{"ops": 1, "infra": 1, "db": 1}) {
+		t.Errorf("pushes = %v, want every dashboard once", pushes)
+	}
+	if pending, err = j.Pending(); err != nil {
+		t.Fatalf("Pending: %v", err)
+	} else if len(pending) != 0 {
+		t.Errorf("%d push events still pending: %+v", len(pending), pending)
+	}
+}
+
+// A pending push event which latest commit isn't known anymore, e.g. after a
+// force-push and a garbage collection, is pushed up to the current head
+// instead of being retried forever.
+func TestReplayUnknownAfter(t *testing.T) {
+	remote := gittest.NewRemote(t)
+	before := remote.Commit("Initial commit", map[string]string{"README.md": "dashboards"}, nil, false)
+	conf := newTestConfig(t, remote)
+	fake := grafanatest.NewFake()
+	client := grafanatest.NewClient(t, fake)
+	startTestWebhook(t, conf, client)
+
+	remote.Commit("Add a dashboard", map[string]string{"dashboards/ops.json": grafanatest.DashboardJSON("ops", "Ops")}, nil, false)
+	j := journal.Open(journal.Path(conf.Git))
+	if _, err := j.Append("refs/heads/master", before.String(), "0123456789abcdef0123456789abcdef01234567"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	lock.Lock()
+	err := replayJournal("refs/heads/master", true)
+	lock.Unlock()
+	if err != nil {
+		t.Fatalf("replayJournal: %v", err)
+	}
+
+	if pushes, _ := fake.Counts(); pushes["ops"] != 1 {
+		t.Errorf("the dashboard was pushed %d times, want once", pushes["ops"])
+	}
+	if pending, err := j.Pending(); err != nil {
+		t.Fatalf("Pending: %v", err)
+	} else if len(pending) != 0 {
+		t.Errorf("%d push events still pending: %+v", len(pending), pending)
+	}
+}
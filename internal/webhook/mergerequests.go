@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/git"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gitlab"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/plan"
+	"github.com/bruce34/grafana-dashboards-manager/internal/poller"
+	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// maxMergeRequestEventSize is the maximum size of a merge request event body
+// read by the webhook.
+const maxMergeRequestEventSize = 10 << 20
+
+// planNoteMarker identifies the merge request comment holding the plan, so
+// it is updated rather than posted again.
+const planNoteMarker = "<!-- grafana-dashboards-manager:plan -->"
+
+// mergeRequestEvent represents the parts of a GitLab merge request event the
+// webhook needs.
+type mergeRequestEvent struct {
+	Project struct {
+		ID int `json:"id"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		IID            int    `json:"iid"`
+		Action         string `json:"action"`
+		TargetBranch   string `json:"target_branch"`
+		MergeCommitSHA string `json:"merge_commit_sha"`
+		LastCommit     struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+	Labels []struct {
+		Title string `json:"title"`
+	} `json:"labels"`
+}
+
+// mergeRequestsEnabled returns true if the webhook needs to process merge
+// request events.
+func mergeRequestsEnabled() bool {
+	return cfg.Pusher.MergeRequests != nil ||
+		(cfg.Pusher.Deploy != nil && len(cfg.Pusher.Deploy.Label) > 0)
+}
+
+// mergeRequestHandler returns a HTTP handler processing GitLab merge request
+// events: comments describing what would change in Grafana are posted on
+// opened and updated merge requests, and labelled merge requests are deployed
+// once merged, depending on the configuration. Merge request events are
+// answered directly, any other request is passed on to the given handler.
+func mergeRequestHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Gitlab-Event") != "Merge Request Hook" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get("X-Gitlab-Token") != cfg.Pusher.Config.Secret {
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxMergeRequestEventSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var event mergeRequestEvent
+		if err = json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch event.ObjectAttributes.Action {
+		case "open", "reopen", "update":
+			if cfg.Pusher.MergeRequests != nil {
+				handleMergeRequestPlan(event)
+			}
+		case "merge":
+			if cfg.Pusher.Deploy != nil && len(cfg.Pusher.Deploy.Label) > 0 {
+				handleLabelledMerge(event)
+			}
+		}
+	})
+}
+
+// handleMergeRequestPlan computes what would change in Grafana if the merge
+// request described by the event was merged, and posts it as a comment on the
+// merge request, or updates the existing comment. Nothing is pushed to
+// Grafana.
+func handleMergeRequestPlan(event mergeRequestEvent) {
+	iid := event.ObjectAttributes.IID
+	logFields := logrus.Fields{
+		"project":       event.Project.ID,
+		"merge_request": iid,
+	}
+
+	ref := "refs/heads/" + event.ObjectAttributes.TargetBranch
+	repo, ok := repos[ref]
+	if !ok {
+		logrus.WithFields(logFields).Info("Merge request doesn't target a managed branch, skipping")
+		return
+	}
+	branchCfg := branchCfgs[ref]
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Synchronise the repository (i.e. pull from remote), so the target
+	// branch is up to date.
+	if err := syncRepo(repo); err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to synchronise the Git repository with the remote")
+		return
+	}
+
+	target, err := repo.GetLatestCommit()
+	if err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to load the target branch")
+		return
+	}
+
+	// The merge request's head is fetched into its own reference, so the
+	// clone's worktree is left alone. Force-pushed merge requests replace the
+	// reference.
+	head, err := repo.FetchMergeRequest(iid)
+	if err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to fetch the merge request")
+		return
+	}
+
+	// Only the changes from the merge request are considered, not the ones
+	// made to the target branch since the merge request's branch was created.
+	base := target
+	if bases, err := head.MergeBase(target); err == nil && len(bases) > 0 {
+		base = bases[0]
+	}
+
+	modified, removed, err := repo.GetChangedFilesBetweenTrees(base, head)
+	if err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to compute the merge request's changes")
+		return
+	}
+
+	contents := make(map[string][]byte)
+	if err = readContents(contents, modified, head); err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to read the merge request's files")
+		return
+	}
+	if err = readContents(contents, removed, base); err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to read the merge request's files")
+		return
+	}
+
+	if err = grafana.FilterIgnored(&contents, branchCfg); err != nil {
+		return
+	}
+
+	dashboardsModified, _, _ := poller.SeparateDashboardsFoldersLibraries(modified)
+	dashboardsRemoved, _, _ := poller.SeparateDashboardsFoldersLibraries(removed)
+
+	_, grafanaDefs, err := puller.GetDefinitionsFromGrafanaAPI(runCtx, grafanaClient, branchCfg)
+	if err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to retrieve the dashboards from Grafana")
+		return
+	}
+
+	p := plan.ForDashboards(dashboardsModified, dashboardsRemoved, contents, grafanaDefs, deleteRemoved)
+	body := planNoteMarker + "\n" + p.Markdown() + "\n_Computed for commit " + head.Hash.String() + "._\n"
+
+	token := cfg.Pusher.MergeRequests.Token
+	if len(token) == 0 {
+		token = cfg.Git.Token
+	}
+	client := gitlab.NewClient(cfg.Pusher.MergeRequests.GitLabAPIURL, token)
+	if err = client.UpsertMergeRequestNote(event.Project.ID, iid, planNoteMarker, body); err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to comment on the merge request")
+		return
+	}
+
+	logrus.WithFields(logFields).Info("Commented the merge request with the changes it would make")
+}
+
+// readContents adds the contents of the given files at the given commit to
+// the map. Files which don't exist at this commit are skipped.
+// Returns an error if a file couldn't be read.
+func readContents(contents map[string][]byte, filenames []string, commit *object.Commit) error {
+	for _, filename := range filenames {
+		content, found, err := git.FileContentAtCommit(commit, filename)
+		if err != nil {
+			return err
+		}
+		if found {
+			contents[filename] = content
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/health"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusRecorder records the status code of the response written through it,
+// for the access logs.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the given status code before writing it.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog returns a HTTP handler logging each request handled by the given
+// handler: its method, path, status code, duration, and the address it comes
+// from, which X-Forwarded-For gives if the peer is one of the given trusted
+// proxies. The requests of the probes and of Prometheus, which are frequent,
+// are only logged at the debug level.
+func accessLog(next http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry := logrus.WithFields(logrus.Fields{
+			"method":    r.Method,
+			"path":      r.URL.Path,
+			"status":    recorder.status,
+			"duration":  time.Since(start),
+			"remote_ip": clientIP(r, trustedProxies).String(),
+		})
+		switch r.URL.Path {
+		case health.LivenessPath, health.ReadinessPath, metrics.Path:
+			entry.Debug("Handled a request")
+		default:
+			entry.Info("Handled a request")
+		}
+	})
+}
+
+// allowSources returns a HTTP handler rejecting with a 403 status the requests
+// which don't come from one of the given allowed networks, and passing the
+// other ones to the given handler. The address a request comes from is given
+// by X-Forwarded-For if the peer is one of the given trusted proxies. Every
+// request is passed if there aren't any allowed networks.
+func allowSources(next http.Handler, allowed []*net.IPNet, trustedProxies []*net.IPNet) http.Handler {
+	if len(allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trustedProxies)
+		if !inNetworks(ip, allowed) {
+			logrus.WithFields(logrus.Fields{
+				"remote_ip": ip.String(),
+				"path":      r.URL.Path,
+			}).Warn("Got a request from an address which isn't allowed, rejecting it")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody returns a HTTP handler rejecting with a 413 status the requests
+// which body is larger than the given size, in bytes, and passing the other
+// ones to the given handler.
+func limitBody(next http.Handler, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// The length may be unknown, so the body is read to check its
+		// size, and handed to the handler from memory.
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > maxSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address the given request comes from: its peer's, or,
+// if the peer is one of the given trusted proxies, the last address of the
+// X-Forwarded-For header which isn't a trusted proxy.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !inNetworks(ip, trustedProxies) {
+		return ip
+	}
+
+	// Each proxy appends the address it got the request from, so the
+	// addresses are walked from the last one, until one isn't a proxy.
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !inNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// inNetworks returns true if the given address is in one of the given
+// networks.
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
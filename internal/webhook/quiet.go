@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
+	"github.com/bruce34/grafana-dashboards-manager/internal/quiet"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quietHoursCheckInterval is the interval at which the webhook checks whether
+// quiet hours started, outside of them.
+const quietHoursCheckInterval = time.Minute
+
+// isUrgentPush returns true if a commit of the push event is marked as urgent,
+// in which case its changes are pushed even during quiet hours.
+func isUrgentPush(pl pushEvent) bool {
+	for _, commit := range pl.Commits {
+		if quiet.IsUrgent(commit.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+// deferPush records the push event in the journal without pushing it, since
+// it was received during quiet hours ending at the given time. The changes
+// are pushed once the quiet hours end. The caller must hold the lock.
+func deferPush(pl pushEvent, branchCfg *config.Config, until time.Time) {
+	logFields := logrus.Fields{
+		"ref":   pl.Ref,
+		"after": pl.After,
+		"until": until,
+	}
+
+	j := journal.Open(journal.Path(branchCfg.Git))
+	if _, err := j.Append(pl.Ref, pl.Before, pl.After); err != nil {
+		logrus.WithFields(logFields).WithField("error", err).Error("Failed to record the push event in the journal, it won't be pushed after the quiet hours")
+		return
+	}
+
+	logrus.WithFields(logFields).Info("Quiet hours, deferring the push event until they end")
+	reportDeferredStatus(pl.ProjectID, pl.After, until)
+}
+
+// applyAfterQuietHours waits for the quiet hours to end, then pushes the
+// changes deferred during them, until the given context is cancelled.
+func applyAfterQuietHours(ctx context.Context) {
+	for {
+		wait := quietHoursCheckInterval
+		until, quietNow := quietHours.Until(time.Now())
+		if quietNow {
+			wait = time.Until(until)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if !quietNow {
+			continue
+		}
+
+		logrus.Info("Quiet hours over, pushing the deferred changes")
+		lock.Lock()
+		for ref := range repos {
+			replayJournal(ref, true)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certReloader serves the webhook's TLS certificate, and reloads it once its
+// files change, e.g. since it's short-lived and renewed by cert-manager.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	// lock protects the certificate and the modification times of its
+	// files when it was loaded, since the handshakes are concurrent.
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertReloader loads the certificate and key in the PEM files at the given
+// paths.
+// Returns an error naming the file which couldn't be read or parsed.
+func newCertReloader(certPath string, keyPath string) (r *certReloader, err error) {
+	r = &certReloader{certPath: certPath, keyPath: keyPath}
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// getCertificate returns the certificate to present to the clients, for
+// tls.Config.GetCertificate. It's reloaded first if one of its files changed
+// since it was loaded. If it can't be reloaded, e.g. because only one of the
+// files was replaced yet, the previous one is kept until the next handshake.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.changed() {
+		return r.cert, nil
+	}
+
+	if err := r.reload(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to reload the webhook's TLS certificate, keeping the previous one")
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"cert": r.certPath,
+			"key":  r.keyPath,
+		}).Info("Reloaded the webhook's TLS certificate")
+	}
+	return r.cert, nil
+}
+
+// changed returns true if the certificate's or the key's file was modified
+// since they were loaded. A file which can't be read isn't reported as
+// modified, since it can't be loaded.
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+// reload loads the certificate and the key from their files, and records their
+// modification times.
+// Returns an error naming the file which couldn't be read or parsed.
+func (r *certReloader) reload() (err error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read the webhook's TLS certificate %s: %w", r.certPath, err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read the webhook's TLS key %s: %w", r.keyPath, err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load the webhook's TLS certificate %s with the key %s: %w", r.certPath, r.keyPath, err)
+	}
+
+	r.cert = &cert
+	r.certModTime, r.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	return
+}
@@ -1,11 +1,24 @@
 package webhook
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/deploy"
 	"github.com/bruce34/grafana-dashboards-manager/internal/git"
 	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+	"github.com/bruce34/grafana-dashboards-manager/internal/health"
+	"github.com/bruce34/grafana-dashboards-manager/internal/journal"
+	"github.com/bruce34/grafana-dashboards-manager/internal/metrics"
 	"github.com/bruce34/grafana-dashboards-manager/internal/poller"
 	"github.com/bruce34/grafana-dashboards-manager/internal/puller"
+	"github.com/bruce34/grafana-dashboards-manager/internal/quiet"
+	"github.com/bruce34/grafana-dashboards-manager/internal/results"
+	"github.com/bruce34/grafana-dashboards-manager/internal/utils"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/go-playground/webhooks.v3"
@@ -15,31 +28,235 @@ import (
 // Some variables need to be global to the package since we need them in the
 // webhook handlers.
 var (
+	// stopCtx is cancelled when the pusher is asked to stop, and runCtx,
+	// which the changes are pushed with, a grace period later, so the push
+	// in progress can finish.
+	stopCtx       context.Context
+	runCtx        context.Context
 	grafanaClient *grafana.Client
 	cfg           *config.Config
 	deleteRemoved bool
-	repo          *git.Repository
+	// repos maps the references of the branches the webhook processes push
+	// events for to the clone of each branch.
+	repos map[string]*git.Repository
+	// branchCfgs maps the same references to the configuration to use with
+	// the clone of each branch.
+	branchCfgs map[string]*config.Config
+	// deployStates maps the same references to the deployment state of the
+	// clone of each branch, when only the changes marked for deployment are
+	// pushed.
+	deployStates map[string]*deploy.State
+	// lock prevents events from being processed concurrently, since they
+	// share the clones.
+	lock sync.Mutex
+	// quietHours is the schedule of the quiet hours during which the changes
+	// are deferred, nil if there aren't any.
+	quietHours *quiet.Schedule
 )
 
-// Setup creates and exposes a GitLab webhook using a given configuration.
+// Setup creates and exposes a GitLab, GitHub or Gitea webhook, or a generic
+// one triggering the poller, using a given configuration. The webhook stops
+// listening once the given context is cancelled, then waits for the requests
+// and the push in progress, which are done with the given work context, so
+// they're only aborted once it's cancelled too. The push events received
+// meanwhile are only recorded in the journal, and pushed after the restart.
 // Returns an error if the webhook couldn't be set up.
-func Setup(conf *config.Config, client *grafana.Client, delRemoved bool) (err error) {
+func Setup(ctx context.Context, workCtx context.Context, conf *config.Config, client *grafana.Client, delRemoved bool) (err error) {
+	stopCtx = ctx
+	runCtx = workCtx
 	cfg = conf
 	grafanaClient = client
 	deleteRemoved = delRemoved
 
-	// Load the Git repository.
-	var needsSync bool
-	repo, needsSync, err = git.NewRepository(cfg.Git)
+	// Report unusable certificates before cloning anything.
+	var certs *certReloader
+	if len(cfg.Pusher.Config.TLSCert) > 0 {
+		if certs, err = newCertReloader(cfg.Pusher.Config.TLSCert, cfg.Pusher.Config.TLSKey); err != nil {
+			return
+		}
+	}
+
+	var handler http.Handler
+	if cfg.Pusher.Config.Provider == config.ProviderGeneric {
+		// The poller handles the clones, the journal and the quiet hours
+		// itself.
+		trigger, err := poller.NewTrigger(cfg, client, delRemoved)
+		if err != nil {
+			return err
+		}
+		handler = genericHandler(trigger, cfg.Pusher.Config.Secret)
+	} else {
+		if err = setupRepos(ctx); err != nil {
+			return
+		}
+		handler = newHandler()
+	}
+	health.Default.RecordSync(nil)
+
+	// The networks were checked when loading the configuration.
+	allowed, err := config.ParseCIDRs(cfg.Pusher.Config.AllowedCIDRs)
+	if err != nil {
+		return
+	}
+	trustedProxies, err := config.ParseCIDRs(cfg.Pusher.Config.TrustedProxies)
 	if err != nil {
-		return err
+		return
+	}
+	// Only the webhook's requests are restricted, the probes and Prometheus
+	// may come from elsewhere.
+	handler = allowSources(limitBody(handler, cfg.Pusher.Config.WebhookMaxBodySize()), allowed, trustedProxies)
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Pusher.Config.Path, handler)
+	if cfg.Pusher.Config.Path != metrics.Path {
+		mux.Handle(metrics.Path, metrics.Default.Handler())
+	}
+	if path := cfg.Pusher.Config.Path; path != health.LivenessPath && path != health.ReadinessPath && path != health.ConfigPath {
+		health.Default.Handle(mux)
 	}
 
-	// Synchronise the repository if needed.
-	if needsSync {
-		if err = repo.Sync(false); err != nil {
+	// Expose the webhook
+	server := &http.Server{
+		Addr:    cfg.Pusher.Config.Interface + ":" + cfg.Pusher.Config.Port,
+		Handler: accessLog(mux, trustedProxies),
+	}
+	if certs != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// Stop accepting requests, and wait for the ones in progress, e.g.
+		// triggered polls, until the grace period is over.
+		server.Shutdown(workCtx)
+		close(stopped)
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"addr": server.Addr,
+		"path": cfg.Pusher.Config.Path,
+		"tls":  certs != nil,
+	}).Info("Listening for webhook events")
+
+	if certs != nil {
+		// The certificate comes from the TLS configuration.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-stopped
+		// Wait for the push in progress, if any.
+		lock.Lock()
+		lock.Unlock()
+		logrus.Info("Webhook stopped")
+		return nil
+	}
+	return
+}
+
+// setupRepos loads, and synchronises if needed, the clone of each branch the
+// webhook processes push events for, then pushes the changes which couldn't be
+// pushed before the restart and starts retrying the ones which fail.
+// Returns an error if a clone or its deployment state couldn't be loaded.
+func setupRepos(ctx context.Context) (err error) {
+	if quietHours, err = quiet.New(cfg.Pusher.QuietHours); err != nil {
+		return
+	}
+
+	repos = make(map[string]*git.Repository)
+	branchCfgs = make(map[string]*config.Config)
+	deployStates = make(map[string]*deploy.State)
+	for _, branchCfg := range cfg.BranchConfigs() {
+		// Load the Git repository.
+		repo, needsSync, err := git.NewRepository(branchCfg.Git)
+		if err != nil {
 			return err
 		}
+
+		// Synchronise the repository if needed.
+		if needsSync {
+			if err = repo.Sync(false); err != nil {
+				return err
+			}
+		}
+
+		ref := repo.BranchRef()
+		repos[ref] = repo
+		branchCfgs[ref] = branchCfg
+
+		if cfg.Pusher.Deploy != nil {
+			head, err := repo.GetLatestCommit()
+			if err != nil {
+				return err
+			}
+			deployStates[ref], err = deploy.LoadOrInitState(
+				deploy.StatePath(branchCfg), cfg.Pusher.Deploy.Target, head.Hash.String(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Push the changes which couldn't be pushed before the restart, unless
+	// they're deferred until the end of the quiet hours.
+	if _, quietNow := quietHours.Until(time.Now()); !quietNow {
+		lock.Lock()
+		for ref := range repos {
+			replayJournal(ref, true)
+		}
+		lock.Unlock()
+	}
+	if quietHours != nil {
+		go applyAfterQuietHours(ctx)
+	}
+	go retryPending(ctx)
+	return
+}
+
+// syncRepo synchronises the given clone with the remote (i.e. pulls from it),
+// and records the result for the readiness probe.
+// Returns an error if the clone couldn't be synchronised.
+func syncRepo(repo *git.Repository) (err error) {
+	err = repo.Sync(false)
+	health.Default.RecordSync(err)
+	return
+}
+
+// pushEvent is a push event received on the webhook, whichever the Git forge
+// which sent it.
+type pushEvent struct {
+	// Ref is the reference of the branch the commits were pushed to.
+	Ref string
+	// Before is the hash of the commit preceding the pushed ones, After the
+	// hash of the latest pushed commit.
+	Before string
+	After  string
+	// ProjectID is the ID of the GitLab project the commits were pushed to,
+	// zero for the other forges.
+	ProjectID int
+	Commits   []pushCommit
+}
+
+// pushCommit is a commit of a push event, with the files it changed.
+type pushCommit struct {
+	ID          string
+	Message     string
+	AuthorEmail string
+	Added       []string
+	Modified    []string
+	Removed     []string
+}
+
+// newHandler returns the HTTP handler processing the events sent by the
+// configured Git forge.
+func newHandler() http.Handler {
+	switch cfg.Pusher.Config.Provider {
+	case config.ProviderGitHub:
+		return signedHandler(githubForge, cfg.Pusher.Config.Secret)
+	case config.ProviderGitea:
+		return signedHandler(giteaForge, cfg.Pusher.Config.Secret)
 	}
 
 	// Initialise the webhook
@@ -49,18 +266,131 @@ func Setup(conf *config.Config, client *grafana.Client, delRemoved bool) (err er
 	// Register the handler
 	hook.RegisterEvents(HandlePush, gitlab.PushEvents)
 
-	// Expose the webhook
-	return webhooks.Run(
-		hook,
-		cfg.Pusher.Config.Interface+":"+cfg.Pusher.Config.Port,
-		cfg.Pusher.Config.Path,
-	)
+	// Merge request events are only needed to comment on merge requests or
+	// deploy labelled ones, in which case they're handled before the GitLab
+	// webhook.
+	handler := webhooks.Handler(hook)
+	if mergeRequestsEnabled() {
+		handler = mergeRequestHandler(handler)
+	}
+	return handler
 }
 
 // HandlePush is called each time a push event is sent by GitLab on the webhook.
 func HandlePush(payload interface{}, header webhooks.Header) {
-	var err error
+	// Process the payload using the right structure
+	gl := payload.(gitlab.PushEventPayload)
+	pl := pushEvent{Ref: gl.Ref, Before: gl.Before, After: gl.After, ProjectID: int(gl.ProjectID)}
+	for _, commit := range gl.Commits {
+		pl.Commits = append(pl.Commits, pushCommit{
+			ID:          commit.ID,
+			Message:     commit.Message,
+			AuthorEmail: commit.Author.Email,
+			Added:       commit.Added,
+			Modified:    commit.Modified,
+			Removed:     commit.Removed,
+		})
+	}
+	processPush(pl)
+}
 
+// processPush pushes to Grafana the changes from the given push event, if it's
+// on a branch the webhook processes push events of, after the ones which
+// couldn't be pushed before. The changes are deferred during quiet hours,
+// unless they're urgent.
+func processPush(pl pushEvent) {
+	// Only push changes made on the branch tracked by the main clone, or on a
+	// branch folders are mapped to, to Grafana
+	repo, ok := repos[pl.Ref]
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"ref":          pl.Ref,
+			"tracked_refs": utils.SortedKeys(repos),
+			"after":        pl.After,
+		}).Info("Got a push event for a branch which isn't tracked, ignoring it")
+		return
+	}
+	branchCfg := branchCfgs[pl.Ref]
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Once asked to stop, the events still coming are only recorded, to be
+	// pushed after the restart.
+	if stopCtx.Err() != nil {
+		j := journal.Open(journal.Path(branchCfg.Git))
+		if _, err := j.Append(pl.Ref, pl.Before, pl.After); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to record the push event in the journal")
+		}
+		logrus.WithFields(logrus.Fields{
+			"ref":   pl.Ref,
+			"after": pl.After,
+		}).Info("Stopping, recording the push event to push it after the restart")
+		return
+	}
+
+	// Don't push during quiet hours, unless the changes are urgent, in which
+	// case the changes deferred before them are pushed too so the changes are
+	// applied in order.
+	if until, quietNow := quietHours.Until(time.Now()); quietNow && !isUrgentPush(pl) {
+		deferPush(pl, branchCfg, until)
+		return
+	}
+
+	reportCommitStatus(pl.ProjectID, pl.After, false, nil)
+
+	// Retry the previous pushes which failed, if any, first so the changes
+	// are applied in order.
+	replayErr := replayJournal(pl.Ref, true)
+
+	// Record the commits before pushing them, so they're pushed again later
+	// if Grafana can't be reached.
+	j := journal.Open(journal.Path(branchCfg.Git))
+	entryID, err := j.Append(pl.Ref, pl.Before, pl.After)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to record the push event in the journal")
+	}
+
+	// Pushing the changes before the pending ones would let the pending ones
+	// overwrite them once pushed, so they're left in the journal, to be
+	// pushed along with them.
+	if replayErr != nil && entryID > 0 {
+		logrus.WithFields(logrus.Fields{
+			"ref":   pl.Ref,
+			"after": pl.After,
+		}).Warn("Previous push events still couldn't be pushed, the push event will be pushed with them")
+		reportCommitStatus(pl.ProjectID, pl.After, true, replayErr)
+		return
+	}
+
+	// Only push the changes marked for deployment, if asked to.
+	if cfg.Pusher.Deploy != nil {
+		err = handleDeployPush(pl, repo, branchCfg)
+	} else {
+		err = handlePush(pl, repo, branchCfg)
+	}
+
+	// Tell GitLab whether the changes were applied.
+	reportCommitStatus(pl.ProjectID, pl.After, true, err)
+
+	if err == nil && entryID > 0 {
+		if err = j.MarkDone(entryID); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to mark the push event as done in the journal")
+		}
+	}
+}
+
+// handlePush pushes to Grafana the changes from the commits described in a
+// push event.
+// Returns an error if the repository couldn't be synchronised or the changes
+// couldn't be pushed.
+func handlePush(pl pushEvent, repo *git.Repository, branchCfg *config.Config) (err error) {
 	var (
 		added    = make([]string, 0)
 		modified = make([]string, 0)
@@ -68,20 +398,12 @@ func HandlePush(payload interface{}, header webhooks.Header) {
 		contents = make(map[string][]byte)
 	)
 
-	// Process the payload using the right structure
-	pl := payload.(gitlab.PushEventPayload)
-
-	// Only push changes made on master to Grafana
-	if pl.Ref != "refs/heads/master" {
-		return
-	}
-
 	for _, commit := range pl.Commits {
 		// We don't want to process commits made by the puller
-		if commit.Author.Email == cfg.Git.CommitsAuthor.Email {
+		if commit.AuthorEmail == cfg.Git.CommitsAuthor.Email {
 			logrus.WithFields(logrus.Fields{
 				"hash":          commit.ID,
-				"author_email":  commit.Author.Email,
+				"author_email":  commit.AuthorEmail,
 				"manager_email": cfg.Git.CommitsAuthor.Email,
 			}).Info("Commit was made by the manager, skipping")
 
@@ -106,69 +428,174 @@ func HandlePush(payload interface{}, header webhooks.Header) {
 
 	// Get the content of the removed files before pulling from the remote, because
 	// we won't be able to access them afterwards
-	if err = grafana.GetFilesContents(removed, &contents, "", cfg); err != nil {
+	if err = grafana.GetFilesContents(removed, &contents, "", branchCfg); err != nil {
 		return
 	}
 
 	// Synchronise the repository (i.e. pull from remote)
-	if err = repo.Sync(false); err != nil {
+	if err = syncRepo(repo); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":      err,
 			"repo":       cfg.Git.User + "@" + cfg.Git.URL,
-			"clone_path": cfg.Git.ClonePath,
+			"clone_path": branchCfg.Git.ClonePath,
 		}).Error("Failed to synchronise the Git repository with the remote")
 
 		return
 	}
 
 	// Get the content of the added files
-	if err = grafana.GetFilesContents(added, &contents, "", cfg); err != nil {
+	if err = grafana.GetFilesContents(added, &contents, "", branchCfg); err != nil {
 		return
 	}
 
 	// Get the content of the modified files
-	if err = grafana.GetFilesContents(modified, &contents, "", cfg); err != nil {
+	if err = grafana.GetFilesContents(modified, &contents, "", branchCfg); err != nil {
 		return
 	}
 
+	return pushChanges(branchCfg, pl.After, added, modified, removed, contents)
+}
+
+// pushChanges pushes the given added and modified files of the given commit to
+// Grafana and, if the user requested it, deletes the dashboards and libraries
+// described by the given removed files. It then calls the puller so the new
+// versions are committed to the repository.
+// Returns an error if Grafana couldn't be reached or if a file couldn't be
+// pushed, in which case the changes should be pushed again later.
+func pushChanges(
+	branchCfg *config.Config, commit string, added []string, modified []string, removed []string,
+	contents map[string][]byte,
+) (err error) {
+	// Write the summary of the push and the pull which follows, if asked to.
+	defer func() { results.Current.Flush(err) }()
+
 	// Remove the ignored files from the map
-	if err = grafana.FilterIgnored(&contents, cfg); err != nil {
+	if err = grafana.FilterIgnored(&contents, branchCfg); err != nil {
 		return
 	}
 
-	dashboardsAdded, foldersAdded, librariesAdded := poller.SeparateDashboardsFoldersLibraries(added)
-	dashboardsModified, foldersModified, librariesModified := poller.SeparateDashboardsFoldersLibraries(modified)
-	dashboardsRemoved, _, librariesRemoved := poller.SeparateDashboardsFoldersLibraries(removed)
-
-	syncPath := puller.SyncPath(cfg)
-	fileVersionFile, _, err := puller.GetDefinitionsFromDisc(syncPath, cfg.Git.VersionsFilePrefix)
-	grafanaClient.CreateFolders(append(foldersAdded, foldersModified...), contents)
-
-	var grafanaVersionFile grafana.DefsFile
-	_, grafanaVersionFile, err = puller.GetDefinitionsFromGrafanaAPI(grafanaClient, cfg)
-
-	// Push all added and modified dashboards to Grafana
-	grafana.PushLibraryFiles(librariesAdded, contents, fileVersionFile, grafanaVersionFile, grafanaClient)
-	grafana.PushLibraryFiles(librariesModified, contents, fileVersionFile, grafanaVersionFile, grafanaClient)
+	// Push the changes of each organisation's files with a client working in
+	// this organisation. The dashboards retrieved to compare the files with
+	// are kept for the pull which follows.
+	snapshot := puller.NewSnapshot()
+	run := results.NewRunResult()
+	for _, orgCfg := range branchCfg.OrgConfigs() {
+		orgClient := grafanaClient.ForOrg(orgCfg.Grafana.OrgID)
+		orgRun, orgErr := pushOrgChanges(
+			orgCfg, orgClient, snapshot,
+			orgCfg.OrgFiles(added), orgCfg.OrgFiles(modified), orgCfg.OrgFiles(removed), contents,
+		)
+		if orgRun == nil {
+			return orgErr
+		}
+		if cfg.Pusher.Annotate {
+			orgClient.AnnotatePush(runCtx, commit, orgRun)
+		}
+		run.Merge(orgRun)
+		if err == nil {
+			err = orgErr
+		}
+	}
 
-	grafana.PushDashboardFiles(dashboardsAdded, contents, fileVersionFile, grafanaVersionFile, grafanaClient)
-	grafana.PushDashboardFiles(dashboardsModified, contents, fileVersionFile, grafanaVersionFile, grafanaClient)
+	results.Current.Record(run)
+	logrus.WithFields(logrus.Fields{
+		"results": run.Summary(),
+	}).Info("Pushed the changes to Grafana")
+	if cfg.Grafana.SelfDashboard {
+		grafanaClient.UpdateSelfDashboardPush(runCtx, commit, run, err)
+	}
 
-	// If the user requested it, delete all dashboards that were removed
-	// from the repository.
-	if deleteRemoved {
-		grafana.DeleteDashboards(dashboardsRemoved, contents, grafanaClient)
-		grafana.DeleteLibraries(librariesRemoved, contents, grafanaClient)
+	// A dry run changes nothing, neither on Grafana nor in the repository.
+	if grafanaClient.DryRun {
+		logrus.Info("Dry run: not pulling the new versions")
+		return
 	}
 
 	// Grafana will auto-update the version number after we pushed the new
 	// dashboards, so we use the puller mechanic to pull the updated numbers and
 	// commit them in the git repo.
-	if err = puller.PullGrafanaAndCommit(grafanaClient, cfg); err != nil {
+	if pullErr := puller.PullGrafanaAndCommit(runCtx, grafanaClient, cfg, snapshot); pullErr != nil {
 		logrus.WithFields(logrus.Fields{
-			"error":      err,
+			"error":      pullErr,
 			"repo":       cfg.Git.User + "@" + cfg.Git.URL,
 			"clone_path": cfg.Git.ClonePath,
 		}).Error("Call to puller returned an error")
 	}
+
+	return
+}
+
+// pushOrgChanges pushes to Grafana the given added, modified and removed
+// files of the organisation the given configuration is for, as described in
+// pushChanges, retrieving the dashboards from Grafana into the given snapshot,
+// which forgets the ones changed.
+// Returns the result of each push and an error encountered pushing a file, if
+// any. Returns no result if the definitions from Grafana couldn't be
+// retrieved.
+func pushOrgChanges(
+	orgCfg *config.Config, client *grafana.Client, snapshot *puller.Snapshot,
+	added []string, modified []string, removed []string,
+	contents map[string][]byte,
+) (run *results.RunResult, err error) {
+	dashboardsAdded, foldersAdded, librariesAdded := poller.SeparateDashboardsFoldersLibraries(added)
+	dashboardsModified, foldersModified, librariesModified := poller.SeparateDashboardsFoldersLibraries(modified)
+	dashboardsRemoved, foldersRemoved, librariesRemoved := poller.SeparateDashboardsFoldersLibraries(removed)
+
+	syncPath := puller.SyncPath(orgCfg)
+	fileVersionFile, _, err := puller.GetDefinitionsFromDisc(syncPath, orgCfg.Git.VersionsFilePrefix)
+	// Push the folders, datasources, libraries and dashboards in the order
+	// they depend on each other, remembering the last error so the changes
+	// can be pushed again later. The datasources are never deleted, since
+	// they may be used by dashboards outside of the repository.
+	changed := append(append(make([]string, 0, len(added)+len(modified)), added...), modified...)
+	run, pushErr, err := grafana.PushAll(runCtx, orgCfg, client, grafana.PushFiles{
+		Folders:           append(foldersAdded, foldersModified...),
+		Datasources:       poller.SeparateDatasources(changed),
+		Libraries:         append(librariesAdded, librariesModified...),
+		Dashboards:        append(dashboardsAdded, dashboardsModified...),
+		RemovedDashboards: dashboardsRemoved,
+		RemovedLibraries:  librariesRemoved,
+		Delete:            deleteRemoved,
+		Contents:          contents,
+	}, fileVersionFile, func(ctx context.Context) (grafana.DefsFile, error) {
+		return snapshot.Definitions(ctx, client, orgCfg)
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"org":   orgCfg.OrgDir,
+		}).Error("Failed to retrieve the definitions from Grafana")
+		return nil, err
+	}
+
+	pushed := results.NewRunResult()
+	// Alert rules reference the folders they belong to, which have been
+	// created above, and the contact points they notify.
+	if orgCfg.Grafana.SyncNotifications {
+		contactPoints, muteTimings, policies := poller.SeparateNotifications(changed)
+		pushed.Merge(grafana.PushNotificationFiles(runCtx, contactPoints, muteTimings, policies, contents, client))
+		// Mute timings can only be deleted once the notification policies
+		// don't refer to them anymore.
+		if deleteRemoved {
+			_, muteTimingsRemoved, _ := poller.SeparateNotifications(removed)
+			pushed.Merge(grafana.DeleteMuteTimings(runCtx, muteTimingsRemoved, contents, client))
+		}
+	}
+	if orgCfg.Grafana.SyncAlertRules {
+		pushed.Merge(grafana.PushAlertRuleFiles(runCtx, poller.SeparateAlertRules(changed), contents, client))
+	}
+	if err = pushErr; err == nil {
+		err = pushed.Err()
+	}
+	run.Merge(pushed)
+
+	// The folders go last, once the dashboards in them have been deleted or
+	// moved elsewhere.
+	if deleteRemoved && client.DeleteRemovedFolders {
+		run.Merge(grafana.DeleteFolders(runCtx, foldersRemoved, dashboardsRemoved, contents, fileVersionFile, client))
+	}
+	// The pull which follows has to retrieve again what changed.
+	snapshot.Invalidate(client, run)
+
+	return
 }
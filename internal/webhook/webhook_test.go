@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bruce34/grafana-dashboards-manager/internal/config"
+	"github.com/bruce34/grafana-dashboards-manager/internal/gittest"
+	"github.com/bruce34/grafana-dashboards-manager/internal/grafana"
+)
+
+// newTestConfig returns the configuration of a webhook processing GitLab push
+// events for the given remote, pushing the changes from a new clone, without
+// committing the new versions after the pushes, which would make the clone
+// diverge from the remote.
+func newTestConfig(t *testing.T, remote *gittest.Remote) *config.Config {
+	t.Helper()
+
+	gitCfg := remote.Settings()
+	gitCfg.DontCommit = true
+	gitCfg.DontPush = true
+	return &config.Config{
+		Git:    gitCfg,
+		Pusher: &config.PusherSettings{Mode: "webhook", Config: config.PusherConfig{Provider: config.ProviderGitLab}},
+	}
+}
+
+// startTestWebhook sets the webhook up with the given configuration and client
+// as Setup does, without listening, loading the clones and pushing the changes
+// recorded in their journals. It's stopped at the end of the test.
+func startTestWebhook(t *testing.T, conf *config.Config, client *grafana.Client) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stopCtx, runCtx = ctx, context.Background()
+	cfg, grafanaClient, deleteRemoved = conf, client, false
+	if err := setupRepos(ctx); err != nil {
+		t.Fatalf("setupRepos: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// Style is how the JSON files of the repository are laid out, on top of their
+// canonical form.
+type Style struct {
+	// Indent is what each level of nesting is indented with, a tab if empty.
+	Indent string
+	// FinalNewline ends the files with a newline.
+	FinalNewline bool
+}
+
+// Canonical returns the canonical form of the given JSON document, which is
+// how the files of the repository are written: the keys of the objects are
+// sorted, recursively, the order of the arrays is kept, the numbers are
+// written as they're given, the strings aren't escaped for HTML and the
+// document is indented with tabs. The same document therefore always gives the
+// same bytes, however its keys were ordered.
+// Returns an error if the document isn't valid JSON.
+func Canonical(document []byte) (canonical []byte, err error) {
+	return Style{}.Canonical(document)
+}
+
+// Canonical returns the canonical form of the given JSON document, see
+// Canonical, indented and ended as the style sets.
+// Returns an error if the document isn't valid JSON.
+func (s Style) Canonical(document []byte) (canonical []byte, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var v interface{}
+	if err = decoder.Decode(&v); err != nil {
+		return
+	}
+
+	indent := s.Indent
+	if indent == "" {
+		indent = "\t"
+	}
+	buf := new(bytes.Buffer)
+	if err = writeCanonical(buf, v, "\n", indent); err != nil {
+		return
+	}
+	if s.FinalNewline {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCanonical writes the given decoded JSON value in its canonical form,
+// starting its nested lines with the given newline and indentation, and
+// indenting each level of nesting further with the given indent.
+func writeCanonical(buf *bytes.Buffer, v interface{}, newline string, indent string) (err error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(newline + indent)
+			if err = writeString(buf, key); err != nil {
+				return
+			}
+			buf.WriteString(": ")
+			if err = writeCanonical(buf, value[key], newline+indent, indent); err != nil {
+				return
+			}
+		}
+		buf.WriteString(newline + "}")
+	case []interface{}:
+		if len(value) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteByte('[')
+		for i, item := range value {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(newline + indent)
+			if err = writeCanonical(buf, item, newline+indent, indent); err != nil {
+				return
+			}
+		}
+		buf.WriteString(newline + "]")
+	case string:
+		return writeString(buf, value)
+	case json.Number:
+		buf.WriteString(value.String())
+	case bool:
+		if value {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case nil:
+		buf.WriteString("null")
+	}
+	return
+}
+
+// writeString writes the given string as a JSON string, without escaping the
+// characters special in HTML.
+func writeString(buf *bytes.Buffer, s string) error {
+	encoded := new(bytes.Buffer)
+	encoder := json.NewEncoder(encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+	return nil
+}
@@ -0,0 +1,95 @@
+package format
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+// golden compares the given output with the golden file of the given name in
+// the testdata directory, updating it with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s", path, got)
+	}
+}
+
+func TestCanonicalGolden(t *testing.T) {
+	document, err := os.ReadFile(filepath.Join("testdata", "dashboard.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	canonical, err := Canonical(document)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	golden(t, "dashboard.golden.json", canonical)
+
+	// The canonical form is its own canonical form.
+	again, err := Canonical(canonical)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	if !bytes.Equal(again, canonical) {
+		t.Errorf("the canonical form changed when written again:\n%s", again)
+	}
+
+	styled, err := Style{Indent: "  ", FinalNewline: true}.Canonical(document)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	golden(t, "dashboard.styled.golden.json", styled)
+}
+
+// The order of the keys and the layout of the document don't change its
+// canonical form, but the order of the arrays does.
+func TestCanonicalKeyOrder(t *testing.T) {
+	a := []byte(`{"uid":"ops","panels":[{"id":1,"type":"text"},{"id":2,"type":"graph"}],"meta":{"b":2,"a":1}}`)
+	b := []byte("{\n  \"meta\": {\"a\": 1, \"b\": 2},\n  \"panels\": [{\"type\": \"text\", \"id\": 1}, {\"type\": \"graph\", \"id\": 2}],\n  \"uid\": \"ops\"\n}")
+	swapped := []byte(`{"uid":"ops","panels":[{"id":2,"type":"graph"},{"id":1,"type":"text"}],"meta":{"b":2,"a":1}}`)
+
+	canonicalA, err := Canonical(a)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	canonicalB, err := Canonical(b)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	if !bytes.Equal(canonicalA, canonicalB) {
+		t.Errorf("documents differing by their keys' order have different canonical forms:\n%s\n%s", canonicalA, canonicalB)
+	}
+
+	canonicalSwapped, err := Canonical(swapped)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	if bytes.Equal(canonicalA, canonicalSwapped) {
+		t.Errorf("the order of an array was changed")
+	}
+}
+
+func TestCanonicalInvalid(t *testing.T) {
+	for _, document := range []string{"", "{", `{"uid":}`} {
+		if _, err := Canonical([]byte(document)); err == nil {
+			t.Errorf("%q: no error", document)
+		}
+	}
+}
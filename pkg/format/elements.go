@@ -0,0 +1,174 @@
+package format
+
+import (
+	"encoding/json"
+)
+
+// Placement gives the folder a dashboard or a library panel belongs to, either
+// by UID or, in files written by hand, by title. A file without either
+// belongs to the General folder.
+type Placement struct {
+	FolderUID string `json:"__folderUID"`
+	Folder    string `json:"__folder,omitempty"`
+}
+
+// set writes the placement's keys to the given description. The folder's UID
+// is always written, unless the file only gives the folder's title.
+func (p Placement) set(description map[string]interface{}) {
+	if p.FolderUID != "" || p.Folder == "" {
+		description[FolderUIDKey] = p.FolderUID
+	}
+	if p.Folder != "" {
+		description[FolderKey] = p.Folder
+	}
+}
+
+// DashboardFile is the file describing a dashboard, in the "dashboards"
+// directory: the dashboard's JSON model as Grafana gives it, without the keys
+// specific to an instance, and with the folder the dashboard belongs to.
+type DashboardFile struct {
+	UID   string
+	Title string
+	Tags  []string
+	// SchemaVersion is the version of the schema of the model, nil if the
+	// model doesn't give it.
+	SchemaVersion *float64
+	Placement
+	// Model holds every key of the file, including the ones above, which
+	// take precedence over it when the file is marshalled.
+	Model map[string]interface{}
+}
+
+// NewDashboardFile returns the file describing the dashboard with the given
+// JSON model, as retrieved from Grafana, in the folder with the given UID.
+// Returns an error if the model couldn't be parsed.
+func NewDashboardFile(model []byte, folderUID string) (file *DashboardFile, err error) {
+	file = new(DashboardFile)
+	if err = json.Unmarshal(model, file); err != nil {
+		return nil, err
+	}
+
+	for _, key := range InstanceKeys {
+		delete(file.Model, key)
+	}
+	file.Placement = Placement{FolderUID: folderUID}
+	return
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *DashboardFile) UnmarshalJSON(b []byte) (err error) {
+	var known struct {
+		UID           string   `json:"uid"`
+		Title         string   `json:"title"`
+		Tags          []string `json:"tags"`
+		SchemaVersion *float64 `json:"schemaVersion"`
+		Placement
+	}
+	if err = json.Unmarshal(b, &known); err != nil {
+		return
+	}
+	var model map[string]interface{}
+	if err = json.Unmarshal(b, &model); err != nil {
+		return
+	}
+
+	*d = DashboardFile{
+		UID:           known.UID,
+		Title:         known.Title,
+		Tags:          known.Tags,
+		SchemaVersion: known.SchemaVersion,
+		Placement:     known.Placement,
+		Model:         model,
+	}
+	return
+}
+
+// MarshalJSON implements json.Marshaler. The keys are sorted.
+func (d DashboardFile) MarshalJSON() ([]byte, error) {
+	description := copyModel(d.Model)
+	if d.UID != "" {
+		description["uid"] = d.UID
+	}
+	if d.Title != "" {
+		description["title"] = d.Title
+	}
+	if d.Tags != nil {
+		description["tags"] = d.Tags
+	}
+	if d.SchemaVersion != nil {
+		description["schemaVersion"] = *d.SchemaVersion
+	}
+	d.Placement.set(description)
+	return json.Marshal(description)
+}
+
+// LibraryFile is the file describing a library panel, in the "libraries"
+// directory: the library element as Grafana gives it, without the keys
+// specific to an instance, and with the folder the library panel belongs to.
+type LibraryFile struct {
+	UID  string
+	Name string
+	Placement
+	// Element holds every key of the file, including the ones above, which
+	// take precedence over it when the file is marshalled.
+	Element map[string]interface{}
+}
+
+// NewLibraryFile returns the file describing the library element with the
+// given JSON description, as retrieved from Grafana, in the folder with the
+// given UID.
+// Returns an error if the description couldn't be parsed.
+func NewLibraryFile(element []byte, folderUID string) (file *LibraryFile, err error) {
+	file = new(LibraryFile)
+	if err = json.Unmarshal(element, file); err != nil {
+		return nil, err
+	}
+
+	for _, key := range InstanceKeys {
+		delete(file.Element, key)
+	}
+	file.Placement = Placement{FolderUID: folderUID}
+	return
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *LibraryFile) UnmarshalJSON(b []byte) (err error) {
+	var known struct {
+		UID  string `json:"uid"`
+		Name string `json:"name"`
+		Placement
+	}
+	if err = json.Unmarshal(b, &known); err != nil {
+		return
+	}
+	var element map[string]interface{}
+	if err = json.Unmarshal(b, &element); err != nil {
+		return
+	}
+
+	*l = LibraryFile{UID: known.UID, Name: known.Name, Placement: known.Placement, Element: element}
+	return
+}
+
+// MarshalJSON implements json.Marshaler. The keys are sorted.
+func (l LibraryFile) MarshalJSON() ([]byte, error) {
+	description := copyModel(l.Element)
+	if l.UID != "" {
+		description["uid"] = l.UID
+	}
+	if l.Name != "" {
+		description["name"] = l.Name
+	}
+	l.Placement.set(description)
+	return json.Marshal(description)
+}
+
+// copyModel returns a shallow copy of the given description, so marshalling a
+// file doesn't change it.
+func copyModel(model map[string]interface{}) map[string]interface{} {
+	description := make(map[string]interface{}, len(model)+2)
+	for key, value := range model {
+		description[key] = value
+	}
+	return description
+}
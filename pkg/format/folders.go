@@ -0,0 +1,82 @@
+package format
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// FolderFile is the file describing a folder, in the "folders" directory,
+// named after the folder's title, followed by its UID if another folder has
+// the same title.
+type FolderFile struct {
+	Title   string   `json:"title" format:"required"`
+	UID     string   `json:"uid" format:"required"`
+	URI     string   `json:"uri"`
+	Tags    []string `json:"tags"`
+	Starred bool     `json:"isStarred"`
+	// FolderUID is the UID of the parent folder, empty at the root.
+	FolderUID string `json:"folderUid"`
+}
+
+// FolderPermissions is the file describing the permissions of a folder, next
+// to the folder's file.
+type FolderPermissions struct {
+	// FolderUID is the UID of the folder the permissions apply to, so they
+	// can be pushed without the folder's own file.
+	FolderUID string       `json:"__folderUID" format:"required"`
+	Items     []Permission `json:"items" format:"required"`
+}
+
+// DashboardPermissions is the file describing the permissions of a dashboard,
+// next to the dashboard's file.
+type DashboardPermissions struct {
+	// DashboardUID is the UID of the dashboard the permissions apply to, so
+	// they can be pushed without the dashboard's own file.
+	DashboardUID string       `json:"__dashboardUID" format:"required"`
+	Items        []Permission `json:"items" format:"required"`
+}
+
+// Permission grants a permission level (1 for View, 2 for Edit, 4 for Admin)
+// to either a basic role, a team or a user. Teams are referenced by name,
+// since their IDs differ from one Grafana instance to another; a TeamID is
+// only used if no name is given. Users are referenced by ID, their login is
+// only informative.
+type Permission struct {
+	Role       string `json:"role,omitempty"`
+	Team       string `json:"team,omitempty"`
+	TeamID     int64  `json:"teamId,omitempty"`
+	UserID     int64  `json:"userId,omitempty"`
+	UserLogin  string `json:"userLogin,omitempty"`
+	Permission int    `json:"permission" format:"required"`
+}
+
+// TeamsFile is the file describing the teams of the Grafana instance the
+// files were pulled from, by name. Permissions reference the teams by name,
+// which is looked up on the instance they're pushed to.
+type TeamsFile map[string]Team
+
+// Team describes a team of the Grafana instance the files were pulled from.
+// Its ID is only meaningful on this instance.
+type Team struct {
+	ID    int64  `json:"id" format:"required"`
+	UID   string `json:"uid,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// IsTeamsFile returns true if the file with the given name describes the
+// teams.
+func IsTeamsFile(filename string) bool {
+	return filepath.Base(filename) == TeamsFileName
+}
+
+// IsPermissionsFile returns true if the file with the given name describes the
+// permissions of a folder or a dashboard rather than a folder or a dashboard.
+func IsPermissionsFile(filename string) bool {
+	return strings.HasSuffix(filename, PermissionsFileSuffix)
+}
+
+// PermissionsTarget returns the name of the file describing the folder or
+// dashboard the given permissions file is for.
+func PermissionsTarget(filename string) string {
+	return strings.TrimSuffix(filename, PermissionsFileSuffix) + ".json"
+}
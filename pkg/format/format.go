@@ -0,0 +1,36 @@
+// Package format describes the files the manager reads from and writes to the
+// Git repository, so other tools can read, write and validate them without
+// reverse-engineering the manager's conventions. The puller and the pusher use
+// these types themselves, and the schemas command emits the JSON Schema
+// document of each format.
+package format
+
+// Version is the version of the formats described by this package. It's
+// increased whenever a format changes in a way which breaks the tools reading
+// or writing the files, and is part of the schemas' IDs.
+const Version = 1
+
+const (
+	// FolderUIDKey is the key giving the UID of the folder a dashboard or a
+	// library panel belongs to. The puller always writes it.
+	FolderUIDKey = "__folderUID"
+	// FolderKey is the key giving the title of the folder a dashboard or a
+	// library panel belongs to, in files written by hand. The pusher looks
+	// the folder up by title, and FolderUIDKey wins if both are present.
+	FolderKey = "__folder"
+	// SecureJSONFieldsKey is the key listing the names of the secret fields
+	// of a datasource, which values are never written to the repository.
+	SecureJSONFieldsKey = "__secureJsonFields"
+	// PermissionsFileSuffix ends the name of the files describing the
+	// permissions of a folder or a dashboard, which sit next to the files
+	// describing the folders and dashboards.
+	PermissionsFileSuffix = ".permissions.json"
+	// TeamsFileName is the name of the file describing the teams, at the
+	// root of the organisation's files.
+	TeamsFileName = "teams.json"
+)
+
+// InstanceKeys are the keys of the descriptions of dashboards and library
+// panels which are specific to a Grafana instance, and are never written to
+// the repository.
+var InstanceKeys = []string{"id", "version"}
@@ -0,0 +1,306 @@
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaDialect is the JSON Schema dialect the documents are written in.
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Schemaer is implemented by the types which describe their JSON Schema
+// themselves instead of having it derived from their fields.
+type Schemaer interface {
+	JSONSchema() map[string]interface{}
+}
+
+// Format describes a file format.
+type Format struct {
+	// Name identifies the format, e.g. "dashboard".
+	Name string
+	// Path is the pattern of the paths of the files in this format, relative
+	// to the organisation's directory in the repository.
+	Path        string
+	Description string
+	// Schema is the JSON Schema of the files, without the document's
+	// header.
+	Schema map[string]interface{}
+}
+
+// Document returns the JSON Schema document describing the format.
+func (f Format) Document() map[string]interface{} {
+	document := map[string]interface{}{
+		"$schema":     SchemaDialect,
+		"$id":         fmt.Sprintf("urn:grafana-dashboards-manager:format:v%d:%s", Version, f.Name),
+		"title":       f.Name,
+		"description": f.Description + " Path: " + f.Path,
+	}
+	for key, value := range f.Schema {
+		document[key] = value
+	}
+	return document
+}
+
+// Formats returns the formats of the files describing the dashboards, library
+// panels, folders, permissions, datasources and alerting resources, sorted by
+// name. The versions file describes the state of a Grafana instance rather
+// than a resource, and isn't one of them.
+func Formats() []Format {
+	formats := []Format{
+		{
+			Name:        "dashboard",
+			Path:        "dashboards/<slug>.json",
+			Description: "A dashboard's JSON model, as Grafana gives it, without its id and version, and with the folder it belongs to. With the by-folder layout, it's in a subdirectory named after its folder's title.",
+			Schema:      DashboardFile{}.JSONSchema(),
+		},
+		{
+			Name:        "dashboard-permissions",
+			Path:        "dashboards/<slug>" + PermissionsFileSuffix,
+			Description: "The permissions set on a dashboard, not including the ones inherited from its folder.",
+			Schema:      SchemaOf(DashboardPermissions{}),
+		},
+		{
+			Name:        "library",
+			Path:        "libraries/<slug>.json",
+			Description: "A library panel, as Grafana gives it, without its id and version, and with the folder it belongs to.",
+			Schema:      LibraryFile{}.JSONSchema(),
+		},
+		{
+			Name:        "folder",
+			Path:        "folders/<title>.json",
+			Description: "A folder.",
+			Schema:      SchemaOf(FolderFile{}),
+		},
+		{
+			Name:        "folder-permissions",
+			Path:        "folders/<title>" + PermissionsFileSuffix,
+			Description: "The permissions set on a folder.",
+			Schema:      SchemaOf(FolderPermissions{}),
+		},
+		{
+			Name:        "teams",
+			Path:        TeamsFileName,
+			Description: "The teams of the Grafana instance the files were pulled from, by name, which the permissions reference.",
+			Schema:      SchemaOf(TeamsFile{}),
+		},
+		{
+			Name:        "datasource",
+			Path:        "datasources/<uid>.json",
+			Description: "A datasource, as Grafana gives it, without the keys specific to the instance nor its secrets, which names are listed instead.",
+			Schema: openObject([]string{"uid"}, map[string]interface{}{
+				"uid":               stringSchema(),
+				"name":              stringSchema(),
+				"type":              stringSchema(),
+				SecureJSONFieldsKey: arraySchema(stringSchema()),
+			}),
+		},
+		{
+			Name:        "alert-rule",
+			Path:        "alerts/<uid>.json",
+			Description: "An alert rule, as the Grafana provisioning API gives it, without the keys specific to the instance.",
+			Schema: openObject([]string{"uid"}, map[string]interface{}{
+				"uid":       stringSchema(),
+				"title":     stringSchema(),
+				"folderUID": stringSchema(),
+				"ruleGroup": stringSchema(),
+			}),
+		},
+		{
+			Name:        "contact-point",
+			Path:        "alerting/contact-points/<uid>.json",
+			Description: "A contact point, as the Grafana provisioning API gives it, with its secrets redacted.",
+			Schema: openObject([]string{"uid"}, map[string]interface{}{
+				"uid":  stringSchema(),
+				"name": stringSchema(),
+				"type": stringSchema(),
+			}),
+		},
+		{
+			Name:        "mute-timing",
+			Path:        "alerting/mute-timings/<name>.json",
+			Description: "A mute timing, as the Grafana provisioning API gives it, without its version. Slashes in the file's name are replaced with underscores.",
+			Schema: openObject([]string{"name"}, map[string]interface{}{
+				"name": stringSchema(),
+			}),
+		},
+		{
+			Name:        "notification-policies",
+			Path:        "alerting/policies.json",
+			Description: "The notification policy tree, as the Grafana provisioning API gives it.",
+			Schema:      openObject(nil, map[string]interface{}{}),
+		},
+	}
+	sort.Slice(formats, func(i, j int) bool { return formats[i].Name < formats[j].Name })
+	return formats
+}
+
+// JSONSchema implements Schemaer. Dashboard models have many more keys than
+// the ones the manager uses, which are the only ones described.
+func (DashboardFile) JSONSchema() map[string]interface{} {
+	return openObject(nil, map[string]interface{}{
+		"uid":           stringSchema(),
+		"title":         stringSchema(),
+		"tags":          nullable(arraySchema(stringSchema())),
+		"schemaVersion": map[string]interface{}{"type": "number"},
+		FolderUIDKey:    stringSchema(),
+		FolderKey:       stringSchema(),
+	})
+}
+
+// JSONSchema implements Schemaer. Only the keys the manager uses are
+// described.
+func (LibraryFile) JSONSchema() map[string]interface{} {
+	return openObject(nil, map[string]interface{}{
+		"uid":        stringSchema(),
+		"name":       stringSchema(),
+		"model":      map[string]interface{}{"type": "object"},
+		FolderUIDKey: stringSchema(),
+		FolderKey:    stringSchema(),
+	})
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+	schemaerType   = reflect.TypeOf((*Schemaer)(nil)).Elem()
+)
+
+// SchemaOf returns the JSON Schema of the JSON representation of the given
+// value's type, derived from its fields and their JSON tags. Struct fields
+// tagged with `format:"required"` are required, and structs don't allow other
+// properties.
+func SchemaOf(v interface{}) map[string]interface{} {
+	return schemaOfType(reflect.TypeOf(v))
+}
+
+// schemaOfType implements SchemaOf.
+func schemaOfType(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return nullable(schemaOfType(t.Elem()))
+	}
+	if t.Implements(schemaerType) {
+		return reflect.Zero(t).Interface().(Schemaer).JSONSchema()
+	}
+
+	switch {
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.String:
+		return stringSchema()
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Byte slices are base64-encoded.
+			return stringSchema()
+		}
+		return nullable(arraySchema(schemaOfType(t.Elem())))
+	case reflect.Map:
+		return nullable(map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaOfType(t.Elem()),
+		})
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		addStructFields(t, properties, &required)
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// addStructFields adds the schemas of the JSON properties of the given struct
+// type to the given properties, and the names of the required ones to the
+// given list. Embedded structs without a JSON name are flattened, like the
+// encoding/json package does.
+func addStructFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaOfType(field.Type)
+		if field.Tag.Get("format") == "required" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openObject returns the schema of an object with the given properties, among
+// others, of which the given ones are required.
+func openObject(required []string, properties map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// stringSchema returns the schema of a string.
+func stringSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string"}
+}
+
+// arraySchema returns the schema of an array of items matching the given
+// schema.
+func arraySchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// nullable returns the given schema, allowing null as well. Nil maps, slices
+// and pointers are marshalled as null.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	t, ok := schema["type"].(string)
+	if !ok {
+		return schema
+	}
+
+	nullableSchema := make(map[string]interface{}, len(schema))
+	for key, value := range schema {
+		nullableSchema[key] = value
+	}
+	nullableSchema["type"] = []string{t, "null"}
+	return nullableSchema
+}